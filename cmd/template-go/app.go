@@ -1,10 +1,56 @@
 package main
 
-import "github.com/jackc/pgx/v5/pgxpool"
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrateTimeout bounds migrations at startup, including waiting for
+// another instance holding the migration lock.
+const migrateTimeout = time.Minute
+
+// leaderName is the leadership shared by every instance of the service.
+const leaderName = "template-go"
 
 // App holds application dependencies.
 type App struct {
-	DB *pgxpool.Pool
+	DB     *pgxpool.Pool
+	Repos  Repositories
+	Config *Config
+	Panics *WriterPanicReporter
+	// Contract is the OpenAPI document enforced by the Contract middleware.
+	Contract *OpenAPI
+	// Replicas routes reads to replicas, nil without SERVICE_REPLICA_DSNS.
+	Replicas *ReplicaRouter
+	// Notify dispatches LISTEN/NOTIFY notifications to registered handlers.
+	Notify *Subscriber
+	// Events streams notifications on the configured topics to SSE clients.
+	Events *Broker
+	// WebSockets tracks upgraded connections so that shutdown closes them.
+	WebSockets *WebSockets
+	// Outbox stores events in transactions and relays them once committed,
+	// from the leader only.
+	Outbox *Outbox
+	// Jobs is the background job queue; register workers with RegisterJob
+	// before Start.
+	Jobs *JobQueue
+	// Scheduler runs periodic tasks once per tick across instances;
+	// register them before Start.
+	Scheduler *Scheduler
+	// Idempotency stores the responses of requests sent with an
+	// Idempotency-Key, replayed when clients retry them.
+	Idempotency IdempotencyStore
+	// Leader elects the instance running singleton components; register
+	// them with OnAcquired before Start.
+	Leader *Elector
+	// Flags evaluates feature flags, readable by handlers with FlagEnabled.
+	Flags *Flags
+
+	background sync.WaitGroup
 }
 
 // NewApp creates a new App with the given configuration.
@@ -13,12 +59,148 @@ func NewApp(cfg *Config) (*App, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &App{DB: pool}, nil
+	app := &App{DB: pool, Config: cfg}
+
+	if cfg.Migrate {
+		ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+		defer cancel()
+		if err = Migrate(ctx, pool); err != nil {
+			app.Close()
+			return nil, err
+		}
+	}
+	if len(cfg.Replicas.DSNs) > 0 {
+		if app.Replicas, err = openReplicaRouter(pool, cfg.Replicas); err != nil {
+			app.Close()
+			return nil, err
+		}
+	}
+	app.Repos = NewRepositories(app.db())
+	app.Notify = NewSubscriber(poolConnector(pool), NotifyOptions{})
+	app.Events = NewBroker(cfg.Events)
+	app.WebSockets = NewWebSockets(cfg.WebSocket)
+	for _, topic := range cfg.Events.Topics {
+		app.Notify.Handle(topic, app.Events.publishNotifications())
+	}
+
+	publisher, err := newOutboxPublisher(cfg.OutboxPublisher, cfg.OutboxSecret)
+	if err != nil {
+		app.Close()
+		return nil, err
+	}
+	app.Leader = NewElector(poolLeaderConnector(pool), leaderName, cfg.Leader)
+	app.Outbox = NewOutbox(pool, publisher, cfg.Outbox)
+	if publisher != nil {
+		app.Notify.Handle(outboxChannel, app.Outbox.wakeOnNotify())
+		app.Leader.OnAcquired(func(ctx context.Context, token int64) {
+			app.Outbox.Run(ctx, app.Leader.Fence(token))
+		})
+	}
+	app.Jobs = NewJobQueue(pool, cfg.Jobs)
+	if cfg.Jobs.Workers > 0 {
+		app.Notify.Handle(jobsChannel, app.Jobs.wakeOnNotify())
+	}
+	app.Scheduler = NewScheduler(pool, advisoryLocker{pool: pool}, SchedulerOptions{})
+	if err = app.Scheduler.Register("prune-jobs", "@hourly", func(ctx context.Context) error {
+		return app.Jobs.Prune(ctx, jobRetention)
+	}); err != nil {
+		app.Close()
+		return nil, err
+	}
+	app.Idempotency = NewIdempotencyStore(pool)
+	if err = app.Scheduler.Register("prune-idempotency-keys", "@hourly", app.Idempotency.Prune); err != nil {
+		app.Close()
+		return nil, err
+	}
+	if err = app.Scheduler.Register("prune-cache", "@hourly", func(ctx context.Context) error {
+		return PruneCache(ctx, pool)
+	}); err != nil {
+		app.Close()
+		return nil, err
+	}
+
+	app.Flags = NewFlags(pool, cfg.Flags)
+	app.Notify.Handle(flagsChannel, app.Flags.wakeOnNotify())
+
+	if cfg.ContractPath != "" {
+		if app.Contract, err = LoadOpenAPI(cfg.ContractPath); err != nil {
+			app.Close()
+			return nil, err
+		}
+	}
+
+	if cfg.PanicLog != "" {
+		if app.Panics, err = OpenPanicReporter(cfg.PanicLog); err != nil {
+			app.Close()
+			return nil, err
+		}
+	}
+
+	return app, nil
+}
+
+// db returns the replica router when replicas are configured, otherwise
+// the primary pool.
+func (app *App) db() dbPool {
+	if app.Replicas != nil {
+		return app.Replicas
+	}
+	return app.DB
 }
 
-// Close closes application resources.
+// Start runs background components until ctx is canceled.
+func (app *App) Start(ctx context.Context) {
+	if app.Notify != nil {
+		app.background.Go(func() { app.Notify.Run(ctx) })
+	}
+	if app.Jobs != nil {
+		app.background.Go(func() { app.Jobs.Run(ctx) })
+	}
+	if app.Scheduler != nil {
+		app.background.Go(func() { app.Scheduler.Run(ctx) })
+	}
+	if app.Leader != nil {
+		app.background.Go(func() { app.Leader.Run(ctx) })
+	}
+	if app.Flags != nil {
+		app.background.Go(func() { app.Flags.Run(ctx) })
+	}
+}
+
+// Close waits for background components, which requires the context
+// passed to Start to be canceled, and closes application resources.
+// Jobs in flight are waited for, up to the job timeout.
 func (app *App) Close() {
+	app.background.Wait()
+	if app.Replicas != nil {
+		app.Replicas.Close()
+	}
 	if app.DB != nil {
 		app.DB.Close()
 	}
+	if app.Panics != nil {
+		if err := app.Panics.Close(); err != nil {
+			slog.Error("Failed to close panic log", "error", err)
+		}
+	}
+}
+
+// readinessChecks returns the checks behind /ready.
+func (app *App) readinessChecks() map[string]ReadinessCheck {
+	checks := map[string]ReadinessCheck{}
+	if app.DB != nil {
+		checks["database"] = app.DB.Ping
+	}
+	if app.Notify != nil {
+		checks["notify"] = app.Notify.Ready
+	}
+	return checks
+}
+
+// panicReporters returns the configured panic reporters.
+func (app *App) panicReporters() []PanicReporter {
+	if app.Panics == nil {
+		return nil
+	}
+	return []PanicReporter{app.Panics}
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -36,6 +37,14 @@ func TestAppClose(t *testing.T) {
 		assert.NotPanics(t, app.Close)
 	})
 
+	t.Run("close with panic reporter", func(t *testing.T) {
+		reporter, err := OpenPanicReporter(filepath.Join(t.TempDir(), "panics.jsonl"))
+		require.NoError(t, err)
+
+		app := &App{Panics: reporter}
+		assert.NotPanics(t, app.Close)
+	})
+
 	t.Run("close with valid DB pool", func(t *testing.T) {
 		skipIfNoTestcontainers(t)
 
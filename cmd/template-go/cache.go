@@ -0,0 +1,555 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/maphash"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Cache stores entries by key. Implementations are safe for concurrent
+// use.
+type Cache[K comparable, V any] interface {
+	// Get returns the entry under key and reports whether there is one
+	// that has not expired.
+	Get(ctx context.Context, key K) (CacheEntry[V], bool, error)
+	// Set stores entry under key.
+	Set(ctx context.Context, key K, entry CacheEntry[V]) error
+	// Delete removes the entry under key, if any.
+	Delete(ctx context.Context, key K) error
+}
+
+// CacheEntry is a cached value. It is fresh until Fresh, or until it
+// expires when Fresh is zero, and is dropped at Expires, or kept until
+// evicted when Expires is zero.
+type CacheEntry[V any] struct {
+	Value   V
+	Fresh   time.Time
+	Expires time.Time
+}
+
+func (e CacheEntry[V]) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && !now.Before(e.Expires)
+}
+
+func (e CacheEntry[V]) stale(now time.Time) bool {
+	if e.Fresh.IsZero() {
+		return e.expired(now)
+	}
+	return !now.Before(e.Fresh)
+}
+
+// localCache is implemented by caches holding entries in this process,
+// which invalidations from other instances drop.
+type localCache[K comparable] interface {
+	deleteLocal(ctx context.Context, key K) error
+}
+
+// MemoryCacheOptions configures a MemoryCache.
+type MemoryCacheOptions struct {
+	// MaxEntries bounds the cache; the least recently used entries of a
+	// shard are evicted beyond its share.
+	MaxEntries int
+	// Shards splits the cache, each with its own lock.
+	Shards int
+}
+
+const (
+	defaultMemoryCacheMaxEntries = 10000
+	defaultMemoryCacheShards     = 16
+)
+
+// MemoryCache is an in-process LRU cache whose entries also expire.
+type MemoryCache[K comparable, V any] struct {
+	seed   maphash.Seed
+	shards []*memoryShard[K, V]
+}
+
+type memoryShard[K comparable, V any] struct {
+	mu    sync.Mutex
+	max   int
+	items map[K]*list.Element
+	// lru holds *memoryItem values, most recently used first.
+	lru *list.List
+}
+
+type memoryItem[K comparable, V any] struct {
+	key   K
+	entry CacheEntry[V]
+}
+
+var _ localCache[string] = (*MemoryCache[string, int])(nil)
+
+// NewMemoryCache returns an empty MemoryCache.
+func NewMemoryCache[K comparable, V any](opts MemoryCacheOptions) *MemoryCache[K, V] {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = defaultMemoryCacheMaxEntries
+	}
+	if opts.Shards <= 0 {
+		opts.Shards = defaultMemoryCacheShards
+	}
+	opts.Shards = min(opts.Shards, opts.MaxEntries)
+
+	c := &MemoryCache[K, V]{seed: maphash.MakeSeed(), shards: make([]*memoryShard[K, V], opts.Shards)}
+	for i := range c.shards {
+		c.shards[i] = &memoryShard[K, V]{
+			max:   (opts.MaxEntries + opts.Shards - 1) / opts.Shards,
+			items: map[K]*list.Element{},
+			lru:   list.New(),
+		}
+	}
+	return c
+}
+
+func (c *MemoryCache[K, V]) shard(key K) *memoryShard[K, V] {
+	return c.shards[maphash.Comparable(c.seed, key)%uint64(len(c.shards))]
+}
+
+// Get returns the entry under key, dropping it if it expired.
+func (c *MemoryCache[K, V]) Get(_ context.Context, key K) (CacheEntry[V], bool, error) {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	el, ok := s.items[key]
+	if !ok {
+		return CacheEntry[V]{}, false, nil
+	}
+	item := el.Value.(*memoryItem[K, V]) //nolint:forcetypeassert // lru only holds items
+	if item.entry.expired(time.Now()) {
+		s.lru.Remove(el)
+		delete(s.items, key)
+		return CacheEntry[V]{}, false, nil
+	}
+	s.lru.MoveToFront(el)
+	return item.entry, true, nil
+}
+
+// Set stores entry, evicting the least recently used entry of the shard
+// when it is full.
+func (c *MemoryCache[K, V]) Set(_ context.Context, key K, entry CacheEntry[V]) error {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		el.Value.(*memoryItem[K, V]).entry = entry //nolint:forcetypeassert // lru only holds items
+		s.lru.MoveToFront(el)
+		return nil
+	}
+	s.items[key] = s.lru.PushFront(&memoryItem[K, V]{key: key, entry: entry})
+	if s.lru.Len() > s.max {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.items, oldest.Value.(*memoryItem[K, V]).key) //nolint:forcetypeassert // lru only holds items
+	}
+	return nil
+}
+
+// Delete removes the entry under key.
+func (c *MemoryCache[K, V]) Delete(_ context.Context, key K) error {
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if el, ok := s.items[key]; ok {
+		s.lru.Remove(el)
+		delete(s.items, key)
+	}
+	return nil
+}
+
+func (c *MemoryCache[K, V]) deleteLocal(ctx context.Context, key K) error {
+	return c.Delete(ctx, key)
+}
+
+// Len returns the number of entries, including expired ones not yet
+// dropped.
+func (c *MemoryCache[K, V]) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		s.mu.Lock()
+		n += s.lru.Len()
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// PostgresCache is a Cache in the unlogged cache_entries table, shared by
+// every instance. Keys and values are stored JSON-encoded, under a
+// namespace per cache. The table is emptied if Postgres crashes.
+type PostgresCache[K comparable, V any] struct {
+	db        Querier
+	namespace string
+}
+
+// NewPostgresCache returns a PostgresCache over namespace in db.
+func NewPostgresCache[K comparable, V any](db Querier, namespace string) *PostgresCache[K, V] {
+	return &PostgresCache[K, V]{db: db, namespace: namespace}
+}
+
+// Get returns the entry under key unless it expired.
+func (c *PostgresCache[K, V]) Get(ctx context.Context, key K) (CacheEntry[V], bool, error) {
+	var entry CacheEntry[V]
+	k, err := encodeCacheKey(key)
+	if err != nil {
+		return entry, false, err
+	}
+	var (
+		value          []byte
+		fresh, expires *time.Time
+	)
+	err = querier(ctx, c.db).QueryRow(ctx, `SELECT value, fresh_until, expires_at FROM cache_entries
+		WHERE namespace = $1 AND key = $2 AND (expires_at IS NULL OR expires_at > now())`,
+		c.namespace, k).Scan(&value, &fresh, &expires)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return entry, false, nil
+	}
+	if err != nil {
+		return entry, false, fmt.Errorf("failed to get %s cache entry: %w", c.namespace, err)
+	}
+	if err := json.Unmarshal(value, &entry.Value); err != nil {
+		return entry, false, fmt.Errorf("failed to decode %s cache entry: %w", c.namespace, err)
+	}
+	if fresh != nil {
+		entry.Fresh = *fresh
+	}
+	if expires != nil {
+		entry.Expires = *expires
+	}
+	return entry, true, nil
+}
+
+// Set upserts the entry under key.
+func (c *PostgresCache[K, V]) Set(ctx context.Context, key K, entry CacheEntry[V]) error {
+	k, err := encodeCacheKey(key)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(entry.Value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s cache entry: %w", c.namespace, err)
+	}
+	_, err = querier(ctx, c.db).Exec(ctx, `INSERT INTO cache_entries (namespace, key, value, fresh_until, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (namespace, key) DO UPDATE
+		SET value = excluded.value, fresh_until = excluded.fresh_until, expires_at = excluded.expires_at`,
+		c.namespace, k, value, optionalTime(entry.Fresh), optionalTime(entry.Expires))
+	if err != nil {
+		return fmt.Errorf("failed to set %s cache entry: %w", c.namespace, err)
+	}
+	return nil
+}
+
+// Delete removes the entry under key.
+func (c *PostgresCache[K, V]) Delete(ctx context.Context, key K) error {
+	k, err := encodeCacheKey(key)
+	if err != nil {
+		return err
+	}
+	if _, err := querier(ctx, c.db).Exec(ctx, "DELETE FROM cache_entries WHERE namespace = $1 AND key = $2", c.namespace, k); err != nil {
+		return fmt.Errorf("failed to delete %s cache entry: %w", c.namespace, err)
+	}
+	return nil
+}
+
+// PruneCache deletes expired entries of every PostgresCache in db.
+func PruneCache(ctx context.Context, db Querier) error {
+	if _, err := querier(ctx, db).Exec(ctx, "DELETE FROM cache_entries WHERE expires_at < now()"); err != nil {
+		return fmt.Errorf("failed to prune cache entries: %w", err)
+	}
+	return nil
+}
+
+func encodeCacheKey[K comparable](key K) (string, error) {
+	b, err := json.Marshal(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode cache key: %w", err)
+	}
+	return string(b), nil
+}
+
+// optionalTime maps the zero time to NULL.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// TieredCache reads through a local cache to a shared one, typically a
+// MemoryCache in front of a PostgresCache, and writes to both.
+type TieredCache[K comparable, V any] struct {
+	local, shared Cache[K, V]
+}
+
+var _ localCache[string] = (*TieredCache[string, int])(nil)
+
+// NewTieredCache returns a TieredCache over local and shared.
+func NewTieredCache[K comparable, V any](local, shared Cache[K, V]) *TieredCache[K, V] {
+	return &TieredCache[K, V]{local: local, shared: shared}
+}
+
+// Get returns a fresh local entry, otherwise the shared entry, which it
+// copies to the local cache, falling back to a stale local one.
+func (c *TieredCache[K, V]) Get(ctx context.Context, key K) (CacheEntry[V], bool, error) {
+	local, ok, err := c.local.Get(ctx, key)
+	if err != nil {
+		return local, false, err
+	}
+	if ok && !local.stale(time.Now()) {
+		return local, true, nil
+	}
+	shared, found, err := c.shared.Get(ctx, key)
+	if err != nil {
+		return shared, false, err
+	}
+	if !found {
+		return local, ok, nil
+	}
+	if err := c.local.Set(ctx, key, shared); err != nil {
+		return shared, false, err
+	}
+	return shared, true, nil
+}
+
+// Set stores entry in the shared cache, then the local one.
+func (c *TieredCache[K, V]) Set(ctx context.Context, key K, entry CacheEntry[V]) error {
+	if err := c.shared.Set(ctx, key, entry); err != nil {
+		return err
+	}
+	return c.local.Set(ctx, key, entry)
+}
+
+// Delete removes the entry from both caches.
+func (c *TieredCache[K, V]) Delete(ctx context.Context, key K) error {
+	return errors.Join(c.local.Delete(ctx, key), c.shared.Delete(ctx, key))
+}
+
+func (c *TieredCache[K, V]) deleteLocal(ctx context.Context, key K) error {
+	return c.local.Delete(ctx, key)
+}
+
+// CacheLoaderOptions configures a CacheLoader.
+type CacheLoaderOptions struct {
+	// TTL is how long loaded values are fresh.
+	TTL time.Duration
+	// Stale is how long values are still served after TTL, while one
+	// request reloads them in the background.
+	Stale time.Duration
+	// LoadTimeout bounds each load, which does not stop when the
+	// requests waiting for it go away.
+	LoadTimeout time.Duration
+	// Notify, when set, is where Invalidate publishes invalidations for
+	// other instances with pg_notify.
+	Notify Querier
+}
+
+const (
+	defaultCacheTTL         = time.Minute
+	defaultCacheLoadTimeout = 10 * time.Second
+)
+
+// cacheChannel carries invalidations published by CacheLoader.Invalidate.
+const cacheChannel = "cache_invalidations"
+
+// cacheInvalidation is the payload of a notification on cacheChannel.
+type cacheInvalidation struct {
+	Cache string          `json:"cache"`
+	Key   json.RawMessage `json:"key"`
+}
+
+// LoadFunc loads the value under key on a cache miss.
+type LoadFunc[K comparable, V any] func(ctx context.Context, key K) (V, error)
+
+// CacheLoader gets values from a Cache, loading and storing them on
+// misses. Concurrent misses of a key share one load, and stale entries
+// are served while they are reloaded in the background. Cache errors are
+// logged and treated as misses.
+type CacheLoader[K comparable, V any] struct {
+	name  string
+	cache Cache[K, V]
+	load  LoadFunc[K, V]
+	opts  CacheLoaderOptions
+	stats *expvar.Map
+
+	// epoch counts invalidations, so that loads that began before one do
+	// not store what they read.
+	epoch   atomic.Uint64
+	mu      sync.Mutex
+	flights map[K]*loadFlight[V]
+}
+
+// loadFlight is a load shared by the requests for a key.
+type loadFlight[V any] struct {
+	done  chan struct{}
+	value V
+	err   error
+}
+
+// NewCacheLoader returns a CacheLoader over cache, reporting metrics
+// under name.
+func NewCacheLoader[K comparable, V any](name string, cache Cache[K, V], load LoadFunc[K, V], opts CacheLoaderOptions) *CacheLoader[K, V] {
+	if opts.TTL <= 0 {
+		opts.TTL = defaultCacheTTL
+	}
+	if opts.LoadTimeout <= 0 {
+		opts.LoadTimeout = defaultCacheLoadTimeout
+	}
+	stats, ok := cacheStats.Get(name).(*expvar.Map)
+	if !ok {
+		stats = new(expvar.Map).Init()
+		cacheStats.Set(name, stats)
+	}
+	return &CacheLoader[K, V]{
+		name:    name,
+		cache:   cache,
+		load:    load,
+		opts:    opts,
+		stats:   stats,
+		flights: map[K]*loadFlight[V]{},
+	}
+}
+
+// Get returns the value under key, loading it on a miss.
+func (l *CacheLoader[K, V]) Get(ctx context.Context, key K) (V, error) {
+	entry, ok, err := l.cache.Get(ctx, key)
+	if err != nil {
+		l.cacheError("get", err)
+		ok = false
+	}
+	switch {
+	case ok && !entry.stale(time.Now()):
+		l.stats.Add("hits", 1)
+		return entry.Value, nil
+	case ok:
+		l.stats.Add("stale_hits", 1)
+		l.flight(ctx, key)
+		return entry.Value, nil
+	}
+
+	l.stats.Add("misses", 1)
+	f := l.flight(ctx, key)
+	select {
+	case <-f.done:
+		return f.value, f.err
+	case <-ctx.Done():
+		var zero V
+		return zero, fmt.Errorf("failed to load %s cache entry: %w", l.name, ctx.Err())
+	}
+}
+
+// flight returns the load of key in progress, starting one if needed.
+func (l *CacheLoader[K, V]) flight(ctx context.Context, key K) *loadFlight[V] {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.flights[key]; ok {
+		return f
+	}
+	f := &loadFlight[V]{done: make(chan struct{})}
+	l.flights[key] = f
+	// The value is shared, so loading must not depend on this caller.
+	go l.run(context.WithoutCancel(ctx), key, f)
+	return f
+}
+
+func (l *CacheLoader[K, V]) run(ctx context.Context, key K, f *loadFlight[V]) {
+	epoch := l.epoch.Load()
+	defer func() {
+		if p := recover(); p != nil {
+			f.err = fmt.Errorf("%s cache load panicked: %v", l.name, p)
+			slog.Error("Cache load panicked", "cache", l.name, "panic", p)
+		}
+		if f.err != nil {
+			l.stats.Add("load_errors", 1)
+		}
+		l.mu.Lock()
+		delete(l.flights, key)
+		l.mu.Unlock()
+		close(f.done)
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, l.opts.LoadTimeout)
+	defer cancel()
+	f.value, f.err = l.load(ctx, key)
+	if f.err != nil || l.epoch.Load() != epoch {
+		return
+	}
+	now := time.Now()
+	entry := CacheEntry[V]{Value: f.value, Fresh: now.Add(l.opts.TTL), Expires: now.Add(l.opts.TTL + l.opts.Stale)}
+	if err := l.cache.Set(ctx, key, entry); err != nil {
+		l.cacheError("set", err)
+	}
+}
+
+// Invalidate deletes the entry under key and, with Notify set, tells
+// every instance to drop it from its local cache.
+func (l *CacheLoader[K, V]) Invalidate(ctx context.Context, key K) error {
+	l.epoch.Add(1)
+	if err := l.cache.Delete(ctx, key); err != nil {
+		return fmt.Errorf("failed to invalidate %s cache entry: %w", l.name, err)
+	}
+	if l.opts.Notify == nil {
+		return nil
+	}
+	k, err := encodeCacheKey(key)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(cacheInvalidation{Cache: l.name, Key: json.RawMessage(k)})
+	if err != nil {
+		return fmt.Errorf("failed to encode cache invalidation: %w", err)
+	}
+	if _, err := querier(ctx, l.opts.Notify).Exec(ctx, "SELECT pg_notify($1, $2)", cacheChannel, string(payload)); err != nil {
+		return fmt.Errorf("failed to publish %s cache invalidation: %w", l.name, err)
+	}
+	return nil
+}
+
+// invalidateOnNotify returns a handler for cacheChannel dropping the
+// invalidated entries of this loader from its local cache.
+func (l *CacheLoader[K, V]) invalidateOnNotify() NotifyHandler {
+	return func(ctx context.Context, n *pgconn.Notification) error {
+		var msg cacheInvalidation
+		if err := json.Unmarshal([]byte(n.Payload), &msg); err != nil {
+			return fmt.Errorf("failed to decode cache invalidation: %w", err)
+		}
+		if msg.Cache != l.name {
+			return nil
+		}
+		l.epoch.Add(1)
+		l.stats.Add("invalidations", 1)
+		local, ok := l.cache.(localCache[K])
+		if !ok {
+			return nil
+		}
+		var key K
+		if err := json.Unmarshal(msg.Key, &key); err != nil {
+			return fmt.Errorf("failed to decode %s cache key: %w", l.name, err)
+		}
+		return local.deleteLocal(ctx, key)
+	}
+}
+
+func (l *CacheLoader[K, V]) cacheError(op string, err error) {
+	l.stats.Add("cache_errors", 1)
+	slog.Warn("Cache operation failed", "cache", l.name, "operation", op, "error", err)
+}
+
+// NewAppCache returns a loader over a MemoryCache in front of the
+// cache_entries table, whose invalidations reach every instance. Call it
+// before Start.
+func NewAppCache[K comparable, V any](app *App, name string, load LoadFunc[K, V], opts CacheLoaderOptions) *CacheLoader[K, V] {
+	cache := NewTieredCache[K, V](NewMemoryCache[K, V](MemoryCacheOptions{}), NewPostgresCache[K, V](app.DB, name))
+	opts.Notify = app.DB
+	loader := NewCacheLoader(name, cache, load, opts)
+	app.Notify.Handle(cacheChannel, loader.invalidateOnNotify())
+	return loader
+}
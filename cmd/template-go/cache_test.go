@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCache(t *testing.T) {
+	t.Run("evicts the least recently used entry", func(t *testing.T) {
+		c := NewMemoryCache[string, int](MemoryCacheOptions{MaxEntries: 2, Shards: 1})
+		require.NoError(t, c.Set(t.Context(), "a", CacheEntry[int]{Value: 1}))
+		require.NoError(t, c.Set(t.Context(), "b", CacheEntry[int]{Value: 2}))
+		_, ok, _ := c.Get(t.Context(), "a")
+		require.True(t, ok)
+		require.NoError(t, c.Set(t.Context(), "c", CacheEntry[int]{Value: 3}))
+
+		_, ok, _ = c.Get(t.Context(), "b")
+		assert.False(t, ok)
+		entry, ok, _ := c.Get(t.Context(), "a")
+		assert.True(t, ok)
+		assert.Equal(t, 1, entry.Value)
+		assert.Equal(t, 2, c.Len())
+	})
+
+	t.Run("drops expired entries", func(t *testing.T) {
+		c := NewMemoryCache[string, int](MemoryCacheOptions{})
+		require.NoError(t, c.Set(t.Context(), "a", CacheEntry[int]{Value: 1, Expires: time.Now().Add(-time.Second)}))
+		_, ok, _ := c.Get(t.Context(), "a")
+		assert.False(t, ok)
+		assert.Zero(t, c.Len())
+	})
+
+	t.Run("bounds every shard", func(t *testing.T) {
+		c := NewMemoryCache[int, int](MemoryCacheOptions{MaxEntries: 64, Shards: 4})
+		for i := range 1000 {
+			require.NoError(t, c.Set(t.Context(), i, CacheEntry[int]{Value: i}))
+		}
+		assert.LessOrEqual(t, c.Len(), 64)
+		assert.Greater(t, c.Len(), 32, "keys spread across shards")
+	})
+
+	t.Run("updates and deletes", func(t *testing.T) {
+		c := NewMemoryCache[string, int](MemoryCacheOptions{})
+		require.NoError(t, c.Set(t.Context(), "a", CacheEntry[int]{Value: 1}))
+		require.NoError(t, c.Set(t.Context(), "a", CacheEntry[int]{Value: 2}))
+		entry, _, _ := c.Get(t.Context(), "a")
+		assert.Equal(t, 2, entry.Value)
+
+		require.NoError(t, c.Delete(t.Context(), "a"))
+		_, ok, _ := c.Get(t.Context(), "a")
+		assert.False(t, ok)
+	})
+}
+
+// failingCache fails every operation.
+type failingCache[K comparable, V any] struct{ err error }
+
+func (c failingCache[K, V]) Get(context.Context, K) (CacheEntry[V], bool, error) {
+	return CacheEntry[V]{}, false, c.err
+}
+func (c failingCache[K, V]) Set(context.Context, K, CacheEntry[V]) error { return c.err }
+func (c failingCache[K, V]) Delete(context.Context, K) error             { return c.err }
+
+func TestTieredCache(t *testing.T) {
+	fresh := time.Now().Add(time.Minute)
+
+	t.Run("copies shared entries to the local cache", func(t *testing.T) {
+		local, shared := NewMemoryCache[string, int](MemoryCacheOptions{}), NewMemoryCache[string, int](MemoryCacheOptions{})
+		c := NewTieredCache[string, int](local, shared)
+		require.NoError(t, shared.Set(t.Context(), "a", CacheEntry[int]{Value: 1, Fresh: fresh}))
+
+		entry, ok, err := c.Get(t.Context(), "a")
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, 1, entry.Value)
+		assert.Equal(t, 1, local.Len())
+	})
+
+	t.Run("prefers a fresher shared entry to a stale local one", func(t *testing.T) {
+		local, shared := NewMemoryCache[string, int](MemoryCacheOptions{}), NewMemoryCache[string, int](MemoryCacheOptions{})
+		c := NewTieredCache[string, int](local, shared)
+		require.NoError(t, local.Set(t.Context(), "a", CacheEntry[int]{Value: 1, Fresh: time.Now().Add(-time.Second)}))
+
+		entry, ok, _ := c.Get(t.Context(), "a")
+		assert.True(t, ok, "a stale local entry is better than none")
+		assert.Equal(t, 1, entry.Value)
+
+		require.NoError(t, shared.Set(t.Context(), "a", CacheEntry[int]{Value: 2, Fresh: fresh}))
+		entry, _, _ = c.Get(t.Context(), "a")
+		assert.Equal(t, 2, entry.Value)
+	})
+
+	t.Run("writes and deletes both", func(t *testing.T) {
+		local, shared := NewMemoryCache[string, int](MemoryCacheOptions{}), NewMemoryCache[string, int](MemoryCacheOptions{})
+		c := NewTieredCache[string, int](local, shared)
+		require.NoError(t, c.Set(t.Context(), "a", CacheEntry[int]{Value: 1}))
+		assert.Equal(t, 1, local.Len())
+		assert.Equal(t, 1, shared.Len())
+
+		require.NoError(t, c.Delete(t.Context(), "a"))
+		assert.Zero(t, local.Len())
+		assert.Zero(t, shared.Len())
+	})
+
+	t.Run("deletes locally even when the shared cache fails", func(t *testing.T) {
+		errCache := errors.New("unavailable")
+		local := NewMemoryCache[string, int](MemoryCacheOptions{})
+		c := NewTieredCache[string, int](local, failingCache[string, int]{err: errCache})
+		require.NoError(t, local.Set(t.Context(), "a", CacheEntry[int]{Value: 1}))
+
+		require.ErrorIs(t, c.Delete(t.Context(), "a"), errCache)
+		assert.Zero(t, local.Len())
+	})
+}
+
+// countingLoad returns the key's length and counts its calls.
+type countingLoad struct {
+	calls   atomic.Int32
+	release chan struct{}
+}
+
+func (l *countingLoad) load(_ context.Context, key string) (int, error) {
+	l.calls.Add(1)
+	if l.release != nil {
+		<-l.release
+	}
+	return len(key), nil
+}
+
+func TestCacheLoader(t *testing.T) {
+	t.Run("loads misses and serves hits", func(t *testing.T) {
+		counter := &countingLoad{}
+		l := NewCacheLoader(t.Name(), NewMemoryCache[string, int](MemoryCacheOptions{}), counter.load, CacheLoaderOptions{})
+
+		for range 3 {
+			v, err := l.Get(t.Context(), "abc")
+			require.NoError(t, err)
+			assert.Equal(t, 3, v)
+		}
+		assert.Equal(t, int32(1), counter.calls.Load())
+		assert.Equal(t, int64(1), expvarMapInt(t, l.stats, "misses"))
+		assert.Equal(t, int64(2), expvarMapInt(t, l.stats, "hits"))
+	})
+
+	t.Run("shares concurrent misses", func(t *testing.T) {
+		counter := &countingLoad{release: make(chan struct{})}
+		l := NewCacheLoader(t.Name(), NewMemoryCache[string, int](MemoryCacheOptions{}), counter.load, CacheLoaderOptions{})
+
+		var wg sync.WaitGroup
+		values := make([]int, 8)
+		for i := range values {
+			wg.Go(func() { values[i], _ = l.Get(t.Context(), "abc") })
+		}
+		require.Eventually(t, func() bool {
+			return expvarMapInt(t, l.stats, "misses") == int64(len(values))
+		}, time.Second, time.Millisecond)
+		close(counter.release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), counter.calls.Load())
+		for _, v := range values {
+			assert.Equal(t, 3, v)
+		}
+	})
+
+	t.Run("serves stale values while reloading", func(t *testing.T) {
+		cache := NewMemoryCache[string, int](MemoryCacheOptions{})
+		require.NoError(t, cache.Set(t.Context(), "abc", CacheEntry[int]{
+			Value:   1,
+			Fresh:   time.Now().Add(-time.Second),
+			Expires: time.Now().Add(time.Minute),
+		}))
+		counter := &countingLoad{}
+		l := NewCacheLoader(t.Name(), cache, counter.load, CacheLoaderOptions{})
+
+		v, err := l.Get(t.Context(), "abc")
+		require.NoError(t, err)
+		assert.Equal(t, 1, v)
+		require.Eventually(t, func() bool {
+			entry, _, _ := cache.Get(t.Context(), "abc")
+			return entry.Value == 3
+		}, time.Second, time.Millisecond)
+		assert.Equal(t, int32(1), counter.calls.Load())
+		assert.Equal(t, int64(1), expvarMapInt(t, l.stats, "stale_hits"))
+	})
+
+	t.Run("keeps values stale for the stale window", func(t *testing.T) {
+		cache := NewMemoryCache[string, int](MemoryCacheOptions{})
+		l := NewCacheLoader(t.Name(), cache, (&countingLoad{}).load, CacheLoaderOptions{TTL: time.Minute, Stale: time.Hour})
+		_, err := l.Get(t.Context(), "abc")
+		require.NoError(t, err)
+
+		entry, _, _ := cache.Get(t.Context(), "abc")
+		assert.WithinDuration(t, time.Now().Add(time.Minute), entry.Fresh, time.Second)
+		assert.WithinDuration(t, time.Now().Add(time.Minute+time.Hour), entry.Expires, time.Second)
+	})
+
+	t.Run("does not cache errors and panics", func(t *testing.T) {
+		errLoad := errors.New("unavailable")
+		var calls atomic.Int32
+		l := NewCacheLoader(t.Name(), NewMemoryCache[string, int](MemoryCacheOptions{}), func(context.Context, string) (int, error) {
+			switch calls.Add(1) {
+			case 1:
+				return 0, errLoad
+			case 2:
+				panic("boom")
+			default:
+				return 1, nil
+			}
+		}, CacheLoaderOptions{})
+
+		_, err := l.Get(t.Context(), "k")
+		require.ErrorIs(t, err, errLoad)
+		_, err = l.Get(t.Context(), "k")
+		require.ErrorContains(t, err, "panicked: boom")
+		v, err := l.Get(t.Context(), "k")
+		require.NoError(t, err)
+		assert.Equal(t, 1, v)
+		assert.Equal(t, int64(2), expvarMapInt(t, l.stats, "load_errors"))
+	})
+
+	t.Run("loads when the cache fails", func(t *testing.T) {
+		l := NewCacheLoader(t.Name(), Cache[string, int](failingCache[string, int]{err: errors.New("unavailable")}), (&countingLoad{}).load, CacheLoaderOptions{})
+
+		v, err := l.Get(t.Context(), "abc")
+		require.NoError(t, err)
+		assert.Equal(t, 3, v)
+		assert.Equal(t, int64(2), expvarMapInt(t, l.stats, "cache_errors"))
+	})
+
+	t.Run("returns when the caller gives up", func(t *testing.T) {
+		counter := &countingLoad{release: make(chan struct{})}
+		defer close(counter.release)
+		l := NewCacheLoader(t.Name(), NewMemoryCache[string, int](MemoryCacheOptions{}), counter.load, CacheLoaderOptions{})
+
+		ctx, cancel := context.WithTimeout(t.Context(), 10*time.Millisecond)
+		defer cancel()
+		_, err := l.Get(ctx, "abc")
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("does not store loads overtaken by an invalidation", func(t *testing.T) {
+		counter := &countingLoad{release: make(chan struct{})}
+		cache := NewMemoryCache[string, int](MemoryCacheOptions{})
+		l := NewCacheLoader(t.Name(), cache, counter.load, CacheLoaderOptions{})
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, _ = l.Get(t.Context(), "abc")
+		}()
+		require.Eventually(t, func() bool { return counter.calls.Load() == 1 }, time.Second, time.Millisecond)
+		require.NoError(t, l.Invalidate(t.Context(), "abc"))
+		close(counter.release)
+		<-done
+
+		assert.Zero(t, cache.Len())
+	})
+}
+
+func TestCacheLoaderInvalidation(t *testing.T) {
+	t.Run("publishes invalidations", func(t *testing.T) {
+		db := &recordingQuerier{}
+		cache := NewMemoryCache[string, int](MemoryCacheOptions{})
+		l := NewCacheLoader(t.Name(), cache, (&countingLoad{}).load, CacheLoaderOptions{Notify: db})
+		_, err := l.Get(t.Context(), "abc")
+		require.NoError(t, err)
+
+		require.NoError(t, l.Invalidate(t.Context(), "abc"))
+		assert.Zero(t, cache.Len())
+		assert.Equal(t, []querierCall{{
+			Method: "Exec",
+			SQL:    "SELECT pg_notify($1, $2)",
+			Args:   []any{cacheChannel, fmt.Sprintf(`{"cache":%q,"key":"abc"}`, t.Name())},
+		}}, db.Calls())
+	})
+
+	t.Run("drops local entries on notifications", func(t *testing.T) {
+		type key struct {
+			Tenant string
+			ID     int
+		}
+		local, shared := NewMemoryCache[key, int](MemoryCacheOptions{}), NewMemoryCache[key, int](MemoryCacheOptions{})
+		l := NewCacheLoader(t.Name(), NewTieredCache[key, int](local, shared), func(context.Context, key) (int, error) {
+			return 1, nil
+		}, CacheLoaderOptions{})
+		k := key{Tenant: "a", ID: 7}
+		_, err := l.Get(t.Context(), k)
+		require.NoError(t, err)
+
+		handle := l.invalidateOnNotify()
+		require.NoError(t, handle(t.Context(), &pgconn.Notification{Payload: `{"cache":"other","key":{"Tenant":"a","ID":7}}`}))
+		assert.Equal(t, 1, local.Len(), "invalidations of other caches are ignored")
+
+		require.NoError(t, handle(t.Context(), &pgconn.Notification{
+			Payload: fmt.Sprintf(`{"cache":%q,"key":{"Tenant":"a","ID":7}}`, t.Name()),
+		}))
+		assert.Zero(t, local.Len())
+		assert.Equal(t, 1, shared.Len(), "the instance that invalidated deleted the shared entry")
+		assert.Equal(t, int64(1), expvarMapInt(t, l.stats, "invalidations"))
+
+		require.Error(t, handle(t.Context(), &pgconn.Notification{Payload: "garbage"}))
+	})
+}
+
+func TestPostgresCacheIntegration(t *testing.T) {
+	skipIfNoTestcontainers(t)
+
+	namespace := t.Name()
+	t.Cleanup(func() {
+		_, _ = testPool.Exec(context.Background(), "DELETE FROM cache_entries WHERE namespace = $1", namespace)
+	})
+	type value struct {
+		Name  string
+		Count int
+	}
+	c := NewPostgresCache[int, value](testPool, namespace)
+
+	_, ok, err := c.Get(t.Context(), 1)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	entry := CacheEntry[value]{
+		Value:   value{Name: "a", Count: 2},
+		Fresh:   time.Now().Add(time.Minute).Truncate(time.Microsecond),
+		Expires: time.Now().Add(time.Hour).Truncate(time.Microsecond),
+	}
+	require.NoError(t, c.Set(t.Context(), 1, entry))
+	got, ok, err := c.Get(t.Context(), 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, entry.Value, got.Value)
+	assert.True(t, entry.Fresh.Equal(got.Fresh))
+	assert.True(t, entry.Expires.Equal(got.Expires))
+
+	require.NoError(t, c.Set(t.Context(), 2, CacheEntry[value]{Value: value{Name: "b"}}))
+	_, ok, err = c.Get(t.Context(), 2)
+	require.NoError(t, err)
+	assert.True(t, ok, "entries without expiry are kept")
+
+	require.NoError(t, c.Set(t.Context(), 3, CacheEntry[value]{Expires: time.Now().Add(-time.Second)}))
+	_, ok, err = c.Get(t.Context(), 3)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, c.Delete(t.Context(), 1))
+	_, ok, err = c.Get(t.Context(), 1)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, PruneCache(t.Context(), testPool))
+	var n int
+	require.NoError(t, testPool.QueryRow(t.Context(), "SELECT count(*) FROM cache_entries WHERE namespace = $1", namespace).Scan(&n))
+	assert.Equal(t, 1, n)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+const jobsUsage = "usage: template-go jobs list [-state STATE] [-kind KIND] [-limit N] | retry ID... | cancel ID..."
+
+// runCommand runs a management command given as arguments instead of
+// serving HTTP.
+func runCommand(ctx context.Context, cfg *Config, args []string, stdout io.Writer) error {
+	switch args[0] {
+	case "jobs":
+		pool, err := openDB(cfg.DSN)
+		if err != nil {
+			return err
+		}
+		defer pool.Close()
+		return runJobsCommand(ctx, NewJobQueue(pool, cfg.Jobs), args[1:], stdout)
+	default:
+		return fmt.Errorf("unknown command %q, want jobs", args[0])
+	}
+}
+
+// runJobsCommand lists, retries or cancels jobs.
+func runJobsCommand(ctx context.Context, q *JobQueue, args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(jobsUsage)
+	}
+
+	switch cmd, rest := args[0], args[1:]; cmd {
+	case "list":
+		fs := flag.NewFlagSet("jobs list", flag.ContinueOnError)
+		fs.SetOutput(stdout)
+		var f JobFilter
+		fs.StringVar(&f.State, "state", "", "only jobs in this state")
+		fs.StringVar(&f.Kind, "kind", "", "only jobs of this kind")
+		fs.IntVar(&f.Limit, "limit", 50, "maximum number of jobs, newest first")
+		if err := fs.Parse(rest); err != nil {
+			return err
+		}
+		jobs, err := q.List(ctx, f)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tKIND\tSTATE\tATTEMPTS\tPRIORITY\tSCHEDULED AT\tLAST ERROR")
+		for _, j := range jobs {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%d/%d\t%d\t%s\t%s\n",
+				j.ID, j.Kind, j.State, j.Attempts, j.MaxAttempts, j.Priority,
+				j.ScheduledAt.UTC().Format(time.RFC3339), j.LastError)
+		}
+		return tw.Flush()
+
+	case "retry", "cancel":
+		if len(rest) == 0 {
+			return errors.New(jobsUsage)
+		}
+		action, done := q.Retry, "retried"
+		if cmd == "cancel" {
+			action, done = q.Cancel, "cancelled"
+		}
+		var errs []error
+		for _, arg := range rest {
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("invalid job ID %q", arg))
+				continue
+			}
+			if err := action(ctx, id); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			fmt.Fprintf(stdout, "job %d %s\n", id, done)
+		}
+		return errors.Join(errs...)
+
+	default:
+		return errors.New(jobsUsage)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRunCommand(t *testing.T) {
+	err := runCommand(t.Context(), &Config{}, []string{"serve"}, &strings.Builder{})
+	require.EqualError(t, err, `unknown command "serve", want jobs`)
+}
+
+func TestRunJobsCommand(t *testing.T) {
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("list", func(t *testing.T) {
+		db := &fakePool{recordingQuerier: recordingQuerier{Rows: [][]any{
+			{int64(2), "email", JobFailed, json.RawMessage(`{}`), 0, 3, 3, at, at, "smtp down"},
+			{int64(1), "report", JobCompleted, json.RawMessage(`{}`), 5, 1, 25, at, at, ""},
+		}}}
+		var out strings.Builder
+
+		err := runJobsCommand(t.Context(), NewJobQueue(db, JobQueueOptions{}), []string{"list", "-state", "failed", "-limit", "2"}, &out)
+		require.NoError(t, err)
+		assert.Equal(t, ""+
+			"ID  KIND    STATE      ATTEMPTS  PRIORITY  SCHEDULED AT          LAST ERROR\n"+
+			"2   email   failed     3/3       0         2026-01-02T03:04:05Z  smtp down\n"+
+			"1   report  completed  1/25      5         2026-01-02T03:04:05Z  \n",
+			out.String())
+		assert.Equal(t, []any{JobFailed, 2}, db.Calls()[0].Args)
+	})
+
+	t.Run("retry and cancel", func(t *testing.T) {
+		for _, cmd := range []string{"retry", "cancel"} {
+			db := &fakePool{recordingQuerier: recordingQuerier{Tag: "UPDATE 1"}}
+			var out strings.Builder
+
+			err := runJobsCommand(t.Context(), NewJobQueue(db, JobQueueOptions{}), []string{cmd, "4", "5"}, &out)
+			require.NoError(t, err)
+			done := map[string]string{"retry": "retried", "cancel": "cancelled"}[cmd]
+			assert.Equal(t, "job 4 "+done+"\njob 5 "+done+"\n", out.String())
+			assert.Equal(t, []any{int64(5)}, db.Calls()[1].Args)
+		}
+	})
+
+	t.Run("reports every failure", func(t *testing.T) {
+		db := &fakePool{recordingQuerier: recordingQuerier{Tag: "UPDATE 0"}}
+		var out strings.Builder
+
+		err := runJobsCommand(t.Context(), NewJobQueue(db, JobQueueOptions{}), []string{"cancel", "x", "9"}, &out)
+		require.ErrorIs(t, err, errJobNotFound)
+		assert.ErrorContains(t, err, `invalid job ID "x"`)
+		assert.Empty(t, out.String())
+	})
+
+	for _, args := range [][]string{nil, {"purge"}, {"retry"}} {
+		t.Run("usage "+strings.Join(args, " "), func(t *testing.T) {
+			err := runJobsCommand(t.Context(), NewJobQueue(&fakePool{}, JobQueueOptions{}), args, &strings.Builder{})
+			require.EqualError(t, err, jobsUsage)
+		})
+	}
+}
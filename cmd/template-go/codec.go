@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// valueWriter is the target of encodeValue, implemented by binary formats.
+type valueWriter interface {
+	writeNil()
+	writeBool(b bool)
+	writeInt(n int64)
+	writeUint(n uint64)
+	writeFloat(f float64)
+	writeString(s string)
+	writeBytes(b []byte)
+	writeTime(t time.Time)
+	beginArray(n int)
+	beginMap(n int)
+	bytes() []byte
+}
+
+var (
+	timeType          = reflect.TypeFor[time.Time]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+	jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+	numberType        = reflect.TypeFor[json.Number]()
+)
+
+// encodeValue walks v the way encoding/json does, honoring json struct
+// tags, and emits it to vw. Values implementing json.Marshaler are
+// re-decoded from their JSON form, keeping numbers exact.
+func encodeValue(vw valueWriter, rv reflect.Value) error {
+	if !rv.IsValid() {
+		vw.writeNil()
+		return nil
+	}
+
+	switch rv.Kind() { //nolint:exhaustive // remaining kinds are handled below
+	case reflect.Pointer, reflect.Interface:
+		if rv.IsNil() {
+			vw.writeNil()
+			return nil
+		}
+	}
+
+	t := rv.Type()
+	switch {
+	case t == timeType:
+		vw.writeTime(rv.Interface().(time.Time)) //nolint:forcetypeassert // checked by type
+		return nil
+	case t.Implements(jsonMarshalerType) && rv.Kind() != reflect.Interface:
+		data, err := rv.Interface().(json.Marshaler).MarshalJSON() //nolint:forcetypeassert // checked by Implements
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %w", t, err)
+		}
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		var generic any
+		if err := dec.Decode(&generic); err != nil {
+			return fmt.Errorf("failed to decode JSON of %s: %w", t, err)
+		}
+		return encodeValue(vw, reflect.ValueOf(generic))
+	case t == numberType:
+		return encodeNumber(vw, json.Number(rv.String()))
+	case t.Implements(textMarshalerType) && rv.Kind() != reflect.Interface:
+		text, err := rv.Interface().(encoding.TextMarshaler).MarshalText() //nolint:forcetypeassert // checked by Implements
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s: %w", t, err)
+		}
+		vw.writeString(string(text))
+		return nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return encodeValue(vw, rv.Elem())
+	case reflect.Bool:
+		vw.writeBool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		vw.writeInt(rv.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		vw.writeUint(rv.Uint())
+	case reflect.Float32, reflect.Float64:
+		vw.writeFloat(rv.Float())
+	case reflect.String:
+		vw.writeString(rv.String())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			vw.writeNil()
+			return nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, rv.Len())
+			reflect.Copy(reflect.ValueOf(b), rv)
+			vw.writeBytes(b)
+			return nil
+		}
+		vw.beginArray(rv.Len())
+		for i := range rv.Len() {
+			if err := encodeValue(vw, rv.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		return encodeMap(vw, rv)
+	case reflect.Struct:
+		return encodeStruct(vw, rv)
+	default:
+		return fmt.Errorf("unsupported type %s", t)
+	}
+	return nil
+}
+
+// encodeNumber emits n as an integer when it is one, or as a float.
+func encodeNumber(vw valueWriter, n json.Number) error {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		vw.writeInt(i)
+		return nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		vw.writeUint(u)
+		return nil
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return fmt.Errorf("invalid number %q: %w", n, err)
+	}
+	vw.writeFloat(f)
+	return nil
+}
+
+func encodeMap(vw valueWriter, rv reflect.Value) error {
+	if rv.IsNil() {
+		vw.writeNil()
+		return nil
+	}
+
+	// Sort keys for deterministic output, like encoding/json.
+	keys := rv.MapKeys()
+	slices.SortFunc(keys, func(a, b reflect.Value) int {
+		return strings.Compare(fmt.Sprint(a.Interface()), fmt.Sprint(b.Interface()))
+	})
+
+	vw.beginMap(len(keys))
+	for _, k := range keys {
+		if err := encodeValue(vw, k); err != nil {
+			return err
+		}
+		if err := encodeValue(vw, rv.MapIndex(k)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// structField is an encoded struct field.
+type structField struct {
+	name  string
+	value reflect.Value
+}
+
+func encodeStruct(vw valueWriter, rv reflect.Value) error {
+	fields := collectFields(rv, nil)
+
+	vw.beginMap(len(fields))
+	for _, f := range fields {
+		vw.writeString(f.name)
+		if err := encodeValue(vw, f.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectFields lists the fields encoding/json would emit, flattening
+// untagged embedded structs and dropping empty omitempty fields.
+func collectFields(rv reflect.Value, fields []structField) []structField {
+	t := rv.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		fv := rv.Field(i)
+		tag := sf.Tag.Get("json")
+
+		if sf.Anonymous && tag == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					continue
+				}
+				fv, ft = fv.Elem(), ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = collectFields(fv, fields)
+				continue
+			}
+		}
+		if !sf.IsExported() || tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = sf.Name
+		}
+		if slices.Contains(strings.Split(opts, ","), "omitempty") && isEmptyValue(fv) {
+			continue
+		}
+		fields = append(fields, structField{name: name, value: fv})
+	}
+	return fields
+}
+
+// isEmptyValue mirrors the omitempty rules of encoding/json.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() { //nolint:exhaustive // other kinds are never empty
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	default:
+		return false
+	}
+}
+
+// cborWriter encodes values as CBOR (RFC 8949).
+type cborWriter struct {
+	buf []byte
+}
+
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborBytes  = 2 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+	cborTag    = 6 << 5
+	cborSimple = 7 << 5
+)
+
+func (c *cborWriter) head(major byte, n uint64) {
+	switch {
+	case n < 24:
+		c.buf = append(c.buf, major|byte(n))
+	case n <= math.MaxUint8:
+		c.buf = append(c.buf, major|24, byte(n))
+	case n <= math.MaxUint16:
+		c.buf = binary.BigEndian.AppendUint16(append(c.buf, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		c.buf = binary.BigEndian.AppendUint32(append(c.buf, major|26), uint32(n))
+	default:
+		c.buf = binary.BigEndian.AppendUint64(append(c.buf, major|27), n)
+	}
+}
+
+func (c *cborWriter) writeNil() { c.buf = append(c.buf, cborSimple|22) }
+
+func (c *cborWriter) writeBool(b bool) {
+	if b {
+		c.buf = append(c.buf, cborSimple|21)
+	} else {
+		c.buf = append(c.buf, cborSimple|20)
+	}
+}
+
+func (c *cborWriter) writeInt(n int64) {
+	if n >= 0 {
+		c.head(cborUint, uint64(n))
+		return
+	}
+	c.head(cborNegInt, uint64(-(n + 1)))
+}
+
+func (c *cborWriter) writeUint(n uint64) { c.head(cborUint, n) }
+
+func (c *cborWriter) writeFloat(f float64) {
+	c.buf = binary.BigEndian.AppendUint64(append(c.buf, cborSimple|27), math.Float64bits(f))
+}
+
+func (c *cborWriter) writeString(s string) {
+	c.head(cborText, uint64(len(s)))
+	c.buf = append(c.buf, s...)
+}
+
+func (c *cborWriter) writeBytes(b []byte) {
+	c.head(cborBytes, uint64(len(b)))
+	c.buf = append(c.buf, b...)
+}
+
+// writeTime uses tag 0, an RFC 3339 date/time string.
+func (c *cborWriter) writeTime(t time.Time) {
+	c.head(cborTag, 0)
+	c.writeString(t.Format(time.RFC3339Nano))
+}
+
+func (c *cborWriter) beginArray(n int) { c.head(cborArray, uint64(n)) }
+func (c *cborWriter) beginMap(n int)   { c.head(cborMap, uint64(n)) }
+func (c *cborWriter) bytes() []byte    { return c.buf }
+
+// msgpackWriter encodes values as MessagePack.
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (m *msgpackWriter) writeNil() { m.buf = append(m.buf, 0xc0) }
+
+func (m *msgpackWriter) writeBool(b bool) {
+	if b {
+		m.buf = append(m.buf, 0xc3)
+	} else {
+		m.buf = append(m.buf, 0xc2)
+	}
+}
+
+func (m *msgpackWriter) writeInt(n int64) {
+	switch {
+	case n >= 0:
+		m.writeUint(uint64(n))
+	case n >= -32:
+		m.buf = append(m.buf, byte(n))
+	case n >= math.MinInt8:
+		m.buf = append(m.buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		m.buf = binary.BigEndian.AppendUint16(append(m.buf, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		m.buf = binary.BigEndian.AppendUint32(append(m.buf, 0xd2), uint32(n))
+	default:
+		m.buf = binary.BigEndian.AppendUint64(append(m.buf, 0xd3), uint64(n))
+	}
+}
+
+func (m *msgpackWriter) writeUint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		m.buf = append(m.buf, byte(n))
+	case n <= math.MaxUint8:
+		m.buf = append(m.buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		m.buf = binary.BigEndian.AppendUint16(append(m.buf, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		m.buf = binary.BigEndian.AppendUint32(append(m.buf, 0xce), uint32(n))
+	default:
+		m.buf = binary.BigEndian.AppendUint64(append(m.buf, 0xcf), n)
+	}
+}
+
+func (m *msgpackWriter) writeFloat(f float64) {
+	m.buf = binary.BigEndian.AppendUint64(append(m.buf, 0xcb), math.Float64bits(f))
+}
+
+func (m *msgpackWriter) writeString(s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		m.buf = append(m.buf, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		m.buf = append(m.buf, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		m.buf = binary.BigEndian.AppendUint16(append(m.buf, 0xda), uint16(n))
+	default:
+		m.buf = binary.BigEndian.AppendUint32(append(m.buf, 0xdb), uint32(n)) //nolint:gosec // strings are far below 4 GiB
+	}
+	m.buf = append(m.buf, s...)
+}
+
+func (m *msgpackWriter) writeBytes(b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		m.buf = append(m.buf, 0xc4, byte(n))
+	case n <= math.MaxUint16:
+		m.buf = binary.BigEndian.AppendUint16(append(m.buf, 0xc5), uint16(n))
+	default:
+		m.buf = binary.BigEndian.AppendUint32(append(m.buf, 0xc6), uint32(n)) //nolint:gosec // payloads are far below 4 GiB
+	}
+	m.buf = append(m.buf, b...)
+}
+
+// writeTime uses the timestamp extension type -1 in its 96-bit form.
+func (m *msgpackWriter) writeTime(t time.Time) {
+	m.buf = append(m.buf, 0xc7, 12, 0xff)
+	m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(t.Nanosecond())) //nolint:gosec // nanoseconds fit in uint32
+	m.buf = binary.BigEndian.AppendUint64(m.buf, uint64(t.Unix()))       //nolint:gosec // two's complement as the spec requires
+}
+
+func (m *msgpackWriter) beginArray(n int) { m.header(n, 0x90, 0xdc, 0xdd) }
+func (m *msgpackWriter) beginMap(n int)   { m.header(n, 0x80, 0xde, 0xdf) }
+func (m *msgpackWriter) bytes() []byte    { return m.buf }
+
+func (m *msgpackWriter) header(n int, fix, c16, c32 byte) {
+	switch {
+	case n < 16:
+		m.buf = append(m.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		m.buf = binary.BigEndian.AppendUint16(append(m.buf, c16), uint16(n))
+	default:
+		m.buf = binary.BigEndian.AppendUint32(append(m.buf, c32), uint32(n)) //nolint:gosec // collections are far below 4 GiB
+	}
+}
+
+// writeEncoded encodes v with vw and copies the result to w.
+func writeEncoded(w io.Writer, v any, vw valueWriter) error {
+	if err := encodeValue(vw, reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	if _, err := w.Write(vw.bytes()); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
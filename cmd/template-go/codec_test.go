@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testEmbedded struct {
+	Kind string `json:"kind"`
+}
+
+type testRecord struct {
+	testEmbedded
+
+	ID      int64    `json:"id"`
+	Name    string   `json:"name,omitempty"`
+	Skipped string   `json:"-"`
+	Tags    []string `json:"tags"`
+	private int
+}
+
+func TestEncodeCBOR(t *testing.T) {
+	// Vectors from RFC 8949 Appendix A.
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{"zero", 0, "00"},
+		{"small uint", 23, "17"},
+		{"one byte uint", 24, "1818"},
+		{"two byte uint", 1000, "1903e8"},
+		{"four byte uint", 1000000, "1a000f4240"},
+		{"eight byte uint", uint64(18446744073709551615), "1bffffffffffffffff"},
+		{"negative", -1, "20"},
+		{"negative thousand", -1000, "3903e7"},
+		{"float", 1.1, "fb3ff199999999999a"},
+		{"false", false, "f4"},
+		{"true", true, "f5"},
+		{"null", nil, "f6"},
+		{"nil slice", []int(nil), "f6"},
+		{"bytes", []byte{1, 2, 3, 4}, "4401020304"},
+		{"empty string", "", "60"},
+		{"string", "IETF", "6449455446"},
+		{"unicode", "ü", "62c3bc"},
+		{"array", []int{1, 2, 3}, "83010203"},
+		{"nested array", []any{1, []int{2, 3}, []int{4, 5}}, "8301820203820405"},
+		{"map", map[string]any{"a": 1, "b": []int{2, 3}}, "a26161016162820203"},
+		{"time", time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC), "c074323031332d30332d32315432303a30343a30305a"},
+		{"text marshaler", netip.MustParseAddr("::1"), "633a3a31"},
+		{"pointer", new(int), "00"},
+		{"json marshaler", json.RawMessage(`{"a":[1,-1,1.1]}`), "a16161830120fb3ff199999999999a"},
+		{"json marshaler beyond 2^53", json.RawMessage(`9007199254740993`), "1b0020000000000001"},
+		{"json number", json.Number("-1000"), "3903e7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, EncodeCBOR(&buf, tt.value))
+			assert.Equal(t, tt.want, hex.EncodeToString(buf.Bytes()))
+		})
+	}
+}
+
+func TestEncodeMsgpack(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		want  string
+	}{
+		{"positive fixint", 127, "7f"},
+		{"uint8", 200, "ccc8"},
+		{"uint16", 1000, "cd03e8"},
+		{"uint32", 100000, "ce000186a0"},
+		{"uint64", uint64(math.MaxUint64), "cfffffffffffffffff"},
+		{"negative fixint", -32, "e0"},
+		{"int8", -100, "d09c"},
+		{"int16", -1000, "d1fc18"},
+		{"int32", -100000, "d2fffe7960"},
+		{"int64", int64(math.MinInt64), "d38000000000000000"},
+		{"float", 1.5, "cb3ff8000000000000"},
+		{"nil", nil, "c0"},
+		{"bool", true, "c3"},
+		{"fixstr", "abc", "a3616263"},
+		{"str8", string(bytes.Repeat([]byte("a"), 32)), "d920" + hex.EncodeToString(bytes.Repeat([]byte("a"), 32))},
+		{"bin8", []byte{1, 2}, "c4020102"},
+		{"fixarray", []int{1, 2}, "920102"},
+		{"array16", make([]int, 16), "dc0010" + hex.EncodeToString(make([]byte, 16))},
+		{"fixmap", map[string]int{"a": 1}, "81a16101"},
+		{"timestamp", time.Unix(1, 2).UTC(), "c70cff000000020000000000000001"},
+		{"json marshaler beyond 2^53", json.RawMessage(`-9007199254740993`), "d3ffdfffffffffffff"},
+		{"json marshaler uint64", json.RawMessage(`18446744073709551615`), "cfffffffffffffffff"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			require.NoError(t, EncodeMsgpack(&buf, tt.value))
+			assert.Equal(t, tt.want, hex.EncodeToString(buf.Bytes()))
+		})
+	}
+}
+
+func TestEncodeStructFields(t *testing.T) {
+	rec := testRecord{
+		testEmbedded: testEmbedded{Kind: "k"},
+		ID:           1,
+		Skipped:      "x",
+		Tags:         []string{"t"},
+		private:      2,
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, EncodeMsgpack(&buf, rec))
+
+	// {"kind":"k","id":1,"tags":["t"]} with json tags, embedding and omitempty applied.
+	assert.Equal(t, "83a46b696e64a16ba2696401a47461677391a174", hex.EncodeToString(buf.Bytes()))
+}
+
+func TestEncodeUnsupported(t *testing.T) {
+	var buf bytes.Buffer
+	require.ErrorContains(t, EncodeCBOR(&buf, make(chan int)), "unsupported type chan int")
+	assert.Zero(t, buf.Len())
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// EncodingWriter is a compressor that can be reset and reused.
+type EncodingWriter interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// Encoding is a content-coding produced by the Compress middleware.
+// Other codings such as brotli can be added by providing their own Encoding.
+type Encoding struct {
+	Name string
+	New  func() (EncodingWriter, error)
+}
+
+// GzipEncoding compresses with gzip at the default level.
+var GzipEncoding = Encoding{
+	Name: "gzip",
+	New: func() (EncodingWriter, error) {
+		return gzip.NewWriterLevel(nil, gzip.DefaultCompression) //nolint:wrapcheck // constant level never fails
+	},
+}
+
+// ZstdEncoding compresses with zstd using a window browsers can decode.
+var ZstdEncoding = Encoding{
+	Name: "zstd",
+	New: func() (EncodingWriter, error) {
+		return zstd.NewWriter(nil, //nolint:wrapcheck // constant options never fail
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithWindowSize(1<<22),
+			zstd.WithEncoderLevel(zstd.SpeedDefault),
+		)
+	},
+}
+
+// CompressOptions configures the Compress middleware.
+type CompressOptions struct {
+	// Encodings in server preference order, used to break q-value ties.
+	Encodings []Encoding
+	// MinSize is the smallest body worth compressing, zero selects the default.
+	MinSize int
+}
+
+const defaultCompressMinSize = 1024
+
+// incompressibleTypes are already compressed media types.
+var incompressibleTypes = []string{
+	"application/gzip",
+	"application/octet-stream",
+	"application/pdf",
+	"application/wasm",
+	"application/zip",
+	"application/zstd",
+	"audio/",
+	"font/woff",
+	"font/woff2",
+	"image/",
+	"video/",
+}
+
+// encoderPool pools writers for a single encoding.
+type encoderPool struct {
+	Encoding
+	pool sync.Pool
+}
+
+func (p *encoderPool) get(w io.Writer) (EncodingWriter, error) {
+	if enc, ok := p.pool.Get().(EncodingWriter); ok {
+		enc.Reset(w)
+		return enc, nil
+	}
+	enc, err := p.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s encoder: %w", p.Name, err)
+	}
+	enc.Reset(w)
+	return enc, nil
+}
+
+func (p *encoderPool) put(enc EncodingWriter) {
+	enc.Reset(io.Discard)
+	p.pool.Put(enc)
+}
+
+// Compress returns middleware that compresses responses according to
+// the request Accept-Encoding. Small bodies and already compressed
+// content types are sent as is.
+func Compress(opts CompressOptions) func(http.Handler) http.Handler {
+	if len(opts.Encodings) == 0 {
+		opts.Encodings = []Encoding{ZstdEncoding, GzipEncoding}
+	}
+	if opts.MinSize == 0 {
+		opts.MinSize = defaultCompressMinSize
+	}
+
+	pools := make([]*encoderPool, len(opts.Encodings))
+	names := make([]string, len(opts.Encodings))
+	for i, enc := range opts.Encodings {
+		pools[i] = &encoderPool{Encoding: enc}
+		names[i] = enc.Name
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			idx := negotiateEncoding(r.Header.Get("Accept-Encoding"), names)
+			if idx < 0 || r.Method == http.MethodHead {
+				w.Header().Add("Vary", "Accept-Encoding")
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			cw := &compressWriter{ResponseWriter: w, pool: pools[idx], minSize: opts.MinSize}
+			next.ServeHTTP(cw, r)
+			cw.finish()
+		})
+	}
+}
+
+// negotiateEncoding returns the index of the preferred acceptable encoding, or -1.
+func negotiateEncoding(header string, names []string) int {
+	if header == "" {
+		return -1
+	}
+
+	weights := map[string]float64{}
+	for part := range strings.SplitSeq(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		weights[coding] = parseQValue(params)
+	}
+
+	best, bestQ := -1, 0.0
+	for i, name := range names {
+		q, ok := weights[name]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = i, q
+		}
+	}
+	return best
+}
+
+// parseQValue returns the q parameter from a ";"-separated parameter list, defaulting to 1.
+func parseQValue(params string) float64 {
+	for param := range strings.SplitSeq(params, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(key), "q") {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || q < 0 {
+			return 0
+		}
+		return min(q, 1)
+	}
+	return 1
+}
+
+// compressWriter buffers the first MinSize bytes to decide whether
+// the response is worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	pool    *encoderPool
+	minSize int
+
+	status  int
+	buf     []byte
+	enc     EncodingWriter
+	decided bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	switch {
+	case cw.decided || code < 200:
+		cw.ResponseWriter.WriteHeader(code)
+	case cw.status == 0:
+		cw.status = code
+		if !cw.bodyAllowed() {
+			_ = cw.decide(false)
+		}
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.status = cmp.Or(cw.status, http.StatusOK)
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	if cw.enc != nil {
+		return cw.enc.Write(b) //nolint:wrapcheck // transparent wrapper
+	}
+	return cw.ResponseWriter.Write(b) //nolint:wrapcheck // transparent wrapper
+}
+
+// Flush commits to an encoding and flushes compressed data to the client.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.status = cmp.Or(cw.status, http.StatusOK)
+		if cw.decide(true) != nil {
+			return
+		}
+	}
+	if cw.enc != nil && cw.enc.Flush() != nil {
+		return
+	}
+	_ = http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Hijack implements http.Hijacker when the underlying writer supports it.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	cw.decided = true
+	return h.Hijack() //nolint:wrapcheck // transparent wrapper
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) bodyAllowed() bool {
+	return cw.status != http.StatusNoContent && cw.status != http.StatusNotModified
+}
+
+// decide writes the headers and buffered data. The body is compressed when
+// wanted (it reached the minimum size or is being streamed) and its status,
+// content type and existing headers allow it.
+func (cw *compressWriter) decide(wanted bool) error {
+	cw.decided = true
+	h := cw.Header()
+
+	if h.Get("Content-Encoding") != "" {
+		wanted = false
+	} else {
+		h.Add("Vary", "Accept-Encoding")
+	}
+
+	if wanted && cw.bodyAllowed() && compressibleType(h.Get("Content-Type")) && h.Get("Content-Range") == "" {
+		enc, err := cw.pool.get(cw.ResponseWriter)
+		if err != nil {
+			slog.Error("failed to start compression", "error", err)
+		} else {
+			cw.enc = enc
+			h.Set("Content-Encoding", cw.pool.Name)
+			h.Del("Content-Length")
+			if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+				h.Set("ETag", "W/"+etag)
+			}
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	buf := cw.buf
+	cw.buf = nil
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err //nolint:wrapcheck // transparent wrapper
+}
+
+// finish flushes a buffered small body or closes the encoder.
+func (cw *compressWriter) finish() {
+	if !cw.decided {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			return
+		}
+		cw.status = cmp.Or(cw.status, http.StatusOK)
+		if cw.decide(false) != nil {
+			return
+		}
+	}
+	if cw.enc == nil {
+		return
+	}
+	if err := cw.enc.Close(); err != nil {
+		slog.Debug("failed to close encoder", "error", err)
+	}
+	cw.pool.put(cw.enc)
+	cw.enc = nil
+}
+
+// compressibleType reports whether the media type benefits from compression.
+func compressibleType(contentType string) bool {
+	if contentType == "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return !slices.ContainsFunc(incompressibleTypes, func(t string) bool {
+		if strings.HasSuffix(t, "/") {
+			return strings.HasPrefix(mediaType, t)
+		}
+		return mediaType == t
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	names := []string{"zstd", "gzip"}
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"empty header", "", -1},
+		{"gzip only", "gzip", 1},
+		{"server preference breaks ties", "gzip, zstd", 0},
+		{"higher q wins", "zstd;q=0.5, gzip;q=0.8", 1},
+		{"q zero refuses", "zstd;q=0, gzip", 1},
+		{"wildcard", "*", 0},
+		{"wildcard with explicit refusal", "zstd;q=0, *;q=0.1", 1},
+		{"unsupported only", "br, deflate", -1},
+		{"identity only", "identity", -1},
+		{"case and spaces", " GZIP ; Q=0.9 ", 1},
+		{"invalid q refuses", "gzip;q=abc", -1},
+		{"q above one is clamped", "gzip;q=5, zstd", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, negotiateEncoding(tt.header, names))
+		})
+	}
+}
+
+func decodeBody(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		out, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		return string(out)
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		require.NoError(t, err)
+		defer zr.Close()
+		out, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		return string(out)
+	default:
+		return string(body)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	large := strings.Repeat(`{"database":"testdb","version":"PostgreSQL 18"}`, 100)
+
+	tests := []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		contentType    string
+		status         int
+		body           string
+		presetEncoding string
+		wantEncoding   string
+	}{
+		{"gzip", http.MethodGet, "gzip", "application/json", http.StatusOK, large, "", "gzip"},
+		{"zstd preferred", http.MethodGet, "gzip, zstd", "application/json", http.StatusOK, large, "", "zstd"},
+		{"no accept-encoding", http.MethodGet, "", "application/json", http.StatusOK, large, "", ""},
+		{"small body", http.MethodGet, "gzip", "application/json", http.StatusOK, `{"ok":true}`, "", ""},
+		{"image skipped", http.MethodGet, "gzip", "image/png", http.StatusOK, large, "", ""},
+		{"zip skipped", http.MethodGet, "gzip", "application/zip", http.StatusOK, large, "", ""},
+		{"missing content type", http.MethodGet, "gzip", "", http.StatusOK, large, "", ""},
+		{"already encoded", http.MethodGet, "gzip", "application/json", http.StatusOK, large, "br", "br"},
+		{"error status compressed", http.MethodGet, "gzip", "application/problem+json", http.StatusInternalServerError, large, "", "gzip"},
+		{"HEAD not compressed", http.MethodHead, "gzip", "application/json", http.StatusOK, "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Compress(CompressOptions{})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				if tt.presetEncoding != "" {
+					w.Header().Set("Content-Encoding", tt.presetEncoding)
+				}
+				w.Header().Set("Content-Length", "123")
+				w.WriteHeader(tt.status)
+				_, _ = io.WriteString(w, tt.body)
+			}))
+
+			req := httptest.NewRequestWithContext(t.Context(), tt.method, "/test", http.NoBody)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, tt.wantEncoding, rec.Header().Get("Content-Encoding"))
+			if tt.presetEncoding == "" {
+				assert.Equal(t, []string{"Accept-Encoding"}, rec.Header().Values("Vary"))
+			}
+			if tt.wantEncoding == "gzip" || tt.wantEncoding == "zstd" {
+				assert.Empty(t, rec.Header().Get("Content-Length"))
+				assert.Less(t, rec.Body.Len(), len(tt.body))
+			}
+			if tt.presetEncoding == "" {
+				assert.Equal(t, tt.body, decodeBody(t, tt.wantEncoding, rec.Body.Bytes()))
+			}
+		})
+	}
+}
+
+func TestCompressMultipleWrites(t *testing.T) {
+	handler := Compress(CompressOptions{MinSize: 16})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for range 10 {
+			_, _ = io.WriteString(w, "chunk-")
+		}
+	}))
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, strings.Repeat("chunk-", 10), decodeBody(t, "gzip", rec.Body.Bytes()))
+}
+
+func TestCompressNoBodyStatuses(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusNotModified} {
+		t.Run(http.StatusText(status), func(t *testing.T) {
+			handler := Compress(CompressOptions{})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("ETag", `"v1"`)
+				w.WriteHeader(status)
+			}))
+
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+			req.Header.Set("Accept-Encoding", "gzip")
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, status, rec.Code)
+			assert.Empty(t, rec.Header().Get("Content-Encoding"))
+			assert.Equal(t, `"v1"`, rec.Header().Get("ETag"))
+			assert.Empty(t, rec.Body.Bytes())
+		})
+	}
+}
+
+func TestCompressWeakensETag(t *testing.T) {
+	handler := Compress(CompressOptions{MinSize: 1})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = io.WriteString(w, `{"ok":true}`)
+	}))
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, `W/"v1"`, rec.Header().Get("ETag"))
+}
+
+func TestCompressFlushStreams(t *testing.T) {
+	handler := Compress(CompressOptions{})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		_, _ = io.WriteString(w, "data: 2\n\n")
+	}))
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	assert.True(t, rec.Flushed)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "data: 1\n\ndata: 2\n\n", decodeBody(t, "gzip", rec.Body.Bytes()))
+}
+
+func TestCompressReusesEncoders(t *testing.T) {
+	created := 0
+	counting := Encoding{
+		Name: "gzip",
+		New: func() (EncodingWriter, error) {
+			created++
+			return GzipEncoding.New()
+		},
+	}
+
+	handler := Compress(CompressOptions{Encodings: []Encoding{counting}, MinSize: 1})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "hello")
+	}))
+
+	for range 3 {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		require.Equal(t, "hello", decodeBody(t, "gzip", rec.Body.Bytes()))
+	}
+
+	assert.LessOrEqual(t, created, 3)
+	assert.GreaterOrEqual(t, created, 1)
+}
+
+func TestNewServerVariesOnAcceptEncoding(t *testing.T) {
+	app := testApp(t)
+	server := app.newServer()
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/health", http.NoBody)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+
+	server.Handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Header().Values("Vary"), "Accept-Encoding")
+}
+
+func BenchmarkCompress(b *testing.B) {
+	rows := make([]DatabaseInfo, 200)
+	for i := range rows {
+		rows[i] = DatabaseInfo{Database: "testdb", Version: "PostgreSQL 18.0 on x86_64-pc-linux-musl"}
+	}
+	payload, err := json.Marshal(rows)
+	require.NoError(b, err)
+
+	handler := Compress(CompressOptions{})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(payload)
+	}))
+
+	for _, encoding := range []string{"identity", "gzip", "zstd"} {
+		b.Run(encoding, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(payload)))
+			for b.Loop() {
+				req := httptest.NewRequestWithContext(b.Context(), http.MethodGet, "/test", http.NoBody)
+				req.Header.Set("Accept-Encoding", encoding)
+				handler.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
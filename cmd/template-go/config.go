@@ -2,23 +2,233 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"net/netip"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Config holds application configuration.
 type Config struct {
-	DSN string
+	DSN            string
+	CORS           CORSPolicy
+	Security       SecurityOptions
+	MaxHeaderBytes int
+	PanicLog       string
+	Log            LoggerOptions
+	TrustedProxies []netip.Prefix
+	Compress       CompressOptions
+	ContractPath   string
+	Contract       ContractOptions
+	Replicas       ReplicaOptions
+	Events         BrokerOptions
+	WebSocket      WebSocketOptions
+	// Migrate applies pending migrations at startup.
+	Migrate bool
+	Outbox  OutboxOptions
+	// OutboxPublisher is "stdout" or a webhook URL; empty disables the relay.
+	OutboxPublisher string
+	OutboxSecret    string
+	Jobs            JobQueueOptions
+	Leader          ElectorOptions
+	Idempotency     IdempotencyOptions
+	Flags           FlagsOptions
+	// AdminToken is the bearer token of admin routes, which are disabled
+	// without one.
+	AdminToken string
 }
 
 // LoadConfig loads configuration from environment variables.
 func LoadConfig() (*Config, error) {
 	cfg := &Config{
-		DSN: os.Getenv("SERVICE_DSN"),
+		DSN:          os.Getenv("SERVICE_DSN"),
+		PanicLog:     os.Getenv("SERVICE_PANIC_LOG"),
+		ContractPath: os.Getenv("SERVICE_CONTRACT"),
+
+		OutboxPublisher: os.Getenv("SERVICE_OUTBOX_PUBLISHER"),
+		OutboxSecret:    os.Getenv("SERVICE_OUTBOX_WEBHOOK_SECRET"),
+		AdminToken:      os.Getenv("SERVICE_ADMIN_TOKEN"),
+		CORS: CORSPolicy{
+			AllowedOrigins: envList("SERVICE_CORS_ORIGINS"),
+			AllowedMethods: envList("SERVICE_CORS_METHODS"),
+			AllowedHeaders: envList("SERVICE_CORS_HEADERS"),
+			ExposedHeaders: envList("SERVICE_CORS_EXPOSE_HEADERS"),
+		},
+		Replicas: ReplicaOptions{
+			DSNs: envList("SERVICE_REPLICA_DSNS"),
+		},
+		Events: BrokerOptions{
+			Topics: envList("SERVICE_EVENTS_TOPICS"),
+		},
+		Log: LoggerOptions{
+			SkipPaths: []string{"/health"},
+		},
+		Flags: FlagsOptions{
+			File: os.Getenv("SERVICE_FLAGS_FILE"),
+		},
+		Security: SecurityOptions{
+			ContentSecurityPolicy: os.Getenv("SERVICE_CSP"),
+			ReferrerPolicy:        os.Getenv("SERVICE_REFERRER_POLICY"),
+		},
 	}
 
 	if cfg.DSN == "" {
 		return nil, errors.New("SERVICE_DSN environment variable is required")
 	}
 
+	var err error
+	if cfg.CORS.AllowCredentials, err = envBool("SERVICE_CORS_CREDENTIALS", false); err != nil {
+		return nil, err
+	}
+	if cfg.CORS.MaxAge, err = envDuration("SERVICE_CORS_MAX_AGE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Security.HSTSMaxAge, err = envDuration("SERVICE_HSTS_MAX_AGE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Security.MaxBodyBytes, err = envInt[int64]("SERVICE_MAX_BODY_BYTES", 0); err != nil {
+		return nil, err
+	}
+	if cfg.MaxHeaderBytes, err = envInt("SERVICE_MAX_HEADER_BYTES", defaultMaxHeaderBytes); err != nil {
+		return nil, err
+	}
+
+	if cfg.Compress.MinSize, err = envInt("SERVICE_COMPRESS_MIN_SIZE", 0); err != nil {
+		return nil, err
+	}
+	if cfg.Contract.ValidateResponses, err = envBool("SERVICE_CONTRACT_VALIDATE_RESPONSES", false); err != nil {
+		return nil, err
+	}
+	if cfg.Replicas.MaxLag, err = envDuration("SERVICE_REPLICA_MAX_LAG", defaultReplicaMaxLag); err != nil {
+		return nil, err
+	}
+	if cfg.Replicas.CheckInterval, err = envDuration("SERVICE_REPLICA_CHECK_INTERVAL", defaultReplicaCheckInterval); err != nil {
+		return nil, err
+	}
+	if cfg.Events.ReplaySize, err = envInt("SERVICE_EVENTS_REPLAY", defaultEventReplaySize); err != nil {
+		return nil, err
+	}
+	if cfg.Events.Heartbeat, err = envDuration("SERVICE_EVENTS_HEARTBEAT", defaultEventHeartbeat); err != nil {
+		return nil, err
+	}
+	cfg.WebSocket.AllowedOrigins = cfg.CORS.AllowedOrigins
+	if cfg.WebSocket.MaxMessageBytes, err = envInt[int64]("SERVICE_WS_MAX_MESSAGE_BYTES", defaultWebSocketMaxMessageBytes); err != nil {
+		return nil, err
+	}
+	if cfg.WebSocket.PingInterval, err = envDuration("SERVICE_WS_PING_INTERVAL", defaultWebSocketPingInterval); err != nil {
+		return nil, err
+	}
+	if cfg.Migrate, err = envBool("SERVICE_MIGRATE", true); err != nil {
+		return nil, err
+	}
+	if _, err = newOutboxPublisher(cfg.OutboxPublisher, cfg.OutboxSecret); err != nil {
+		return nil, fmt.Errorf("invalid SERVICE_OUTBOX_PUBLISHER: %w", err)
+	}
+	if cfg.Outbox.PollInterval, err = envDuration("SERVICE_OUTBOX_POLL_INTERVAL", defaultOutboxPollInterval); err != nil {
+		return nil, err
+	}
+	if cfg.Outbox.MaxAttempts, err = envInt("SERVICE_OUTBOX_MAX_ATTEMPTS", defaultOutboxMaxAttempts); err != nil {
+		return nil, err
+	}
+	if cfg.Jobs.Workers, err = envInt("SERVICE_JOBS_WORKERS", defaultJobWorkers); err != nil {
+		return nil, err
+	}
+	if cfg.Jobs.PollInterval, err = envDuration("SERVICE_JOBS_POLL_INTERVAL", defaultJobPollInterval); err != nil {
+		return nil, err
+	}
+	if cfg.Jobs.Timeout, err = envDuration("SERVICE_JOBS_TIMEOUT", defaultJobTimeout); err != nil {
+		return nil, err
+	}
+	if cfg.Leader.Lease, err = envDuration("SERVICE_LEADER_LEASE", defaultLeaderLease); err != nil {
+		return nil, err
+	}
+	if cfg.Idempotency.TTL, err = envDuration("SERVICE_IDEMPOTENCY_TTL", defaultIdempotencyTTL); err != nil {
+		return nil, err
+	}
+	if cfg.Flags.ReloadInterval, err = envDuration("SERVICE_FLAGS_RELOAD_INTERVAL", defaultFlagsReloadInterval); err != nil {
+		return nil, err
+	}
+	if cfg.TrustedProxies, err = ParseTrustedProxies(envList("SERVICE_TRUSTED_PROXIES")); err != nil {
+		return nil, err
+	}
+	if skip := envList("SERVICE_LOG_SKIP"); skip != nil {
+		cfg.Log.SkipPaths = skip
+	}
+	if cfg.Log.SampleRate, err = envFloat("SERVICE_LOG_SAMPLE_RATE", 1); err != nil {
+		return nil, err
+	}
+	switch format := os.Getenv("SERVICE_LOG_FORMAT"); format {
+	case "", "text":
+	case "combined":
+		cfg.Log.Combined = os.Stdout
+	default:
+		return nil, fmt.Errorf("invalid SERVICE_LOG_FORMAT: %q", format)
+	}
+
 	return cfg, nil
 }
+
+// envList returns a comma-separated environment variable as a slice.
+func envList(key string) []string {
+	var out []string
+	for item := range strings.SplitSeq(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// envBool parses a boolean environment variable, returning def when unset.
+func envBool(key string, def bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return b, nil
+}
+
+// envInt parses an integer environment variable, returning def when unset.
+func envInt[T int | int64](key string, def T) (T, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return T(n), nil
+}
+
+// envFloat parses a float environment variable, returning def when unset.
+func envFloat(key string, def float64) (float64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return f, nil
+}
+
+// envDuration parses a duration environment variable, returning def when unset.
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return d, nil
+}
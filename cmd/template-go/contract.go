@@ -0,0 +1,742 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/netip"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// ContractOptions configures the Contract middleware.
+type ContractOptions struct {
+	// ValidateResponses buffers JSON responses and replaces those that do
+	// not match the document with a 500 problem. Meant for tests and debugging.
+	ValidateResponses bool
+}
+
+// LoadOpenAPI reads an OpenAPI 3.1 document in JSON format.
+func LoadOpenAPI(path string) (*OpenAPI, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read OpenAPI document: %w", err)
+	}
+	var doc OpenAPI
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI document: %w", err)
+	}
+	return &doc, nil
+}
+
+// UnmarshalJSON reads the operations of a path item, merging path-level
+// parameters into each of them.
+func (p *PathItem) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err //nolint:wrapcheck // reported with its location by the caller
+	}
+
+	var shared []Parameter
+	if params, ok := raw["parameters"]; ok {
+		if err := json.Unmarshal(params, &shared); err != nil {
+			return err //nolint:wrapcheck // reported with its location by the caller
+		}
+	}
+
+	*p = PathItem{}
+	for _, method := range []string{"get", "put", "post", "delete", "options", "head", "patch", "trace"} {
+		data, ok := raw[method]
+		if !ok {
+			continue
+		}
+		var op Operation
+		if err := json.Unmarshal(data, &op); err != nil {
+			return err //nolint:wrapcheck // reported with its location by the caller
+		}
+		for _, param := range shared {
+			if !slices.ContainsFunc(op.Parameters, func(q Parameter) bool { return q.Name == param.Name && q.In == param.In }) {
+				op.Parameters = append(op.Parameters, param)
+			}
+		}
+		(*p)[method] = &op
+	}
+	return nil
+}
+
+// contractRoute is an operation with its parsed path template.
+type contractRoute struct {
+	method   string
+	segments []string
+	literals int
+	op       *Operation
+}
+
+// contract validates requests and responses against a document.
+type contract struct {
+	doc      *OpenAPI
+	routes   []contractRoute
+	patterns sync.Map
+}
+
+// Contract returns middleware that validates path, query and header
+// parameters and JSON request bodies against doc before calling next.
+// Invalid requests get a problem with the failing parameters and JSON
+// pointers. Requests that match no operation are passed through.
+func Contract(doc *OpenAPI, opts ContractOptions) func(http.Handler) http.Handler {
+	c := newContract(doc)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			op, params := c.match(r)
+			if op == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if err := c.checkRequest(w, r, op, params); err != nil {
+				respondErr(w, r, err)
+				return
+			}
+
+			if !opts.ValidateResponses {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &contractWriter{ResponseWriter: w}
+			next.ServeHTTP(cw, r)
+			c.finishResponse(cw, r, op)
+		})
+	}
+}
+
+// newContract indexes the operations of doc. Routes are built in path and
+// method order and sorted stably, so that overlapping templates always
+// resolve the same way.
+func newContract(doc *OpenAPI) *contract {
+	c := &contract{doc: doc}
+	for _, path := range slices.Sorted(maps.Keys(doc.Paths)) {
+		item := doc.Paths[path]
+		segments := strings.Split(path, "/")
+		literals := 0
+		for _, s := range segments {
+			if !strings.HasPrefix(s, "{") {
+				literals++
+			}
+		}
+		for _, method := range slices.Sorted(maps.Keys(item)) {
+			c.routes = append(c.routes, contractRoute{
+				method:   strings.ToUpper(method),
+				segments: segments,
+				literals: literals,
+				op:       item[method],
+			})
+		}
+	}
+	// Prefer literal segments over templated ones, like ServeMux.
+	slices.SortStableFunc(c.routes, func(a, b contractRoute) int {
+		return cmp.Compare(b.literals, a.literals)
+	})
+	return c
+}
+
+// match finds the operation for the request and its path parameters.
+func (c *contract) match(r *http.Request) (*Operation, map[string]string) {
+	segments := strings.Split(r.URL.EscapedPath(), "/")
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+
+	for _, route := range c.routes {
+		if route.method != method || len(route.segments) != len(segments) {
+			continue
+		}
+		params := map[string]string{}
+		matched := true
+		for i, tmpl := range route.segments {
+			if name, ok := strings.CutPrefix(tmpl, "{"); ok && strings.HasSuffix(name, "}") {
+				value, err := url.PathUnescape(segments[i])
+				if err != nil || value == "" {
+					matched = false
+					break
+				}
+				params[strings.TrimSuffix(name, "}")] = value
+				continue
+			}
+			if tmpl != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return route.op, params
+		}
+	}
+	return nil, nil
+}
+
+// checkRequest validates parameters and the body of r against op.
+func (c *contract) checkRequest(w http.ResponseWriter, r *http.Request, op *Operation, pathParams map[string]string) error {
+	var fields []FieldError
+
+	query := r.URL.Query()
+	for _, param := range op.Parameters {
+		var values []string
+		switch param.In {
+		case "path":
+			if v, ok := pathParams[param.Name]; ok {
+				values = []string{v}
+			}
+		case "query":
+			values = query[param.Name]
+		case "header":
+			values = r.Header.Values(param.Name)
+		default:
+			continue
+		}
+
+		if detail := c.checkParam(param, values); detail != "" {
+			fields = append(fields, FieldError{Parameter: param.Name, Detail: detail})
+		}
+	}
+
+	if op.RequestBody != nil {
+		bodyFields, err := c.checkBody(w, r, op.RequestBody)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, bodyFields...)
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// checkParam converts the raw values of a parameter to its schema type
+// and validates them, returning a description of the first problem.
+func (c *contract) checkParam(param Parameter, values []string) string {
+	if len(values) == 0 {
+		if param.Required {
+			return "is required"
+		}
+		return ""
+	}
+	if param.Schema == nil {
+		return ""
+	}
+
+	schema := c.resolve(param.Schema)
+	var value any
+	if slices.Contains(schema.typeList(), "array") {
+		items := make([]any, len(values))
+		for i, v := range values {
+			item, detail := c.paramValue(schema.Items, v)
+			if detail != "" {
+				return detail
+			}
+			items[i] = item
+		}
+		value = items
+	} else {
+		var detail string
+		if value, detail = c.paramValue(schema, values[0]); detail != "" {
+			return detail
+		}
+	}
+
+	if errs := c.validate(schema, value, ""); len(errs) > 0 {
+		return errs[0].Detail
+	}
+	return ""
+}
+
+// paramValue converts a raw parameter to the JSON type of schema.
+func (c *contract) paramValue(schema *Schema, raw string) (any, string) {
+	if schema == nil {
+		return raw, ""
+	}
+	types := c.resolve(schema).typeList()
+	switch {
+	case slices.Contains(types, "string") || len(types) == 0:
+		return raw, ""
+	case slices.Contains(types, "integer"):
+		if _, err := strconv.ParseInt(raw, 10, 64); err != nil {
+			return nil, "must be an integer"
+		}
+		return json.Number(raw), ""
+	case slices.Contains(types, "number"):
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			return nil, "must be a number"
+		}
+		return json.Number(raw), ""
+	case slices.Contains(types, "boolean"):
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return nil, "must be a boolean"
+		}
+		return b, ""
+	default:
+		return raw, ""
+	}
+}
+
+// checkBody validates a JSON request body and restores it for the handler.
+func (c *contract) checkBody(w http.ResponseWriter, r *http.Request, spec *RequestBody) ([]FieldError, error) {
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		if spec.Required {
+			return nil, &RequestError{Status: http.StatusBadRequest, Detail: "request body must not be empty"}
+		}
+		return nil, nil
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, &RequestError{Status: http.StatusUnsupportedMediaType, Detail: "invalid Content-Type"}
+	}
+	content, ok := spec.Content[mediaType]
+	if !ok {
+		types := make([]string, 0, len(spec.Content))
+		for t := range spec.Content {
+			types = append(types, t)
+		}
+		slices.Sort(types)
+		return nil, &RequestError{
+			Status: http.StatusUnsupportedMediaType,
+			Detail: "Content-Type must be one of: " + strings.Join(types, ", "),
+		}
+	}
+	if !isJSONContentType(mediaType) || content.Schema == nil {
+		return nil, nil
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes))
+	if err != nil {
+		return nil, decodeError(err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+
+	value, err := decodeJSONValue(data)
+	if err != nil {
+		return nil, err
+	}
+	return c.validate(content.Schema, value, ""), nil
+}
+
+// decodeJSONValue decodes a single JSON value keeping numbers as json.Number.
+func decodeJSONValue(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return nil, decodeError(err)
+	}
+	if _, err := dec.Token(); !errors.Is(err, io.EOF) {
+		return nil, &RequestError{Status: http.StatusBadRequest, Detail: "request body must contain a single JSON value"}
+	}
+	return value, nil
+}
+
+// resolve follows $ref to component schemas.
+func (c *contract) resolve(s *Schema) *Schema {
+	for s != nil && s.Ref != "" {
+		name, ok := strings.CutPrefix(s.Ref, "#/components/schemas/")
+		if !ok {
+			return &Schema{}
+		}
+		s = c.doc.Components.Schemas[name]
+	}
+	if s == nil {
+		return &Schema{}
+	}
+	return s
+}
+
+// validate checks a decoded JSON value against s and returns every
+// violation located by a JSON pointer below pointer.
+func (c *contract) validate(s *Schema, value any, pointer string) []FieldError {
+	s = c.resolve(s)
+	var errs []FieldError
+	fail := func(detail string) []FieldError {
+		return append(errs, FieldError{Pointer: pointer, Detail: detail})
+	}
+
+	if types := s.typeList(); len(types) > 0 && !slices.ContainsFunc(types, func(t string) bool { return jsonTypeMatches(t, value) }) {
+		if value == nil {
+			return fail("must not be null")
+		}
+		return fail("must be " + strings.Join(types, " or "))
+	}
+	if len(s.Enum) > 0 && !slices.ContainsFunc(s.Enum, func(e any) bool { return jsonEqual(e, value) }) {
+		options := make([]string, len(s.Enum))
+		for i, e := range s.Enum {
+			options[i] = fmt.Sprint(e)
+		}
+		return fail("must be one of: " + strings.Join(options, ", "))
+	}
+
+	switch v := value.(type) {
+	case string:
+		if detail := c.checkString(s, v); detail != "" {
+			return fail(detail)
+		}
+	case json.Number:
+		if detail := checkNumber(s, v); detail != "" {
+			return fail(detail)
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fail("must contain at least " + strconv.Itoa(*s.MinItems) + " items")
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fail("must contain at most " + strconv.Itoa(*s.MaxItems) + " items")
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				errs = append(errs, c.validate(s.Items, item, pointer+"/"+strconv.Itoa(i))...)
+			}
+		}
+	case map[string]any:
+		errs = append(errs, c.validateObject(s, v, pointer)...)
+	}
+
+	for _, sub := range s.AllOf {
+		errs = append(errs, c.validate(sub, value, pointer)...)
+	}
+	if len(s.AnyOf) > 0 && !slices.ContainsFunc(s.AnyOf, func(sub *Schema) bool { return len(c.validate(sub, value, pointer)) == 0 }) {
+		errs = fail("must match at least one schema")
+	}
+	if len(s.OneOf) > 0 {
+		matches := 0
+		for _, sub := range s.OneOf {
+			if len(c.validate(sub, value, pointer)) == 0 {
+				matches++
+			}
+		}
+		if matches != 1 {
+			errs = fail("must match exactly one schema")
+		}
+	}
+	return errs
+}
+
+func (c *contract) validateObject(s *Schema, obj map[string]any, pointer string) []FieldError {
+	var errs []FieldError
+	for _, name := range s.Required {
+		if _, ok := obj[name]; !ok {
+			errs = append(errs, FieldError{Pointer: pointer + jsonPointer(name), Detail: "is required"})
+		}
+	}
+
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		fieldPointer := pointer + jsonPointer(k)
+		switch prop, ok := s.Properties[k]; {
+		case ok:
+			errs = append(errs, c.validate(prop, obj[k], fieldPointer)...)
+		case s.AdditionalProperties != nil:
+			errs = append(errs, c.validate(s.AdditionalProperties, obj[k], fieldPointer)...)
+		case s.closed:
+			errs = append(errs, FieldError{Pointer: fieldPointer, Detail: "unknown field"})
+		}
+	}
+	return errs
+}
+
+func (c *contract) checkString(s *Schema, v string) string {
+	n := utf8.RuneCountInString(v)
+	switch {
+	case s.MinLength != nil && n < *s.MinLength:
+		return "must contain at least " + strconv.Itoa(*s.MinLength) + " characters"
+	case s.MaxLength != nil && n > *s.MaxLength:
+		return "must contain at most " + strconv.Itoa(*s.MaxLength) + " characters"
+	}
+	if s.Pattern != "" {
+		re, err := c.pattern(s.Pattern)
+		if err == nil && !re.MatchString(v) {
+			return "must match pattern " + s.Pattern
+		}
+	}
+	return checkFormat(s.Format, v)
+}
+
+// pattern compiles and caches a schema pattern.
+func (c *contract) pattern(expr string) (*regexp.Regexp, error) {
+	if re, ok := c.patterns.Load(expr); ok {
+		return re.(*regexp.Regexp), nil //nolint:forcetypeassert // only regexps are stored
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		slog.Warn("invalid schema pattern", "pattern", expr, "error", err)
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	c.patterns.Store(expr, re)
+	return re, nil
+}
+
+// checkFormat validates the formats with a well-defined syntax; others are annotations.
+func checkFormat(format, v string) string {
+	var err error
+	switch format {
+	case "date-time":
+		_, err = time.Parse(time.RFC3339, v)
+	case "date":
+		_, err = time.Parse(time.DateOnly, v)
+	case "duration":
+		_, err = time.ParseDuration(v)
+	case "email":
+		var addr *mail.Address
+		if addr, err = mail.ParseAddress(v); err == nil && addr.Address != v {
+			err = errors.New("display name")
+		}
+	case "ipv4", "ipv6":
+		var addr netip.Addr
+		if addr, err = netip.ParseAddr(v); err == nil && addr.Is4() != (format == "ipv4") {
+			err = errors.New("wrong family")
+		}
+	case "uuid":
+		if len(v) != 36 || strings.Count(v, "-") != 4 {
+			err = errors.New("malformed")
+		}
+	default:
+		return ""
+	}
+	if err != nil {
+		return "must be a valid " + format
+	}
+	return ""
+}
+
+func checkNumber(s *Schema, v json.Number) string {
+	f, err := v.Float64()
+	if err != nil {
+		return "must be a number"
+	}
+	switch {
+	case s.Minimum != nil && f < *s.Minimum:
+		return "must be at least " + strconv.FormatFloat(*s.Minimum, 'f', -1, 64)
+	case s.Maximum != nil && f > *s.Maximum:
+		return "must be at most " + strconv.FormatFloat(*s.Maximum, 'f', -1, 64)
+	case s.Format == "int32" && (f < math.MinInt32 || f > math.MaxInt32):
+		return "must be a 32-bit integer"
+	}
+	return ""
+}
+
+// jsonTypeMatches reports whether a decoded JSON value has the schema type.
+func jsonTypeMatches(typ string, value any) bool {
+	switch v := value.(type) {
+	case nil:
+		return typ == "null"
+	case bool:
+		return typ == "boolean"
+	case string:
+		return typ == "string"
+	case json.Number:
+		if typ == "number" {
+			return true
+		}
+		f, err := v.Float64()
+		return typ == "integer" && err == nil && f == math.Trunc(f)
+	case []any:
+		return typ == "array"
+	case map[string]any:
+		return typ == "object"
+	default:
+		return false
+	}
+}
+
+// jsonEqual compares an enum entry with a decoded value, numbers by value
+// and arrays and objects element by element.
+func jsonEqual(enum, value any) bool {
+	switch v := value.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		switch e := enum.(type) {
+		case float64:
+			return err == nil && e == f
+		case json.Number:
+			ef, eerr := e.Float64()
+			return err == nil && eerr == nil && ef == f
+		}
+		return false
+	case []any:
+		e, ok := enum.([]any)
+		if !ok || len(e) != len(v) {
+			return false
+		}
+		for i := range v {
+			if !jsonEqual(e[i], v[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]any:
+		e, ok := enum.(map[string]any)
+		if !ok || len(e) != len(v) {
+			return false
+		}
+		for k, x := range v {
+			if ex, ok := e[k]; !ok || !jsonEqual(ex, x) {
+				return false
+			}
+		}
+		return true
+	}
+	return reflect.DeepEqual(enum, value)
+}
+
+// contractWriter buffers a response until it has been validated. Streams
+// are passed through as written, since buffering would hold them back.
+type contractWriter struct {
+	http.ResponseWriter
+
+	status      int
+	buf         bytes.Buffer
+	hijacked    bool
+	passthrough bool
+}
+
+func (cw *contractWriter) WriteHeader(code int) {
+	if code < 200 || cw.passthrough {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = code
+		cw.passthrough = isStreamContentType(cw.Header().Get("Content-Type"))
+		if cw.passthrough {
+			cw.ResponseWriter.WriteHeader(code)
+		}
+	}
+}
+
+func (cw *contractWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.passthrough {
+		return cw.ResponseWriter.Write(b) //nolint:wrapcheck // transparent wrapper
+	}
+	return cw.buf.Write(b) //nolint:wrapcheck // bytes.Buffer never fails
+}
+
+// Flush flushes streams; validated responses are sent once complete.
+func (cw *contractWriter) Flush() {
+	if cw.passthrough {
+		_ = http.NewResponseController(cw.ResponseWriter).Flush()
+	}
+}
+
+// Hijack implements http.Hijacker, skipping validation of the connection.
+func (cw *contractWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	cw.hijacked = true
+	return h.Hijack() //nolint:wrapcheck // transparent wrapper
+}
+
+// Unwrap lets http.ResponseController reach deadlines of the connection.
+func (cw *contractWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// isStreamContentType reports whether responses of contentType are
+// streamed incrementally.
+func isStreamContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/event-stream" || mediaType == "application/x-ndjson"
+}
+
+// finishResponse validates the buffered response and sends it, or a 500
+// problem describing how it departs from the document.
+func (c *contract) finishResponse(cw *contractWriter, r *http.Request, op *Operation) {
+	if cw.hijacked || cw.passthrough {
+		return
+	}
+	status := cmp.Or(cw.status, http.StatusOK)
+	w := cw.ResponseWriter
+
+	fields := c.checkResponse(op, r.Method, status, w.Header().Get("Content-Type"), cw.buf.Bytes())
+	if len(fields) > 0 {
+		slog.ErrorContext(r.Context(), "response does not match the API contract",
+			"method", r.Method, "url", r.URL.RequestURI(), "status", status, "errors", fields)
+		clearEntityHeaders(w.Header())
+		writeProblem(w, problem{
+			Status: http.StatusInternalServerError,
+			Detail: "response does not match the API contract",
+			Errors: fields,
+		})
+		return
+	}
+
+	w.WriteHeader(status)
+	if _, err := w.Write(cw.buf.Bytes()); err != nil {
+		slog.Debug("failed to write response", "error", err)
+	}
+}
+
+// checkResponse validates status, content type and JSON body of a response.
+// Responses to HEAD, which are matched to GET operations, have no body to
+// validate.
+func (c *contract) checkResponse(op *Operation, method string, status int, contentType string, body []byte) []FieldError {
+	code := strconv.Itoa(status)
+	resp := cmp.Or(op.Responses[code], op.Responses[code[:1]+"XX"], op.Responses["default"])
+	if resp == nil {
+		return []FieldError{{Detail: "status " + code + " is not documented"}}
+	}
+	if method == http.MethodHead {
+		return nil
+	}
+
+	if len(body) == 0 {
+		if len(resp.Content) > 0 && status != http.StatusNoContent && status != http.StatusNotModified {
+			return []FieldError{{Detail: "response body is missing"}}
+		}
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	content, ok := resp.Content[mediaType]
+	if !ok {
+		return []FieldError{{Detail: "content type " + cmp.Or(mediaType, "(none)") + " is not documented for status " + code}}
+	}
+	if !isJSONContentType(mediaType) || content.Schema == nil {
+		return nil
+	}
+
+	value, err := decodeJSONValue(body)
+	if err != nil {
+		return []FieldError{{Detail: "response body is not valid JSON"}}
+	}
+	return c.validate(content.Schema, value, "")
+}
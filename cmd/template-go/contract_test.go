@@ -0,0 +1,482 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCreateItem struct {
+	Name string   `json:"name" validate:"required,min=2"`
+	Tags []string `json:"tags" validate:"max=2"`
+}
+
+// testContractDoc documents item routes without serving them.
+func testContractDoc() *OpenAPI {
+	rt := NewRouter()
+	rt.Handle("GET /items/{id}", Handle(getTestItem), RouteDoc{Summary: "Get item"})
+	rt.Handle("POST /items", Handle(func(_ context.Context, _ testCreateItem) (testCreated, error) {
+		return testCreated{ID: 1}, nil
+	}), RouteDoc{Summary: "Create item"})
+	rt.HandleFunc("GET /raw", handleHealth, RouteDoc{Summary: "Raw item", ContentType: "application/json", Response: testItem{}})
+	return rt.OpenAPI(Info{Title: "test", Version: "1"})
+}
+
+func TestContractRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		wantStatus  int
+		wantErrors  []FieldError
+	}{
+		{
+			name:       "valid parameters",
+			method:     http.MethodGet,
+			target:     "/items/7?limit=5&fields=a&fields=b&timeout=1s",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "invalid path parameter",
+			method:     http.MethodGet,
+			target:     "/items/abc",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []FieldError{{Parameter: "id", Detail: "must be an integer"}},
+		},
+		{
+			name:       "path parameter below minimum",
+			method:     http.MethodGet,
+			target:     "/items/0",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []FieldError{{Parameter: "id", Detail: "must be at least 1"}},
+		},
+		{
+			name:       "invalid query parameters",
+			method:     http.MethodGet,
+			target:     "/items/7?limit=500&verbose=maybe&timeout=soon",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []FieldError{
+				{Parameter: "limit", Detail: "must be at most 100"},
+				{Parameter: "verbose", Detail: "must be a boolean"},
+				{Parameter: "timeout", Detail: "must be a valid duration"},
+			},
+		},
+		{
+			name:        "valid body",
+			method:      http.MethodPost,
+			target:      "/items",
+			contentType: "application/json",
+			body:        `{"name":"box","tags":["a"]}`,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "invalid body",
+			method:      http.MethodPost,
+			target:      "/items",
+			contentType: "application/json",
+			body:        `{"name":1,"tags":["a","b","c"]}`,
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantErrors: []FieldError{
+				{Pointer: "/name", Detail: "must be string"},
+				{Pointer: "/tags", Detail: "must contain at most 2 items"},
+			},
+		},
+		{
+			name:        "missing required field",
+			method:      http.MethodPost,
+			target:      "/items",
+			contentType: "application/json",
+			body:        `{"tags":[]}`,
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantErrors:  []FieldError{{Pointer: "/name", Detail: "is required"}},
+		},
+		{
+			name:        "malformed body",
+			method:      http.MethodPost,
+			target:      "/items",
+			contentType: "application/json",
+			body:        `{"name":`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "missing body",
+			method:      http.MethodPost,
+			target:      "/items",
+			contentType: "application/json",
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "unsupported content type",
+			method:      http.MethodPost,
+			target:      "/items",
+			contentType: "text/plain",
+			body:        "box",
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "undocumented route passes through",
+			method:     http.MethodGet,
+			target:     "/unknown?limit=x",
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotBody string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				data, _ := io.ReadAll(r.Body)
+				gotBody = string(data)
+			})
+
+			req := httptest.NewRequestWithContext(t.Context(), tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			Contract(testContractDoc(), ContractOptions{})(next).ServeHTTP(rec, req)
+
+			require.Equal(t, tt.wantStatus, rec.Code, rec.Body.String())
+			if tt.wantStatus == http.StatusOK {
+				assert.Equal(t, tt.body, gotBody, "body is restored for the handler")
+				return
+			}
+
+			var p problem
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+			assert.Equal(t, tt.wantErrors, p.Errors)
+		})
+	}
+}
+
+func TestContractResponses(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		status      int
+		contentType string
+		body        string
+		wantStatus  int
+		wantErrors  []FieldError
+	}{
+		{
+			name:        "valid response",
+			target:      "/raw",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        `{"id":1,"fields":["a"],"limit":10,"note":""}`,
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "wrong field type",
+			target:      "/raw",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			body:        `{"id":"1","fields":null,"limit":1.5,"note":""}`,
+			wantStatus:  http.StatusInternalServerError,
+			wantErrors: []FieldError{
+				{Pointer: "/fields", Detail: "must not be null"},
+				{Pointer: "/id", Detail: "must be integer"},
+				{Pointer: "/limit", Detail: "must be integer"},
+			},
+		},
+		{
+			name:       "undocumented status",
+			target:     "/raw",
+			status:     http.StatusTeapot,
+			wantStatus: http.StatusInternalServerError,
+			wantErrors: []FieldError{{Detail: "status 418 is not documented"}},
+		},
+		{
+			name:        "undocumented content type",
+			target:      "/raw",
+			status:      http.StatusOK,
+			contentType: "text/plain",
+			body:        "item",
+			wantStatus:  http.StatusInternalServerError,
+			wantErrors:  []FieldError{{Detail: "content type text/plain is not documented for status 200"}},
+		},
+		{
+			name:        "documented problem",
+			target:      "/items/7",
+			status:      http.StatusInternalServerError,
+			contentType: "application/problem+json",
+			body:        `{"type":"about:blank","title":"Internal Server Error","status":500}`,
+			wantStatus:  http.StatusInternalServerError,
+		},
+		{
+			name:        "HEAD responses have no body",
+			method:      http.MethodHead,
+			target:      "/raw",
+			status:      http.StatusOK,
+			contentType: "application/json",
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "non-JSON bodies are not decoded",
+			target:      "/items/7",
+			status:      http.StatusOK,
+			contentType: "application/cbor",
+			body:        "\xa0",
+			wantStatus:  http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			})
+
+			req := httptest.NewRequestWithContext(t.Context(), cmp.Or(tt.method, http.MethodGet), tt.target, http.NoBody)
+			rec := httptest.NewRecorder()
+			Contract(testContractDoc(), ContractOptions{ValidateResponses: true})(next).ServeHTTP(rec, req)
+
+			require.Equal(t, tt.wantStatus, rec.Code, rec.Body.String())
+			if tt.wantErrors == nil {
+				assert.Equal(t, tt.body, rec.Body.String())
+				return
+			}
+
+			assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+			var p problem
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+			assert.Equal(t, "response does not match the API contract", p.Detail)
+			assert.Equal(t, tt.wantErrors, p.Errors)
+		})
+	}
+}
+
+func TestContractMatchIsDeterministic(t *testing.T) {
+	doc := &OpenAPI{Paths: map[string]PathItem{
+		"/items/{id}":    {"get": {Summary: "item"}},
+		"/{kind}/latest": {"get": {Summary: "latest"}},
+		"/{kind}/{id}":   {"get": {Summary: "any"}},
+	}}
+	tests := []struct {
+		target string
+		want   string
+	}{
+		// Both templates have two literal segments, so path order decides.
+		{target: "/items/latest", want: "item"},
+		{target: "/items/7", want: "item"},
+		{target: "/orders/latest", want: "latest"},
+		{target: "/orders/7", want: "any"},
+	}
+
+	for range 20 {
+		c := newContract(doc)
+		for _, tt := range tests {
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, tt.target, http.NoBody)
+			op, _ := c.match(req)
+			require.NotNil(t, op, tt.target)
+			assert.Equal(t, tt.want, op.Summary, tt.target)
+		}
+	}
+}
+
+func TestContractStreamsPassThrough(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = w.Write([]byte("data: 1\n\n"))
+		_ = http.NewResponseController(w).Flush()
+	})
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/raw", http.NoBody)
+	rec := httptest.NewRecorder()
+	Contract(testContractDoc(), ContractOptions{ValidateResponses: true})(next).ServeHTTP(rec, req)
+
+	assert.True(t, rec.Flushed)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "data: 1\n\n", rec.Body.String())
+}
+
+func TestContractEnum(t *testing.T) {
+	schema := &Schema{Enum: []any{
+		"plain",
+		1.5,
+		[]any{1.0, "a"},
+		map[string]any{"x": true, "n": []any{2.0}},
+	}}
+	tests := []struct {
+		body  string
+		valid bool
+	}{
+		{body: `"plain"`, valid: true},
+		{body: `1.50`, valid: true},
+		{body: `[1, "a"]`, valid: true},
+		{body: `{"n": [2], "x": true}`, valid: true},
+		{body: `[1]`},
+		{body: `["a", 1]`},
+		{body: `{"x": true}`},
+		{body: `{"x": true, "n": [2], "y": null}`},
+		{body: `"other"`},
+	}
+
+	c := newContract(&OpenAPI{})
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			value, err := decodeJSONValue([]byte(tt.body))
+			require.NoError(t, err)
+			fields := c.validate(schema, value, "")
+			if tt.valid {
+				assert.Empty(t, fields)
+			} else {
+				assert.NotEmpty(t, fields)
+			}
+		})
+	}
+}
+
+const testContractDocument = `{
+  "openapi": "3.1.0",
+  "info": {"title": "pets", "version": "1"},
+  "paths": {
+    "/pets/{petId}": {
+      "parameters": [{"name": "petId", "in": "path", "required": true, "schema": {"type": "string", "format": "uuid"}}],
+      "put": {
+        "parameters": [{"name": "X-Tenant", "in": "header", "required": true, "schema": {"type": "string", "pattern": "^[a-z]+$"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Pet"}}}},
+        "responses": {"2XX": {"description": "Saved"}}
+      }
+    }
+  },
+  "components": {
+    "schemas": {
+      "Pet": {
+        "type": "object",
+        "required": ["name", "kind"],
+        "additionalProperties": false,
+        "properties": {
+          "name": {"type": "string", "minLength": 1},
+          "nickname": {"type": ["string", "null"]},
+          "kind": {"enum": ["cat", "dog"]},
+          "age": {"oneOf": [{"type": "integer", "minimum": 0}, {"type": "string", "format": "date"}]},
+          "labels": {"type": "object", "additionalProperties": {"type": "string"}}
+        }
+      }
+    }
+  }
+}`
+
+func TestLoadOpenAPI(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "openapi.json")
+	require.NoError(t, os.WriteFile(path, []byte(testContractDocument), 0o600))
+
+	doc, err := LoadOpenAPI(path)
+	require.NoError(t, err)
+	require.Contains(t, doc.Paths["/pets/{petId}"], "put")
+	assert.Len(t, doc.Paths["/pets/{petId}"]["put"].Parameters, 2)
+
+	const petID = "/pets/0b7e4a4e-8c55-4a53-9f8e-4d1c6c3b2a10"
+	tests := []struct {
+		name       string
+		target     string
+		tenant     string
+		body       string
+		wantStatus int
+		wantErrors []FieldError
+	}{
+		{
+			name:       "valid",
+			target:     petID,
+			tenant:     "acme",
+			body:       `{"name":"Tom","nickname":null,"kind":"cat","age":3,"labels":{"color":"grey"}}`,
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "invalid",
+			target:     "/pets/42",
+			tenant:     "ACME",
+			body:       `{"name":"","kind":"fish","age":-1,"labels":{"color":1},"owner":"me"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []FieldError{
+				{Parameter: "X-Tenant", Detail: "must match pattern ^[a-z]+$"},
+				{Parameter: "petId", Detail: "must be a valid uuid"},
+				{Pointer: "/age", Detail: "must match exactly one schema"},
+				{Pointer: "/kind", Detail: "must be one of: cat, dog"},
+				{Pointer: "/labels/color", Detail: "must be string"},
+				{Pointer: "/name", Detail: "must contain at least 1 characters"},
+				{Pointer: "/owner", Detail: "unknown field"},
+			},
+		},
+		{
+			name:       "missing header and body fields",
+			target:     petID,
+			body:       `{"nickname":"T"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []FieldError{
+				{Parameter: "X-Tenant", Detail: "is required"},
+				{Pointer: "/name", Detail: "is required"},
+				{Pointer: "/kind", Detail: "is required"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			})
+
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodPut, tt.target, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.tenant != "" {
+				req.Header.Set("X-Tenant", tt.tenant)
+			}
+			rec := httptest.NewRecorder()
+			Contract(doc, ContractOptions{ValidateResponses: true})(next).ServeHTTP(rec, req)
+
+			require.Equal(t, tt.wantStatus, rec.Code, rec.Body.String())
+			if tt.wantErrors != nil {
+				var p problem
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+				assert.Equal(t, tt.wantErrors, p.Errors)
+			}
+		})
+	}
+}
+
+func TestLoadOpenAPIErrors(t *testing.T) {
+	_, err := LoadOpenAPI(filepath.Join(t.TempDir(), "missing.json"))
+	require.ErrorContains(t, err, "failed to read OpenAPI document")
+
+	path := filepath.Join(t.TempDir(), "openapi.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"paths":{"/":{"get":{"parameters":{}}}}}`), 0o600))
+	_, err = LoadOpenAPI(path)
+	require.ErrorContains(t, err, "failed to parse OpenAPI document")
+}
+
+func TestNewServerContract(t *testing.T) {
+	app := testApp(t)
+	app.Contract = app.routes().OpenAPI(Info{Title: "template-go", Version: "test"})
+	app.Config.Contract.ValidateResponses = true
+	server := app.newServer()
+
+	for _, path := range []string{"/health", "/openapi.json"} {
+		t.Run(path, func(t *testing.T) {
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, path, http.NoBody)
+			rec := httptest.NewRecorder()
+			server.Handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSPolicy describes the CORS rules applied to a set of origins.
+//
+// Origins may be exact ("https://app.example.com"), a wildcard
+// subdomain ("https://*.example.com") or "*" for any origin.
+type CORSPolicy struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
+
+var defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// CORS returns middleware that applies the first policy matching the request origin.
+// Preflight requests are answered before reaching the next handler.
+func CORS(policies ...CORSPolicy) func(http.Handler) http.Handler {
+	// Responses only vary by origin when some policy reflects it.
+	varyOrigin := slices.ContainsFunc(policies, func(p CORSPolicy) bool {
+		return !p.wildcard() || p.AllowCredentials
+	})
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Add("Vary", "Origin")
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+
+				if policy, ok := matchCORSPolicy(policies, origin); ok {
+					policy.handlePreflight(w, r, origin)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if varyOrigin {
+				w.Header().Add("Vary", "Origin")
+			}
+			if policy, ok := matchCORSPolicy(policies, origin); ok {
+				policy.setOriginHeaders(w, origin)
+				if len(policy.ExposedHeaders) > 0 {
+					w.Header().Set("Access-Control-Expose-Headers", strings.Join(policy.ExposedHeaders, ", "))
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// matchCORSPolicy returns the first policy that allows the origin.
+func matchCORSPolicy(policies []CORSPolicy, origin string) (*CORSPolicy, bool) {
+	if origin == "" {
+		return nil, false
+	}
+	for i := range policies {
+		if policies[i].allowsOrigin(origin) {
+			return &policies[i], true
+		}
+	}
+	return nil, false
+}
+
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	for _, allowed := range p.AllowedOrigins {
+		if matchOrigin(strings.ToLower(allowed), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin reports whether origin matches pattern, which may contain
+// a single "*" standing for one or more subdomain labels.
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+
+	prefix, suffix, ok := strings.Cut(pattern, "*")
+	if !ok || !strings.HasPrefix(suffix, ".") {
+		return false
+	}
+	if len(origin) <= len(prefix)+len(suffix) {
+		return false
+	}
+	if !strings.HasPrefix(origin, prefix) || !strings.HasSuffix(origin, suffix) {
+		return false
+	}
+
+	sub := origin[len(prefix) : len(origin)-len(suffix)]
+	return !strings.ContainsAny(sub, "/:@") && !strings.HasPrefix(sub, ".") && !strings.HasSuffix(sub, ".")
+}
+
+func (p *CORSPolicy) wildcard() bool {
+	return slices.Contains(p.AllowedOrigins, "*")
+}
+
+// setOriginHeaders sets Access-Control-Allow-Origin and credentials headers.
+// A literal "*" is only sent for wildcard policies without credentials,
+// since browsers reject it on credentialed requests.
+func (p *CORSPolicy) setOriginHeaders(w http.ResponseWriter, origin string) {
+	h := w.Header()
+	if p.wildcard() && !p.AllowCredentials {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if p.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (p *CORSPolicy) handlePreflight(w http.ResponseWriter, r *http.Request, origin string) {
+	method := r.Header.Get("Access-Control-Request-Method")
+	methods := p.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	if !slices.Contains(methods, method) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	requested := parseHeaderList(r.Header.Get("Access-Control-Request-Headers"))
+	if !p.allowsHeaders(requested) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	p.setOriginHeaders(w, origin)
+
+	h := w.Header()
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(requested) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if p.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *CORSPolicy) allowsHeaders(requested []string) bool {
+	if slices.Contains(p.AllowedHeaders, "*") {
+		return true
+	}
+	for _, name := range requested {
+		if !slices.ContainsFunc(p.AllowedHeaders, func(allowed string) bool {
+			return strings.EqualFold(allowed, name)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseHeaderList splits a comma-separated header value into lowercase tokens.
+func parseHeaderList(value string) []string {
+	var out []string
+	for part := range strings.SplitSeq(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, strings.ToLower(part))
+		}
+	}
+	return out
+}
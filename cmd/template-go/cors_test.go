@@ -0,0 +1,274 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		origin  string
+		want    bool
+	}{
+		{"any origin", "*", "https://example.com", true},
+		{"exact match", "https://example.com", "https://example.com", true},
+		{"exact mismatch scheme", "https://example.com", "http://example.com", false},
+		{"exact mismatch port", "https://example.com", "https://example.com:8443", false},
+		{"wildcard subdomain", "https://*.example.com", "https://app.example.com", true},
+		{"wildcard nested subdomain", "https://*.example.com", "https://a.b.example.com", true},
+		{"wildcard does not match apex", "https://*.example.com", "https://example.com", false},
+		{"wildcard does not match lookalike", "https://*.example.com", "https://evilexample.com", false},
+		{"wildcard does not match other suffix", "https://*.example.com", "https://app.example.com.evil.io", false},
+		{"wildcard rejects userinfo", "https://*.example.com", "https://user@app.example.com", false},
+		{"wildcard rejects port smuggling", "https://*.example.com", "https://evil.io:1.example.com", false},
+		{"wildcard requires dot suffix", "https://*example.com", "https://evilexample.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, matchOrigin(tt.pattern, tt.origin))
+		})
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	tests := []struct {
+		name           string
+		policies       []CORSPolicy
+		origin         string
+		method         string
+		requestHeaders string
+		wantOrigin     string
+		wantMethods    string
+		wantHeaders    string
+		wantMaxAge     string
+		wantCreds      string
+	}{
+		{
+			name:        "allowed origin with default methods",
+			policies:    []CORSPolicy{{AllowedOrigins: []string{"https://app.example.com"}}},
+			origin:      "https://app.example.com",
+			method:      http.MethodPost,
+			wantOrigin:  "https://app.example.com",
+			wantMethods: "GET, HEAD, POST",
+		},
+		{
+			name:     "disallowed origin",
+			policies: []CORSPolicy{{AllowedOrigins: []string{"https://app.example.com"}}},
+			origin:   "https://evil.example.net",
+			method:   http.MethodGet,
+		},
+		{
+			name:     "disallowed method",
+			policies: []CORSPolicy{{AllowedOrigins: []string{"https://app.example.com"}}},
+			origin:   "https://app.example.com",
+			method:   http.MethodDelete,
+		},
+		{
+			name: "allowed headers are echoed",
+			policies: []CORSPolicy{{
+				AllowedOrigins: []string{"https://app.example.com"},
+				AllowedMethods: []string{http.MethodPut},
+				AllowedHeaders: []string{"Content-Type", "Authorization"},
+			}},
+			origin:         "https://app.example.com",
+			method:         http.MethodPut,
+			requestHeaders: "content-type, Authorization",
+			wantOrigin:     "https://app.example.com",
+			wantMethods:    "PUT",
+			wantHeaders:    "content-type, authorization",
+		},
+		{
+			name: "disallowed header",
+			policies: []CORSPolicy{{
+				AllowedOrigins: []string{"https://app.example.com"},
+				AllowedHeaders: []string{"Content-Type"},
+			}},
+			origin:         "https://app.example.com",
+			method:         http.MethodPost,
+			requestHeaders: "X-Secret",
+		},
+		{
+			name: "any header",
+			policies: []CORSPolicy{{
+				AllowedOrigins: []string{"https://app.example.com"},
+				AllowedHeaders: []string{"*"},
+			}},
+			origin:         "https://app.example.com",
+			method:         http.MethodPost,
+			requestHeaders: "X-Anything",
+			wantOrigin:     "https://app.example.com",
+			wantMethods:    "GET, HEAD, POST",
+			wantHeaders:    "x-anything",
+		},
+		{
+			name: "max age and credentials",
+			policies: []CORSPolicy{{
+				AllowedOrigins:   []string{"https://*.example.com"},
+				AllowCredentials: true,
+				MaxAge:           10 * time.Minute,
+			}},
+			origin:      "https://dash.example.com",
+			method:      http.MethodGet,
+			wantOrigin:  "https://dash.example.com",
+			wantMethods: "GET, HEAD, POST",
+			wantMaxAge:  "600",
+			wantCreds:   "true",
+		},
+		{
+			name:        "wildcard without credentials",
+			policies:    []CORSPolicy{{AllowedOrigins: []string{"*"}}},
+			origin:      "https://anything.example.net",
+			method:      http.MethodGet,
+			wantOrigin:  "*",
+			wantMethods: "GET, HEAD, POST",
+		},
+		{
+			name: "first matching policy wins",
+			policies: []CORSPolicy{
+				{AllowedOrigins: []string{"https://admin.example.com"}, AllowedMethods: []string{http.MethodDelete}},
+				{AllowedOrigins: []string{"https://*.example.com"}},
+			},
+			origin:      "https://admin.example.com",
+			method:      http.MethodDelete,
+			wantOrigin:  "https://admin.example.com",
+			wantMethods: "DELETE",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			handler := CORS(tt.policies...)(http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+				called = true
+			}))
+
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodOptions, "/test", http.NoBody)
+			req.Header.Set("Origin", tt.origin)
+			req.Header.Set("Access-Control-Request-Method", tt.method)
+			if tt.requestHeaders != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.requestHeaders)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			assert.False(t, called, "preflight must not reach the next handler")
+			assert.Equal(t, http.StatusNoContent, rec.Code)
+			assert.Equal(t, tt.wantOrigin, rec.Header().Get("Access-Control-Allow-Origin"))
+			assert.Equal(t, tt.wantMethods, rec.Header().Get("Access-Control-Allow-Methods"))
+			assert.Equal(t, tt.wantHeaders, rec.Header().Get("Access-Control-Allow-Headers"))
+			assert.Equal(t, tt.wantMaxAge, rec.Header().Get("Access-Control-Max-Age"))
+			assert.Equal(t, tt.wantCreds, rec.Header().Get("Access-Control-Allow-Credentials"))
+			assert.Equal(t,
+				[]string{"Origin", "Access-Control-Request-Method", "Access-Control-Request-Headers"},
+				rec.Header().Values("Vary"),
+			)
+		})
+	}
+}
+
+func TestCORSActualRequest(t *testing.T) {
+	tests := []struct {
+		name        string
+		policies    []CORSPolicy
+		origin      string
+		wantOrigin  string
+		wantExpose  string
+		wantCreds   string
+		wantVary    []string
+		wantHandled bool
+	}{
+		{
+			name:       "allowed origin",
+			policies:   []CORSPolicy{{AllowedOrigins: []string{"https://app.example.com"}, ExposedHeaders: []string{"X-Request-Id", "ETag"}}},
+			origin:     "https://app.example.com",
+			wantOrigin: "https://app.example.com",
+			wantExpose: "X-Request-Id, ETag",
+			wantVary:   []string{"Origin"},
+		},
+		{
+			name:     "disallowed origin still varies",
+			policies: []CORSPolicy{{AllowedOrigins: []string{"https://app.example.com"}}},
+			origin:   "https://evil.example.net",
+			wantVary: []string{"Origin"},
+		},
+		{
+			name:     "no origin still varies",
+			policies: []CORSPolicy{{AllowedOrigins: []string{"https://app.example.com"}}},
+			wantVary: []string{"Origin"},
+		},
+		{
+			name:       "wildcard without credentials does not vary",
+			policies:   []CORSPolicy{{AllowedOrigins: []string{"*"}}},
+			origin:     "https://app.example.com",
+			wantOrigin: "*",
+		},
+		{
+			name:       "wildcard with credentials reflects origin",
+			policies:   []CORSPolicy{{AllowedOrigins: []string{"*"}, AllowCredentials: true}},
+			origin:     "https://app.example.com",
+			wantOrigin: "https://app.example.com",
+			wantCreds:  "true",
+			wantVary:   []string{"Origin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := CORS(tt.policies...)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, tt.wantOrigin, rec.Header().Get("Access-Control-Allow-Origin"))
+			assert.Equal(t, tt.wantExpose, rec.Header().Get("Access-Control-Expose-Headers"))
+			assert.Equal(t, tt.wantCreds, rec.Header().Get("Access-Control-Allow-Credentials"))
+			assert.Equal(t, tt.wantVary, rec.Header().Values("Vary"))
+		})
+	}
+}
+
+func TestCORSPlainOptionsPassesThrough(t *testing.T) {
+	handler := CORS(CORSPolicy{AllowedOrigins: []string{"*"}})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodOptions, "/test", http.NoBody)
+	req.Header.Set("Origin", "https://app.example.com")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusTeapot, rec.Code)
+}
+
+func TestNewServerCORSPreflight(t *testing.T) {
+	app := testApp(t)
+	app.Config.CORS = CORSPolicy{AllowedOrigins: []string{"https://app.example.com"}}
+	server := app.newServer()
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodOptions, "/test", http.NoBody)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	rec := httptest.NewRecorder()
+
+	server.Handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, "https://app.example.com", rec.Header().Get("Access-Control-Allow-Origin"))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule computes the ticks of a periodic task.
+type Schedule interface {
+	// Next returns the first tick after t, or the zero time if none.
+	Next(t time.Time) time.Time
+}
+
+// ParseSchedule parses a five-field cron expression (minute, hour, day of
+// month, month, day of week), a descriptor such as @daily, or @every with
+// a duration. Cron fields accept *, lists, ranges, steps, and month and
+// weekday names; when both day fields are restricted, either may match.
+// Ticks are computed in loc.
+func ParseSchedule(spec string, loc *time.Location) (Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if d, ok := strings.CutPrefix(spec, "@every "); ok {
+		interval, err := time.ParseDuration(strings.TrimSpace(d))
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+		if interval < time.Second {
+			return nil, fmt.Errorf("invalid schedule %q: interval below 1s", spec)
+		}
+		return everySchedule(interval), nil
+	}
+	if expr, ok := cronDescriptors[spec]; ok {
+		spec = expr
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: want 5 fields, got %d", spec, len(fields))
+	}
+	s := &cronSchedule{loc: loc}
+	var err error
+	for i, dst := range []*cronField{&s.minute, &s.hour, &s.dom, &s.month, &s.dow} {
+		if *dst, err = parseCronField(fields[i], cronRanges[i]); err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %w", spec, err)
+		}
+	}
+	// Sunday may be written as 7.
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = strings.HasPrefix(fields[2], "*")
+	s.dowAny = strings.HasPrefix(fields[4], "*")
+	if s.Next(time.Now()).IsZero() {
+		return nil, fmt.Errorf("invalid schedule %q: %w", spec, errNoTick)
+	}
+	return s, nil
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// cronRange bounds a field and names its values.
+type cronRange struct {
+	min, max int
+	names    []string
+}
+
+var cronRanges = [5]cronRange{
+	{min: 0, max: 59},
+	{min: 0, max: 23},
+	{min: 1, max: 31},
+	{min: 1, max: 12, names: []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{min: 0, max: 7, names: []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// cronField is a set of allowed values as a bitmask.
+type cronField uint64
+
+func (f cronField) has(v int) bool { return f&(1<<v) != 0 }
+
+func parseCronField(s string, r cronRange) (cronField, error) {
+	var f cronField
+	for part := range strings.SplitSeq(s, ",") {
+		expr, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			step = n
+		}
+
+		lo, hi := r.min, r.max
+		switch {
+		case expr == "*":
+		case strings.Contains(expr, "-"):
+			a, b, _ := strings.Cut(expr, "-")
+			var err error
+			if lo, err = r.value(a); err != nil {
+				return 0, err
+			}
+			if hi, err = r.value(b); err != nil {
+				return 0, err
+			}
+			if lo > hi {
+				return 0, fmt.Errorf("invalid range %q", expr)
+			}
+		default:
+			var err error
+			if lo, err = r.value(expr); err != nil {
+				return 0, err
+			}
+			if !hasStep {
+				hi = lo
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			f |= 1 << v
+		}
+	}
+	return f, nil
+}
+
+// value parses a number or name within r.
+func (r cronRange) value(s string) (int, error) {
+	for i, name := range r.names {
+		if strings.EqualFold(s, name) {
+			return i + r.min, nil
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < r.min || n > r.max {
+		return 0, fmt.Errorf("value %q out of range %d-%d", s, r.min, r.max)
+	}
+	return n, nil
+}
+
+// cronSchedule matches times whose fields are all allowed.
+type cronSchedule struct {
+	minute, hour, dom, month, dow cronField
+	domAny, dowAny                bool
+	loc                           *time.Location
+}
+
+// cronSearchYears bounds the search for ticks, which never come for
+// dates such as February 30.
+const cronSearchYears = 5
+
+var errNoTick = errors.New("no tick within 5 years")
+
+// Next skips non-matching months, days and hours as a whole, so that it
+// takes at most a few hundred steps.
+func (s *cronSchedule) Next(after time.Time) time.Time {
+	loc := s.loc
+	if loc == nil {
+		loc = time.UTC
+	}
+	t := after.In(loc).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case !s.month.has(int(m)):
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, loc)
+		case !s.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+		case !s.hour.has(t.Hour()):
+			t = time.Date(y, m, d, t.Hour()+1, 0, 0, 0, loc)
+		case !s.minute.has(t.Minute()):
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches applies the cron rule that a restricted day of month and a
+// restricted day of week match alternatively.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := s.dom.has(t.Day()), s.dow.has(int(t.Weekday()))
+	if s.domAny || s.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// everySchedule ticks at fixed multiples of its interval rather than
+// relative to startup, so that every replica computes the same ticks.
+type everySchedule time.Duration
+
+func (e everySchedule) Next(after time.Time) time.Time {
+	d := time.Duration(e)
+	return after.Truncate(d).Add(d)
+}
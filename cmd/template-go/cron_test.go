@@ -0,0 +1,114 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSchedule(t *testing.T) {
+	// Thursday.
+	from := time.Date(2026, 1, 1, 10, 30, 15, 0, time.UTC)
+
+	tests := []struct {
+		spec string
+		want []time.Time
+	}{
+		{spec: "* * * * *", want: []time.Time{
+			time.Date(2026, 1, 1, 10, 31, 0, 0, time.UTC),
+			time.Date(2026, 1, 1, 10, 32, 0, 0, time.UTC),
+		}},
+		{spec: "*/15 * * * *", want: []time.Time{
+			time.Date(2026, 1, 1, 10, 45, 0, 0, time.UTC),
+			time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC),
+		}},
+		{spec: "0 9-17/4 * * *", want: []time.Time{
+			time.Date(2026, 1, 1, 13, 0, 0, 0, time.UTC),
+			time.Date(2026, 1, 1, 17, 0, 0, 0, time.UTC),
+			time.Date(2026, 1, 2, 9, 0, 0, 0, time.UTC),
+		}},
+		{spec: "30 2 * * mon,FRI", want: []time.Time{
+			time.Date(2026, 1, 2, 2, 30, 0, 0, time.UTC),
+			time.Date(2026, 1, 5, 2, 30, 0, 0, time.UTC),
+		}},
+		{spec: "0 0 * * 7", want: []time.Time{
+			time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC),
+		}},
+		{spec: "0 0 1 jan-mar *", want: []time.Time{
+			time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC),
+			time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC),
+		}},
+		// Restricted day of month and day of week match alternatively.
+		{spec: "0 12 13 * fri", want: []time.Time{
+			time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC),
+			time.Date(2026, 1, 9, 12, 0, 0, 0, time.UTC),
+			time.Date(2026, 1, 13, 12, 0, 0, 0, time.UTC),
+			time.Date(2026, 1, 16, 12, 0, 0, 0, time.UTC),
+		}},
+		{spec: "0 0 29 2 *", want: []time.Time{
+			time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		}},
+		{spec: "@daily", want: []time.Time{
+			time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC),
+			time.Date(2026, 1, 3, 0, 0, 0, 0, time.UTC),
+		}},
+		{spec: "@hourly", want: []time.Time{
+			time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC),
+		}},
+		{spec: "@every 10m", want: []time.Time{
+			time.Date(2026, 1, 1, 10, 40, 0, 0, time.UTC),
+			time.Date(2026, 1, 1, 10, 50, 0, 0, time.UTC),
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			s, err := ParseSchedule(tt.spec, time.UTC)
+			require.NoError(t, err)
+
+			next := from
+			for _, want := range tt.want {
+				next = s.Next(next)
+				assert.Equal(t, want, next)
+			}
+		})
+	}
+}
+
+func TestParseScheduleLocation(t *testing.T) {
+	loc := time.FixedZone("UTC+3", 3*60*60)
+	s, err := ParseSchedule("0 9 * * *", loc)
+	require.NoError(t, err)
+
+	next := s.Next(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.True(t, time.Date(2026, 1, 1, 6, 0, 0, 0, time.UTC).Equal(next))
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"* * * foo *",
+		"0 0 30 2 *",
+		"@every",
+		"@every soon",
+		"@every 10ms",
+		"@fortnightly",
+	} {
+		t.Run(spec, func(t *testing.T) {
+			_, err := ParseSchedule(spec, time.UTC)
+			assert.Error(t, err)
+		})
+	}
+}
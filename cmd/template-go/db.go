@@ -5,9 +5,26 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
+// Querier runs queries. It is satisfied by *pgxpool.Pool, *pgxpool.Conn
+// and pgx.Tx, so repositories work the same inside and outside transactions.
+type Querier interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+var (
+	_ Querier = (*pgxpool.Pool)(nil)
+	_ Querier = (*pgxpool.Conn)(nil)
+	_ Querier = pgx.Tx(nil)
+)
+
 // openDB opens a database connection pool.
 func openDB(dsn string) (*pgxpool.Pool, error) {
 	config, err := pgxpool.ParseConfig(dsn)
@@ -35,21 +52,3 @@ func openDB(dsn string) (*pgxpool.Pool, error) {
 
 	return pool, nil
 }
-
-// DatabaseInfo holds the database name and version.
-type DatabaseInfo struct {
-	Database string `json:"database"`
-	Version  string `json:"version"`
-}
-
-// getDatabaseInfo queries the database for its name and version.
-func getDatabaseInfo(ctx context.Context, db *pgxpool.Pool) (*DatabaseInfo, error) {
-	var info DatabaseInfo
-
-	err := db.QueryRow(ctx, "SELECT current_database(), version()").Scan(&info.Database, &info.Version)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get database info: %w", err)
-	}
-
-	return &info, nil
-}
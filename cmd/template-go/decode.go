@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// maxJSONBodyBytes limits JSON request bodies independently of Secure.
+const maxJSONBodyBytes = 1 << 20
+
+// decodeJSON decodes a single JSON value from the request body into T
+// and validates it. Unknown fields, trailing data, wrong content types
+// and bodies over maxJSONBodyBytes are rejected with a *RequestError,
+// failed validation with a *ValidationError.
+func decodeJSON[T any](w http.ResponseWriter, r *http.Request) (T, error) {
+	var v T
+	if err := readJSON(w, r, &v); err != nil {
+		return v, err
+	}
+	if err := validate(v); err != nil {
+		return v, err
+	}
+	return v, nil
+}
+
+// readJSON decodes the request body into v without validating it.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	if !isJSONContentType(r.Header.Get("Content-Type")) {
+		return &RequestError{Status: http.StatusUnsupportedMediaType, Detail: "Content-Type must be application/json"}
+	}
+
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxJSONBodyBytes))
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if err := dec.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return decodeError(err)
+		}
+		return &RequestError{Status: http.StatusBadRequest, Detail: "request body must contain a single JSON value"}
+	}
+	return nil
+}
+
+// decodeError converts json.Decoder errors into client errors.
+func decodeError(err error) error {
+	var (
+		syntaxErr *json.SyntaxError
+		typeErr   *json.UnmarshalTypeError
+		maxErr    *http.MaxBytesError
+	)
+
+	switch {
+	case errors.Is(err, io.EOF):
+		return &RequestError{Status: http.StatusBadRequest, Detail: "request body must not be empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &RequestError{Status: http.StatusBadRequest, Detail: "request body contains malformed JSON", Err: err}
+	case errors.As(err, &syntaxErr):
+		return &RequestError{
+			Status: http.StatusBadRequest,
+			Detail: fmt.Sprintf("request body contains malformed JSON at offset %d", syntaxErr.Offset),
+			Err:    err,
+		}
+	case errors.As(err, &typeErr):
+		return &ValidationError{Fields: []FieldError{{
+			Pointer: jsonPointer(strings.Split(typeErr.Field, ".")...),
+			Detail:  "must be " + typeErr.Type.String(),
+		}}}
+	case errors.As(err, &maxErr):
+		return &RequestError{
+			Status: http.StatusRequestEntityTooLarge,
+			Detail: fmt.Sprintf("request body must not exceed %d bytes", maxErr.Limit),
+		}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return &ValidationError{Fields: []FieldError{{Pointer: jsonPointer(field), Detail: "unknown field"}}}
+	default:
+		return &RequestError{Status: http.StatusBadRequest, Detail: "invalid request body", Err: err}
+	}
+}
+
+// isJSONContentType accepts application/json and application/*+json.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" ||
+		(strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantErrors  []FieldError
+	}{
+		{
+			name:        "valid payload",
+			contentType: "application/json",
+			body:        `{"name":"alice","email":"alice@example.com","age":30}`,
+		},
+		{
+			name:        "json suffix media type with charset",
+			contentType: "application/merge-patch+json; charset=utf-8",
+			body:        `{"name":"alice","email":"alice@example.com","age":30}`,
+		},
+		{
+			name:        "wrong content type",
+			contentType: "text/plain",
+			body:        `{"name":"alice"}`,
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "missing content type",
+			body:       `{"name":"alice"}`,
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:        "empty body",
+			contentType: "application/json",
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "malformed JSON",
+			contentType: "application/json",
+			body:        `{"name":}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "truncated JSON",
+			contentType: "application/json",
+			body:        `{"name":"alice"`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "multiple values",
+			contentType: "application/json",
+			body:        `{"name":"alice","email":"alice@example.com","age":30}{}`,
+			wantStatus:  http.StatusBadRequest,
+		},
+		{
+			name:        "oversized body",
+			contentType: "application/json",
+			body:        `{"name":"` + strings.Repeat("a", maxJSONBodyBytes) + `"}`,
+			wantStatus:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "unknown field",
+			contentType: "application/json",
+			body:        `{"name":"alice","admin":true}`,
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantErrors:  []FieldError{{Pointer: "/admin", Detail: "unknown field"}},
+		},
+		{
+			name:        "wrong field type",
+			contentType: "application/json",
+			body:        `{"name":"alice","email":"alice@example.com","age":"thirty"}`,
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantErrors:  []FieldError{{Pointer: "/age", Detail: "must be int"}},
+		},
+		{
+			name:        "nested wrong type",
+			contentType: "application/json",
+			body:        `{"name":"alice","email":"alice@example.com","age":30,"address":{"city":1}}`,
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantErrors:  []FieldError{{Pointer: "/address/city", Detail: "must be string"}},
+		},
+		{
+			name:        "invalid payload",
+			contentType: "application/json",
+			body:        `{"name":"a","email":"nope","age":10}`,
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantErrors: []FieldError{
+				{Pointer: "/name", Detail: "must contain at least 2 characters"},
+				{Pointer: "/email", Detail: "must be a valid email address"},
+				{Pointer: "/age", Detail: "must be at least 18"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				user, err := decodeJSON[testCreateUser](w, r)
+				if err != nil {
+					respondErr(w, r, err)
+					return
+				}
+				respondJSON(w, http.StatusCreated, user)
+			})
+
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/users", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if tt.wantStatus == 0 {
+				require.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+				var user testCreateUser
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&user))
+				assert.Equal(t, "alice", user.Name)
+				return
+			}
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+
+			var body problem
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+			assert.Equal(t, tt.wantStatus, body.Status)
+			assert.NotEmpty(t, body.Detail)
+			assert.Equal(t, tt.wantErrors, body.Errors)
+		})
+	}
+}
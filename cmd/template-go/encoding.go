@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Encoder writes v to w in a specific media type.
+type Encoder func(w io.Writer, v any) error
+
+// EncodeJSON encodes v as JSON followed by a newline.
+func EncodeJSON(w io.Writer, v any) error {
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	return nil
+}
+
+// EncodeCBOR encodes v as CBOR (RFC 8949) using its JSON field names.
+func EncodeCBOR(w io.Writer, v any) error {
+	return writeEncoded(w, v, &cborWriter{})
+}
+
+// EncodeMsgpack encodes v as MessagePack using its JSON field names.
+func EncodeMsgpack(w io.Writer, v any) error {
+	return writeEncoded(w, v, &msgpackWriter{})
+}
+
+// EncoderRegistry maps media types to encoders. Registration order is the
+// server preference used to break Accept header ties.
+type EncoderRegistry struct {
+	types    []string
+	encoders map[string]Encoder
+}
+
+// NewEncoderRegistry returns an empty registry.
+func NewEncoderRegistry() *EncoderRegistry {
+	return &EncoderRegistry{encoders: map[string]Encoder{}}
+}
+
+// Register adds or replaces the encoder for mediaType.
+func (reg *EncoderRegistry) Register(mediaType string, enc Encoder) {
+	mediaType = strings.ToLower(mediaType)
+	if _, ok := reg.encoders[mediaType]; !ok {
+		reg.types = append(reg.types, mediaType)
+	}
+	reg.encoders[mediaType] = enc
+}
+
+// Types returns the registered media types in preference order.
+func (reg *EncoderRegistry) Types() []string {
+	return slices.Clone(reg.types)
+}
+
+// Negotiate returns the media type and encoder preferred by the Accept header.
+func (reg *EncoderRegistry) Negotiate(accept string) (string, Encoder, bool) {
+	mediaType, ok := negotiateContentType(accept, reg.types)
+	if !ok {
+		return "", nil, false
+	}
+	return mediaType, reg.encoders[mediaType], true
+}
+
+// encoders are used by respond; JSON is the default for requests without Accept.
+var encoders = func() *EncoderRegistry {
+	reg := NewEncoderRegistry()
+	reg.Register("application/json", EncodeJSON)
+	reg.Register("application/cbor", EncodeCBOR)
+	reg.Register("application/msgpack", EncodeMsgpack)
+	reg.Register("application/x-msgpack", EncodeMsgpack)
+	return reg
+}()
+
+// respond writes data in the representation negotiated from the Accept header.
+func respond(w http.ResponseWriter, r *http.Request, status int, data any) {
+	w.Header().Add("Vary", "Accept")
+
+	mediaType, enc, ok := encoders.Negotiate(r.Header.Get("Accept"))
+	if !ok {
+		respondProblem(w, http.StatusNotAcceptable, "supported media types: "+strings.Join(encoders.Types(), ", "))
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(status)
+	if err := enc(w, data); err != nil {
+		slog.Error("failed to encode response", "error", err, "content_type", mediaType)
+	}
+}
+
+// ndjsonFlushRows is how many NDJSON rows are written between flushes.
+const ndjsonFlushRows = 100
+
+// streamNDJSON writes every value of seq as one line of
+// application/x-ndjson, flushing periodically so large results are never
+// held in memory. An error before the first row is sent as a problem;
+// once streaming has started the connection is aborted instead, so
+// clients see a truncated response rather than a seemingly complete one.
+func streamNDJSON[T any](w http.ResponseWriter, r *http.Request, seq iter.Seq2[T, error]) {
+	w.Header().Add("Vary", "Accept")
+	if _, ok := negotiateContentType(r.Header.Get("Accept"), []string{"application/x-ndjson"}); !ok {
+		respondProblem(w, http.StatusNotAcceptable, "supported media types: application/x-ndjson")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	rows := 0
+	for v, err := range seq {
+		if err == nil && rows == 0 {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+		}
+		if err == nil {
+			err = enc.Encode(v)
+		}
+		if err != nil {
+			if rows == 0 {
+				respondErr(w, r, err)
+				return
+			}
+			slog.Error("failed to stream response", "error", err, "rows", rows)
+			panic(http.ErrAbortHandler)
+		}
+
+		rows++
+		if rows%ndjsonFlushRows == 0 {
+			_ = rc.Flush()
+		}
+	}
+
+	if rows == 0 {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	_ = rc.Flush()
+}
+
+// rowSeq iterates over rows, converting each with fn. The rows are closed
+// when iteration stops and any query error is yielded last.
+func rowSeq[T any](rows pgx.Rows, fn pgx.RowToFunc[T]) iter.Seq2[T, error] {
+	return func(yield func(T, error) bool) {
+		defer rows.Close()
+
+		for rows.Next() {
+			v, err := fn(rows)
+			if err != nil {
+				var zero T
+				yield(zero, fmt.Errorf("failed to scan row: %w", err))
+				return
+			}
+			if !yield(v, nil) {
+				return
+			}
+		}
+		if err := rows.Err(); err != nil {
+			var zero T
+			yield(zero, fmt.Errorf("failed to read rows: %w", err))
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"iter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncoderRegistryNegotiate(t *testing.T) {
+	tests := []struct {
+		name     string
+		accept   string
+		wantType string
+		wantOK   bool
+	}{
+		{"no header", "", "application/json", true},
+		{"wildcard", "*/*", "application/json", true},
+		{"cbor", "application/cbor", "application/cbor", true},
+		{"msgpack", "application/msgpack", "application/msgpack", true},
+		{"legacy msgpack", "application/x-msgpack", "application/x-msgpack", true},
+		{"quality", "application/json;q=0.5, application/cbor", "application/cbor", true},
+		{"mismatch", "text/html", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mediaType, enc, ok := encoders.Negotiate(tt.accept)
+			assert.Equal(t, tt.wantOK, ok)
+			assert.Equal(t, tt.wantType, mediaType)
+			assert.Equal(t, tt.wantOK, enc != nil)
+		})
+	}
+}
+
+func TestEncoderRegistryRegister(t *testing.T) {
+	reg := NewEncoderRegistry()
+	reg.Register("application/json", EncodeJSON)
+	reg.Register("Application/CBOR", EncodeCBOR)
+	reg.Register("application/json", EncodeMsgpack)
+
+	assert.Equal(t, []string{"application/json", "application/cbor"}, reg.Types())
+
+	_, enc, ok := reg.Negotiate("application/json")
+	require.True(t, ok)
+	rec := httptest.NewRecorder()
+	require.NoError(t, enc(rec, 1))
+	assert.Equal(t, "01", hex.EncodeToString(rec.Body.Bytes()))
+}
+
+func TestRespond(t *testing.T) {
+	tests := []struct {
+		name       string
+		accept     string
+		wantStatus int
+		wantType   string
+		wantBody   string
+	}{
+		{"json", "", http.StatusOK, "application/json", "7b2261223a317d0a"},
+		{"cbor", "application/cbor", http.StatusOK, "application/cbor", "a1616101"},
+		{"msgpack", "application/msgpack", http.StatusOK, "application/msgpack", "81a16101"},
+		{"not acceptable", "text/csv", http.StatusNotAcceptable, "application/problem+json", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+
+			respond(rec, req, http.StatusOK, map[string]int{"a": 1})
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, tt.wantType, rec.Header().Get("Content-Type"))
+			assert.Equal(t, "Accept", rec.Header().Get("Vary"))
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, hex.EncodeToString(rec.Body.Bytes()))
+			}
+		})
+	}
+}
+
+// countSeq yields n rows, then err if it is not nil.
+func countSeq(n int, err error) iter.Seq2[testItem, error] {
+	return func(yield func(testItem, error) bool) {
+		for i := range n {
+			if !yield(testItem{ID: int64(i)}, nil) {
+				return
+			}
+		}
+		if err != nil {
+			yield(testItem{}, err)
+		}
+	}
+}
+
+func TestStreamNDJSON(t *testing.T) {
+	t.Run("streams rows", func(t *testing.T) {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		streamNDJSON(rec, req, countSeq(250, nil))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+		assert.True(t, rec.Flushed)
+
+		scanner := bufio.NewScanner(rec.Body)
+		var ids []int64
+		for scanner.Scan() {
+			var item testItem
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &item))
+			ids = append(ids, item.ID)
+		}
+		require.Len(t, ids, 250)
+		assert.Equal(t, int64(249), ids[249])
+	})
+
+	t.Run("empty result", func(t *testing.T) {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		streamNDJSON(rec, req, countSeq(0, nil))
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+		assert.Empty(t, rec.Body.String())
+	})
+
+	t.Run("error before first row", func(t *testing.T) {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		streamNDJSON(rec, req, countSeq(0, pgx.ErrNoRows))
+
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	})
+
+	t.Run("error mid stream aborts", func(t *testing.T) {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			streamNDJSON(rec, req, countSeq(3, errors.New("connection reset")))
+		})
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("not acceptable", func(t *testing.T) {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+
+		streamNDJSON(rec, req, countSeq(1, nil))
+
+		assert.Equal(t, http.StatusNotAcceptable, rec.Code)
+	})
+}
+
+func TestRowSeq(t *testing.T) {
+	t.Run("yields rows", func(t *testing.T) {
+		rows := &fakeRows{values: [][]any{{int64(1)}, {int64(2)}, {int64(3)}}}
+
+		var got []int64
+		for v, err := range rowSeq(rows, pgx.RowTo[int64]) {
+			require.NoError(t, err)
+			got = append(got, v)
+		}
+
+		assert.Equal(t, []int64{1, 2, 3}, got)
+		assert.True(t, rows.closed)
+	})
+
+	t.Run("stops early", func(t *testing.T) {
+		rows := &fakeRows{values: [][]any{{int64(1)}, {int64(2)}, {int64(3)}}}
+
+		for range rowSeq(rows, pgx.RowTo[int64]) {
+			break
+		}
+
+		assert.Equal(t, 1, rows.pos)
+		assert.True(t, rows.closed)
+	})
+
+	t.Run("yields query error", func(t *testing.T) {
+		rows := &fakeRows{values: [][]any{{int64(1)}}, err: errors.New("canceled")}
+
+		var errs []error
+		for _, err := range rowSeq(rows, pgx.RowTo[int64]) {
+			errs = append(errs, err)
+		}
+
+		require.Len(t, errs, 2)
+		require.NoError(t, errs[0])
+		require.ErrorContains(t, errs[1], "failed to read rows: canceled")
+	})
+}
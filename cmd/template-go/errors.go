@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// RequestError is a client error carrying the HTTP status to respond with.
+type RequestError struct {
+	Status int
+	Detail string
+	Err    error
+}
+
+func (e *RequestError) Error() string {
+	if e.Err != nil {
+		return e.Detail + ": " + e.Err.Error()
+	}
+	return e.Detail
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// statusClientClosedRequest is the nginx convention for a request that
+// the client abandoned before the response.
+const statusClientClosedRequest = 499
+
+// classifyError maps an error to the problem returned to clients.
+// Details of server errors are not exposed.
+func classifyError(err error) problem {
+	var (
+		reqErr *RequestError
+		valErr *ValidationError
+	)
+
+	switch {
+	case errors.As(err, &valErr):
+		return problem{
+			Status: http.StatusUnprocessableEntity,
+			Detail: "request validation failed",
+			Errors: valErr.Fields,
+		}
+	case errors.As(err, &reqErr):
+		return problem{Status: reqErr.Status, Detail: reqErr.Detail}
+	case errors.Is(err, pgx.ErrNoRows):
+		return problem{Status: http.StatusNotFound, Detail: "resource not found"}
+	case errors.Is(err, context.DeadlineExceeded):
+		return problem{Status: http.StatusGatewayTimeout, Detail: "request timed out"}
+	case errors.Is(err, context.Canceled):
+		return problem{Status: statusClientClosedRequest, Title: "Client Closed Request"}
+	default:
+		return problem{Status: http.StatusInternalServerError}
+	}
+}
+
+// respondErr classifies err, logs server errors and writes a problem response.
+func respondErr(w http.ResponseWriter, r *http.Request, err error) {
+	p := classifyError(err)
+	if p.Status >= 500 {
+		slog.ErrorContext(r.Context(), "request failed", "error", err, "url", r.URL.RequestURI())
+	}
+	writeProblem(w, p)
+}
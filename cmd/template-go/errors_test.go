@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestError(t *testing.T) {
+	err := &RequestError{Status: http.StatusBadRequest, Detail: "invalid request body", Err: assert.AnError}
+
+	assert.Equal(t, "invalid request body: "+assert.AnError.Error(), err.Error())
+	require.ErrorIs(t, err, assert.AnError)
+	assert.Equal(t, "bad", (&RequestError{Detail: "bad"}).Error())
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantDetail string
+	}{
+		{"request error", &RequestError{Status: http.StatusConflict, Detail: "already exists"}, http.StatusConflict, "already exists"},
+		{"wrapped request error", fmt.Errorf("create: %w", &RequestError{Status: http.StatusForbidden, Detail: "denied"}), http.StatusForbidden, "denied"},
+		{"validation error", &ValidationError{Fields: []FieldError{{Pointer: "/name", Detail: "is required"}}}, http.StatusUnprocessableEntity, "request validation failed"},
+		{"no rows", fmt.Errorf("get user: %w", pgx.ErrNoRows), http.StatusNotFound, "resource not found"},
+		{"deadline", fmt.Errorf("query: %w", context.DeadlineExceeded), http.StatusGatewayTimeout, "request timed out"},
+		{"canceled by the client", fmt.Errorf("query: %w", context.Canceled), statusClientClosedRequest, ""},
+		{"unknown error hides detail", assert.AnError, http.StatusInternalServerError, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := classifyError(tt.err)
+
+			assert.Equal(t, tt.wantStatus, p.Status)
+			assert.Equal(t, tt.wantDetail, p.Detail)
+		})
+	}
+}
+
+func TestRespondErr(t *testing.T) {
+	t.Run("logs and hides server errors", func(t *testing.T) {
+		buf := captureLog(t, nil)
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		respondErr(rec, req, assert.AnError)
+
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.NotContains(t, rec.Body.String(), assert.AnError.Error())
+		assert.Contains(t, buf.String(), "request failed")
+		assert.Contains(t, buf.String(), assert.AnError.Error())
+	})
+
+	t.Run("does not log canceled requests", func(t *testing.T) {
+		buf := captureLog(t, nil)
+
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+		req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/test", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		respondErr(rec, req, fmt.Errorf("query: %w", ctx.Err()))
+
+		assert.Equal(t, statusClientClosedRequest, rec.Code)
+		assert.Empty(t, buf.String())
+	})
+
+	t.Run("does not log client errors", func(t *testing.T) {
+		buf := captureLog(t, nil)
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		respondErr(rec, req, &ValidationError{Fields: []FieldError{{Parameter: "limit", Detail: "must be an integer"}}})
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		assert.Empty(t, buf.String())
+
+		var body problem
+		require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+		assert.Equal(t, []FieldError{{Parameter: "limit", Detail: "must be an integer"}}, body.Errors)
+	})
+}
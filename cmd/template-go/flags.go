@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// FlagsOptions configures Flags.
+type FlagsOptions struct {
+	// File holds the flag definitions as a JSON array; empty reads them
+	// from the feature_flags table.
+	File string
+	// ReloadInterval is how often definitions are re-read. Changes to the
+	// tables are also picked up at once through notifications.
+	ReloadInterval time.Duration
+}
+
+const defaultFlagsReloadInterval = 30 * time.Second
+
+// flagsChannel is notified by triggers on the feature flag tables.
+const flagsChannel = "feature_flags"
+
+// Flag defines a feature flag. A disabled flag is off. An enabled flag
+// without rules is on; with rules, the first rule matching the subject
+// decides, and the flag is off for subjects no rule matches.
+type Flag struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Enabled     bool       `json:"enabled"`
+	Rules       []FlagRule `json:"rules,omitempty"`
+}
+
+// FlagRule turns a flag on for a share of the subjects having an
+// attribute. Subjects are bucketed by a hash of the flag name and the
+// attribute value, so that each keeps its outcome as the share grows.
+type FlagRule struct {
+	// Attribute is hashed to bucket subjects; subjects without it do not
+	// match. Requests have "principal", a hash of their credentials,
+	// "ip", and "header:<name>" and "query:<name>".
+	Attribute string `json:"attribute"`
+	// Values restrict the rule to subjects whose attribute is one of them.
+	Values []string `json:"values,omitempty"`
+	// Percentage of the matching subjects the flag is on for, from 0 to
+	// 100; all of them when unset.
+	Percentage *float64 `json:"percentage,omitempty"`
+}
+
+// FlagAttributes returns the value of the named attribute of the subject
+// a flag is evaluated for, or "" when it has none.
+type FlagAttributes func(name string) string
+
+// FlagSource loads flag definitions.
+type FlagSource interface {
+	LoadFlags(ctx context.Context) ([]Flag, error)
+}
+
+// fileFlagSource reads definitions from a JSON file.
+type fileFlagSource struct {
+	path string
+}
+
+func (s fileFlagSource) LoadFlags(context.Context) ([]Flag, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feature flags: %w", err)
+	}
+	var flags []Flag
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&flags); err != nil {
+		return nil, fmt.Errorf("failed to decode feature flags from %s: %w", s.path, err)
+	}
+	return flags, nil
+}
+
+// pgFlagSource reads definitions from the feature_flags table.
+type pgFlagSource struct {
+	db Querier
+}
+
+func (s pgFlagSource) LoadFlags(ctx context.Context) ([]Flag, error) {
+	rows, err := s.db.Query(ctx, "SELECT name, description, enabled, rules FROM feature_flags ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query feature flags: %w", err)
+	}
+	defer rows.Close()
+
+	var flags []Flag
+	for rows.Next() {
+		var (
+			flag  Flag
+			rules []byte
+		)
+		if err := rows.Scan(&flag.Name, &flag.Description, &flag.Enabled, &rules); err != nil {
+			return nil, fmt.Errorf("failed to scan feature flag: %w", err)
+		}
+		if err := json.Unmarshal(rules, &flag.Rules); err != nil {
+			return nil, fmt.Errorf("failed to decode rules of feature flag %s: %w", flag.Name, err)
+		}
+		flags = append(flags, flag)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query feature flags: %w", err)
+	}
+	return flags, nil
+}
+
+// Flags evaluates feature flags loaded from a FlagSource, with overrides
+// from the feature_flag_overrides table. Until the first load, every
+// flag is off.
+type Flags struct {
+	source FlagSource
+	db     Querier
+	opts   FlagsOptions
+	set    atomic.Pointer[flagSet]
+	wake   chan struct{}
+}
+
+// flagSet is a loaded set of definitions and overrides.
+type flagSet struct {
+	flags     map[string]Flag
+	overrides map[string]bool
+}
+
+// NewFlags returns Flags reading definitions from opts.File, or from the
+// feature_flags table of db without one.
+func NewFlags(db Querier, opts FlagsOptions) *Flags {
+	var source FlagSource = pgFlagSource{db: db}
+	if opts.File != "" {
+		source = fileFlagSource{path: opts.File}
+	}
+	return newFlags(source, db, opts)
+}
+
+func newFlags(source FlagSource, db Querier, opts FlagsOptions) *Flags {
+	if opts.ReloadInterval <= 0 {
+		opts.ReloadInterval = defaultFlagsReloadInterval
+	}
+	return &Flags{source: source, db: db, opts: opts, wake: make(chan struct{}, 1)}
+}
+
+// Reload loads definitions and overrides. Invalid definitions are
+// rejected as a whole, keeping the flags loaded before.
+func (f *Flags) Reload(ctx context.Context) error {
+	set, err := f.load(ctx)
+	if err != nil {
+		flagStats.Add("reload_errors", 1)
+		return err
+	}
+	f.set.Store(set)
+	flagStats.Add("reloads", 1)
+	return nil
+}
+
+func (f *Flags) load(ctx context.Context) (*flagSet, error) {
+	defs, err := f.source.LoadFlags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	set := &flagSet{flags: make(map[string]Flag, len(defs)), overrides: map[string]bool{}}
+	for _, flag := range defs {
+		if err := validateFlag(flag); err != nil {
+			return nil, err
+		}
+		if _, ok := set.flags[flag.Name]; ok {
+			return nil, fmt.Errorf("duplicate feature flag %s", flag.Name)
+		}
+		set.flags[flag.Name] = flag
+	}
+
+	rows, err := f.db.Query(ctx, "SELECT name, enabled FROM feature_flag_overrides")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query feature flag overrides: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name    string
+			enabled bool
+		)
+		if err := rows.Scan(&name, &enabled); err != nil {
+			return nil, fmt.Errorf("failed to scan feature flag override: %w", err)
+		}
+		set.overrides[name] = enabled
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query feature flag overrides: %w", err)
+	}
+	return set, nil
+}
+
+func validateFlag(flag Flag) error {
+	if flag.Name == "" {
+		return errors.New("feature flag without a name")
+	}
+	for _, rule := range flag.Rules {
+		if rule.Attribute == "" {
+			return fmt.Errorf("feature flag %s has a rule without an attribute", flag.Name)
+		}
+		if p := rule.Percentage; p != nil && (*p < 0 || *p > 100) {
+			return fmt.Errorf("feature flag %s has a percentage outside 0 to 100", flag.Name)
+		}
+	}
+	return nil
+}
+
+// Run reloads the flags at once, then on every interval or wake-up,
+// until ctx is canceled.
+func (f *Flags) Run(ctx context.Context) {
+	for {
+		if err := f.Reload(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("Failed to reload feature flags", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-f.wake:
+		case <-time.After(f.opts.ReloadInterval):
+		}
+	}
+}
+
+// Wake makes Run reload the flags at once.
+func (f *Flags) Wake() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wakeOnNotify returns a handler for flagsChannel waking Run.
+func (f *Flags) wakeOnNotify() NotifyHandler {
+	return func(context.Context, *pgconn.Notification) error {
+		f.Wake()
+		return nil
+	}
+}
+
+// Enabled reports whether the flag name is on for the subject described
+// by attrs, which may be nil. An override decides for every subject.
+// Unknown flags are off.
+func (f *Flags) Enabled(name string, attrs FlagAttributes) bool {
+	set := f.set.Load()
+	if set == nil {
+		return false
+	}
+	flag, ok := set.flags[name]
+	if !ok {
+		return false
+	}
+	if on, ok := set.overrides[name]; ok {
+		return on
+	}
+	return flag.evaluate(attrs)
+}
+
+func (flag Flag) evaluate(attrs FlagAttributes) bool {
+	if !flag.Enabled {
+		return false
+	}
+	if len(flag.Rules) == 0 {
+		return true
+	}
+	if attrs == nil {
+		return false
+	}
+	for _, rule := range flag.Rules {
+		value := attrs(rule.Attribute)
+		if value == "" || (len(rule.Values) > 0 && !slices.Contains(rule.Values, value)) {
+			continue
+		}
+		return rule.Percentage == nil || flagBucket(flag.Name, value) < *rule.Percentage
+	}
+	return false
+}
+
+// flagBucket hashes value into [0, 100) in steps of 0.01, independently
+// per flag, so that rollouts of different flags reach different subjects.
+func flagBucket(flag, value string) float64 {
+	sum := sha256.Sum256([]byte(flag + "\x00" + value))
+	return float64(binary.BigEndian.Uint64(sum[:8])%10000) / 100
+}
+
+// Override turns the flag name on or off for every subject on every
+// instance, until the override is cleared. It is written outside of any
+// transaction in ctx and applied to the loaded flags at once, while other
+// instances reload on the notification from the table's trigger.
+func (f *Flags) Override(ctx context.Context, name string, enabled bool) error {
+	_, err := f.db.Exec(ctx, `INSERT INTO feature_flag_overrides (name, enabled) VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET enabled = excluded.enabled, updated_at = now()`, name, enabled)
+	if err != nil {
+		return fmt.Errorf("failed to override feature flag %s: %w", name, err)
+	}
+	f.setOverride(name, &enabled)
+	return nil
+}
+
+// ClearOverride makes the flag name follow its definition again.
+func (f *Flags) ClearOverride(ctx context.Context, name string) error {
+	if _, err := f.db.Exec(ctx, "DELETE FROM feature_flag_overrides WHERE name = $1", name); err != nil {
+		return fmt.Errorf("failed to clear override of feature flag %s: %w", name, err)
+	}
+	f.setOverride(name, nil)
+	return nil
+}
+
+// setOverride replaces the loaded set with a copy overriding name, or
+// without its override when enabled is nil.
+func (f *Flags) setOverride(name string, enabled *bool) {
+	for {
+		loaded := f.set.Load()
+		if loaded == nil {
+			return
+		}
+		set := &flagSet{flags: loaded.flags, overrides: maps.Clone(loaded.overrides)}
+		if enabled != nil {
+			set.overrides[name] = *enabled
+		} else {
+			delete(set.overrides, name)
+		}
+		if f.set.CompareAndSwap(loaded, set) {
+			return
+		}
+	}
+}
+
+// FlagStatus describes a loaded flag and its override.
+type FlagStatus struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Enabled     bool       `json:"enabled"`
+	Rules       []FlagRule `json:"rules,omitempty"`
+	Override    *bool      `json:"override,omitempty"`
+}
+
+// FlagReport lists the loaded flags.
+type FlagReport struct {
+	Flags []FlagStatus `json:"flags"`
+}
+
+// Report returns the loaded flags sorted by name.
+func (f *Flags) Report() *FlagReport {
+	report := &FlagReport{Flags: []FlagStatus{}}
+	set := f.set.Load()
+	if set == nil {
+		return report
+	}
+	for _, flag := range set.flags {
+		report.Flags = append(report.Flags, set.status(flag))
+	}
+	slices.SortFunc(report.Flags, func(a, b FlagStatus) int { return strings.Compare(a.Name, b.Name) })
+	return report
+}
+
+// Status returns the loaded flag name, reporting false when unknown.
+func (f *Flags) Status(name string) (FlagStatus, bool) {
+	set := f.set.Load()
+	if set == nil {
+		return FlagStatus{}, false
+	}
+	flag, ok := set.flags[name]
+	if !ok {
+		return FlagStatus{}, false
+	}
+	return set.status(flag), true
+}
+
+func (s *flagSet) status(flag Flag) FlagStatus {
+	status := FlagStatus{Name: flag.Name, Description: flag.Description, Enabled: flag.Enabled, Rules: flag.Rules}
+	if on, ok := s.overrides[flag.Name]; ok {
+		status.Override = &on
+	}
+	return status
+}
+
+type flagsKey struct{}
+
+// requestFlags evaluates flags for the client of a request.
+type requestFlags struct {
+	flags *Flags
+	attrs FlagAttributes
+}
+
+// WithFlags returns middleware making flags readable from the request
+// context with FlagEnabled, evaluated for the client of the request.
+func WithFlags(flags *Flags) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rf := &requestFlags{flags: flags, attrs: requestFlagAttributes(r)}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), flagsKey{}, rf)))
+		})
+	}
+}
+
+// FlagEnabled reports whether the flag name is on for the request of ctx.
+// It is false outside WithFlags.
+func FlagEnabled(ctx context.Context, name string) bool {
+	rf, ok := ctx.Value(flagsKey{}).(*requestFlags)
+	if !ok {
+		return false
+	}
+	return rf.flags.Enabled(name, rf.attrs)
+}
+
+// RequireFlag returns middleware answering 404 while the flag name is off
+// for the request, to dark-launch a route. It requires WithFlags.
+func RequireFlag(name string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !FlagEnabled(r.Context(), name) {
+				respondProblem(w, http.StatusNotFound, "")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requestFlagAttributes describes the client of r, see FlagRule.
+func requestFlagAttributes(r *http.Request) FlagAttributes {
+	return func(name string) string {
+		if header, ok := strings.CutPrefix(name, "header:"); ok {
+			return r.Header.Get(header)
+		}
+		if param, ok := strings.CutPrefix(name, "query:"); ok {
+			return r.URL.Query().Get(param)
+		}
+		switch name {
+		case "principal":
+			if r.Header.Get("Authorization") == "" {
+				return ""
+			}
+			return credentialsHash(r)
+		case "ip":
+			return requestClient(r).IP
+		}
+		return ""
+	}
+}
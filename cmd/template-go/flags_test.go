@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticFlags is a FlagSource serving fixed definitions.
+type staticFlags struct {
+	flags []Flag
+	err   error
+}
+
+func (s *staticFlags) LoadFlags(context.Context) ([]Flag, error) {
+	return s.flags, s.err
+}
+
+func percentage(p float64) *float64 { return &p }
+
+// attributes describes a subject with fixed attributes.
+func attributes(values map[string]string) FlagAttributes {
+	return func(name string) string { return values[name] }
+}
+
+// loadedFlags returns Flags loaded from flags, with overrides served as
+// rows of db.
+func loadedFlags(t *testing.T, db Querier, flags ...Flag) *Flags {
+	t.Helper()
+	f := newFlags(&staticFlags{flags: flags}, db, FlagsOptions{})
+	require.NoError(t, f.Reload(t.Context()))
+	return f
+}
+
+func TestFlagsEnabled(t *testing.T) {
+	f := loadedFlags(t, &recordingQuerier{},
+		Flag{Name: "off"},
+		Flag{Name: "on", Enabled: true},
+		Flag{Name: "tenants", Enabled: true, Rules: []FlagRule{
+			{Attribute: "header:X-Tenant", Values: []string{"acme", "globex"}},
+		}},
+		Flag{Name: "nobody", Enabled: true, Rules: []FlagRule{{Attribute: "principal", Percentage: percentage(0)}}},
+		Flag{Name: "ordered", Enabled: true, Rules: []FlagRule{
+			{Attribute: "header:X-Tenant", Values: []string{"acme"}, Percentage: percentage(0)},
+			{Attribute: "principal"},
+		}},
+	)
+
+	tests := []struct {
+		name  string
+		flag  string
+		attrs map[string]string
+		want  bool
+	}{
+		{name: "disabled", flag: "off", want: false},
+		{name: "enabled without rules", flag: "on", want: true},
+		{name: "unknown", flag: "missing", want: false},
+		{name: "matching value", flag: "tenants", attrs: map[string]string{"header:X-Tenant": "globex"}, want: true},
+		{name: "other value", flag: "tenants", attrs: map[string]string{"header:X-Tenant": "initech"}, want: false},
+		{name: "missing attribute", flag: "tenants", want: false},
+		{name: "zero percent", flag: "nobody", attrs: map[string]string{"principal": "alice"}, want: false},
+		{name: "first matching rule decides", flag: "ordered", attrs: map[string]string{"header:X-Tenant": "acme", "principal": "alice"}, want: false},
+		{name: "later rule", flag: "ordered", attrs: map[string]string{"header:X-Tenant": "initech", "principal": "alice"}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, f.Enabled(tt.flag, attributes(tt.attrs)))
+		})
+	}
+
+	assert.False(t, f.Enabled("tenants", nil), "rules need attributes")
+	assert.False(t, newFlags(&staticFlags{}, &recordingQuerier{}, FlagsOptions{}).Enabled("on", nil), "flags are off until loaded")
+}
+
+func TestFlagsRollout(t *testing.T) {
+	rollout := func(p float64) *Flags {
+		return loadedFlags(t, &recordingQuerier{}, Flag{Name: "beta", Enabled: true, Rules: []FlagRule{
+			{Attribute: "principal", Percentage: percentage(p)},
+		}})
+	}
+	quarter, half := rollout(25), rollout(50)
+
+	on := 0
+	for i := range 10000 {
+		subject := attributes(map[string]string{"principal": fmt.Sprint("user-", i)})
+		if quarter.Enabled("beta", subject) {
+			on++
+			assert.True(t, half.Enabled("beta", subject), "subjects keep the flag as the rollout grows")
+		}
+	}
+	assert.InDelta(t, 2500, on, 200)
+
+	other := loadedFlags(t, &recordingQuerier{}, Flag{Name: "gamma", Enabled: true, Rules: []FlagRule{
+		{Attribute: "principal", Percentage: percentage(25)},
+	}})
+	both := 0
+	for i := range 10000 {
+		subject := attributes(map[string]string{"principal": fmt.Sprint("user-", i)})
+		if quarter.Enabled("beta", subject) && other.Enabled("gamma", subject) {
+			both++
+		}
+	}
+	assert.InDelta(t, 625, both, 150, "rollouts of different flags are independent")
+}
+
+func TestFlagsReload(t *testing.T) {
+	t.Run("applies overrides", func(t *testing.T) {
+		db := &recordingQuerier{Rows: [][]any{{"on", false}, {"off", true}}}
+		f := loadedFlags(t, db, Flag{Name: "on", Enabled: true}, Flag{Name: "off"})
+
+		assert.False(t, f.Enabled("on", nil))
+		assert.True(t, f.Enabled("off", nil))
+		status, ok := f.Status("off")
+		require.True(t, ok)
+		assert.Equal(t, new(true), status.Override)
+	})
+
+	t.Run("keeps the loaded flags on errors", func(t *testing.T) {
+		source := &staticFlags{flags: []Flag{{Name: "on", Enabled: true}}}
+		f := newFlags(source, &recordingQuerier{}, FlagsOptions{})
+		require.NoError(t, f.Reload(t.Context()))
+
+		tests := []struct {
+			name  string
+			flags []Flag
+			err   error
+		}{
+			{name: "source error", err: errors.New("unavailable")},
+			{name: "duplicate", flags: []Flag{{Name: "a"}, {Name: "a"}}},
+			{name: "without name", flags: []Flag{{Enabled: true}}},
+			{name: "rule without attribute", flags: []Flag{{Name: "a", Rules: []FlagRule{{}}}}},
+			{name: "percentage out of range", flags: []Flag{{Name: "a", Rules: []FlagRule{{Attribute: "ip", Percentage: percentage(150)}}}}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				before := expvarMapInt(t, flagStats, "reload_errors")
+				source.flags, source.err = tt.flags, tt.err
+				require.Error(t, f.Reload(t.Context()))
+				assert.True(t, f.Enabled("on", nil))
+				assert.Equal(t, before+1, expvarMapInt(t, flagStats, "reload_errors"))
+			})
+		}
+	})
+
+	t.Run("reloads when woken", func(t *testing.T) {
+		source := &staticFlags{}
+		f := newFlags(source, &recordingQuerier{}, FlagsOptions{ReloadInterval: time.Hour})
+		ctx, cancel := context.WithCancel(t.Context())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			f.Run(ctx)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+
+		require.Eventually(t, func() bool { return f.set.Load() != nil }, time.Second, time.Millisecond)
+		source.flags = []Flag{{Name: "on", Enabled: true}}
+		require.NoError(t, f.wakeOnNotify()(t.Context(), nil))
+		require.Eventually(t, func() bool { return f.Enabled("on", nil) }, time.Second, time.Millisecond)
+	})
+}
+
+func TestFileFlagSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "flags.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "beta", "enabled": true, "rules": [{"attribute": "principal", "percentage": 10}]}
+	]`), 0o600))
+
+	flags, err := fileFlagSource{path: path}.LoadFlags(t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []Flag{{Name: "beta", Enabled: true, Rules: []FlagRule{{Attribute: "principal", Percentage: percentage(10)}}}}, flags)
+
+	require.NoError(t, os.WriteFile(path, []byte(`[{"name": "beta", "enable": true}]`), 0o600))
+	_, err = fileFlagSource{path: path}.LoadFlags(t.Context())
+	require.Error(t, err, "misspelled fields are rejected")
+
+	_, err = fileFlagSource{path: filepath.Join(t.TempDir(), "missing.json")}.LoadFlags(t.Context())
+	require.Error(t, err)
+}
+
+func TestWithFlags(t *testing.T) {
+	rule := func(attribute, value string) Flag {
+		return Flag{Name: attribute, Enabled: true, Rules: []FlagRule{{Attribute: attribute, Values: []string{value}}}}
+	}
+	f := loadedFlags(t, &recordingQuerier{},
+		rule("header:X-Tenant", "acme"),
+		rule("query:preview", "1"),
+		rule("ip", "198.51.100.7"),
+		rule("principal", credentialsHash(&http.Request{Header: http.Header{"Authorization": {"Bearer alice"}}})),
+		Flag{Name: "dark-route"},
+	)
+
+	var enabled map[string]bool
+	h := WithFlags(f)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		enabled = map[string]bool{}
+		for _, name := range []string{"header:X-Tenant", "query:preview", "ip", "principal"} {
+			enabled[name] = FlagEnabled(r.Context(), name)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/?preview=1", http.NoBody)
+	req.RemoteAddr = "198.51.100.7:1234"
+	req.Header.Set("X-Tenant", "acme")
+	req.Header.Set("Authorization", "Bearer alice")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, map[string]bool{"header:X-Tenant": true, "query:preview": true, "ip": true, "principal": true}, enabled)
+
+	req = httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody)
+	req.Header.Set("Authorization", "Bearer bob")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, map[string]bool{"header:X-Tenant": false, "query:preview": false, "ip": false, "principal": false}, enabled)
+
+	assert.False(t, FlagEnabled(t.Context(), "header:X-Tenant"), "flags are off outside WithFlags")
+
+	t.Run("require flag", func(t *testing.T) {
+		route := WithFlags(f)(RequireFlag("dark-route")(h))
+		rec := httptest.NewRecorder()
+		route.ServeHTTP(rec, httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody))
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+
+		route = WithFlags(f)(RequireFlag("header:X-Tenant")(h))
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/", http.NoBody)
+		req.Header.Set("X-Tenant", "acme")
+		rec = httptest.NewRecorder()
+		route.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+	})
+}
+
+func TestFlagAdmin(t *testing.T) {
+	db := &recordingQuerier{Tag: "INSERT 0 1"}
+	app := &App{Flags: loadedFlags(t, db, Flag{Name: "beta", Description: "New checkout"}, Flag{Name: "alpha"})}
+
+	report, err := app.featureFlags(t.Context(), struct{}{})
+	require.NoError(t, err)
+	assert.Equal(t, []FlagStatus{{Name: "alpha"}, {Name: "beta", Description: "New checkout"}}, report.Flags)
+
+	// The override is saved at once, not in the caller's transaction.
+	var txq recordingQuerier
+	txCtx := context.WithValue(t.Context(), txKey{}, &fakeTx{q: &txq, log: new([]string)})
+	status, err := app.overrideFlag(txCtx, flagOverride{Name: "beta", Enabled: new(true)})
+	require.NoError(t, err)
+	assert.Equal(t, &FlagStatus{Name: "beta", Description: "New checkout", Override: new(true)}, status)
+	assert.True(t, app.Flags.Enabled("beta", nil))
+
+	_, err = app.overrideFlag(t.Context(), flagOverride{Name: "missing", Enabled: new(true)})
+	var reqErr *RequestError
+	require.ErrorAs(t, err, &reqErr)
+	assert.Equal(t, http.StatusNotFound, reqErr.Status)
+
+	_, err = app.clearFlagOverride(t.Context(), flagName{Name: "beta"})
+	require.NoError(t, err)
+	assert.False(t, app.Flags.Enabled("beta", nil))
+
+	var execs []querierCall
+	for _, call := range db.Calls() {
+		if call.Method == "Exec" {
+			execs = append(execs, querierCall{Method: call.Method, Args: call.Args})
+		}
+	}
+	assert.Equal(t, []querierCall{
+		{Method: "Exec", Args: []any{"beta", true}},
+		{Method: "Exec", Args: []any{"beta"}},
+	}, execs)
+	assert.Empty(t, txq.Calls())
+}
+
+func TestFlagsIntegration(t *testing.T) {
+	skipIfNoTestcontainers(t)
+
+	name := t.Name()
+	t.Cleanup(func() {
+		_, _ = testPool.Exec(context.Background(), "DELETE FROM feature_flags WHERE name = $1", name)
+		_, _ = testPool.Exec(context.Background(), "DELETE FROM feature_flag_overrides WHERE name = $1", name)
+	})
+	_, err := testPool.Exec(t.Context(), `INSERT INTO feature_flags (name, enabled, rules) VALUES ($1, true, $2)`,
+		name, `[{"attribute": "header:X-Tenant", "values": ["acme"]}]`)
+	require.NoError(t, err)
+
+	f := NewFlags(testPool, FlagsOptions{})
+	require.NoError(t, f.Reload(t.Context()))
+	acme := attributes(map[string]string{"header:X-Tenant": "acme"})
+	assert.True(t, f.Enabled(name, acme))
+	assert.False(t, f.Enabled(name, nil))
+
+	require.NoError(t, f.Override(t.Context(), name, false))
+	assert.False(t, f.Enabled(name, acme))
+	require.NoError(t, f.ClearOverride(t.Context(), name))
+	assert.True(t, f.Enabled(name, acme))
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// StatusCoder lets a typed handler response choose its HTTP status.
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// NoContent is a typed handler response sent as 204 without a body.
+type NoContent struct{}
+
+// StatusCode implements StatusCoder.
+func (NoContent) StatusCode() int { return http.StatusNoContent }
+
+// Handle adapts a typed function to an http.Handler.
+//
+// Req is decoded from the JSON body, then fields tagged `path:"name"` or
+// `query:"name"` are set from the route pattern and query string; such
+// fields should also be tagged `json:"-"`. The decoded request is validated,
+// the response is encoded according to the Accept header and errors are
+// mapped by classifyError. It panics when a parameter field has a type
+// that cannot be bound, so that routes fail at startup.
+func Handle[Req, Resp any](fn func(ctx context.Context, req Req) (Resp, error)) http.Handler {
+	checkParams(reflect.TypeFor[Req]())
+	return typedHandler[Req, Resp](func(w http.ResponseWriter, r *http.Request) {
+		req, err := bindRequest[Req](w, r)
+		if err != nil {
+			respondErr(w, r, err)
+			return
+		}
+
+		resp, err := fn(r.Context(), req)
+		if err != nil {
+			respondErr(w, r, err)
+			return
+		}
+
+		status := http.StatusOK
+		if sc, ok := any(resp).(StatusCoder); ok {
+			status = sc.StatusCode()
+		}
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+		respond(w, r, status, resp)
+	})
+}
+
+// typedHandler is returned by Handle so the Router can document its types.
+type typedHandler[Req, Resp any] http.HandlerFunc
+
+func (h typedHandler[Req, Resp]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h(w, r)
+}
+
+func (typedHandler[Req, Resp]) routeTypes() (req, resp reflect.Type) {
+	return reflect.TypeFor[Req](), reflect.TypeFor[Resp]()
+}
+
+// bindRequest decodes and validates Req from the request.
+func bindRequest[Req any](w http.ResponseWriter, r *http.Request) (Req, error) {
+	var req Req
+
+	if r.Body != nil && r.Body != http.NoBody && r.ContentLength != 0 {
+		if err := readJSON(w, r, &req); err != nil {
+			return req, err
+		}
+	}
+	if err := bindParams(r, &req); err != nil {
+		return req, err
+	}
+	if err := validate(req); err != nil {
+		return req, err
+	}
+	return req, nil
+}
+
+// bindParams sets path and query tagged fields of the struct pointed to by dst.
+func bindParams(r *http.Request, dst any) error {
+	rv := reflect.ValueOf(dst).Elem()
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var fields []FieldError
+	query := r.URL.Query()
+	t := rv.Type()
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+
+		var (
+			name   string
+			values []string
+		)
+		if name = sf.Tag.Get("path"); name != "" {
+			if v := r.PathValue(name); v != "" {
+				values = []string{v}
+			}
+		} else if name = sf.Tag.Get("query"); name != "" {
+			values = query[name]
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		if err := setParam(rv.Field(i), values); err != nil {
+			fields = append(fields, FieldError{Parameter: name, Detail: err.Error()})
+		}
+	}
+
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+// checkParams panics unless every path and query tagged field of t can be
+// set by setParam.
+func checkParams(t reflect.Type) {
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() || (sf.Tag.Get("path") == "" && sf.Tag.Get("query") == "") {
+			continue
+		}
+		if !isParamType(sf.Type) {
+			panic(fmt.Sprintf("Handle: parameter %s.%s has unsupported type %s", t, sf.Name, sf.Type))
+		}
+	}
+}
+
+// isParamType reports whether setParam can convert strings into t.
+func isParamType(t reflect.Type) bool {
+	if t.Kind() == reflect.Pointer {
+		return isParamType(t.Elem())
+	}
+	if reflect.PointerTo(t).Implements(textUnmarshalerType) || t == durationType {
+		return true
+	}
+	switch t.Kind() { //nolint:exhaustive // other kinds are unsupported
+	case reflect.Slice:
+		return t.Elem().Kind() != reflect.Uint8 && isParamType(t.Elem())
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	default:
+		return false
+	}
+}
+
+var (
+	durationType        = reflect.TypeFor[time.Duration]()
+	textUnmarshalerType = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// setParam converts string parameter values into the field type.
+func setParam(fv reflect.Value, values []string) error {
+	if fv.Kind() == reflect.Pointer {
+		elem := reflect.New(fv.Type().Elem())
+		if err := setParam(elem.Elem(), values); err != nil {
+			return err
+		}
+		fv.Set(elem)
+		return nil
+	}
+
+	if fv.Addr().Type().Implements(textUnmarshalerType) {
+		u, _ := fv.Addr().Interface().(encoding.TextUnmarshaler)
+		if err := u.UnmarshalText([]byte(values[0])); err != nil {
+			return fmt.Errorf("must be a valid %s", fv.Type().Name())
+		}
+		return nil
+	}
+
+	if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() != reflect.Uint8 {
+		slice := reflect.MakeSlice(fv.Type(), len(values), len(values))
+		for i, v := range values {
+			if err := setParam(slice.Index(i), []string{v}); err != nil {
+				return err
+			}
+		}
+		fv.Set(slice)
+		return nil
+	}
+
+	return setScalar(fv, values[0])
+}
+
+func setScalar(fv reflect.Value, value string) error {
+	if fv.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.New("must be a duration")
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+
+	switch fv.Kind() { //nolint:exhaustive // other kinds are rejected by checkParams
+	case reflect.String:
+		fv.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("must be a boolean")
+		}
+		fv.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, fv.Type().Bits())
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		fv.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, fv.Type().Bits())
+		if err != nil {
+			return errors.New("must be a non-negative integer")
+		}
+		fv.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, fv.Type().Bits())
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		fv.SetFloat(f)
+	default:
+		panic("bindParams: unsupported parameter kind " + fv.Kind().String() + " passed checkParams")
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testGetItem struct {
+	ID      int64          `json:"-" path:"id" validate:"required,min=1"`
+	Fields  []string       `json:"-" query:"fields"`
+	Limit   *int           `json:"-" query:"limit" validate:"max=100"`
+	Verbose bool           `json:"-" query:"verbose"`
+	Timeout time.Duration  `json:"-" query:"timeout"`
+	Ratio   float64        `json:"-" query:"ratio"`
+	Count   uint8          `json:"-" query:"count"`
+	Addr    netip.Addr     `json:"-" query:"addr"`
+	Note    string         `json:"note,omitempty" validate:"max=10"`
+	Extra   map[string]int `json:"extra,omitempty"`
+}
+
+type testItem struct {
+	ID     int64    `json:"id"`
+	Fields []string `json:"fields"`
+	Limit  int      `json:"limit"`
+	Note   string   `json:"note"`
+}
+
+type testCreated struct {
+	ID int64 `json:"id"`
+}
+
+func (testCreated) StatusCode() int { return http.StatusCreated }
+
+func getTestItem(_ context.Context, req testGetItem) (testItem, error) {
+	if req.ID == 404 {
+		return testItem{}, &RequestError{Status: http.StatusNotFound, Detail: "item not found"}
+	}
+	limit := 10
+	if req.Limit != nil {
+		limit = *req.Limit
+	}
+	return testItem{ID: req.ID, Fields: req.Fields, Limit: limit, Note: req.Note}, nil
+}
+
+func serveTyped(t *testing.T, pattern string, h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.Handle(pattern, h)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestGetTestItemWithoutHTTP(t *testing.T) {
+	item, err := getTestItem(t.Context(), testGetItem{ID: 7, Fields: []string{"a"}})
+	require.NoError(t, err)
+	assert.Equal(t, testItem{ID: 7, Fields: []string{"a"}, Limit: 10}, item)
+}
+
+func TestHandle(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		accept     string
+		wantStatus int
+		wantItem   *testItem
+		wantErrors []FieldError
+	}{
+		{
+			name:       "path and query binding",
+			method:     http.MethodGet,
+			target:     "/items/7?fields=a&fields=b&limit=5&verbose=true&timeout=1s&ratio=0.5&count=3&addr=192.0.2.1",
+			wantStatus: http.StatusOK,
+			wantItem:   &testItem{ID: 7, Fields: []string{"a", "b"}, Limit: 5},
+		},
+		{
+			name:       "body binding",
+			method:     http.MethodPost,
+			target:     "/items/7",
+			body:       `{"note":"hello"}`,
+			wantStatus: http.StatusOK,
+			wantItem:   &testItem{ID: 7, Limit: 10, Note: "hello"},
+		},
+		{
+			name:       "invalid parameter types",
+			method:     http.MethodGet,
+			target:     "/items/abc?limit=many&verbose=maybe&timeout=soon&ratio=x&count=300&addr=host",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []FieldError{
+				{Parameter: "id", Detail: "must be an integer"},
+				{Parameter: "limit", Detail: "must be an integer"},
+				{Parameter: "verbose", Detail: "must be a boolean"},
+				{Parameter: "timeout", Detail: "must be a duration"},
+				{Parameter: "ratio", Detail: "must be a number"},
+				{Parameter: "count", Detail: "must be a non-negative integer"},
+				{Parameter: "addr", Detail: "must be a valid Addr"},
+			},
+		},
+		{
+			name:       "parameter validation",
+			method:     http.MethodGet,
+			target:     "/items/0?limit=500",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []FieldError{
+				{Parameter: "id", Detail: "is required"},
+				{Parameter: "limit", Detail: "must be at most 100"},
+			},
+		},
+		{
+			name:       "body validation",
+			method:     http.MethodPost,
+			target:     "/items/7",
+			body:       `{"note":"far too long"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantErrors: []FieldError{{Pointer: "/note", Detail: "must contain at most 10 characters"}},
+		},
+		{
+			name:       "malformed body",
+			method:     http.MethodPost,
+			target:     "/items/7",
+			body:       `{`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "error mapped by classifier",
+			method:     http.MethodGet,
+			target:     "/items/404",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "not acceptable",
+			method:     http.MethodGet,
+			target:     "/items/7",
+			accept:     "text/html",
+			wantStatus: http.StatusNotAcceptable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body *strings.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req := httptest.NewRequestWithContext(t.Context(), tt.method, tt.target, http.NoBody)
+			if body != nil {
+				req = httptest.NewRequestWithContext(t.Context(), tt.method, tt.target, body)
+				req.Header.Set("Content-Type", "application/json")
+			}
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+
+			rec := serveTyped(t, "/items/{id}", Handle(getTestItem), req)
+
+			require.Equal(t, tt.wantStatus, rec.Code, rec.Body.String())
+			if tt.wantItem != nil {
+				assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+				var item testItem
+				require.NoError(t, json.NewDecoder(rec.Body).Decode(&item))
+				assert.Equal(t, *tt.wantItem, item)
+				return
+			}
+
+			assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+			var p problem
+			require.NoError(t, json.NewDecoder(rec.Body).Decode(&p))
+			assert.Equal(t, tt.wantErrors, p.Errors)
+		})
+	}
+}
+
+func TestHandleChecksParamTypes(t *testing.T) {
+	type supported struct {
+		ID      int64          `json:"-" path:"id"`
+		Tags    []string       `json:"-" query:"tag"`
+		Limit   *uint8         `json:"-" query:"limit"`
+		Timeout time.Duration  `json:"-" query:"timeout"`
+		Addr    netip.Addr     `json:"-" query:"addr"`
+		Ratios  []*float64     `json:"-" query:"ratio"`
+		Body    map[string]any `json:"body"`
+	}
+	assert.NotPanics(t, func() {
+		Handle(func(context.Context, supported) (NoContent, error) { return NoContent{}, nil })
+	})
+
+	type unsupported struct {
+		Filter map[string]string `json:"-" query:"filter"`
+	}
+	assert.PanicsWithValue(t, "Handle: parameter main.unsupported.Filter has unsupported type map[string]string", func() {
+		Handle(func(context.Context, unsupported) (NoContent, error) { return NoContent{}, nil })
+	})
+
+	type rawBytes struct {
+		Token []byte `json:"-" path:"token"`
+	}
+	assert.Panics(t, func() {
+		Handle(func(context.Context, rawBytes) (NoContent, error) { return NoContent{}, nil })
+	})
+}
+
+func TestHandleStatusCodes(t *testing.T) {
+	t.Run("custom status", func(t *testing.T) {
+		h := Handle(func(_ context.Context, _ struct{}) (testCreated, error) {
+			return testCreated{ID: 1}, nil
+		})
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/items", http.NoBody)
+		rec := serveTyped(t, "POST /items", h, req)
+
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.JSONEq(t, `{"id":1}`, rec.Body.String())
+	})
+
+	t.Run("no content", func(t *testing.T) {
+		h := Handle(func(_ context.Context, _ struct{}) (NoContent, error) {
+			return NoContent{}, nil
+		})
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodDelete, "/items", http.NoBody)
+		rec := serveTyped(t, "DELETE /items", h, req)
+
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		assert.Empty(t, rec.Body.String())
+	})
+
+	t.Run("unknown body field on empty request", func(t *testing.T) {
+		h := Handle(func(_ context.Context, _ struct{}) (NoContent, error) {
+			return NoContent{}, nil
+		})
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/items", strings.NewReader(`{"x":1}`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := serveTyped(t, "POST /items", h, req)
+
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	})
+}
@@ -1,41 +1,95 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
 	"log/slog"
 	"net/http"
+	"time"
 )
 
-type errorResponse struct {
-	Error string `json:"error"`
+// problem is an RFC 9457 problem details body.
+type problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []FieldError `json:"errors,omitempty"`
 }
 
 // respondJSON writes a JSON response with the given status code.
 func respondJSON(w http.ResponseWriter, status int, data any) {
-	w.Header().Set("Content-Type", "application/json")
+	writeJSON(w, status, "application/json", data)
+}
+
+// respondProblem writes an application/problem+json response.
+func respondProblem(w http.ResponseWriter, status int, detail string) {
+	writeProblem(w, problem{Status: status, Detail: detail})
+}
+
+// writeProblem fills in the problem type and title and writes it.
+func writeProblem(w http.ResponseWriter, p problem) {
+	p.Type = cmp.Or(p.Type, "about:blank")
+	p.Title = cmp.Or(p.Title, http.StatusText(p.Status))
+	writeJSON(w, p.Status, "application/problem+json", p)
+}
+
+func writeJSON(w http.ResponseWriter, status int, contentType string, data any) {
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(status)
 	if err := json.NewEncoder(w).Encode(data); err != nil {
 		slog.Error("failed to encode response", "error", err)
 	}
 }
 
-// respondError writes a JSON error response.
-func respondError(w http.ResponseWriter, status int, message string) {
-	respondJSON(w, status, errorResponse{Error: message})
-}
-
 func handleHealth(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
-// handleDatabaseTest returns database name and version as JSON.
-func (app *App) handleDatabaseTest(w http.ResponseWriter, r *http.Request) {
-	dbInfo, err := getDatabaseInfo(r.Context(), app.DB)
-	if err != nil {
-		slog.Error("failed to get database info", "error", err)
-		respondError(w, http.StatusInternalServerError, err.Error())
-		return
+// testCachePolicy caches the database name and version, which change
+// only with a server upgrade.
+var testCachePolicy = CachePolicy{CacheControl: "public, max-age=60", TTL: time.Minute}
+
+// databaseTest returns database name and version.
+func (app *App) databaseTest(ctx context.Context, _ struct{}) (*DatabaseInfo, error) {
+	return app.Repos.Info.DatabaseInfo(ctx)
+}
+
+// scheduledTasks reports the scheduled tasks and their latest runs.
+func (app *App) scheduledTasks(ctx context.Context, _ struct{}) (*TaskStatusReport, error) {
+	return app.Scheduler.Status(ctx)
+}
+
+// flagOverride turns a feature flag on or off for every client.
+type flagOverride struct {
+	Name    string `json:"-" path:"name"`
+	Enabled *bool  `json:"enabled" validate:"required"`
+}
+
+// flagName selects a feature flag.
+type flagName struct {
+	Name string `json:"-" path:"name"`
+}
+
+// featureFlags lists the feature flags and their overrides.
+func (app *App) featureFlags(_ context.Context, _ struct{}) (*FlagReport, error) {
+	return app.Flags.Report(), nil
+}
+
+// overrideFlag overrides a loaded feature flag on every instance.
+func (app *App) overrideFlag(ctx context.Context, req flagOverride) (*FlagStatus, error) {
+	if _, ok := app.Flags.Status(req.Name); !ok {
+		return nil, &RequestError{Status: http.StatusNotFound, Detail: "unknown feature flag"}
 	}
+	if err := app.Flags.Override(ctx, req.Name, *req.Enabled); err != nil {
+		return nil, err
+	}
+	status, _ := app.Flags.Status(req.Name)
+	return &status, nil
+}
 
-	respondJSON(w, http.StatusOK, dbInfo)
+// clearFlagOverride makes a feature flag follow its definition again.
+func (app *App) clearFlagOverride(ctx context.Context, req flagName) (NoContent, error) {
+	return NoContent{}, app.Flags.ClearOverride(ctx, req.Name)
 }
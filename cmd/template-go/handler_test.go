@@ -8,20 +8,19 @@ import (
 	"net/http/httptest"
 	"testing"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
 func TestHandleDatabaseTest_Success(t *testing.T) {
-	skipIfNoTestcontainers(t)
-
-	app := testApp(t)
+	app := fakeApp(t)
 
 	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
 	require.NoError(t, err)
 
 	rr := httptest.NewRecorder()
-	app.handleDatabaseTest(rr, req)
+	Handle(app.databaseTest).ServeHTTP(rr, req)
 
 	assert.Equal(t, http.StatusOK, rr.Code)
 	assert.Contains(t, rr.Header().Get("Content-Type"), "application/json")
@@ -34,10 +33,20 @@ func TestHandleDatabaseTest_Success(t *testing.T) {
 	assert.Contains(t, response.Version, "PostgreSQL")
 }
 
-func TestHandleDatabaseTest_ViaServer_Success(t *testing.T) {
+func TestDatabaseTest(t *testing.T) {
 	skipIfNoTestcontainers(t)
 
 	app := testApp(t)
+
+	info, err := app.databaseTest(t.Context(), struct{}{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "testdb", info.Database)
+	assert.Contains(t, info.Version, "PostgreSQL")
+}
+
+func TestHandleDatabaseTest_ViaServer_Success(t *testing.T) {
+	app := fakeApp(t)
 	server := app.newServer()
 	ts := httptest.NewServer(server.Handler)
 	defer ts.Close()
@@ -60,9 +69,7 @@ func TestHandleDatabaseTest_ViaServer_Success(t *testing.T) {
 }
 
 func TestHandleDatabaseTestContextCancellation(t *testing.T) {
-	skipIfNoTestcontainers(t)
-
-	app := testApp(t)
+	app := fakeApp(t)
 
 	ctx, cancel := context.WithCancel(t.Context())
 	cancel()
@@ -71,9 +78,35 @@ func TestHandleDatabaseTestContextCancellation(t *testing.T) {
 	require.NoError(t, err)
 
 	rr := httptest.NewRecorder()
-	app.handleDatabaseTest(rr, req)
+	Handle(app.databaseTest).ServeHTTP(rr, req)
+
+	assert.Equal(t, statusClientClosedRequest, rr.Code)
+}
 
-	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+func TestHandleDatabaseTestErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+	}{
+		{"no rows", pgx.ErrNoRows, http.StatusNotFound},
+		{"timeout", context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{"connection failure", errors.New("connection refused"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := fakeApp(t)
+			app.Repos.Info = &memInfoRepository{err: tt.err}
+
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+			rec := httptest.NewRecorder()
+			Handle(app.databaseTest).ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+		})
+	}
 }
 
 func TestHealthEndpoint(t *testing.T) {
@@ -98,9 +131,7 @@ func (ew *errorWriter) Write(_ []byte) (int, error) {
 }
 
 func TestHandleDatabaseTest_JSONEncodeError(t *testing.T) {
-	skipIfNoTestcontainers(t)
-
-	app := testApp(t)
+	app := fakeApp(t)
 
 	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
 	require.NoError(t, err)
@@ -108,5 +139,23 @@ func TestHandleDatabaseTest_JSONEncodeError(t *testing.T) {
 	rec := httptest.NewRecorder()
 	ew := &errorWriter{ResponseWriter: rec}
 
-	app.handleDatabaseTest(ew, req)
+	Handle(app.databaseTest).ServeHTTP(ew, req)
+}
+
+func TestRespondProblem(t *testing.T) {
+	rec := httptest.NewRecorder()
+
+	respondProblem(rec, http.StatusBadRequest, "malformed request path")
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+
+	var body problem
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	assert.Equal(t, problem{
+		Type:   "about:blank",
+		Title:  "Bad Request",
+		Status: http.StatusBadRequest,
+		Detail: "malformed request path",
+	}, body)
 }
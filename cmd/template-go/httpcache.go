@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachePolicy configures Cached for a route.
+type CachePolicy struct {
+	// CacheControl is sent with successful responses, for example
+	// "public, max-age=60".
+	CacheControl string
+	// WeakETag marks ETags weak, for bodies that may differ byte for
+	// byte while meaning the same, such as with unordered fields.
+	WeakETag bool
+	// TTL keeps responses in memory and serves them without running the
+	// handler for that long; zero disables the server-side cache.
+	TTL time.Duration
+	// MaxEntries bounds the server-side cache.
+	MaxEntries int
+}
+
+const defaultCacheMaxEntries = 1000
+
+// cachedResponse is a buffered 200 response with its validators.
+type cachedResponse struct {
+	status   int
+	header   http.Header
+	body     []byte
+	etag     string
+	modified time.Time
+	expires  time.Time
+}
+
+// cacheFlight is a response being produced for requests with the same key.
+type cacheFlight struct {
+	done chan struct{}
+	resp *cachedResponse
+}
+
+// responseCache is the server-side cache of one route.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+	flights map[string]*cacheFlight
+	max     int
+}
+
+// Cached returns middleware for GET and HEAD routes that buffers
+// successful responses to send them with an ETag derived from the body
+// and the policy's Cache-Control, and answers 304 to requests whose
+// If-None-Match or If-Modified-Since show they have it already. With a
+// TTL, responses are also kept in memory per URL and Accept header, and
+// concurrent misses share one run of the handler. Requests with an
+// Authorization header bypass that cache. Handlers must not stream.
+func Cached(policy CachePolicy) func(http.Handler) http.Handler {
+	if policy.MaxEntries <= 0 {
+		policy.MaxEntries = defaultCacheMaxEntries
+	}
+	var cache *responseCache
+	if policy.TTL > 0 {
+		cache = &responseCache{
+			entries: map[string]*cachedResponse{},
+			flights: map[string]*cacheFlight{},
+			max:     policy.MaxEntries,
+		}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			var resp *cachedResponse
+			if cache != nil && r.Header.Get("Authorization") == "" {
+				resp = cache.get(r, next, policy)
+			} else {
+				resp = bufferResponse(r, next, policy)
+			}
+			serveCached(w, r, resp, policy)
+		})
+	}
+}
+
+// get returns the cached response for r, running next on a miss unless
+// another request is already doing so.
+func (c *responseCache) get(r *http.Request, next http.Handler, policy CachePolicy) *cachedResponse {
+	key := r.URL.RequestURI() + "\x00" + r.Header.Get("Accept")
+	now := time.Now()
+
+	c.mu.Lock()
+	if resp, ok := c.entries[key]; ok && now.Before(resp.expires) {
+		c.mu.Unlock()
+		httpCacheStats.Add("hits", 1)
+		return resp
+	}
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		httpCacheStats.Add("shared", 1)
+		select {
+		case <-f.done:
+			return f.resp
+		case <-r.Context().Done():
+			// The client is gone; what is sent no longer matters.
+			return problemResponse(http.StatusServiceUnavailable)
+		}
+	}
+	f := &cacheFlight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+	httpCacheStats.Add("misses", 1)
+
+	var resp *cachedResponse
+	defer func() {
+		c.mu.Lock()
+		delete(c.flights, key)
+		if resp != nil && resp.status == http.StatusOK {
+			c.store(key, resp)
+		}
+		c.mu.Unlock()
+		if resp == nil {
+			// The handler panicked: waiting requests fail rather than hang.
+			f.resp = problemResponse(http.StatusInternalServerError)
+		} else {
+			f.resp = resp
+		}
+		close(f.done)
+	}()
+
+	// The response is shared, so it must not depend on this client
+	// staying connected.
+	resp = bufferResponse(r.WithContext(context.WithoutCancel(r.Context())), next, policy)
+	resp.expires = time.Now().Add(policy.TTL)
+	return resp
+}
+
+// store adds resp, evicting expired entries, then the one closest to
+// expiry, when the cache is full.
+func (c *responseCache) store(key string, resp *cachedResponse) {
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.max {
+		now := time.Now()
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= c.max {
+			var oldest string
+			for k, e := range c.entries {
+				if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+					oldest = k
+				}
+			}
+			delete(c.entries, oldest)
+		}
+	}
+	c.entries[key] = resp
+}
+
+// bufferResponse runs next into a buffer and, for a 200, derives the
+// validators of the body.
+func bufferResponse(r *http.Request, next http.Handler, policy CachePolicy) *cachedResponse {
+	bw := &bufferedResponse{header: http.Header{}}
+	next.ServeHTTP(bw, r)
+
+	resp := &cachedResponse{status: bw.status, header: bw.header, body: bw.body.Bytes()}
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	if resp.status != http.StatusOK {
+		return resp
+	}
+
+	resp.etag = resp.header.Get("ETag")
+	if resp.etag == "" {
+		resp.etag = bodyETag(resp.body, policy.WeakETag)
+	}
+	if lm, err := http.ParseTime(resp.header.Get("Last-Modified")); err == nil {
+		resp.modified = lm
+	} else if policy.TTL > 0 {
+		// A cached body was last known to change when it was produced.
+		resp.modified = time.Now().UTC().Truncate(time.Second)
+	}
+	return resp
+}
+
+// problemResponse buffers a problem response.
+func problemResponse(status int) *cachedResponse {
+	bw := &bufferedResponse{header: http.Header{}}
+	respondProblem(bw, status, "")
+	return &cachedResponse{status: status, header: bw.header, body: bw.body.Bytes()}
+}
+
+// bodyETag hashes a response body into an entity tag.
+func bodyETag(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	etag := `"` + base64.RawURLEncoding.EncodeToString(sum[:16]) + `"`
+	if weak {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// serveCached writes resp, or 304 when the request's validators match.
+func serveCached(w http.ResponseWriter, r *http.Request, resp *cachedResponse, policy CachePolicy) {
+	h := w.Header()
+	for name, values := range resp.header {
+		if name == "Vary" {
+			h[name] = append(h[name], values...)
+			continue
+		}
+		// Cached headers are shared, so later changes must not reach them.
+		h[name] = slices.Clone(values)
+	}
+	if resp.status != http.StatusOK {
+		w.WriteHeader(resp.status)
+		_, _ = w.Write(resp.body)
+		return
+	}
+
+	h.Set("ETag", resp.etag)
+	if !resp.modified.IsZero() {
+		h.Set("Last-Modified", resp.modified.Format(http.TimeFormat))
+	}
+	if policy.CacheControl != "" {
+		h.Set("Cache-Control", policy.CacheControl)
+	}
+
+	if notModified(r, resp) {
+		httpCacheStats.Add("not_modified", 1)
+		for _, name := range []string{"Content-Type", "Content-Length", "Content-Encoding"} {
+			h.Del(name)
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(resp.body)
+	}
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since without it,
+// as in RFC 9110 section 13.2.2.
+func notModified(r *http.Request, resp *cachedResponse) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for tag := range strings.SplitSeq(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "*" || weakETagMatch(tag, resp.etag) {
+				return true
+			}
+		}
+		return false
+	}
+	if resp.modified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !resp.modified.After(since)
+}
+
+// weakETagMatch compares entity tags ignoring weakness. Compress weakens
+// the tags of bodies it encodes, so clients send them back weak.
+func weakETagMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// bufferedResponse is an http.ResponseWriter keeping the response in
+// memory.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(code int) {
+	if b.status == 0 && code >= 200 {
+		b.status = code
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p) //nolint:wrapcheck // bytes.Buffer never fails
+}
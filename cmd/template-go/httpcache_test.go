@@ -0,0 +1,230 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingInfo serves a DatabaseInfo and counts its runs.
+type countingInfo struct {
+	calls atomic.Int32
+}
+
+func (c *countingInfo) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.calls.Add(1)
+	respond(w, r, http.StatusOK, DatabaseInfo{Database: "testdb", Version: r.URL.Query().Get("v")})
+}
+
+func cachedGet(t *testing.T, h http.Handler, target string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, target, http.NoBody)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCachedConditional(t *testing.T) {
+	h := Cached(CachePolicy{CacheControl: "public, max-age=60"})(&countingInfo{})
+	first := cachedGet(t, h, "/test", nil)
+	require.Equal(t, http.StatusOK, first.Code)
+	etag := first.Header().Get("ETag")
+	require.Regexp(t, `^"[\w-]+"$`, etag)
+	assert.Equal(t, "public, max-age=60", first.Header().Get("Cache-Control"))
+	assert.Empty(t, first.Header().Get("Last-Modified"), "uncached bodies have no known modification time")
+
+	tests := []struct {
+		name       string
+		header     map[string]string
+		wantStatus int
+	}{
+		{name: "matching tag", header: map[string]string{"If-None-Match": etag}, wantStatus: http.StatusNotModified},
+		{name: "weakened tag", header: map[string]string{"If-None-Match": "W/" + etag}, wantStatus: http.StatusNotModified},
+		{name: "tag in a list", header: map[string]string{"If-None-Match": `"other", ` + etag}, wantStatus: http.StatusNotModified},
+		{name: "any tag", header: map[string]string{"If-None-Match": "*"}, wantStatus: http.StatusNotModified},
+		{name: "stale tag", header: map[string]string{"If-None-Match": `"other"`}, wantStatus: http.StatusOK},
+		{name: "date without modification time", header: map[string]string{"If-Modified-Since": time.Now().Format(http.TimeFormat)}, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := cachedGet(t, h, "/test", tt.header)
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, etag, rec.Header().Get("ETag"))
+			if tt.wantStatus == http.StatusNotModified {
+				assert.Empty(t, rec.Body.String())
+				assert.Empty(t, rec.Header().Get("Content-Type"))
+			} else {
+				assert.Equal(t, first.Body.String(), rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestCachedValidators(t *testing.T) {
+	modified := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	lastModified := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		_, _ = w.Write([]byte("body"))
+	})
+
+	t.Run("weak tags", func(t *testing.T) {
+		rec := cachedGet(t, Cached(CachePolicy{WeakETag: true})(lastModified), "/", nil)
+		assert.Regexp(t, `^W/"[\w-]+"$`, rec.Header().Get("ETag"))
+	})
+
+	t.Run("handler tags are kept", func(t *testing.T) {
+		h := Cached(CachePolicy{})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("ETag", `"v1"`)
+			_, _ = w.Write([]byte("body"))
+		}))
+		assert.Equal(t, `"v1"`, cachedGet(t, h, "/", nil).Header().Get("ETag"))
+		assert.Equal(t, http.StatusNotModified, cachedGet(t, h, "/", map[string]string{"If-None-Match": `"v1"`}).Code)
+	})
+
+	t.Run("if modified since", func(t *testing.T) {
+		h := Cached(CachePolicy{})(lastModified)
+		tests := []struct {
+			since      time.Time
+			wantStatus int
+		}{
+			{since: modified, wantStatus: http.StatusNotModified},
+			{since: modified.Add(time.Hour), wantStatus: http.StatusNotModified},
+			{since: modified.Add(-time.Hour), wantStatus: http.StatusOK},
+		}
+		for _, tt := range tests {
+			rec := cachedGet(t, h, "/", map[string]string{"If-Modified-Since": tt.since.Format(http.TimeFormat)})
+			assert.Equal(t, tt.wantStatus, rec.Code, tt.since)
+		}
+	})
+
+	t.Run("if none match takes precedence", func(t *testing.T) {
+		rec := cachedGet(t, Cached(CachePolicy{})(lastModified), "/", map[string]string{
+			"If-None-Match":     `"other"`,
+			"If-Modified-Since": modified.Format(http.TimeFormat),
+		})
+		assert.Equal(t, http.StatusOK, rec.Code)
+	})
+
+	t.Run("errors pass through", func(t *testing.T) {
+		h := Cached(CachePolicy{CacheControl: "public, max-age=60", TTL: time.Minute})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			respondProblem(w, http.StatusGatewayTimeout, "")
+		}))
+		rec := cachedGet(t, h, "/", nil)
+		assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+		assert.Empty(t, rec.Header().Get("ETag"))
+		assert.Empty(t, rec.Header().Get("Cache-Control"))
+		assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	})
+
+	t.Run("head requests", func(t *testing.T) {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodHead, "/", http.NoBody)
+		rec := httptest.NewRecorder()
+		Cached(CachePolicy{})(lastModified).ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.NotEmpty(t, rec.Header().Get("ETag"))
+		assert.Empty(t, rec.Body.String())
+	})
+}
+
+func TestCachedServerSide(t *testing.T) {
+	t.Run("serves hits without the handler", func(t *testing.T) {
+		info := &countingInfo{}
+		h := Cached(CachePolicy{TTL: time.Minute})(info)
+
+		first := cachedGet(t, h, "/test", nil)
+		second := cachedGet(t, h, "/test", nil)
+		assert.Equal(t, int32(1), info.calls.Load())
+		assert.Equal(t, first.Body.String(), second.Body.String())
+		assert.Equal(t, first.Header().Get("ETag"), second.Header().Get("ETag"))
+		assert.NotEmpty(t, second.Header().Get("Last-Modified"))
+		assert.Equal(t, []string{"Accept"}, second.Header().Values("Vary"))
+
+		cachedGet(t, h, "/test?v=2", nil)
+		cachedGet(t, h, "/test", map[string]string{"Accept": "application/cbor"})
+		cachedGet(t, h, "/test", map[string]string{"Authorization": "Bearer token"})
+		assert.Equal(t, int32(4), info.calls.Load(), "URLs, media types and credentials are cached apart")
+	})
+
+	t.Run("expires entries", func(t *testing.T) {
+		info := &countingInfo{}
+		h := Cached(CachePolicy{TTL: 10 * time.Millisecond})(info)
+
+		cachedGet(t, h, "/test", nil)
+		time.Sleep(20 * time.Millisecond)
+		cachedGet(t, h, "/test", nil)
+		assert.Equal(t, int32(2), info.calls.Load())
+	})
+
+	t.Run("evicts when full", func(t *testing.T) {
+		info := &countingInfo{}
+		h := Cached(CachePolicy{TTL: time.Minute, MaxEntries: 1})(info)
+
+		cachedGet(t, h, "/test?v=1", nil)
+		cachedGet(t, h, "/test?v=2", nil)
+		cachedGet(t, h, "/test?v=1", nil)
+		assert.Equal(t, int32(3), info.calls.Load())
+	})
+
+	t.Run("shares concurrent misses", func(t *testing.T) {
+		var calls atomic.Int32
+		release := make(chan struct{})
+		h := Cached(CachePolicy{TTL: time.Minute})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			calls.Add(1)
+			<-release
+			_, _ = w.Write([]byte("body"))
+		}))
+
+		shared := expvarMapInt(t, httpCacheStats, "shared")
+		var wg sync.WaitGroup
+		codes := make([]int, 8)
+		for i := range codes {
+			wg.Go(func() { codes[i] = cachedGet(t, h, "/test", nil).Code })
+		}
+		require.Eventually(t, func() bool {
+			return expvarMapInt(t, httpCacheStats, "shared") == shared+int64(len(codes)-1)
+		}, time.Second, time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), calls.Load())
+		for _, code := range codes {
+			assert.Equal(t, http.StatusOK, code)
+		}
+	})
+
+	t.Run("fails waiting requests when the handler panics", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		h := Cached(CachePolicy{TTL: time.Minute})(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			close(started)
+			<-release
+			panic("boom")
+		}))
+
+		go func() {
+			defer func() { _ = recover() }()
+			cachedGet(t, h, "/panic", nil)
+		}()
+		<-started
+		shared := expvarMapInt(t, httpCacheStats, "shared")
+		waiting := make(chan int)
+		go func() { waiting <- cachedGet(t, h, "/panic", nil).Code }()
+		require.Eventually(t, func() bool { return expvarMapInt(t, httpCacheStats, "shared") > shared }, time.Second, time.Millisecond)
+		close(release)
+
+		select {
+		case code := <-waiting:
+			assert.Equal(t, http.StatusInternalServerError, code)
+		case <-time.After(time.Second):
+			t.Fatal("waiting request hung")
+		}
+	})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// IdempotencyOptions configures the Idempotent middleware.
+type IdempotencyOptions struct {
+	// Methods honor the Idempotency-Key header, POST and PATCH when empty.
+	Methods []string
+	// TTL is how long responses are kept for replay.
+	TTL time.Duration
+	// LockTimeout is how long a request in flight holds its key, after
+	// which a retry may run it again, as when the instance crashed.
+	LockTimeout time.Duration
+	// MaxResponseBytes bounds stored bodies; larger responses are not
+	// stored and their retries run again.
+	MaxResponseBytes int
+}
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// idempotencyReplayedHeader marks responses replayed from the store.
+	idempotencyReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+
+	defaultIdempotencyTTL              = 24 * time.Hour
+	defaultIdempotencyLockTimeout      = time.Minute
+	defaultIdempotencyMaxResponseBytes = 1 << 20
+)
+
+var (
+	errIdempotencyInFlight = errors.New("request in flight")
+	errIdempotencyMismatch = errors.New("key reused with a different request")
+)
+
+// StoredResponse is a response kept for replay.
+type StoredResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// IdempotencyStore keeps the responses of requests by idempotency key.
+// Keys are scoped, so that clients with different credentials do not
+// share them.
+type IdempotencyStore interface {
+	// Claim reserves key for the request with fingerprint for lock and
+	// reports whether it did. If the key is taken, it returns the stored
+	// response of the same request, errIdempotencyInFlight while that
+	// request has not completed, or errIdempotencyMismatch for a
+	// different request.
+	Claim(ctx context.Context, scope, key string, fingerprint []byte, lock time.Duration) (stored *StoredResponse, claimed bool, err error)
+	// Complete stores the response of a claimed key until ttl elapses.
+	Complete(ctx context.Context, scope, key string, resp *StoredResponse, ttl time.Duration) error
+	// Release frees a claimed key without storing a response.
+	Release(ctx context.Context, scope, key string) error
+	// Prune deletes expired keys.
+	Prune(ctx context.Context) error
+}
+
+// NewIdempotencyStore returns an IdempotencyStore in the idempotency_keys
+// table of db.
+func NewIdempotencyStore(db Querier) IdempotencyStore {
+	return &pgIdempotencyStore{db: db}
+}
+
+type pgIdempotencyStore struct {
+	db Querier
+}
+
+// Claim inserts the key, or takes over an expired one. A key in flight
+// expires after lock, so that a request whose instance crashed can be
+// retried.
+func (s *pgIdempotencyStore) Claim(ctx context.Context, scope, key string, fingerprint []byte, lock time.Duration) (*StoredResponse, bool, error) {
+	q := querier(ctx, s.db)
+	tag, err := q.Exec(ctx, `INSERT INTO idempotency_keys (scope, key, fingerprint, expires_at)
+		VALUES ($1, $2, $3, now() + make_interval(secs => $4))
+		ON CONFLICT (scope, key) DO UPDATE
+		SET fingerprint = excluded.fingerprint, status = NULL, headers = NULL, body = NULL,
+			created_at = now(), expires_at = excluded.expires_at
+		WHERE idempotency_keys.expires_at < now()`,
+		scope, key, fingerprint, lock.Seconds())
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	if tag.RowsAffected() == 1 {
+		return nil, true, nil
+	}
+
+	var (
+		stored []byte
+		resp   StoredResponse
+		status *int
+	)
+	err = q.QueryRow(ctx, "SELECT fingerprint, status, headers, body FROM idempotency_keys WHERE scope = $1 AND key = $2",
+		scope, key).Scan(&stored, &status, &resp.Header, &resp.Body)
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		// Pruned in between; the client can retry.
+		return nil, false, errIdempotencyInFlight
+	case err != nil:
+		return nil, false, fmt.Errorf("failed to read idempotency key: %w", err)
+	case !bytes.Equal(stored, fingerprint):
+		return nil, false, errIdempotencyMismatch
+	case status == nil:
+		return nil, false, errIdempotencyInFlight
+	}
+	resp.Status = *status
+	return &resp, false, nil
+}
+
+func (s *pgIdempotencyStore) Complete(ctx context.Context, scope, key string, resp *StoredResponse, ttl time.Duration) error {
+	_, err := querier(ctx, s.db).Exec(ctx, `UPDATE idempotency_keys
+		SET status = $3, headers = $4, body = $5, expires_at = now() + make_interval(secs => $6)
+		WHERE scope = $1 AND key = $2`,
+		scope, key, resp.Status, resp.Header, resp.Body, ttl.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to store idempotent response: %w", err)
+	}
+	return nil
+}
+
+func (s *pgIdempotencyStore) Release(ctx context.Context, scope, key string) error {
+	_, err := querier(ctx, s.db).Exec(ctx, "DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2 AND status IS NULL", scope, key)
+	if err != nil {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
+
+func (s *pgIdempotencyStore) Prune(ctx context.Context) error {
+	if _, err := querier(ctx, s.db).Exec(ctx, "DELETE FROM idempotency_keys WHERE expires_at < now()"); err != nil {
+		return fmt.Errorf("failed to prune idempotency keys: %w", err)
+	}
+	return nil
+}
+
+// Idempotent returns middleware making requests with an Idempotency-Key
+// header safe to retry: the first request runs and its response is
+// stored, and retries with the same key and payload get it replayed.
+// A retry arriving while the first request runs gets 409, and a key
+// reused with a different method, URL or body gets 422. Server errors
+// are not stored, so that retrying runs the request again.
+func Idempotent(store IdempotencyStore, opts IdempotencyOptions) func(http.Handler) http.Handler {
+	if len(opts.Methods) == 0 {
+		opts.Methods = []string{http.MethodPost, http.MethodPatch}
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = defaultIdempotencyTTL
+	}
+	if opts.LockTimeout <= 0 {
+		opts.LockTimeout = defaultIdempotencyLockTimeout
+	}
+	if opts.MaxResponseBytes <= 0 {
+		opts.MaxResponseBytes = defaultIdempotencyMaxResponseBytes
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(idempotencyKeyHeader)
+			if key == "" || !slices.Contains(opts.Methods, r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxIdempotencyKeyLength {
+				respondProblem(w, http.StatusBadRequest, "Idempotency-Key is too long")
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				var maxErr *http.MaxBytesError
+				if errors.As(err, &maxErr) {
+					respondProblem(w, http.StatusRequestEntityTooLarge, "request body too large")
+					return
+				}
+				respondProblem(w, http.StatusBadRequest, "failed to read request body")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			ctx := r.Context()
+			scope := credentialsHash(r)
+			stored, claimed, err := store.Claim(ctx, scope, key, requestFingerprint(r, body), opts.LockTimeout)
+			switch {
+			case errors.Is(err, errIdempotencyInFlight):
+				idempotencyStats.Add("conflicts", 1)
+				w.Header().Set("Retry-After", "1")
+				respondProblem(w, http.StatusConflict, "a request with this Idempotency-Key is in progress")
+				return
+			case errors.Is(err, errIdempotencyMismatch):
+				idempotencyStats.Add("mismatches", 1)
+				respondProblem(w, http.StatusUnprocessableEntity, "Idempotency-Key was used for a different request")
+				return
+			case err != nil:
+				respondErr(w, r, err)
+				return
+			case !claimed:
+				idempotencyStats.Add("replayed", 1)
+				replayResponse(w, stored)
+				return
+			}
+
+			// Storing outlives a client that gave up waiting.
+			storeCtx := context.WithoutCancel(ctx)
+			rec := &idempotencyRecorder{ResponseWriter: w, max: opts.MaxResponseBytes}
+			completed := false
+			defer func() {
+				if completed {
+					return
+				}
+				if err := store.Release(storeCtx, scope, key); err != nil {
+					logStoreError(r, err)
+				}
+			}()
+
+			next.ServeHTTP(rec, r)
+
+			resp := rec.response()
+			if resp == nil || resp.Status >= 500 {
+				return
+			}
+			if err := store.Complete(storeCtx, scope, key, resp, opts.TTL); err != nil {
+				logStoreError(r, err)
+				return
+			}
+			completed = true
+			idempotencyStats.Add("stored", 1)
+		})
+	}
+}
+
+// credentialsHash identifies the credentials of r without keeping them.
+// It scopes idempotency keys and is the principal of feature flags.
+func credentialsHash(r *http.Request) string {
+	sum := sha256.Sum256([]byte(r.Header.Get("Authorization")))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestFingerprint identifies the method, URL and body of a request.
+func requestFingerprint(r *http.Request, body []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// replayResponse writes a stored response.
+func replayResponse(w http.ResponseWriter, resp *StoredResponse) {
+	header := w.Header()
+	for name, values := range resp.Header {
+		header[name] = values
+	}
+	header.Set(idempotencyReplayedHeader, "true")
+	w.WriteHeader(resp.Status)
+	_, _ = w.Write(resp.Body)
+}
+
+func logStoreError(r *http.Request, err error) {
+	idempotencyStats.Add("errors", 1)
+	slog.ErrorContext(r.Context(), "Idempotency store failed", "error", err, "url", r.URL.RequestURI())
+}
+
+// idempotencyRecorder passes a response through while keeping a copy.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status   int
+	header   http.Header
+	body     bytes.Buffer
+	max      int
+	overflow bool
+}
+
+func (rec *idempotencyRecorder) WriteHeader(code int) {
+	if rec.status == 0 && code >= 200 {
+		rec.status = code
+		rec.header = rec.ResponseWriter.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if !rec.overflow {
+		if rec.body.Len()+len(b) > rec.max {
+			rec.overflow = true
+			rec.body = bytes.Buffer{}
+		} else {
+			rec.body.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b) //nolint:wrapcheck // transparent wrapper
+}
+
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// response returns the recorded response, or nil when it was too large
+// to store.
+func (rec *idempotencyRecorder) response() *StoredResponse {
+	if rec.overflow {
+		return nil
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+		rec.header = rec.ResponseWriter.Header().Clone()
+	}
+	return &StoredResponse{Status: rec.status, Header: rec.header, Body: rec.body.Bytes()}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memIdempotencyStore is an in-memory IdempotencyStore without expiry.
+type memIdempotencyStore struct {
+	mu   sync.Mutex
+	keys map[string]*memIdempotencyEntry
+}
+
+type memIdempotencyEntry struct {
+	fingerprint []byte
+	resp        *StoredResponse
+}
+
+func newMemIdempotencyStore() *memIdempotencyStore {
+	return &memIdempotencyStore{keys: map[string]*memIdempotencyEntry{}}
+}
+
+func (s *memIdempotencyStore) Claim(_ context.Context, scope, key string, fingerprint []byte, _ time.Duration) (*StoredResponse, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.keys[scope+key]
+	switch {
+	case !ok:
+		s.keys[scope+key] = &memIdempotencyEntry{fingerprint: fingerprint}
+		return nil, true, nil
+	case !bytes.Equal(entry.fingerprint, fingerprint):
+		return nil, false, errIdempotencyMismatch
+	case entry.resp == nil:
+		return nil, false, errIdempotencyInFlight
+	}
+	return entry.resp, false, nil
+}
+
+func (s *memIdempotencyStore) Complete(_ context.Context, scope, key string, resp *StoredResponse, _ time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[scope+key].resp = resp
+	return nil
+}
+
+func (s *memIdempotencyStore) Release(_ context.Context, scope, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, scope+key)
+	return nil
+}
+
+func (s *memIdempotencyStore) Prune(context.Context) error { return nil }
+
+func (s *memIdempotencyStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+// createCounter answers 201 with the number of times it ran.
+type createCounter struct {
+	calls atomic.Int32
+}
+
+func (c *createCounter) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	n := c.calls.Add(1)
+	w.Header().Set("Location", "/items/1")
+	writeJSON(w, http.StatusCreated, "application/json", map[string]int32{"call": n})
+}
+
+func idempotentRequest(t *testing.T, h http.Handler, method, key, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequestWithContext(t.Context(), method, "/items", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestIdempotent(t *testing.T) {
+	t.Run("replays the stored response", func(t *testing.T) {
+		counter := &createCounter{}
+		h := Idempotent(newMemIdempotencyStore(), IdempotencyOptions{})(counter)
+
+		first := idempotentRequest(t, h, http.MethodPost, "k1", `{"name":"a"}`)
+		retry := idempotentRequest(t, h, http.MethodPost, "k1", `{"name":"a"}`)
+
+		assert.Equal(t, int32(1), counter.calls.Load())
+		assert.Equal(t, http.StatusCreated, retry.Code)
+		assert.JSONEq(t, first.Body.String(), retry.Body.String())
+		assert.Equal(t, "/items/1", retry.Header().Get("Location"))
+		assert.Empty(t, first.Header().Get(idempotencyReplayedHeader))
+		assert.Equal(t, "true", retry.Header().Get(idempotencyReplayedHeader))
+	})
+
+	t.Run("ignores requests without a key or with safe methods", func(t *testing.T) {
+		counter := &createCounter{}
+		store := newMemIdempotencyStore()
+		h := Idempotent(store, IdempotencyOptions{})(counter)
+
+		idempotentRequest(t, h, http.MethodPost, "", `{}`)
+		idempotentRequest(t, h, http.MethodPost, "", `{}`)
+		idempotentRequest(t, h, http.MethodPut, "k1", `{}`)
+		idempotentRequest(t, h, http.MethodPut, "k1", `{}`)
+
+		assert.Equal(t, int32(4), counter.calls.Load())
+		assert.Zero(t, store.Len())
+	})
+
+	t.Run("rejects key reuse with a different request", func(t *testing.T) {
+		counter := &createCounter{}
+		h := Idempotent(newMemIdempotencyStore(), IdempotencyOptions{})(counter)
+
+		idempotentRequest(t, h, http.MethodPost, "k1", `{"name":"a"}`)
+		rec := idempotentRequest(t, h, http.MethodPost, "k1", `{"name":"b"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		rec = idempotentRequest(t, h, http.MethodPatch, "k1", `{"name":"a"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+		assert.Equal(t, int32(1), counter.calls.Load())
+	})
+
+	t.Run("rejects duplicates in flight", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		h := Idempotent(newMemIdempotencyStore(), IdempotencyOptions{})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			close(started)
+			<-release
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+		done := make(chan int)
+		go func() { done <- idempotentRequest(t, h, http.MethodPost, "k1", `{}`).Code }()
+		<-started
+
+		rec := idempotentRequest(t, h, http.MethodPost, "k1", `{}`)
+		assert.Equal(t, http.StatusConflict, rec.Code)
+		assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+		close(release)
+		assert.Equal(t, http.StatusNoContent, <-done)
+		assert.Equal(t, http.StatusNoContent, idempotentRequest(t, h, http.MethodPost, "k1", `{}`).Code)
+	})
+
+	t.Run("runs again after server errors and panics", func(t *testing.T) {
+		var calls atomic.Int32
+		h := Idempotent(newMemIdempotencyStore(), IdempotencyOptions{})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			switch calls.Add(1) {
+			case 1:
+				w.WriteHeader(http.StatusServiceUnavailable)
+			case 2:
+				panic("boom")
+			default:
+				w.WriteHeader(http.StatusAccepted)
+			}
+		}))
+
+		assert.Equal(t, http.StatusServiceUnavailable, idempotentRequest(t, h, http.MethodPost, "k1", `{}`).Code)
+		assert.Panics(t, func() { idempotentRequest(t, h, http.MethodPost, "k1", `{}`) })
+		assert.Equal(t, http.StatusAccepted, idempotentRequest(t, h, http.MethodPost, "k1", `{}`).Code)
+		assert.Equal(t, http.StatusAccepted, idempotentRequest(t, h, http.MethodPost, "k1", `{}`).Code)
+		assert.Equal(t, int32(3), calls.Load())
+	})
+
+	t.Run("does not store large responses", func(t *testing.T) {
+		counter := &createCounter{}
+		store := newMemIdempotencyStore()
+		h := Idempotent(store, IdempotencyOptions{MaxResponseBytes: 4})(counter)
+
+		idempotentRequest(t, h, http.MethodPost, "k1", `{}`)
+		idempotentRequest(t, h, http.MethodPost, "k1", `{}`)
+		assert.Equal(t, int32(2), counter.calls.Load())
+		assert.Zero(t, store.Len())
+	})
+
+	t.Run("scopes keys by credentials", func(t *testing.T) {
+		counter := &createCounter{}
+		h := Idempotent(newMemIdempotencyStore(), IdempotencyOptions{})(counter)
+
+		for _, token := range []string{"Bearer a", "Bearer b"} {
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/items", strings.NewReader(`{}`))
+			req.Header.Set(idempotencyKeyHeader, "k1")
+			req.Header.Set("Authorization", token)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			assert.Equal(t, http.StatusCreated, rec.Code)
+		}
+		assert.Equal(t, int32(2), counter.calls.Load())
+	})
+
+	t.Run("rejects invalid keys and bodies", func(t *testing.T) {
+		h := Idempotent(newMemIdempotencyStore(), IdempotencyOptions{})(&createCounter{})
+
+		rec := idempotentRequest(t, h, http.MethodPost, strings.Repeat("k", maxIdempotencyKeyLength+1), `{}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/items", strings.NewReader(`{"name":"a"}`))
+		req.Header.Set(idempotencyKeyHeader, "k1")
+		rec = httptest.NewRecorder()
+		req.Body = http.MaxBytesReader(rec, req.Body, 4)
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	})
+}
+
+func TestIdempotencyStoreIntegration(t *testing.T) {
+	skipIfNoTestcontainers(t)
+
+	store := NewIdempotencyStore(testPool)
+	scope := t.Name()
+	t.Cleanup(func() {
+		_, _ = testPool.Exec(context.Background(), "DELETE FROM idempotency_keys WHERE scope = $1", scope)
+	})
+	fingerprint := []byte("request")
+
+	_, claimed, err := store.Claim(t.Context(), scope, "k1", fingerprint, time.Minute)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	_, _, err = store.Claim(t.Context(), scope, "k1", fingerprint, time.Minute)
+	require.ErrorIs(t, err, errIdempotencyInFlight)
+	_, _, err = store.Claim(t.Context(), scope, "k1", []byte("other"), time.Minute)
+	require.ErrorIs(t, err, errIdempotencyMismatch)
+
+	resp := &StoredResponse{Status: http.StatusCreated, Header: http.Header{"Location": {"/items/1"}}, Body: []byte(`{"id":1}`)}
+	require.NoError(t, store.Complete(t.Context(), scope, "k1", resp, time.Hour))
+	stored, claimed, err := store.Claim(t.Context(), scope, "k1", fingerprint, time.Minute)
+	require.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, resp, stored)
+
+	t.Run("released keys can be claimed again", func(t *testing.T) {
+		_, claimed, err := store.Claim(t.Context(), scope, "k2", fingerprint, time.Minute)
+		require.NoError(t, err)
+		require.True(t, claimed)
+		require.NoError(t, store.Release(t.Context(), scope, "k2"))
+
+		_, claimed, err = store.Claim(t.Context(), scope, "k2", []byte("other"), time.Minute)
+		require.NoError(t, err)
+		assert.True(t, claimed)
+	})
+
+	t.Run("expired keys are taken over and pruned", func(t *testing.T) {
+		_, claimed, err := store.Claim(t.Context(), scope, "k3", fingerprint, -time.Second)
+		require.NoError(t, err)
+		require.True(t, claimed)
+
+		_, claimed, err = store.Claim(t.Context(), scope, "k3", []byte("other"), -time.Second)
+		require.NoError(t, err)
+		assert.True(t, claimed, "a crashed request does not hold its key")
+
+		require.NoError(t, store.Prune(t.Context()))
+		var n int
+		require.NoError(t, testPool.QueryRow(t.Context(), "SELECT count(*) FROM idempotency_keys WHERE scope = $1", scope).Scan(&n))
+		assert.Equal(t, 2, n)
+	})
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// JobArgs are the JSON arguments of a job kind.
+type JobArgs interface {
+	// Kind names the job kind; it must be stable across releases.
+	Kind() string
+}
+
+// Job is a claimed job passed to its worker function.
+type Job[T JobArgs] struct {
+	ID   int64
+	Args T
+	// Attempt counts this attempt, starting at 1.
+	Attempt     int
+	MaxAttempts int
+	Priority    int
+	CreatedAt   time.Time
+}
+
+// JobOptions configures an enqueued job.
+type JobOptions struct {
+	// Priority orders due jobs, higher first.
+	Priority int
+	// ScheduledAt delays the job, zero runs it as soon as possible.
+	ScheduledAt time.Time
+	// MaxAttempts overrides the queue default.
+	MaxAttempts int
+	// UniqueKey, when set, allows one unfinished job of the kind with this
+	// key; enqueueing a duplicate returns the ID of the existing job.
+	UniqueKey string
+}
+
+// Job states.
+const (
+	JobAvailable = "available"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// JobQueueOptions configures a JobQueue.
+type JobQueueOptions struct {
+	// Workers is how many jobs run at once per process; zero or less
+	// disables the worker pool.
+	Workers int
+	// PollInterval is how often due jobs are checked for when no enqueue
+	// notification arrives.
+	PollInterval time.Duration
+	// Timeout bounds each attempt. Jobs running twice as long, as left by
+	// crashed processes, are rescued and retried.
+	Timeout time.Duration
+	// MaxAttempts is the default for jobs enqueued without one.
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the delay between attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+const (
+	defaultJobWorkers      = 4
+	defaultJobPollInterval = time.Second
+	defaultJobTimeout      = 5 * time.Minute
+	defaultJobMaxAttempts  = 25
+	defaultJobMinBackoff   = time.Second
+	defaultJobMaxBackoff   = time.Hour
+	// jobRescueInterval is how often abandoned jobs are looked for.
+	jobRescueInterval = time.Minute
+	// jobRetention is how long completed and cancelled jobs are kept.
+	jobRetention = 7 * 24 * time.Hour
+)
+
+// jobsChannel is notified by Enqueue to wake the workers on commit.
+const jobsChannel = "jobs"
+
+var errJobNotFound = errors.New("job not found")
+
+// jobRow is a claimed job before its arguments are decoded.
+type jobRow struct {
+	ID          int64
+	Kind        string
+	Args        json.RawMessage
+	Priority    int
+	Attempts    int
+	MaxAttempts int
+	CreatedAt   time.Time
+}
+
+// jobWorker runs a claimed job of one kind.
+type jobWorker func(ctx context.Context, row *jobRow) error
+
+// JobQueue stores jobs in the jobs table and runs them with a pool of
+// workers. Workers claim due jobs with FOR UPDATE SKIP LOCKED, so any
+// number of processes can share the queue. A failed job is retried with
+// exponential backoff until MaxAttempts; errors wrapped with Permanent
+// fail it at once. Delivery is at least once: a job whose process dies
+// while running it is run again.
+type JobQueue struct {
+	db    dbPool
+	opts  JobQueueOptions
+	wake  chan struct{}
+	freed chan struct{}
+
+	mu      sync.Mutex
+	workers map[string]jobWorker
+	running bool
+}
+
+// NewJobQueue creates a JobQueue on db.
+func NewJobQueue(db dbPool, opts JobQueueOptions) *JobQueue {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultJobPollInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultJobTimeout
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultJobMaxAttempts
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultJobMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaultJobMaxBackoff, opts.MinBackoff)
+	}
+	return &JobQueue{
+		db:      db,
+		opts:    opts,
+		wake:    make(chan struct{}, 1),
+		freed:   make(chan struct{}, 1),
+		workers: map[string]jobWorker{},
+	}
+}
+
+// RegisterJob makes q run jobs of T's kind with work. It must be called
+// before Run; jobs of kinds without a worker stay queued.
+func RegisterJob[T JobArgs](q *JobQueue, work func(ctx context.Context, job *Job[T]) error) {
+	var zero T
+	kind := zero.Kind()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.running {
+		panic("jobs: RegisterJob called after Run")
+	}
+	if _, ok := q.workers[kind]; ok {
+		panic("jobs: duplicate worker for kind " + kind)
+	}
+	q.workers[kind] = func(ctx context.Context, row *jobRow) error {
+		job := &Job[T]{
+			ID:          row.ID,
+			Attempt:     row.Attempts,
+			MaxAttempts: row.MaxAttempts,
+			Priority:    row.Priority,
+			CreatedAt:   row.CreatedAt,
+		}
+		if err := json.Unmarshal(row.Args, &job.Args); err != nil {
+			return Permanent(fmt.Errorf("failed to decode %s args: %w", kind, err))
+		}
+		return work(ctx, job)
+	}
+}
+
+// Enqueue adds a job. Inside App.WithTx the job joins the transaction and
+// becomes visible to workers only once it commits.
+func (q *JobQueue) Enqueue(ctx context.Context, args JobArgs, opts JobOptions) (int64, error) {
+	kind := args.Kind()
+	data, err := json.Marshal(args)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal %s args: %w", kind, err)
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = q.opts.MaxAttempts
+	}
+	var scheduledAt, uniqueKey any
+	if !opts.ScheduledAt.IsZero() {
+		scheduledAt = opts.ScheduledAt
+	}
+	if opts.UniqueKey != "" {
+		uniqueKey = opts.UniqueKey
+	}
+
+	db := querier(ctx, q.db)
+	var id int64
+	for {
+		err = db.QueryRow(ctx, `INSERT INTO jobs (kind, args, priority, scheduled_at, max_attempts, unique_key)
+			VALUES ($1, $2, $3, COALESCE($4, now()), $5, $6)
+			ON CONFLICT (kind, unique_key) WHERE unique_key IS NOT NULL AND state IN ('available', 'running') DO NOTHING
+			RETURNING id`,
+			kind, data, opts.Priority, scheduledAt, opts.MaxAttempts, uniqueKey,
+		).Scan(&id)
+		if !errors.Is(err, pgx.ErrNoRows) {
+			break
+		}
+		err = db.QueryRow(ctx,
+			"SELECT id FROM jobs WHERE kind = $1 AND unique_key = $2 AND state IN ('available', 'running')",
+			kind, opts.UniqueKey,
+		).Scan(&id)
+		if err == nil {
+			return id, nil
+		}
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("failed to find duplicate %s job: %w", kind, err)
+		}
+		// The duplicate finished since the insert, so there is room for
+		// this job now.
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to enqueue %s job: %w", kind, err)
+	}
+
+	if _, err := db.Exec(ctx, "SELECT pg_notify($1, $2)", jobsChannel, kind); err != nil {
+		return 0, fmt.Errorf("failed to notify job workers: %w", err)
+	}
+	jobStats.Add("enqueued", 1)
+	return id, nil
+}
+
+// Wake makes idle workers check for due jobs at once.
+func (q *JobQueue) Wake() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wakeOnNotify returns a NotifyHandler waking the workers.
+func (q *JobQueue) wakeOnNotify() NotifyHandler {
+	return func(context.Context, *pgconn.Notification) error {
+		q.Wake()
+		return nil
+	}
+}
+
+// Run claims and runs jobs until ctx is canceled, then stops claiming and
+// waits for the jobs in flight. These are not canceled with ctx but run
+// until they finish or reach Timeout, so that shutdown does not waste the
+// work done so far.
+func (q *JobQueue) Run(ctx context.Context) {
+	q.mu.Lock()
+	q.running = true
+	kinds := slices.Sorted(maps.Keys(q.workers))
+	q.mu.Unlock()
+	if len(kinds) == 0 || q.opts.Workers <= 0 {
+		return
+	}
+	slog.InfoContext(ctx, "Job workers started", "workers", q.opts.Workers, "kinds", kinds)
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	slots := make(chan struct{}, q.opts.Workers)
+	var lastRescue time.Time
+
+	for {
+		if time.Since(lastRescue) >= jobRescueInterval {
+			if err := q.rescue(ctx); err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Failed to rescue abandoned jobs", "error", err)
+			}
+			lastRescue = time.Now()
+		}
+
+		if free := q.opts.Workers - len(slots); free > 0 {
+			rows, err := q.claim(ctx, kinds, free)
+			if err != nil && ctx.Err() == nil {
+				jobStats.Add("errors", 1)
+				slog.ErrorContext(ctx, "Failed to claim jobs", "error", err)
+			}
+			for _, row := range rows {
+				slots <- struct{}{}
+				wg.Go(func() {
+					defer func() {
+						<-slots
+						select {
+						case q.freed <- struct{}{}:
+						default:
+						}
+					}()
+					q.work(ctx, row)
+				})
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-q.freed:
+		case <-time.After(q.opts.PollInterval):
+		}
+	}
+}
+
+// claim marks up to limit due jobs of kinds as running.
+func (q *JobQueue) claim(ctx context.Context, kinds []string, limit int) ([]*jobRow, error) {
+	rows, err := q.db.Query(ctx, `UPDATE jobs
+		SET state = 'running', attempts = attempts + 1, attempted_at = now()
+		WHERE id IN (
+			SELECT id FROM jobs
+			WHERE state = 'available' AND scheduled_at <= now() AND kind = ANY($1)
+			ORDER BY priority DESC, scheduled_at, id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, kind, args, priority, attempts, max_attempts, created_at`, kinds, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var out []*jobRow
+	for rows.Next() {
+		row := &jobRow{}
+		if err := rows.Scan(&row.ID, &row.Kind, &row.Args, &row.Priority, &row.Attempts, &row.MaxAttempts, &row.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan job: %w", err)
+		}
+		out = append(out, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to claim jobs: %w", err)
+	}
+	return out, nil
+}
+
+// work runs a claimed job and records its outcome.
+func (q *JobQueue) work(ctx context.Context, row *jobRow) {
+	jobStats.Add("running", 1)
+	defer jobStats.Add("running", -1)
+
+	jobCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), q.opts.Timeout)
+	start := time.Now()
+	err := q.run(jobCtx, row)
+	cancel()
+
+	logger := slog.With("job_id", row.ID, "kind", row.Kind, "attempt", row.Attempts, "duration", time.Since(start))
+	dbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err := q.finish(dbCtx, logger, row, err); err != nil {
+		jobStats.Add("errors", 1)
+		logger.ErrorContext(ctx, "Failed to record job outcome", "error", err)
+	}
+}
+
+// run calls the worker, turning a panic into an error.
+func (q *JobQueue) run(ctx context.Context, row *jobRow) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	q.mu.Lock()
+	work := q.workers[row.Kind]
+	q.mu.Unlock()
+	return work(ctx, row)
+}
+
+// finish completes, retries or fails row depending on err. Updates only
+// apply to running jobs in the same attempt, so a job cancelled meanwhile
+// stays cancelled, and a job rescued and claimed again is left to its new
+// worker.
+func (q *JobQueue) finish(ctx context.Context, logger *slog.Logger, row *jobRow, err error) error {
+	if err == nil {
+		if _, err := q.db.Exec(ctx,
+			"UPDATE jobs SET state = 'completed', finished_at = now() WHERE id = $1 AND attempts = $2 AND state = 'running'",
+			row.ID, row.Attempts,
+		); err != nil {
+			return fmt.Errorf("failed to complete job: %w", err)
+		}
+		jobStats.Add("completed", 1)
+		logger.InfoContext(ctx, "Job completed")
+		return nil
+	}
+
+	var permanent *permanentError
+	if errors.As(err, &permanent) || row.Attempts >= row.MaxAttempts {
+		if _, err := q.db.Exec(ctx,
+			"UPDATE jobs SET state = 'failed', last_error = $3, finished_at = now() WHERE id = $1 AND attempts = $2 AND state = 'running'",
+			row.ID, row.Attempts, err.Error(),
+		); err != nil {
+			return fmt.Errorf("failed to fail job: %w", err)
+		}
+		jobStats.Add("failed", 1)
+		logger.ErrorContext(ctx, "Job failed", "error", err)
+		return nil
+	}
+
+	delay := retryBackoff(q.opts.MinBackoff, q.opts.MaxBackoff, row.Attempts)
+	if _, err := q.db.Exec(ctx,
+		"UPDATE jobs SET state = 'available', last_error = $3, scheduled_at = now() + make_interval(secs => $4) WHERE id = $1 AND attempts = $2 AND state = 'running'",
+		row.ID, row.Attempts, err.Error(), delay.Seconds(),
+	); err != nil {
+		return fmt.Errorf("failed to reschedule job: %w", err)
+	}
+	jobStats.Add("retried", 1)
+	logger.WarnContext(ctx, "Job attempt failed", "error", err, "retry_in", delay)
+	return nil
+}
+
+// rescue retries or fails jobs that have been running for twice the
+// Timeout, which only happens when their process died.
+func (q *JobQueue) rescue(ctx context.Context) error {
+	tag, err := q.db.Exec(ctx, `UPDATE jobs
+		SET state = CASE WHEN attempts >= max_attempts THEN 'failed' ELSE 'available' END,
+			finished_at = CASE WHEN attempts >= max_attempts THEN now() END,
+			scheduled_at = now(),
+			last_error = 'abandoned by its worker'
+		WHERE state = 'running' AND attempted_at < now() - make_interval(secs => $1)`,
+		(2 * q.opts.Timeout).Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to rescue jobs: %w", err)
+	}
+	if n := tag.RowsAffected(); n > 0 {
+		jobStats.Add("rescued", n)
+		slog.WarnContext(ctx, "Rescued abandoned jobs", "count", n)
+	}
+	return nil
+}
+
+// Prune deletes completed and cancelled jobs finished before olderThan.
+func (q *JobQueue) Prune(ctx context.Context, olderThan time.Duration) error {
+	tag, err := q.db.Exec(ctx, `DELETE FROM jobs
+		WHERE state IN ('completed', 'cancelled') AND finished_at < now() - make_interval(secs => $1)`,
+		olderThan.Seconds())
+	if err != nil {
+		return fmt.Errorf("failed to prune jobs: %w", err)
+	}
+	slog.InfoContext(ctx, "Pruned finished jobs", "count", tag.RowsAffected())
+	return nil
+}
+
+// JobInfo describes a stored job.
+type JobInfo struct {
+	ID          int64
+	Kind        string
+	State       string
+	Args        json.RawMessage
+	Priority    int
+	Attempts    int
+	MaxAttempts int
+	ScheduledAt time.Time
+	CreatedAt   time.Time
+	LastError   string
+}
+
+// JobFilter selects jobs to list; zero fields match every job.
+type JobFilter struct {
+	State string
+	Kind  string
+	Limit int
+}
+
+// List returns the newest jobs matching f.
+func (q *JobQueue) List(ctx context.Context, f JobFilter) ([]JobInfo, error) {
+	if f.Limit <= 0 {
+		f.Limit = 50
+	}
+	var conds []string
+	var args []any
+	if f.State != "" {
+		args = append(args, f.State)
+		conds = append(conds, fmt.Sprintf("state = $%d", len(args)))
+	}
+	if f.Kind != "" {
+		args = append(args, f.Kind)
+		conds = append(conds, fmt.Sprintf("kind = $%d", len(args)))
+	}
+	sql := `SELECT id, kind, state, args, priority, attempts, max_attempts, scheduled_at, created_at, COALESCE(last_error, '')
+		FROM jobs`
+	if len(conds) > 0 {
+		sql += " WHERE " + strings.Join(conds, " AND ")
+	}
+	args = append(args, f.Limit)
+	sql += fmt.Sprintf(" ORDER BY id DESC LIMIT $%d", len(args))
+
+	rows, err := q.db.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var out []JobInfo
+	for rows.Next() {
+		var j JobInfo
+		if err := rows.Scan(&j.ID, &j.Kind, &j.State, &j.Args, &j.Priority, &j.Attempts, &j.MaxAttempts, &j.ScheduledAt, &j.CreatedAt, &j.LastError); err != nil {
+			return nil, fmt.Errorf("failed to scan job: %w", err)
+		}
+		out = append(out, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	return out, nil
+}
+
+// Retry makes a failed or cancelled job available again at once, with
+// one more attempt if it had used them all.
+func (q *JobQueue) Retry(ctx context.Context, id int64) error {
+	tag, err := q.db.Exec(ctx, `UPDATE jobs
+		SET state = 'available', scheduled_at = now(), finished_at = NULL,
+			max_attempts = GREATEST(max_attempts, attempts + 1)
+		WHERE id = $1 AND state IN ('failed', 'cancelled')`, id)
+	if err != nil {
+		return fmt.Errorf("failed to retry job %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: no failed or cancelled job %d", errJobNotFound, id)
+	}
+	q.Wake()
+	return nil
+}
+
+// Cancel stops an unfinished job from being run or retried. A running
+// attempt is not interrupted, but its outcome is discarded.
+func (q *JobQueue) Cancel(ctx context.Context, id int64) error {
+	tag, err := q.db.Exec(ctx, `UPDATE jobs
+		SET state = 'cancelled', finished_at = now()
+		WHERE id = $1 AND state IN ('available', 'running')`, id)
+	if err != nil {
+		return fmt.Errorf("failed to cancel job %d: %w", id, err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("%w: no available or running job %d", errJobNotFound, id)
+	}
+	return nil
+}
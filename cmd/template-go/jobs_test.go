@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type emailArgs struct {
+	To string `json:"to"`
+}
+
+func (emailArgs) Kind() string { return "email" }
+
+type reportArgs struct {
+	Day string `json:"day"`
+}
+
+func (reportArgs) Kind() string { return "report" }
+
+// emailRow returns a claimed email job.
+func emailRow(id int64, attempts int) []any {
+	return []any{id, "email", json.RawMessage(`{"to":"a@example.com"}`), 0, attempts, 3, time.Unix(0, 0)}
+}
+
+func TestRegisterJob(t *testing.T) {
+	t.Run("rejects duplicate kinds", func(t *testing.T) {
+		q := NewJobQueue(&fakePool{}, JobQueueOptions{})
+		RegisterJob(q, func(context.Context, *Job[emailArgs]) error { return nil })
+		assert.Panics(t, func() {
+			RegisterJob(q, func(context.Context, *Job[emailArgs]) error { return nil })
+		})
+	})
+
+	t.Run("rejects registration after Run", func(t *testing.T) {
+		q := NewJobQueue(&fakePool{}, JobQueueOptions{})
+		q.Run(t.Context())
+		assert.Panics(t, func() {
+			RegisterJob(q, func(context.Context, *Job[emailArgs]) error { return nil })
+		})
+	})
+
+	t.Run("decodes args", func(t *testing.T) {
+		q := NewJobQueue(&fakePool{}, JobQueueOptions{})
+		var got *Job[emailArgs]
+		RegisterJob(q, func(_ context.Context, job *Job[emailArgs]) error {
+			got = job
+			return nil
+		})
+
+		require.NoError(t, q.run(t.Context(), &jobRow{ID: 7, Kind: "email", Args: json.RawMessage(`{"to":"a@example.com"}`), Attempts: 2, MaxAttempts: 3}))
+		assert.Equal(t, &Job[emailArgs]{ID: 7, Args: emailArgs{To: "a@example.com"}, Attempt: 2, MaxAttempts: 3}, got)
+	})
+
+	t.Run("fails undecodable args permanently", func(t *testing.T) {
+		q := NewJobQueue(&fakePool{}, JobQueueOptions{})
+		RegisterJob(q, func(context.Context, *Job[emailArgs]) error { return nil })
+
+		err := q.run(t.Context(), &jobRow{Kind: "email", Args: json.RawMessage(`[]`)})
+		var permanent *permanentError
+		assert.ErrorAs(t, err, &permanent)
+	})
+
+	t.Run("recovers panics", func(t *testing.T) {
+		q := NewJobQueue(&fakePool{}, JobQueueOptions{})
+		RegisterJob(q, func(context.Context, *Job[emailArgs]) error { panic("boom") })
+
+		err := q.run(t.Context(), &jobRow{Kind: "email", Args: json.RawMessage(`{}`)})
+		assert.EqualError(t, err, "panic: boom")
+	})
+}
+
+func TestJobQueueEnqueue(t *testing.T) {
+	db := &fakePool{recordingQuerier: recordingQuerier{Rows: [][]any{{int64(5)}}}}
+	q := NewJobQueue(db, JobQueueOptions{MaxAttempts: 7})
+	at := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	id, err := q.Enqueue(t.Context(), emailArgs{To: "a@example.com"}, JobOptions{Priority: 2, ScheduledAt: at, UniqueKey: "welcome"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), id)
+
+	_, err = q.Enqueue(t.Context(), reportArgs{Day: "2026-01-02"}, JobOptions{MaxAttempts: 1})
+	require.NoError(t, err)
+
+	calls := db.Calls()
+	require.Len(t, calls, 4)
+	assert.Equal(t, []any{"email", []byte(`{"to":"a@example.com"}`), 2, at, 7, "welcome"}, calls[0].Args)
+	assert.Equal(t, []any{jobsChannel, "email"}, calls[1].Args)
+	assert.Equal(t, []any{"report", []byte(`{"day":"2026-01-02"}`), 0, nil, 1, nil}, calls[2].Args)
+}
+
+// scriptedRowPool answers QueryRow with rows in turn, a nil row standing
+// for no rows.
+type scriptedRowPool struct {
+	fakePool
+
+	rows [][]any
+}
+
+func (p *scriptedRowPool) QueryRow(_ context.Context, sql string, args ...any) pgx.Row {
+	p.record("QueryRow", sql, args)
+	row := p.rows[0]
+	p.rows = p.rows[1:]
+	if row == nil {
+		return fakeRow{err: pgx.ErrNoRows}
+	}
+	return fakeRow{values: row}
+}
+
+func TestJobQueueEnqueueUnique(t *testing.T) {
+	tests := []struct {
+		name      string
+		rows      [][]any
+		wantID    int64
+		wantCalls int
+	}{
+		{name: "returns the duplicate", rows: [][]any{nil, {int64(5)}}, wantID: 5, wantCalls: 2},
+		{name: "inserts again once the duplicate finished", rows: [][]any{nil, nil, {int64(9)}}, wantID: 9, wantCalls: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &scriptedRowPool{rows: tt.rows}
+			q := NewJobQueue(db, JobQueueOptions{})
+
+			id, err := q.Enqueue(t.Context(), emailArgs{To: "a@example.com"}, JobOptions{UniqueKey: "welcome"})
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantID, id)
+			assert.Len(t, db.Calls(), tt.wantCalls)
+			assert.Empty(t, db.rows)
+		})
+	}
+}
+
+func TestJobQueueFinish(t *testing.T) {
+	errDown := errors.New("smtp down")
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+		wantSQL  string
+		wantArgs []any
+	}{
+		{
+			name:     "completes",
+			attempts: 1,
+			wantSQL:  "UPDATE jobs SET state = 'completed', finished_at = now() WHERE id = $1 AND attempts = $2 AND state = 'running'",
+			wantArgs: []any{int64(7), 1},
+		},
+		{
+			name:     "retries with backoff",
+			err:      errDown,
+			attempts: 2,
+			wantSQL:  "UPDATE jobs SET state = 'available', last_error = $3, scheduled_at = now() + make_interval(secs => $4) WHERE id = $1 AND attempts = $2 AND state = 'running'",
+			wantArgs: []any{int64(7), 2, "smtp down", 2.0},
+		},
+		{
+			name:     "fails after max attempts",
+			err:      errDown,
+			attempts: 3,
+			wantSQL:  "UPDATE jobs SET state = 'failed', last_error = $3, finished_at = now() WHERE id = $1 AND attempts = $2 AND state = 'running'",
+			wantArgs: []any{int64(7), 3, "smtp down"},
+		},
+		{
+			name:     "fails permanent errors",
+			err:      Permanent(errDown),
+			attempts: 1,
+			wantSQL:  "UPDATE jobs SET state = 'failed', last_error = $3, finished_at = now() WHERE id = $1 AND attempts = $2 AND state = 'running'",
+			wantArgs: []any{int64(7), 1, "smtp down"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &fakePool{}
+			q := NewJobQueue(db, JobQueueOptions{})
+
+			require.NoError(t, q.finish(t.Context(), slog.Default(), &jobRow{ID: 7, Attempts: tt.attempts, MaxAttempts: 3}, tt.err))
+
+			calls := db.Calls()
+			require.Len(t, calls, 1)
+			assert.Equal(t, tt.wantSQL, calls[0].SQL)
+			assert.Equal(t, tt.wantArgs, calls[0].Args)
+		})
+	}
+}
+
+func TestJobQueueRun(t *testing.T) {
+	t.Run("returns without workers", func(t *testing.T) {
+		q := NewJobQueue(&fakePool{}, JobQueueOptions{Workers: 0})
+		RegisterJob(q, func(context.Context, *Job[emailArgs]) error { return nil })
+		q.Run(t.Context())
+	})
+
+	t.Run("waits for jobs in flight on shutdown", func(t *testing.T) {
+		db := &fakePool{recordingQuerier: recordingQuerier{Rows: [][]any{emailRow(7, 1)}}}
+		q := NewJobQueue(db, JobQueueOptions{Workers: 1, PollInterval: time.Hour})
+		started, release := make(chan struct{}), make(chan struct{})
+		var jobErr error
+		RegisterJob(q, func(ctx context.Context, _ *Job[emailArgs]) error {
+			close(started)
+			<-release
+			jobErr = ctx.Err()
+			return nil
+		})
+
+		ctx, cancel := context.WithCancel(t.Context())
+		done := make(chan struct{})
+		go func() {
+			q.Run(ctx)
+			close(done)
+		}()
+
+		<-started
+		cancel()
+		select {
+		case <-done:
+			t.Fatal("Run returned before the job finished")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		close(release)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Run did not return")
+		}
+		require.NoError(t, jobErr, "the job context must outlive shutdown")
+
+		calls := db.Calls()
+		assert.Contains(t, calls[len(calls)-1].SQL, "state = 'completed'")
+	})
+}
+
+func TestJobQueueRetryCancel(t *testing.T) {
+	tests := []struct {
+		name    string
+		tag     string
+		call    func(q *JobQueue, ctx context.Context) error
+		wantErr error
+	}{
+		{name: "retry", tag: "UPDATE 1", call: func(q *JobQueue, ctx context.Context) error { return q.Retry(ctx, 1) }},
+		{name: "retry missing", tag: "UPDATE 0", call: func(q *JobQueue, ctx context.Context) error { return q.Retry(ctx, 1) }, wantErr: errJobNotFound},
+		{name: "cancel", tag: "UPDATE 1", call: func(q *JobQueue, ctx context.Context) error { return q.Cancel(ctx, 1) }},
+		{name: "cancel missing", tag: "UPDATE 0", call: func(q *JobQueue, ctx context.Context) error { return q.Cancel(ctx, 1) }, wantErr: errJobNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewJobQueue(&fakePool{recordingQuerier: recordingQuerier{Tag: tt.tag}}, JobQueueOptions{})
+			err := tt.call(q, t.Context())
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestJobQueuePrune(t *testing.T) {
+	db := &fakePool{recordingQuerier: recordingQuerier{Tag: "DELETE 3"}}
+	q := NewJobQueue(db, JobQueueOptions{})
+
+	require.NoError(t, q.Prune(t.Context(), time.Hour))
+	assert.Equal(t, []any{3600.0}, db.Calls()[0].Args)
+}
+
+func TestJobQueueList(t *testing.T) {
+	db := &fakePool{}
+	q := NewJobQueue(db, JobQueueOptions{})
+
+	_, err := q.List(t.Context(), JobFilter{})
+	require.NoError(t, err)
+	_, err = q.List(t.Context(), JobFilter{State: JobFailed, Kind: "email", Limit: 5})
+	require.NoError(t, err)
+
+	calls := db.Calls()
+	assert.NotContains(t, calls[0].SQL, "WHERE")
+	assert.Equal(t, []any{50}, calls[0].Args)
+	assert.Contains(t, calls[1].SQL, "WHERE state = $1 AND kind = $2 ORDER BY id DESC LIMIT $3")
+	assert.Equal(t, []any{JobFailed, "email", 5}, calls[1].Args)
+}
+
+func TestJobQueueIntegration(t *testing.T) {
+	skipIfNoTestcontainers(t)
+
+	_, err := testPool.Exec(t.Context(), "TRUNCATE jobs")
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = testPool.Exec(context.Background(), "TRUNCATE jobs") })
+
+	q := NewJobQueue(testPool, JobQueueOptions{Workers: 2, PollInterval: 10 * time.Millisecond, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	ran := make(chan string, 10)
+	RegisterJob(q, func(_ context.Context, job *Job[emailArgs]) error {
+		ran <- job.Args.To
+		if job.Args.To == "flaky" && job.Attempt < 2 {
+			return errors.New("try again")
+		}
+		return nil
+	})
+
+	first, err := q.Enqueue(t.Context(), emailArgs{To: "a"}, JobOptions{UniqueKey: "a"})
+	require.NoError(t, err)
+	dup, err := q.Enqueue(t.Context(), emailArgs{To: "a"}, JobOptions{UniqueKey: "a"})
+	require.NoError(t, err)
+	assert.Equal(t, first, dup, "unique jobs are enqueued once")
+
+	_, err = q.Enqueue(t.Context(), emailArgs{To: "flaky"}, JobOptions{})
+	require.NoError(t, err)
+	later, err := q.Enqueue(t.Context(), emailArgs{To: "later"}, JobOptions{ScheduledAt: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(done)
+	}()
+
+	var got []string
+	for range 3 {
+		select {
+		case to := <-ran:
+			got = append(got, to)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("jobs did not run, got %v", got)
+		}
+	}
+	assert.ElementsMatch(t, []string{"a", "flaky", "flaky"}, got)
+
+	require.Eventually(t, func() bool {
+		jobs, err := q.List(t.Context(), JobFilter{State: JobCompleted})
+		return err == nil && len(jobs) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	require.NoError(t, q.Cancel(t.Context(), later))
+	require.ErrorIs(t, q.Cancel(t.Context(), later), errJobNotFound)
+	require.NoError(t, q.Retry(t.Context(), later))
+
+	jobs, err := q.List(t.Context(), JobFilter{Kind: "email", State: JobAvailable})
+	require.NoError(t, err)
+	require.Len(t, jobs, 1)
+	assert.Equal(t, later, jobs[0].ID)
+}
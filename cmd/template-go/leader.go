@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ElectorOptions configures an Elector.
+type ElectorOptions struct {
+	// RetryInterval is how often followers try to take leadership, and
+	// so bounds failover once the lock is released.
+	RetryInterval time.Duration
+	// Lease bounds how long a leader that stopped responding keeps the
+	// lock: Postgres ends its session once idle for Lease. The leader
+	// checks its connection every Lease/3 and steps down when a check
+	// fails, before Postgres would give the lock away.
+	Lease time.Duration
+}
+
+const (
+	defaultLeaderRetryInterval = time.Second
+	defaultLeaderLease         = 5 * time.Second
+)
+
+var errNotLeader = errors.New("not the leader")
+
+// leaderConn is a dedicated connection, satisfied by *pgx.Conn.
+type leaderConn interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Ping(ctx context.Context) error
+	Close(ctx context.Context) error
+}
+
+// leaderConnector opens a dedicated connection.
+type leaderConnector func(ctx context.Context) (leaderConn, error)
+
+// poolLeaderConnector opens connections outside of pool, so that the
+// session holding the lock is not shared with other queries.
+func poolLeaderConnector(pool *pgxpool.Pool) leaderConnector {
+	return func(ctx context.Context) (leaderConn, error) {
+		return dialPool(ctx, pool)
+	}
+}
+
+// LeaderFunc runs while leadership is held. Its context is canceled when
+// leadership is lost, and token is the fencing token of the term.
+type LeaderFunc func(ctx context.Context, token int64)
+
+// Elector elects one leader among the instances sharing a name, using a
+// session-level advisory lock held on a dedicated connection. Every new
+// leader increments the token in leader_terms, which CheckFence uses to
+// reject writes from a deposed leader that has not noticed yet.
+type Elector struct {
+	connect  leaderConnector
+	name     string
+	key      int64
+	opts     ElectorOptions
+	instance string
+
+	mu       sync.Mutex
+	acquired []LeaderFunc
+	lost     []func(token int64)
+	running  bool
+	token    atomic.Int64
+}
+
+// NewElector creates an Elector for the leadership name.
+func NewElector(connect leaderConnector, name string, opts ElectorOptions) *Elector {
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = defaultLeaderRetryInterval
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = defaultLeaderLease
+	}
+	host, _ := os.Hostname()
+	return &Elector{
+		connect:  connect,
+		name:     name,
+		key:      leaderLockKey(name),
+		opts:     opts,
+		instance: host + ":" + strconv.Itoa(os.Getpid()),
+	}
+}
+
+// OnAcquired registers fn to run in its own goroutine whenever this
+// instance becomes the leader. It must be called before Run.
+func (e *Elector) OnAcquired(fn LeaderFunc) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running {
+		panic("leader: OnAcquired called after Run")
+	}
+	e.acquired = append(e.acquired, fn)
+}
+
+// OnLost registers fn to run when leadership ends, after every
+// LeaderFunc of the term returned. It must be called before Run.
+func (e *Elector) OnLost(fn func(token int64)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.running {
+		panic("leader: OnLost called after Run")
+	}
+	e.lost = append(e.lost, fn)
+}
+
+// Token returns the fencing token of the current term, or 0 while this
+// instance is not the leader.
+func (e *Elector) Token() int64 {
+	return e.token.Load()
+}
+
+// Run campaigns for leadership until ctx is canceled, then steps down
+// and releases the lock. Without callbacks there is nothing to lead and
+// it returns at once.
+func (e *Elector) Run(ctx context.Context) {
+	e.mu.Lock()
+	e.running = true
+	idle := len(e.acquired) == 0 && len(e.lost) == 0
+	e.mu.Unlock()
+	if idle {
+		return
+	}
+
+	for {
+		err := e.campaign(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		leaderStats.Add("errors", 1)
+		slog.WarnContext(ctx, "Leader election failed", "name", e.name, "error", err, "retry_in", e.opts.RetryInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.opts.RetryInterval):
+		}
+	}
+}
+
+// campaign connects and tries to take the lock until it does, then leads
+// until the connection fails or ctx is canceled. Closing the connection
+// ends the session and so releases the lock.
+func (e *Elector) campaign(ctx context.Context) error {
+	conn, err := e.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+		defer cancel()
+		_ = conn.Close(closeCtx)
+	}()
+
+	for {
+		token, ok, err := e.tryAcquire(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if ok {
+			return e.lead(ctx, conn, token)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(e.opts.RetryInterval):
+		}
+	}
+}
+
+// tryAcquire takes the lock if it is free and starts a new term.
+func (e *Elector) tryAcquire(ctx context.Context, conn leaderConn) (int64, bool, error) {
+	var ok bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", e.key).Scan(&ok); err != nil {
+		return 0, false, fmt.Errorf("failed to take advisory lock: %w", err)
+	}
+	if !ok {
+		return 0, false, nil
+	}
+
+	lease := strconv.FormatInt(e.opts.Lease.Milliseconds(), 10)
+	if _, err := conn.Exec(ctx, "SELECT set_config('idle_session_timeout', $1, false)", lease); err != nil {
+		return 0, false, fmt.Errorf("failed to set lease: %w", err)
+	}
+	var token int64
+	if err := conn.QueryRow(ctx, `INSERT INTO leader_terms (name, token, holder) VALUES ($1, 1, $2)
+		ON CONFLICT (name) DO UPDATE SET token = leader_terms.token + 1, holder = excluded.holder, acquired_at = now()
+		RETURNING token`, e.name, e.instance).Scan(&token); err != nil {
+		return 0, false, fmt.Errorf("failed to start term: %w", err)
+	}
+	return token, true, nil
+}
+
+// lead runs the callbacks of a term until the connection fails or ctx is
+// canceled.
+func (e *Elector) lead(ctx context.Context, conn leaderConn, token int64) error {
+	e.mu.Lock()
+	acquired, lost := e.acquired, e.lost
+	e.mu.Unlock()
+
+	e.token.Store(token)
+	leaderStats.Add("acquired", 1)
+	slog.InfoContext(ctx, "Leadership acquired", "name", e.name, "token", token)
+
+	leadCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	for _, fn := range acquired {
+		wg.Go(func() { e.call(leadCtx, fn, token) })
+	}
+	err := e.hold(leadCtx, conn)
+	cancel()
+	wg.Wait()
+
+	e.token.Store(0)
+	leaderStats.Add("lost", 1)
+	for _, fn := range lost {
+		fn(token)
+	}
+	if ctx.Err() != nil {
+		slog.InfoContext(ctx, "Leadership released", "name", e.name, "token", token)
+	} else {
+		slog.WarnContext(ctx, "Leadership lost", "name", e.name, "token", token, "error", err)
+	}
+	return err
+}
+
+// hold checks the connection every Lease/3 until a check fails or ctx
+// is canceled.
+func (e *Elector) hold(ctx context.Context, conn leaderConn) error {
+	interval := e.opts.Lease / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		pingCtx, cancel := context.WithTimeout(ctx, interval)
+		err := conn.Ping(pingCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to check connection: %w", err)
+		}
+	}
+}
+
+// call runs fn, logging a panic rather than crashing the process.
+func (e *Elector) call(ctx context.Context, fn LeaderFunc, token int64) {
+	defer func() {
+		if p := recover(); p != nil {
+			leaderStats.Add("errors", 1)
+			slog.ErrorContext(ctx, "Leader callback panicked", "name", e.name, "panic", p)
+		}
+	}()
+	fn(ctx, token)
+}
+
+// CheckFence fails with errNotLeader unless token is the current term.
+// Called in the transaction making the leader's writes, it also keeps a
+// new term from starting until that transaction ends, so a deposed leader
+// cannot commit once its successor took over.
+func (e *Elector) CheckFence(ctx context.Context, db Querier, token int64) error {
+	var current int64
+	err := querier(ctx, db).QueryRow(ctx, "SELECT token FROM leader_terms WHERE name = $1 FOR SHARE", e.name).Scan(&current)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return errNotLeader
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check fencing token: %w", err)
+	}
+	if current != token {
+		return fmt.Errorf("%w: token %d superseded by %d", errNotLeader, token, current)
+	}
+	return nil
+}
+
+// Fence checks, in the transaction of q, that a write may still proceed.
+type Fence func(ctx context.Context, q Querier) error
+
+// Fence returns a Fence calling CheckFence with token.
+func (e *Elector) Fence(token int64) Fence {
+	return func(ctx context.Context, q Querier) error {
+		return e.CheckFence(ctx, q, token)
+	}
+}
+
+// leaderLockKey derives the advisory lock key of a leadership name.
+func leaderLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("leader:" + name))
+	return int64(h.Sum64()) //nolint:gosec // the key only needs to be stable
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLockServer emulates the advisory locks and leader_terms of a
+// Postgres server for the sessions it hands out.
+type fakeLockServer struct {
+	mu      sync.Mutex
+	holders map[int64]*fakeLeaderConn
+	tokens  map[string]int64
+}
+
+func newFakeLockServer() *fakeLockServer {
+	return &fakeLockServer{holders: map[int64]*fakeLeaderConn{}, tokens: map[string]int64{}}
+}
+
+func (s *fakeLockServer) connect(context.Context) (leaderConn, error) {
+	return &fakeLeaderConn{server: s}, nil
+}
+
+// drop ends the session holding key, as when its connection is lost.
+func (s *fakeLockServer) drop(key int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn := s.holders[key]; conn != nil {
+		conn.ended = true
+		delete(s.holders, key)
+	}
+}
+
+func (s *fakeLockServer) held(key int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.holders[key] != nil
+}
+
+// fakeLeaderConn is a session of a fakeLockServer.
+type fakeLeaderConn struct {
+	server *fakeLockServer
+	ended  bool
+}
+
+var errSessionEnded = errors.New("session ended")
+
+func (c *fakeLeaderConn) Exec(context.Context, string, ...any) (pgconn.CommandTag, error) {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.ended {
+		return pgconn.CommandTag{}, errSessionEnded
+	}
+	return pgconn.NewCommandTag("SELECT 1"), nil
+}
+
+func (c *fakeLeaderConn) QueryRow(_ context.Context, sql string, args ...any) pgx.Row {
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c.ended {
+		return fakeRow{err: errSessionEnded}
+	}
+	switch {
+	case strings.Contains(sql, "pg_try_advisory_lock"):
+		key := args[0].(int64)
+		if holder := s.holders[key]; holder != nil && holder != c {
+			return fakeRow{values: []any{false}}
+		}
+		s.holders[key] = c
+		return fakeRow{values: []any{true}}
+	case strings.HasPrefix(sql, "INSERT INTO leader_terms"):
+		name := args[0].(string)
+		s.tokens[name]++
+		return fakeRow{values: []any{s.tokens[name]}}
+	}
+	return fakeRow{err: errors.New("unexpected query: " + sql)}
+}
+
+func (c *fakeLeaderConn) Ping(context.Context) error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.ended {
+		return errSessionEnded
+	}
+	return nil
+}
+
+func (c *fakeLeaderConn) Close(context.Context) error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	c.ended = true
+	for key, holder := range c.server.holders {
+		if holder == c {
+			delete(c.server.holders, key)
+		}
+	}
+	return nil
+}
+
+var testElectorOptions = ElectorOptions{RetryInterval: 5 * time.Millisecond, Lease: 30 * time.Millisecond}
+
+// leaderEvents records the terms an Elector acquires and loses.
+type leaderEvents struct {
+	acquired chan int64
+	lost     chan int64
+}
+
+// watchLeadership registers callbacks recording the terms of e and
+// leading until leadership is lost.
+func watchLeadership(e *Elector) *leaderEvents {
+	ev := &leaderEvents{acquired: make(chan int64, 8), lost: make(chan int64, 8)}
+	e.OnAcquired(func(ctx context.Context, token int64) {
+		ev.acquired <- token
+		<-ctx.Done()
+	})
+	e.OnLost(func(token int64) { ev.lost <- token })
+	return ev
+}
+
+// runElector runs e until the returned function is called, which waits
+// for Run to return.
+func runElector(t *testing.T, e *Elector) (stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.Run(ctx)
+	}()
+	stop = func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func receive(t *testing.T, ch <-chan int64) int64 {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a leadership change")
+		return 0
+	}
+}
+
+func TestElectorRegister(t *testing.T) {
+	e := NewElector(newFakeLockServer().connect, "test", ElectorOptions{})
+	e.Run(t.Context())
+
+	assert.Panics(t, func() { e.OnAcquired(func(context.Context, int64) {}) })
+	assert.Panics(t, func() { e.OnLost(func(int64) {}) })
+}
+
+func TestElector(t *testing.T) {
+	t.Run("releases leadership on shutdown", func(t *testing.T) {
+		server := newFakeLockServer()
+		e := NewElector(server.connect, "test", testElectorOptions)
+		ev := watchLeadership(e)
+		stop := runElector(t, e)
+
+		assert.Equal(t, int64(1), receive(t, ev.acquired))
+		assert.Equal(t, int64(1), e.Token())
+		assert.True(t, server.held(leaderLockKey("test")))
+
+		stop()
+		assert.Equal(t, int64(1), receive(t, ev.lost))
+		assert.Zero(t, e.Token())
+		assert.False(t, server.held(leaderLockKey("test")))
+	})
+
+	t.Run("fails over when the leader's connection drops", func(t *testing.T) {
+		server := newFakeLockServer()
+		first := NewElector(server.connect, "test", testElectorOptions)
+		firstEvents := watchLeadership(first)
+		runElector(t, first)
+		require.Equal(t, int64(1), receive(t, firstEvents.acquired))
+
+		second := NewElector(server.connect, "test", testElectorOptions)
+		secondEvents := watchLeadership(second)
+		runElector(t, second)
+		select {
+		case <-secondEvents.acquired:
+			t.Fatal("two leaders at once")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		server.drop(leaderLockKey("test"))
+		assert.Equal(t, int64(1), receive(t, firstEvents.lost))
+		assert.Equal(t, int64(2), receive(t, secondEvents.acquired))
+		assert.Equal(t, int64(2), second.Token())
+	})
+
+	t.Run("elects separately per name", func(t *testing.T) {
+		server := newFakeLockServer()
+		a := NewElector(server.connect, "a", testElectorOptions)
+		b := NewElector(server.connect, "b", testElectorOptions)
+		aEvents, bEvents := watchLeadership(a), watchLeadership(b)
+		runElector(t, a)
+		runElector(t, b)
+
+		assert.Equal(t, int64(1), receive(t, aEvents.acquired))
+		assert.Equal(t, int64(1), receive(t, bEvents.acquired))
+	})
+
+	t.Run("survives panicking callbacks", func(t *testing.T) {
+		e := NewElector(newFakeLockServer().connect, "test", testElectorOptions)
+		e.OnAcquired(func(context.Context, int64) { panic("boom") })
+		ev := watchLeadership(e)
+		runElector(t, e)
+
+		assert.Equal(t, int64(1), receive(t, ev.acquired))
+	})
+}
+
+func TestElectorCheckFence(t *testing.T) {
+	tests := []struct {
+		name    string
+		rows    [][]any
+		token   int64
+		wantErr bool
+	}{
+		{name: "current term", rows: [][]any{{int64(3)}}, token: 3},
+		{name: "superseded term", rows: [][]any{{int64(4)}}, token: 3, wantErr: true},
+		{name: "no term", token: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &fakePool{recordingQuerier: recordingQuerier{Rows: tt.rows}}
+			e := NewElector(newFakeLockServer().connect, "test", ElectorOptions{})
+
+			err := e.CheckFence(t.Context(), db, tt.token)
+			if tt.wantErr {
+				require.ErrorIs(t, err, errNotLeader)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, []any{"test"}, db.Calls()[0].Args)
+		})
+	}
+}
+
+func TestElectorIntegration(t *testing.T) {
+	skipIfNoTestcontainers(t)
+	t.Cleanup(func() {
+		_, _ = testPool.Exec(context.Background(), "DELETE FROM leader_terms WHERE name = 'integration'")
+	})
+
+	opts := ElectorOptions{RetryInterval: 50 * time.Millisecond, Lease: 600 * time.Millisecond}
+	first := NewElector(poolLeaderConnector(testPool), "integration", opts)
+	firstEvents := watchLeadership(first)
+	runElector(t, first)
+	firstToken := receive(t, firstEvents.acquired)
+
+	second := NewElector(poolLeaderConnector(testPool), "integration", opts)
+	secondEvents := watchLeadership(second)
+	stopSecond := runElector(t, second)
+
+	// Terminating the leader's session releases its lock, as when its
+	// connection drops.
+	_, err := testPool.Exec(t.Context(), `SELECT pg_terminate_backend(pid) FROM pg_locks
+		WHERE locktype = 'advisory' AND granted AND (classid::bigint << 32 | objid::bigint) = $1`, leaderLockKey("integration"))
+	require.NoError(t, err)
+
+	assert.Equal(t, firstToken, receive(t, firstEvents.lost))
+	secondToken := receive(t, secondEvents.acquired)
+	assert.Equal(t, firstToken+1, secondToken)
+
+	err = pgx.BeginFunc(t.Context(), testPool, func(tx pgx.Tx) error {
+		return first.CheckFence(t.Context(), tx, firstToken)
+	})
+	require.ErrorIs(t, err, errNotLeader)
+	require.NoError(t, pgx.BeginFunc(t.Context(), testPool, func(tx pgx.Tx) error {
+		return second.CheckFence(t.Context(), tx, secondToken)
+	}))
+
+	stopSecond()
+	assert.Equal(t, secondToken, receive(t, secondEvents.lost))
+	assert.Equal(t, secondToken+1, receive(t, firstEvents.acquired), "the released lock is taken over")
+}
@@ -4,6 +4,7 @@ package main
 import (
 	"context"
 	"errors"
+	"expvar"
 	"log/slog"
 	"net/http"
 	"os"
@@ -21,6 +22,14 @@ func main() {
 		os.Exit(1)
 	}
 
+	if len(os.Args) > 1 {
+		if err := runCommand(context.Background(), cfg, os.Args[1:], os.Stdout); err != nil {
+			slog.Error("Command failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	app, err := NewApp(cfg)
 	if err != nil {
 		slog.Error("Failed to initialize application", "error", err)
@@ -31,6 +40,8 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	app.Start(ctx)
+
 	go func() {
 		slog.Info("Starting server", "address", server.Addr)
 		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -54,17 +65,136 @@ func main() {
 	app.Close()
 }
 
-func (app *App) newServer() *http.Server {
-	mux := http.NewServeMux()
+// routes registers the documented API routes.
+func (app *App) routes() *Router {
+	rt := NewRouter()
 
-	mux.HandleFunc("GET /health", handleHealth)
-	mux.HandleFunc("GET /test", app.handleDatabaseTest)
+	rt.HandleFunc("GET /health", handleHealth, RouteDoc{
+		Summary: "Health check",
+		Tags:    []string{"system"},
+	})
+	rt.HandleFunc("GET /ready", handleReady(app.readinessChecks()), RouteDoc{
+		Summary:     "Readiness check",
+		Description: "Reports whether the database and notification listener can serve traffic.",
+		Tags:        []string{"system"},
+		ContentType: "application/json",
+		Response:    ReadinessReport{},
+		Errors:      []int{http.StatusServiceUnavailable},
+	})
+	rt.Handle("GET /events", app.Events, RouteDoc{
+		Summary:     "Event stream",
+		Description: "Streams notifications on the requested topics as server-sent events. Clients resuming with Last-Event-ID receive the events they missed, or a reset event when those are no longer available.",
+		Tags:        []string{"events"},
+		ContentType: "text/event-stream",
+		Response:    "",
+		Parameters: []Parameter{
+			{Name: "topic", In: "query", Required: true, Schema: &Schema{Type: "array", Items: &Schema{Type: "string"}}},
+			{Name: "Last-Event-ID", In: "header", Schema: &Schema{Type: "string"}},
+		},
+		Errors: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusNotAcceptable, http.StatusServiceUnavailable},
+	})
+	rt.Handle("GET /ws", app.WebSockets.Handler(handleEcho), RouteDoc{
+		Summary:     "WebSocket echo",
+		Description: "Upgrades to a WebSocket that sends every message back.",
+		Tags:        []string{"events"},
+		Status:      http.StatusSwitchingProtocols,
+		Errors:      []int{http.StatusBadRequest, http.StatusForbidden, http.StatusUpgradeRequired, http.StatusNotImplemented, http.StatusServiceUnavailable},
+	})
+	rt.Handle("GET /test", With(Handle(app.databaseTest), Cached(testCachePolicy)), RouteDoc{
+		Summary:     "Database name and version",
+		Tags:        []string{"database"},
+		Errors:      []int{http.StatusGatewayTimeout},
+		Conditional: true,
+	})
+	rt.SecurityScheme(adminScheme, SecurityScheme{
+		Type:        "http",
+		Scheme:      "bearer",
+		Description: "The token configured in SERVICE_ADMIN_TOKEN.",
+	})
+	admin := RequireAdmin(app.Config.AdminToken)
+	rt.Handle("GET /admin/tasks", With(Handle(app.scheduledTasks), admin), RouteDoc{
+		Summary:     "Scheduled tasks",
+		Description: "Lists the scheduled tasks with their next tick and latest run on any instance.",
+		Tags:        []string{"admin"},
+		Errors:      []int{http.StatusUnauthorized, http.StatusNotFound},
+		Security:    []string{adminScheme},
+	})
+	rt.Handle("GET /admin/flags", With(Handle(app.featureFlags), admin), RouteDoc{
+		Summary:     "Feature flags",
+		Description: "Lists the loaded feature flags with their rules and overrides.",
+		Tags:        []string{"admin"},
+		Errors:      []int{http.StatusUnauthorized, http.StatusNotFound},
+		Security:    []string{adminScheme},
+	})
+	rt.Handle("PUT /admin/flags/{name}/override", With(Handle(app.overrideFlag), admin), RouteDoc{
+		Summary:     "Override a feature flag",
+		Description: "Turns a feature flag on or off for every client on every instance, whatever its rules.",
+		Tags:        []string{"admin"},
+		Errors:      []int{http.StatusUnauthorized, http.StatusNotFound},
+		Security:    []string{adminScheme},
+	})
+	rt.Handle("DELETE /admin/flags/{name}/override", With(Handle(app.clearFlagOverride), admin), RouteDoc{
+		Summary:     "Clear a feature flag override",
+		Description: "Makes a feature flag follow its definition again.",
+		Tags:        []string{"admin"},
+		Errors:      []int{http.StatusUnauthorized, http.StatusNotFound},
+		Security:    []string{adminScheme},
+	})
+	rt.Handle("GET /openapi.json", rt.OpenAPIHandler(Info{Title: "template-go", Version: buildVersion()}), RouteDoc{
+		Summary:     "OpenAPI document",
+		Tags:        []string{"system"},
+		ContentType: "application/json",
+	})
+	rt.Handle("GET /debug/vars", With(expvar.Handler(), admin), RouteDoc{
+		Summary:     "Runtime and database routing metrics",
+		Tags:        []string{"admin"},
+		ContentType: "application/json",
+		Errors:      []int{http.StatusUnauthorized, http.StatusNotFound},
+		Security:    []string{adminScheme},
+	})
 
-	return &http.Server{
-		Addr:         ":8000",
-		Handler:      Logger(Recoverer(mux)),
-		IdleTimeout:  60 * time.Second,
-		ReadTimeout:  15 * time.Second,
-		WriteTimeout: 15 * time.Second,
+	return rt
+}
+
+func (app *App) newServer() *http.Server {
+	var handler http.Handler = app.routes()
+	if app.Flags != nil {
+		handler = WithFlags(app.Flags)(handler)
+	}
+	if app.Idempotency != nil {
+		handler = Idempotent(app.Idempotency, app.Config.Idempotency)(handler)
+	}
+	if app.Contract != nil {
+		handler = Contract(app.Contract, app.Config.Contract)(handler)
+	}
+	if len(app.Config.CORS.AllowedOrigins) > 0 {
+		handler = CORS(app.Config.CORS)(handler)
+	}
+	handler = Secure(app.Config.Security)(handler)
+	if app.Config.Compress.MinSize >= 0 {
+		handler = Compress(app.Config.Compress)(handler)
+	}
+	handler = RecovererWith(app.panicReporters()...)(handler)
+	handler = LoggerWith(app.Config.Log)(handler)
+	if len(app.Config.TrustedProxies) > 0 {
+		handler = TrustedProxies(app.Config.TrustedProxies)(handler)
+	}
+
+	server := &http.Server{
+		Addr:           ":8000",
+		Handler:        handler,
+		IdleTimeout:    60 * time.Second,
+		ReadTimeout:    15 * time.Second,
+		WriteTimeout:   15 * time.Second,
+		MaxHeaderBytes: app.Config.MaxHeaderBytes,
+	}
+	// Shutdown waits for idle connections, which streams never become,
+	// and ignores hijacked ones.
+	if app.Events != nil {
+		server.RegisterOnShutdown(app.Events.Close)
+	}
+	if app.WebSockets != nil {
+		server.RegisterOnShutdown(app.WebSockets.Close)
 	}
+	return server
 }
@@ -22,7 +22,15 @@ var (
 
 func testApp(t *testing.T) *App {
 	t.Helper()
-	return &App{DB: testPool}
+	return &App{
+		DB:         testPool,
+		Repos:      NewRepositories(testPool),
+		Config:     &Config{},
+		Events:     NewBroker(BrokerOptions{}),
+		WebSockets: NewWebSockets(WebSocketOptions{}),
+		Scheduler:  NewScheduler(testPool, advisoryLocker{pool: testPool}, SchedulerOptions{}),
+		Flags:      NewFlags(testPool, FlagsOptions{}),
+	}
 }
 
 func TestMain(m *testing.M) {
@@ -84,6 +92,12 @@ func TestMain(m *testing.M) {
 		terminate()
 		os.Exit(1)
 	}
+	if err = Migrate(ctx, testPool); err != nil {
+		fmt.Printf("Failed to migrate database: %s\n", err)
+		testPool.Close()
+		terminate()
+		os.Exit(1)
+	}
 
 	code := m.Run()
 
@@ -107,6 +121,43 @@ func TestNewServer(t *testing.T) {
 	assert.NotNil(t, server.Handler)
 }
 
+func TestNewServerLogsPattern(t *testing.T) {
+	buf := captureLog(t, nil)
+	app := testApp(t)
+	require.NotNil(t, app.Flags)
+	server := app.newServer()
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/openapi.json", http.NoBody)
+	rr := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, buf.String(), `pattern="GET /openapi.json"`)
+}
+
+func TestNewServerDebugVars(t *testing.T) {
+	app := testApp(t)
+	app.Config.AdminToken = "s3cret"
+	server := app.newServer()
+
+	for _, tt := range []struct {
+		authorization string
+		wantStatus    int
+	}{
+		{wantStatus: http.StatusUnauthorized},
+		{authorization: "Bearer s3cret", wantStatus: http.StatusOK},
+	} {
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/debug/vars", http.NoBody)
+		if tt.authorization != "" {
+			req.Header.Set("Authorization", tt.authorization)
+		}
+		rr := httptest.NewRecorder()
+		server.Handler.ServeHTTP(rr, req)
+
+		assert.Equal(t, tt.wantStatus, rr.Code)
+	}
+}
+
 func TestNewServerNonExistentRoute(t *testing.T) {
 	app := testApp(t)
 	server := app.newServer()
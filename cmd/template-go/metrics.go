@@ -0,0 +1,45 @@
+package main
+
+import "expvar"
+
+// Metrics are published with expvar and served at /debug/vars to admins.
+var (
+	// dbRoutes counts queries and transactions per routing decision:
+	// primary, replica, or fallback when no replica is healthy.
+	dbRoutes = expvar.NewMap("db_routes")
+	// dbReplicas reports the health and lag of each replica.
+	dbReplicas = expvar.NewMap("db_replicas")
+	// notifyStats counts notifications received, dropped on full queues,
+	// failed in handlers, and listener reconnects.
+	notifyStats = expvar.NewMap("notify")
+	// eventStats tracks connected SSE clients, published events and
+	// clients disconnected for falling behind.
+	eventStats = expvar.NewMap("events")
+	// websocketStats tracks open WebSocket connections and data messages.
+	websocketStats = expvar.NewMap("websockets")
+	// outboxStats counts relayed, retried and dead-lettered outbox messages
+	// and reports the pending count and the age of the oldest one as lag.
+	outboxStats = expvar.NewMap("outbox")
+	// jobStats counts enqueued, completed, retried, failed and rescued jobs
+	// and tracks the jobs running in this process.
+	jobStats = expvar.NewMap("jobs")
+	// schedulerStats counts task runs that succeeded or failed here, ticks
+	// skipped because another instance ran them, and scheduler errors.
+	schedulerStats = expvar.NewMap("scheduler")
+	// leaderStats counts leadership terms acquired and lost by this
+	// instance and election errors.
+	leaderStats = expvar.NewMap("leader")
+	// idempotencyStats counts responses stored and replayed for
+	// Idempotency-Key requests, duplicates rejected while in flight or
+	// with a different payload, and store errors.
+	idempotencyStats = expvar.NewMap("idempotency")
+	// httpCacheStats counts server-side response cache hits and misses,
+	// requests that shared another's miss, and 304 responses.
+	httpCacheStats = expvar.NewMap("http_cache")
+	// cacheStats holds, per CacheLoader, hits, stale hits served while
+	// reloading, misses, load and cache errors, and invalidations received.
+	cacheStats = expvar.NewMap("cache")
+	// flagStats counts feature flag reloads and failed reloads, which keep
+	// the flags loaded before.
+	flagStats = expvar.NewMap("flags")
+)
@@ -1,65 +1,319 @@
 package main
 
 import (
+	"bufio"
+	"cmp"
+	"context"
+	"fmt"
+	"io"
 	"log/slog"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-// responseWriter captures the HTTP status code.
+// responseWriter captures the HTTP status code and response size.
 type responseWriter struct {
 	http.ResponseWriter
-	status int
+	status      int
+	bytes       int64
+	wroteHeader bool
+	hijacked    bool
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
-	rw.status = code
+	if !rw.wroteHeader {
+		rw.status = code
+		rw.wroteHeader = code >= 200
+	}
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(b)
+	rw.bytes += int64(n)
+	return n, err //nolint:wrapcheck // transparent wrapper
+}
+
+// ReadFrom lets io.Copy use the underlying writer's fast path.
+func (rw *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	rw.wroteHeader = true
+	n, err := io.Copy(rw.ResponseWriter, src)
+	rw.bytes += n
+	return n, err //nolint:wrapcheck // transparent wrapper
+}
+
+// Flush implements http.Flusher when the underlying writer supports it.
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		rw.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker when the underlying writer supports it.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := h.Hijack()
+	if err == nil {
+		rw.wroteHeader, rw.hijacked = true, true
+		rw.status = http.StatusSwitchingProtocols
+	}
+	return conn, brw, err //nolint:wrapcheck // transparent wrapper
+}
+
 func (rw *responseWriter) Unwrap() http.ResponseWriter {
 	return rw.ResponseWriter
 }
 
+// countingReader counts bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err //nolint:wrapcheck // transparent wrapper
+}
+
+// LoggerOptions configures LoggerWith.
+type LoggerOptions struct {
+	// SkipPaths are not logged unless the request fails.
+	// Entries ending in "/" match by prefix.
+	SkipPaths []string
+	// SampleRate is the fraction of successful requests logged,
+	// values outside (0, 1) log every request.
+	SampleRate float64
+	// Combined, when set, receives Apache/NCSA combined log lines
+	// instead of structured slog records.
+	Combined io.Writer
+}
+
 // Logger logs requests with level based on status code.
 func Logger(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/health" {
-			next.ServeHTTP(w, r)
-			return
-		}
+	return LoggerWith(LoggerOptions{SkipPaths: []string{"/health"}})(next)
+}
 
-		start := time.Now()
-		rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
-		next.ServeHTTP(rw, r)
+// LoggerWith returns Logger with path filtering, sampling and output format options.
+// Requests with a 4xx or 5xx status are always logged.
+func LoggerWith(opts LoggerOptions) func(http.Handler) http.Handler {
+	var combinedMu sync.Mutex
 
-		level := slog.LevelInfo
-		switch {
-		case rw.status >= 500:
-			level = slog.LevelError
-		case rw.status >= 400:
-			level = slog.LevelWarn
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+			pattern := &routePattern{}
+			r = r.WithContext(context.WithValue(r.Context(), routePatternKey{}, pattern))
+
+			var body *countingReader
+			if r.Body != nil && r.Body != http.NoBody {
+				body = &countingReader{ReadCloser: r.Body}
+				r.Body = body
+			}
+
+			next.ServeHTTP(rw, r)
+
+			if rw.status < 400 && (opts.skip(r.URL.Path) || !opts.sample()) {
+				return
+			}
+
+			var bytesIn int64
+			if body != nil {
+				bytesIn = body.n
+			}
+
+			if opts.Combined != nil {
+				combinedMu.Lock()
+				defer combinedMu.Unlock()
+				if _, err := io.WriteString(opts.Combined, combinedLogLine(r, rw, start)); err != nil {
+					slog.Error("failed to write access log", "error", err)
+				}
+				return
+			}
+
+			if rw.hijacked {
+				// The handler took over the connection, typically a WebSocket,
+				// and returned when it ended: its duration says more than a 101.
+				slog.LogAttrs(r.Context(), slog.LevelInfo, "connection",
+					slog.String("method", r.Method),
+					slog.String("url", r.URL.RequestURI()),
+					slog.String("pattern", pattern.of(r)),
+					slog.String("proto", r.Proto),
+					slog.String("ip", requestClient(r).IP),
+					slog.String("useragent", r.UserAgent()),
+					slog.String("upgrade", r.Header.Get("Upgrade")),
+					slog.Duration("duration", time.Since(start)),
+				)
+				return
+			}
+
+			level := slog.LevelInfo
+			switch {
+			case rw.status >= 500:
+				level = slog.LevelError
+			case rw.status >= 400:
+				level = slog.LevelWarn
+			}
+
+			slog.LogAttrs(r.Context(), level, "request",
+				slog.String("method", r.Method),
+				slog.String("url", r.URL.RequestURI()),
+				slog.String("pattern", pattern.of(r)),
+				slog.String("proto", r.Proto),
+				slog.String("ip", requestClient(r).IP),
+				slog.String("useragent", r.UserAgent()),
+				slog.Int("status", rw.status),
+				slog.Int64("bytesin", bytesIn),
+				slog.Int64("bytesout", rw.bytes),
+				slog.Duration("duration", time.Since(start)),
+			)
+		})
+	}
+}
+
+type routePatternKey struct{}
+
+// routePattern carries the pattern matched by a Router back to the
+// logger, which only sees its own copy of the request when middleware in
+// between passes a copy on with WithContext.
+type routePattern struct{ value string }
+
+// of returns the pattern reported by a Router, or the one ServeMux set
+// on r.
+func (p *routePattern) of(r *http.Request) string {
+	return cmp.Or(p.value, r.Pattern)
+}
+
+// reportPattern records the pattern of r for the logger, if any.
+func reportPattern(r *http.Request) {
+	if p, ok := r.Context().Value(routePatternKey{}).(*routePattern); ok {
+		p.value = r.Pattern
+	}
+}
+
+func (o *LoggerOptions) skip(path string) bool {
+	for _, p := range o.SkipPaths {
+		if p == path || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
 		}
+	}
+	return false
+}
+
+func (o *LoggerOptions) sample() bool {
+	if o.SampleRate <= 0 || o.SampleRate >= 1 {
+		return true
+	}
+	return rand.Float64() < o.SampleRate //nolint:gosec // sampling does not need a secure source
+}
+
+// combinedLogLine formats a request in the Apache/NCSA combined log format.
+func combinedLogLine(r *http.Request, rw *responseWriter, start time.Time) string {
+	user := "-"
+	if name, _, ok := r.BasicAuth(); ok && name != "" {
+		user = name
+	}
+	size := "-"
+	if rw.bytes > 0 {
+		size = strconv.FormatInt(rw.bytes, 10)
+	}
 
-		slog.LogAttrs(r.Context(), level, "request",
-			slog.String("method", r.Method),
-			slog.String("url", r.URL.RequestURI()),
-			slog.String("useragent", r.UserAgent()),
-			slog.Int("status", rw.status),
-			slog.Duration("duration", time.Since(start)),
-		)
-	})
+	return fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n",
+		requestClient(r).IP,
+		user,
+		start.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+r.URL.RequestURI()+" "+r.Proto),
+		rw.status,
+		size,
+		strconv.Quote(cmp.Or(r.Referer(), "-")),
+		strconv.Quote(cmp.Or(r.UserAgent(), "-")),
+	)
 }
 
 // Recoverer recovers from panics and returns 500.
 func Recoverer(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if err := recover(); err != nil {
-				slog.Error("panic recovered", "error", err, "url", r.URL)
-				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	return RecovererWith()(next)
+}
+
+// RecovererWith returns Recoverer that also forwards panics to the given reporters.
+//
+// When the handler has already sent headers the response cannot be replaced,
+// so the connection is aborted instead. http.ErrAbortHandler is re-panicked
+// untouched for the server to handle.
+func RecovererWith(reporters ...PanicReporter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw, ok := w.(*responseWriter)
+			if !ok {
+				rw = &responseWriter{ResponseWriter: w, status: http.StatusOK}
 			}
-		}()
-		next.ServeHTTP(w, r)
-	})
+
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+
+				report := PanicReport{
+					Time:   time.Now(),
+					Value:  fmt.Sprint(err),
+					Stack:  string(debug.Stack()),
+					Method: r.Method,
+					URL:    r.URL.RequestURI(),
+				}
+				slog.LogAttrs(r.Context(), slog.LevelError, "panic recovered",
+					slog.Any("error", err),
+					slog.String("method", report.Method),
+					slog.String("url", report.URL),
+					slog.String("stack", report.Stack),
+				)
+				for _, reporter := range reporters {
+					reporter.ReportPanic(r.Context(), report)
+				}
+
+				if rw.wroteHeader {
+					panic(http.ErrAbortHandler)
+				}
+
+				clearEntityHeaders(rw.Header())
+				respondProblem(rw, http.StatusInternalServerError, "")
+			}()
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// entityHeaders describe a response body the handler may not have finished.
+var entityHeaders = []string{
+	"Content-Disposition",
+	"Content-Encoding",
+	"Content-Length",
+	"Content-Range",
+	"Content-Type",
+	"ETag",
+	"Last-Modified",
+	"Trailer",
+	"Transfer-Encoding",
+}
+
+func clearEntityHeaders(h http.Header) {
+	for _, key := range entityHeaders {
+		h.Del(key)
+	}
 }
@@ -2,14 +2,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 // captureLog redirects slog to a buffer for the test duration.
@@ -51,6 +54,75 @@ func TestResponseWriter(t *testing.T) {
 		}
 	})
 
+	t.Run("counts written bytes", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		rw := &responseWriter{ResponseWriter: rec, status: http.StatusOK}
+
+		_, _ = rw.Write([]byte("hello "))
+		_, _ = io.Copy(rw, strings.NewReader("world"))
+
+		assert.Equal(t, int64(11), rw.bytes)
+		assert.Equal(t, "hello world", rec.Body.String())
+	})
+
+	t.Run("keeps first status", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		rw := &responseWriter{ResponseWriter: rec, status: http.StatusOK}
+
+		rw.WriteHeader(http.StatusEarlyHints)
+		rw.WriteHeader(http.StatusAccepted)
+		rw.WriteHeader(http.StatusInternalServerError)
+
+		assert.Equal(t, http.StatusAccepted, rw.status)
+	})
+
+	t.Run("implements optional interfaces", func(t *testing.T) {
+		rw := &responseWriter{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+
+		assert.Implements(t, (*http.Flusher)(nil), rw)
+		assert.Implements(t, (*http.Hijacker)(nil), rw)
+		assert.Implements(t, (*io.ReaderFrom)(nil), rw)
+	})
+
+	t.Run("flush reaches underlying writer", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		rw := &responseWriter{ResponseWriter: rec, status: http.StatusOK}
+
+		rw.Flush()
+
+		assert.True(t, rec.Flushed)
+	})
+
+	t.Run("hijack unsupported", func(t *testing.T) {
+		rw := &responseWriter{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+
+		_, _, err := rw.Hijack()
+		require.ErrorIs(t, err, http.ErrNotSupported)
+	})
+
+	t.Run("hijack through server", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+			conn, buf, err := rw.Hijack()
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+			_, _ = buf.WriteString("HTTP/1.1 204 No Content\r\nConnection: close\r\n\r\n")
+			_ = buf.Flush()
+		}))
+		defer ts.Close()
+
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, ts.URL, http.NoBody)
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	})
+
 	t.Run("unwrap returns underlying writer", func(t *testing.T) {
 		rec := httptest.NewRecorder()
 		rw := &responseWriter{ResponseWriter: rec, status: http.StatusOK}
@@ -168,6 +240,111 @@ func TestLoggerMiddlewareRequestDetails(t *testing.T) {
 	assert.Contains(t, logOutput, "duration=")
 }
 
+func TestLoggerMiddlewareSizesAndPattern(t *testing.T) {
+	buf := captureLog(t, nil)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /items/{id}", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = w.Write([]byte("created"))
+	})
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/items/42", strings.NewReader("payload"))
+	req.RemoteAddr = "192.0.2.10:51234"
+	rec := httptest.NewRecorder()
+
+	Logger(mux).ServeHTTP(rec, req)
+
+	logOutput := buf.String()
+	assert.Contains(t, logOutput, `pattern="POST /items/{id}"`)
+	assert.Contains(t, logOutput, "proto=HTTP/1.1")
+	assert.Contains(t, logOutput, "ip=192.0.2.10")
+	assert.Contains(t, logOutput, "bytesin=7")
+	assert.Contains(t, logOutput, "bytesout=7")
+}
+
+func TestLoggerWithFiltering(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         LoggerOptions
+		path         string
+		status       int
+		expectLogged bool
+	}{
+		{"skipped exact path", LoggerOptions{SkipPaths: []string{"/ready"}}, "/ready", http.StatusOK, false},
+		{"skipped prefix", LoggerOptions{SkipPaths: []string{"/static/"}}, "/static/app.js", http.StatusOK, false},
+		{"prefix requires slash", LoggerOptions{SkipPaths: []string{"/static"}}, "/static/app.js", http.StatusOK, true},
+		{"skipped path still logs errors", LoggerOptions{SkipPaths: []string{"/ready"}}, "/ready", http.StatusServiceUnavailable, true},
+		{"skipped path still logs client errors", LoggerOptions{SkipPaths: []string{"/ready"}}, "/ready", http.StatusNotFound, true},
+		{"zero sample rate logs everything", LoggerOptions{}, "/test", http.StatusOK, true},
+		{"tiny sample rate drops successes", LoggerOptions{SampleRate: 1e-12}, "/test", http.StatusOK, false},
+		{"tiny sample rate keeps errors", LoggerOptions{SampleRate: 1e-12}, "/test", http.StatusInternalServerError, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureLog(t, nil)
+
+			handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tt.status)
+			})
+
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, tt.path, http.NoBody)
+			rec := httptest.NewRecorder()
+
+			LoggerWith(tt.opts)(handler).ServeHTTP(rec, req)
+
+			if tt.expectLogged {
+				assert.Contains(t, buf.String(), fmt.Sprintf("status=%d", tt.status))
+			} else {
+				assert.Empty(t, buf.String())
+			}
+		})
+	}
+}
+
+func TestLoggerWithCombinedFormat(t *testing.T) {
+	slogBuf := captureLog(t, nil)
+	var buf bytes.Buffer
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("12345"))
+	})
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/items?x=1", http.NoBody)
+	req.RemoteAddr = "192.0.2.10:51234"
+	req.SetBasicAuth("alice", "secret")
+	req.Header.Set("Referer", "https://app.example.com/")
+	req.Header.Set("User-Agent", "TestAgent/1.0")
+	rec := httptest.NewRecorder()
+
+	LoggerWith(LoggerOptions{Combined: &buf})(handler).ServeHTTP(rec, req)
+
+	assert.Empty(t, slogBuf.String())
+	assert.Regexp(t,
+		`^192\.0\.2\.10 - alice \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\] "POST /items\?x=1 HTTP/1\.1" 201 5 "https://app\.example\.com/" "TestAgent/1\.0"\n$`,
+		buf.String(),
+	)
+}
+
+func TestLoggerWithCombinedFormatEmptyFields(t *testing.T) {
+	var buf bytes.Buffer
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+	req.RemoteAddr = "192.0.2.10:51234"
+	rec := httptest.NewRecorder()
+
+	LoggerWith(LoggerOptions{Combined: &buf})(handler).ServeHTTP(rec, req)
+
+	assert.Contains(t, buf.String(), `192.0.2.10 - - [`)
+	assert.Contains(t, buf.String(), `"GET /test HTTP/1.1" 204 - "-" "-"`)
+}
+
 func TestRecovererMiddleware(t *testing.T) {
 	t.Run("recovers from panic with string", func(t *testing.T) {
 		buf := captureLog(t, nil)
@@ -244,6 +421,158 @@ func TestRecovererMiddleware(t *testing.T) {
 	})
 }
 
+// recordingReporter collects panic reports for assertions.
+type recordingReporter struct {
+	reports []PanicReport
+}
+
+func (r *recordingReporter) ReportPanic(_ context.Context, report PanicReport) {
+	r.reports = append(r.reports, report)
+}
+
+func TestRecovererWith(t *testing.T) {
+	t.Run("logs stack and reports panic", func(t *testing.T) {
+		buf := captureLog(t, nil)
+		reporter := &recordingReporter{}
+
+		handler := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+			panic("reported panic")
+		})
+
+		wrapped := RecovererWith(reporter)(handler)
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/panic?x=1", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		wrapped.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+		assert.Contains(t, buf.String(), "stack=")
+		assert.Contains(t, buf.String(), "runtime/debug.Stack")
+
+		require.Len(t, reporter.reports, 1)
+		report := reporter.reports[0]
+		assert.Equal(t, "reported panic", report.Value)
+		assert.Equal(t, http.MethodPost, report.Method)
+		assert.Equal(t, "/panic?x=1", report.URL)
+		assert.Contains(t, report.Stack, "goroutine")
+		assert.False(t, report.Time.IsZero())
+	})
+
+	t.Run("clears entity headers before responding", func(t *testing.T) {
+		captureLog(t, nil)
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "text/csv")
+			w.Header().Set("Content-Length", "1024")
+			w.Header().Set("ETag", `"abc"`)
+			w.Header().Set("X-Request-Id", "keep")
+			panic("before write")
+		})
+
+		wrapped := Recoverer(handler)
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/panic", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		wrapped.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusInternalServerError, rec.Code)
+		assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+		assert.Empty(t, rec.Header().Get("Content-Length"))
+		assert.Empty(t, rec.Header().Get("ETag"))
+		assert.Equal(t, "keep", rec.Header().Get("X-Request-Id"))
+	})
+
+	t.Run("aborts when headers already sent", func(t *testing.T) {
+		buf := captureLog(t, nil)
+		reporter := &recordingReporter{}
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte("partial"))
+			panic("after write")
+		})
+
+		wrapped := RecovererWith(reporter)(handler)
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/panic", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			wrapped.ServeHTTP(rec, req)
+		})
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "partial", rec.Body.String())
+		assert.Contains(t, buf.String(), "panic recovered")
+		assert.Len(t, reporter.reports, 1)
+	})
+
+	t.Run("aborts after implicit header write", func(t *testing.T) {
+		captureLog(t, nil)
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("partial"))
+			panic("after write")
+		})
+
+		wrapped := Recoverer(handler)
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/panic", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			wrapped.ServeHTTP(rec, req)
+		})
+	})
+
+	t.Run("re-panics ErrAbortHandler without reporting", func(t *testing.T) {
+		buf := captureLog(t, nil)
+		reporter := &recordingReporter{}
+
+		handler := http.HandlerFunc(func(_ http.ResponseWriter, _ *http.Request) {
+			panic(http.ErrAbortHandler)
+		})
+
+		wrapped := RecovererWith(reporter)(handler)
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/abort", http.NoBody)
+		rec := httptest.NewRecorder()
+
+		assert.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			wrapped.ServeHTTP(rec, req)
+		})
+
+		assert.Empty(t, buf.String())
+		assert.Empty(t, reporter.reports)
+	})
+
+	t.Run("aborted connection through server", func(t *testing.T) {
+		captureLog(t, nil)
+
+		handler := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("partial"))
+			_ = http.NewResponseController(w).Flush()
+			panic("after flush")
+		})
+
+		ts := httptest.NewServer(Recoverer(handler))
+		defer ts.Close()
+
+		req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, ts.URL, http.NoBody)
+		require.NoError(t, err)
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		_, err = io.ReadAll(resp.Body)
+		require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+}
+
 func TestMiddlewareChain(t *testing.T) {
 	t.Run("logger and recoverer chain", func(t *testing.T) {
 		buf := captureLog(t, nil)
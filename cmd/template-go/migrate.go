@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// migrations holds the schema as numbered SQL files, NNNN_name.sql.
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// migrationLockID is the advisory lock serializing concurrent migrators,
+// such as replicas of the service starting together.
+const migrationLockID = 0x6d6967726174 // "migrat"
+
+// migration is a schema change read from a migration file.
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// loadMigrations reads the *.sql files of fsys sorted by version.
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+
+	out := make([]migration, 0, len(names))
+	for _, name := range names {
+		prefix, _, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration name %q, want NNNN_name.sql", name)
+		}
+		sql, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %q: %w", name, err)
+		}
+		out = append(out, migration{Version: version, Name: path.Base(name), SQL: string(sql)})
+	}
+
+	slices.SortFunc(out, func(a, b migration) int { return a.Version - b.Version })
+	for i := 1; i < len(out); i++ {
+		if out[i].Version == out[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version %d: %q and %q", out[i].Version, out[i-1].Name, out[i].Name)
+		}
+	}
+	return out, nil
+}
+
+// Migrate applies the embedded migrations that have not run yet, all in
+// one transaction under an advisory lock, so that concurrent instances
+// apply each migration once and a failure leaves the schema unchanged.
+func Migrate(ctx context.Context, db txBeginner) error {
+	sub, err := fs.Sub(migrations, "migrations")
+	if err != nil {
+		return fmt.Errorf("failed to open migrations: %w", err)
+	}
+	return migrate(ctx, db, sub)
+}
+
+func migrate(ctx context.Context, db txBeginner, fsys fs.FS) error {
+	all, err := loadMigrations(fsys)
+	if err != nil {
+		return err
+	}
+
+	return withTx(ctx, db, TxOptions{MaxRetries: -1}, func(ctx context.Context, tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", migrationLockID); err != nil {
+			return fmt.Errorf("failed to lock migrations: %w", err)
+		}
+		if _, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    integer PRIMARY KEY,
+			name       text NOT NULL,
+			applied_at timestamptz NOT NULL DEFAULT now()
+		)`); err != nil {
+			return fmt.Errorf("failed to create schema_migrations: %w", err)
+		}
+
+		rows, err := tx.Query(ctx, "SELECT version FROM schema_migrations")
+		if err != nil {
+			return fmt.Errorf("failed to read applied migrations: %w", err)
+		}
+		applied, err := pgx.CollectRows(rows, pgx.RowTo[int])
+		if err != nil {
+			return fmt.Errorf("failed to read applied migrations: %w", err)
+		}
+
+		for _, m := range all {
+			if slices.Contains(applied, m.Version) {
+				continue
+			}
+			if _, err := tx.Exec(ctx, m.SQL); err != nil {
+				return fmt.Errorf("failed to apply migration %q: %w", m.Name, err)
+			}
+			if _, err := tx.Exec(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name); err != nil {
+				return fmt.Errorf("failed to record migration %q: %w", m.Name, err)
+			}
+			slog.InfoContext(ctx, "Applied migration", "version", m.Version, "name", m.Name)
+		}
+		return nil
+	})
+}
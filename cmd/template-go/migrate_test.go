@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	t.Run("sorts by version", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"0010_later.sql":  {Data: []byte("SELECT 10")},
+			"0002_second.sql": {Data: []byte("SELECT 2")},
+			"0001_first.sql":  {Data: []byte("SELECT 1")},
+			"README.md":       {Data: []byte("ignored")},
+		}
+
+		got, err := loadMigrations(fsys)
+		require.NoError(t, err)
+		assert.Equal(t, []migration{
+			{Version: 1, Name: "0001_first.sql", SQL: "SELECT 1"},
+			{Version: 2, Name: "0002_second.sql", SQL: "SELECT 2"},
+			{Version: 10, Name: "0010_later.sql", SQL: "SELECT 10"},
+		}, got)
+	})
+
+	tests := []struct {
+		name string
+		fsys fstest.MapFS
+	}{
+		{name: "missing version", fsys: fstest.MapFS{"outbox.sql": {}}},
+		{name: "zero version", fsys: fstest.MapFS{"0000_init.sql": {}}},
+		{name: "duplicate version", fsys: fstest.MapFS{"0001_a.sql": {}, "1_b.sql": {}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadMigrations(tt.fsys)
+			require.Error(t, err)
+		})
+	}
+
+	t.Run("embedded migrations are valid", func(t *testing.T) {
+		db := &fakeBeginner{}
+		require.NoError(t, Migrate(t.Context(), db))
+		assert.Equal(t, []string{"begin", "commit"}, db.log)
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	fsys := fstest.MapFS{
+		"0001_first.sql":  {Data: []byte("CREATE TABLE first ()")},
+		"0002_second.sql": {Data: []byte("CREATE TABLE second ()")},
+	}
+
+	t.Run("applies pending migrations", func(t *testing.T) {
+		db := &fakeBeginner{q: recordingQuerier{Rows: [][]any{{1}}}}
+
+		require.NoError(t, migrate(t.Context(), db, fsys))
+
+		var sqls []string
+		for _, c := range db.q.Calls() {
+			sqls = append(sqls, c.SQL)
+		}
+		require.Len(t, sqls, 5)
+		assert.Contains(t, sqls[0], "pg_advisory_xact_lock")
+		assert.Contains(t, sqls[1], "CREATE TABLE IF NOT EXISTS schema_migrations")
+		assert.Equal(t, "SELECT version FROM schema_migrations", sqls[2])
+		assert.Equal(t, "CREATE TABLE second ()", sqls[3])
+		assert.Contains(t, sqls[4], "INSERT INTO schema_migrations")
+		assert.Equal(t, []any{2, "0002_second.sql"}, db.q.Calls()[4].Args)
+		assert.Equal(t, []string{"begin", "commit"}, db.log)
+	})
+
+	t.Run("rolls back on failure", func(t *testing.T) {
+		errDB := errors.New("syntax error")
+		db := &fakeBeginner{q: recordingQuerier{Err: errDB}}
+
+		err := migrate(t.Context(), db, fsys)
+		require.ErrorIs(t, err, errDB)
+		assert.Equal(t, []string{"begin", "rollback"}, db.log)
+	})
+}
+
+func TestMigrateIntegration(t *testing.T) {
+	skipIfNoTestcontainers(t)
+
+	// TestMain migrated the database already, so this run is a no-op.
+	require.NoError(t, Migrate(t.Context(), testPool))
+
+	sub, err := fs.Sub(migrations, "migrations")
+	require.NoError(t, err)
+	all, err := loadMigrations(sub)
+	require.NoError(t, err)
+
+	var applied int
+	require.NoError(t, testPool.QueryRow(t.Context(), "SELECT count(*) FROM schema_migrations").Scan(&applied))
+	assert.Equal(t, len(all), applied)
+
+	var exists bool
+	require.NoError(t, testPool.QueryRow(t.Context(), "SELECT to_regclass('outbox') IS NOT NULL").Scan(&exists))
+	assert.True(t, exists)
+}
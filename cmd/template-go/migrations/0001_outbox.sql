@@ -0,0 +1,17 @@
+-- Events enqueued by transactions and delivered by the outbox relay.
+-- Delivered events are deleted; dead letters keep dead_at and last_error.
+CREATE TABLE outbox (
+    id           bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    topic        text NOT NULL,
+    key          text NOT NULL DEFAULT '',
+    payload      jsonb NOT NULL,
+    headers      jsonb NOT NULL DEFAULT '{}',
+    created_at   timestamptz NOT NULL DEFAULT now(),
+    available_at timestamptz NOT NULL DEFAULT now(),
+    attempts     integer NOT NULL DEFAULT 0,
+    last_error   text,
+    dead_at      timestamptz
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE dead_at IS NULL;
+CREATE INDEX outbox_dead_idx ON outbox (dead_at) WHERE dead_at IS NOT NULL;
@@ -0,0 +1,25 @@
+-- Background jobs claimed by the worker pool. Finished jobs are kept with
+-- their final state for inspection with `template-go jobs list`.
+CREATE TABLE jobs (
+    id           bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    kind         text NOT NULL,
+    args         jsonb NOT NULL DEFAULT '{}',
+    state        text NOT NULL DEFAULT 'available'
+                 CHECK (state IN ('available', 'running', 'completed', 'failed', 'cancelled')),
+    priority     integer NOT NULL DEFAULT 0,
+    scheduled_at timestamptz NOT NULL DEFAULT now(),
+    attempts     integer NOT NULL DEFAULT 0,
+    max_attempts integer NOT NULL,
+    unique_key   text,
+    last_error   text,
+    created_at   timestamptz NOT NULL DEFAULT now(),
+    attempted_at timestamptz,
+    finished_at  timestamptz
+);
+
+CREATE INDEX jobs_available_idx ON jobs (priority DESC, scheduled_at, id) WHERE state = 'available';
+CREATE INDEX jobs_running_idx ON jobs (attempted_at) WHERE state = 'running';
+
+-- A unique key allows one unfinished job per kind.
+CREATE UNIQUE INDEX jobs_unique_idx ON jobs (kind, unique_key)
+    WHERE unique_key IS NOT NULL AND state IN ('available', 'running');
@@ -0,0 +1,13 @@
+-- Runs of scheduled tasks. The unique tick makes each run happen once
+-- across instances.
+CREATE TABLE task_runs (
+    id           bigint GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    task         text NOT NULL,
+    scheduled_at timestamptz NOT NULL,
+    started_at   timestamptz NOT NULL DEFAULT now(),
+    finished_at  timestamptz,
+    status       text NOT NULL DEFAULT 'running' CHECK (status IN ('running', 'succeeded', 'failed')),
+    error        text,
+    instance     text NOT NULL,
+    UNIQUE (task, scheduled_at)
+);
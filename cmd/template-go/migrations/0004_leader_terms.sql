@@ -0,0 +1,8 @@
+-- Leadership terms. The token grows with every new leader and fences off
+-- writes from deposed ones.
+CREATE TABLE leader_terms (
+    name        text PRIMARY KEY,
+    token       bigint NOT NULL,
+    holder      text NOT NULL,
+    acquired_at timestamptz NOT NULL DEFAULT now()
+);
@@ -0,0 +1,13 @@
+-- Entries of the application cache shared by every instance. The table is
+-- unlogged: faster to write, emptied after a crash, which a cache can
+-- afford. NULL times mean fresh until expiry and kept until deleted.
+CREATE UNLOGGED TABLE cache_entries (
+    namespace   text NOT NULL,
+    key         text NOT NULL,
+    value       jsonb NOT NULL,
+    fresh_until timestamptz,
+    expires_at  timestamptz,
+    PRIMARY KEY (namespace, key)
+);
+
+CREATE INDEX cache_entries_expires_at_idx ON cache_entries (expires_at);
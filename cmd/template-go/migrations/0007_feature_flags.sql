@@ -0,0 +1,31 @@
+-- Feature flag definitions, read unless SERVICE_FLAGS_FILE is set, and
+-- overrides set through the admin API, which apply to either source.
+CREATE TABLE feature_flags (
+    name        text PRIMARY KEY,
+    description text NOT NULL DEFAULT '',
+    enabled     boolean NOT NULL DEFAULT false,
+    rules       jsonb NOT NULL DEFAULT '[]',
+    updated_at  timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE feature_flag_overrides (
+    name       text PRIMARY KEY,
+    enabled    boolean NOT NULL,
+    updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- Changes to either table make every instance reload the flags.
+CREATE FUNCTION notify_feature_flags() RETURNS trigger LANGUAGE plpgsql AS $$
+BEGIN
+    PERFORM pg_notify('feature_flags', '');
+    RETURN NULL;
+END;
+$$;
+
+CREATE TRIGGER feature_flags_notify
+    AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON feature_flags
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_feature_flags();
+
+CREATE TRIGGER feature_flag_overrides_notify
+    AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON feature_flag_overrides
+    FOR EACH STATEMENT EXECUTE FUNCTION notify_feature_flags();
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateContentType(t *testing.T) {
+	offers := []string{"application/json", "application/cbor"}
+
+	tests := []struct {
+		name   string
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"missing header takes first offer", "", "application/json", true},
+		{"exact match", "application/cbor", "application/cbor", true},
+		{"wildcard", "*/*", "application/json", true},
+		{"type wildcard", "application/*", "application/json", true},
+		{"q-values", "application/json;q=0.5, application/cbor", "application/cbor", true},
+		{"specific range overrides wildcard", "*/*;q=0.9, application/json;q=0", "application/cbor", true},
+		{"refused everything", "application/json;q=0, application/cbor;q=0", "", false},
+		{"no match", "text/html", "", false},
+		{"browser accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "application/json", true},
+		{"malformed entries skipped", "garbage, application/cbor", "application/cbor", true},
+		{"parameters ignored", "application/json; charset=utf-8", "application/json", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := negotiateContentType(tt.accept, offers)
+
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("no offers", func(t *testing.T) {
+		_, ok := negotiateContentType("*/*", nil)
+		assert.False(t, ok)
+	})
+}
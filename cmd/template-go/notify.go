@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// NotifyHandler handles a notification received on a channel.
+type NotifyHandler func(ctx context.Context, n *pgconn.Notification) error
+
+// NotifyOptions configures a Subscriber.
+type NotifyOptions struct {
+	// QueueSize bounds the notifications buffered per handler; further
+	// notifications are dropped until the handler catches up.
+	QueueSize int
+	// MinBackoff and MaxBackoff bound the delay between reconnects.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+const (
+	defaultNotifyQueueSize  = 64
+	defaultNotifyMinBackoff = 100 * time.Millisecond
+	defaultNotifyMaxBackoff = 30 * time.Second
+)
+
+var errNotListening = errors.New("not listening")
+
+// notifyConn is a dedicated connection, satisfied by *pgx.Conn.
+type notifyConn interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	WaitForNotification(ctx context.Context) (*pgconn.Notification, error)
+	Close(ctx context.Context) error
+}
+
+// notifyConnector opens a dedicated connection.
+type notifyConnector func(ctx context.Context) (notifyConn, error)
+
+// poolConnector opens connections outside of pool with its configuration,
+// so that a long-lived LISTEN does not hold a pooled connection.
+func poolConnector(pool *pgxpool.Pool) notifyConnector {
+	return func(ctx context.Context) (notifyConn, error) {
+		return dialPool(ctx, pool)
+	}
+}
+
+// dialPool opens a connection outside of pool with its configuration.
+func dialPool(ctx context.Context, pool *pgxpool.Pool) (*pgx.Conn, error) {
+	conn, err := pgx.ConnectConfig(ctx, pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect: %w", err)
+	}
+	return conn, nil
+}
+
+// notifyQueue feeds one handler from a bounded buffer.
+type notifyQueue struct {
+	channel string
+	handler NotifyHandler
+	ch      chan *pgconn.Notification
+}
+
+// Subscriber LISTENs on the channels of its handlers over a dedicated
+// connection, reconnecting with backoff and listening again after each
+// reconnect. Every handler runs in its own goroutine so that a slow one
+// does not delay the others.
+type Subscriber struct {
+	connect notifyConnector
+	opts    NotifyOptions
+
+	mu        sync.Mutex
+	queues    map[string][]*notifyQueue
+	running   bool
+	listening atomic.Bool
+	lastErr   atomic.Pointer[error]
+}
+
+// NewSubscriber creates a Subscriber using connect for its connection.
+func NewSubscriber(connect notifyConnector, opts NotifyOptions) *Subscriber {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultNotifyQueueSize
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultNotifyMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaultNotifyMaxBackoff, opts.MinBackoff)
+	}
+	return &Subscriber{connect: connect, opts: opts, queues: map[string][]*notifyQueue{}}
+}
+
+// Handle registers handler for notifications on channel. It must be
+// called before Run.
+func (s *Subscriber) Handle(channel string, handler NotifyHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		panic("notify: Handle called after Run")
+	}
+	s.queues[channel] = append(s.queues[channel], &notifyQueue{
+		channel: channel,
+		handler: handler,
+		ch:      make(chan *pgconn.Notification, s.opts.QueueSize),
+	})
+}
+
+// Ready reports an error while the subscriber is not listening. Without
+// handlers there is nothing to listen to and it is always ready.
+func (s *Subscriber) Ready(context.Context) error {
+	s.mu.Lock()
+	idle := len(s.queues) == 0
+	s.mu.Unlock()
+	if idle || s.listening.Load() {
+		return nil
+	}
+	if err := s.lastErr.Load(); err != nil {
+		return fmt.Errorf("%w: %w", errNotListening, *err)
+	}
+	return errNotListening
+}
+
+// Run listens until ctx is canceled, then waits for handlers to finish
+// the notification in progress. Queued notifications are discarded.
+func (s *Subscriber) Run(ctx context.Context) {
+	s.mu.Lock()
+	s.running = true
+	queues := s.queues
+	s.mu.Unlock()
+	if len(queues) == 0 {
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, qs := range queues {
+		for _, q := range qs {
+			wg.Go(func() { s.work(ctx, q) })
+		}
+	}
+	defer wg.Wait()
+
+	for attempt := 0; ; attempt++ {
+		err := s.listen(ctx, queues)
+		if ctx.Err() != nil {
+			s.listening.Store(false)
+			return
+		}
+		if s.listening.Swap(false) {
+			// The connection worked before failing, so start backing off anew.
+			attempt = 0
+		}
+		s.lastErr.Store(&err)
+		notifyStats.Add("reconnects", 1)
+
+		delay := s.backoff(attempt)
+		slog.WarnContext(ctx, "Notification listener disconnected", "error", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// listen connects, LISTENs on every channel and dispatches notifications
+// until the connection fails.
+func (s *Subscriber) listen(ctx context.Context, queues map[string][]*notifyQueue) error {
+	conn, err := s.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		closeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+		defer cancel()
+		_ = conn.Close(closeCtx)
+	}()
+
+	for channel := range queues {
+		if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{channel}.Sanitize()); err != nil {
+			return fmt.Errorf("failed to listen on %q: %w", channel, err)
+		}
+	}
+	s.listening.Store(true)
+	s.lastErr.Store(nil)
+	slog.InfoContext(ctx, "Listening for notifications", "channels", len(queues))
+
+	for {
+		n, err := conn.WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to wait for notification: %w", err)
+		}
+		notifyStats.Add("received", 1)
+		for _, q := range queues[n.Channel] {
+			select {
+			case q.ch <- n:
+			default:
+				notifyStats.Add("dropped", 1)
+				slog.WarnContext(ctx, "Notification queue full, dropping", "channel", n.Channel)
+			}
+		}
+	}
+}
+
+// work runs q's handler for each queued notification until ctx ends.
+func (s *Subscriber) work(ctx context.Context, q *notifyQueue) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-q.ch:
+			if err := s.handle(ctx, q, n); err != nil {
+				notifyStats.Add("errors", 1)
+				slog.ErrorContext(ctx, "Notification handler failed", "channel", q.channel, "error", err)
+			}
+		}
+	}
+}
+
+// handle runs the handler, turning a panic into an error so that the
+// worker keeps serving the queue.
+func (s *Subscriber) handle(ctx context.Context, q *notifyQueue, n *pgconn.Notification) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return q.handler(ctx, n)
+}
+
+// backoff doubles MinBackoff per attempt up to MaxBackoff, with jitter.
+func (s *Subscriber) backoff(attempt int) time.Duration {
+	d := s.opts.MaxBackoff
+	if attempt < 32 {
+		d = min(s.opts.MinBackoff<<attempt, s.opts.MaxBackoff)
+	}
+	return d/2 + rand.N(d/2+1) //nolint:gosec // jitter does not need a secure source
+}
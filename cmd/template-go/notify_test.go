@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNotifyConn delivers notifications sent on its channel and fails
+// WaitForNotification when the channel is closed.
+type fakeNotifyConn struct {
+	mu       sync.Mutex
+	listened []string
+	notes    chan *pgconn.Notification
+	closed   bool
+}
+
+func newFakeNotifyConn() *fakeNotifyConn {
+	return &fakeNotifyConn{notes: make(chan *pgconn.Notification, 16)}
+}
+
+func (c *fakeNotifyConn) Exec(_ context.Context, sql string, _ ...any) (pgconn.CommandTag, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.listened = append(c.listened, sql)
+	return pgconn.NewCommandTag("LISTEN"), nil
+}
+
+func (c *fakeNotifyConn) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case n, ok := <-c.notes:
+		if !ok {
+			return nil, errors.New("conn closed")
+		}
+		return n, nil
+	}
+}
+
+func (c *fakeNotifyConn) Close(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *fakeNotifyConn) Listened() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.listened...)
+}
+
+// fakeConnector hands out conns in order, failing with errs first.
+type fakeConnector struct {
+	mu    sync.Mutex
+	errs  []error
+	conns []*fakeNotifyConn
+	calls int
+}
+
+func (f *fakeConnector) connect(context.Context) (notifyConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return nil, err
+	}
+	if len(f.conns) == 0 {
+		return nil, errors.New("no more connections")
+	}
+	conn := f.conns[0]
+	f.conns = f.conns[1:]
+	return conn, nil
+}
+
+var testNotifyOptions = NotifyOptions{QueueSize: 2, MinBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}
+
+// runSubscriber runs s until the test ends.
+func runSubscriber(t *testing.T, s *Subscriber) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(t.Context())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestSubscriberDispatches(t *testing.T) {
+	conn := newFakeNotifyConn()
+	s := NewSubscriber((&fakeConnector{conns: []*fakeNotifyConn{conn}}).connect, testNotifyOptions)
+
+	got := make(chan string, 4)
+	s.Handle("orders", func(_ context.Context, n *pgconn.Notification) error {
+		got <- "a:" + n.Payload
+		return nil
+	})
+	s.Handle("orders", func(_ context.Context, n *pgconn.Notification) error {
+		got <- "b:" + n.Payload
+		return nil
+	})
+	s.Handle("users", func(context.Context, *pgconn.Notification) error {
+		t.Error("unexpected notification on users")
+		return nil
+	})
+	runSubscriber(t, s)
+
+	require.Eventually(t, func() bool { return s.Ready(t.Context()) == nil }, time.Second, time.Millisecond)
+	assert.ElementsMatch(t, []string{`LISTEN "orders"`, `LISTEN "users"`}, conn.Listened())
+
+	conn.notes <- &pgconn.Notification{Channel: "orders", Payload: "42"}
+	assert.ElementsMatch(t, []string{"a:42", "b:42"}, []string{<-got, <-got})
+}
+
+func TestSubscriberReconnects(t *testing.T) {
+	first, second := newFakeNotifyConn(), newFakeNotifyConn()
+	connector := &fakeConnector{
+		errs:  []error{errors.New("connection refused")},
+		conns: []*fakeNotifyConn{first, second},
+	}
+	s := NewSubscriber(connector.connect, testNotifyOptions)
+	got := make(chan string, 1)
+	s.Handle("events", func(_ context.Context, n *pgconn.Notification) error {
+		got <- n.Payload
+		return nil
+	})
+	require.ErrorIs(t, s.Ready(t.Context()), errNotListening)
+	runSubscriber(t, s)
+
+	require.Eventually(t, func() bool { return len(first.Listened()) == 1 }, time.Second, time.Millisecond)
+	close(first.notes)
+
+	require.Eventually(t, func() bool { return len(second.Listened()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{`LISTEN "events"`}, second.Listened(), "channels are listened to again")
+	second.notes <- &pgconn.Notification{Channel: "events", Payload: "after"}
+	assert.Equal(t, "after", <-got)
+	assert.Eventually(t, func() bool { return s.Ready(t.Context()) == nil }, time.Second, time.Millisecond)
+}
+
+func TestSubscriberNotReady(t *testing.T) {
+	s := NewSubscriber((&fakeConnector{}).connect, testNotifyOptions)
+	s.Handle("events", func(context.Context, *pgconn.Notification) error { return nil })
+	runSubscriber(t, s)
+
+	require.Eventually(t, func() bool {
+		err := s.Ready(t.Context())
+		return err != nil && err.Error() == "not listening: no more connections"
+	}, time.Second, time.Millisecond)
+}
+
+func TestSubscriberDropsWhenQueueFull(t *testing.T) {
+	conn := newFakeNotifyConn()
+	s := NewSubscriber((&fakeConnector{conns: []*fakeNotifyConn{conn}}).connect, testNotifyOptions)
+	started, release := make(chan struct{}, 8), make(chan struct{})
+	handled := make(chan string, 8)
+	s.Handle("events", func(_ context.Context, n *pgconn.Notification) error {
+		started <- struct{}{}
+		<-release
+		handled <- n.Payload
+		return nil
+	})
+	runSubscriber(t, s)
+	require.Eventually(t, func() bool { return s.Ready(t.Context()) == nil }, time.Second, time.Millisecond)
+	dropped := notifyStat(t, "dropped")
+
+	// One notification is being handled, two are queued, the rest dropped.
+	conn.notes <- &pgconn.Notification{Channel: "events", Payload: "1"}
+	<-started
+	for _, p := range []string{"2", "3", "4", "5"} {
+		conn.notes <- &pgconn.Notification{Channel: "events", Payload: p}
+	}
+	require.Eventually(t, func() bool { return notifyStat(t, "dropped") == dropped+2 }, time.Second, time.Millisecond)
+
+	close(release)
+	assert.Equal(t, []string{"1", "2", "3"}, []string{<-handled, <-handled, <-handled})
+}
+
+func TestSubscriberRecoversHandlerPanics(t *testing.T) {
+	conn := newFakeNotifyConn()
+	s := NewSubscriber((&fakeConnector{conns: []*fakeNotifyConn{conn}}).connect, testNotifyOptions)
+	got := make(chan string, 2)
+	s.Handle("events", func(_ context.Context, n *pgconn.Notification) error {
+		if n.Payload == "bad" {
+			panic("boom")
+		}
+		got <- n.Payload
+		return nil
+	})
+	runSubscriber(t, s)
+	errs := notifyStat(t, "errors")
+
+	conn.notes <- &pgconn.Notification{Channel: "events", Payload: "bad"}
+	conn.notes <- &pgconn.Notification{Channel: "events", Payload: "good"}
+
+	assert.Equal(t, "good", <-got)
+	assert.Equal(t, errs+1, notifyStat(t, "errors"))
+}
+
+func TestSubscriberWithoutHandlers(t *testing.T) {
+	connector := &fakeConnector{}
+	s := NewSubscriber(connector.connect, testNotifyOptions)
+
+	s.Run(t.Context())
+
+	require.NoError(t, s.Ready(t.Context()))
+	assert.Zero(t, connector.calls)
+	assert.Panics(t, func() { s.Handle("late", nil) })
+}
+
+func TestSubscriberBackoff(t *testing.T) {
+	s := NewSubscriber(nil, NotifyOptions{MinBackoff: 10 * time.Millisecond, MaxBackoff: time.Second})
+	for attempt := range 40 {
+		want := time.Second
+		if attempt < 7 {
+			want = 10 * time.Millisecond << attempt
+		}
+		got := s.backoff(attempt)
+		assert.GreaterOrEqual(t, got, want/2)
+		assert.LessOrEqual(t, got, want)
+	}
+}
+
+func TestSubscriberIntegration(t *testing.T) {
+	skipIfNoTestcontainers(t)
+
+	s := NewSubscriber(poolConnector(testPool), NotifyOptions{})
+	got := make(chan string, 1)
+	s.Handle("template events", func(_ context.Context, n *pgconn.Notification) error {
+		got <- n.Payload
+		return nil
+	})
+	runSubscriber(t, s)
+	require.Eventually(t, func() bool { return s.Ready(t.Context()) == nil }, 5*time.Second, 10*time.Millisecond)
+
+	_, err := testPool.Exec(t.Context(), "SELECT pg_notify('template events', 'hello')")
+	require.NoError(t, err)
+
+	select {
+	case payload := <-got:
+		assert.Equal(t, "hello", payload)
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification not received")
+	}
+}
+
+// notifyStat returns a notify counter.
+func notifyStat(t *testing.T, key string) int64 {
+	t.Helper()
+	return expvarMapInt(t, notifyStats, key)
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// OpenAPI is an OpenAPI 3.1 document.
+type OpenAPI struct {
+	OpenAPI    string              `json:"openapi"`
+	Info       Info                `json:"info"`
+	Paths      map[string]PathItem `json:"paths"`
+	Components Components          `json:"components,omitzero"`
+}
+
+// Info describes the API.
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// PathItem maps lowercase HTTP methods to operations.
+type PathItem map[string]*Operation
+
+// Operation documents a single route.
+type Operation struct {
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+// Parameter is a path, query or header parameter.
+type Parameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required,omitempty"`
+	Schema   *Schema `json:"schema,omitempty"`
+}
+
+// RequestBody describes an operation request body.
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response describes a response of an operation.
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// MediaType holds the schema of one content type.
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+// Components holds reusable schemas and security schemes.
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas,omitempty"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// SecurityScheme describes how clients authenticate.
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	Name         string `json:"name,omitempty"`
+	In           string `json:"in,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+// RouteDoc documents a route registered on a Router.
+type RouteDoc struct {
+	Summary     string
+	Description string
+	Tags        []string
+	// ContentType and Response describe the success body of handlers not
+	// created with Handle, whose types are documented automatically.
+	ContentType string
+	Response    any
+	// Parameters documents the query and header parameters of such handlers.
+	Parameters []Parameter
+	// Status is the success status of such handlers, 200 when zero.
+	Status int
+	// Errors lists error statuses beyond those every route can return.
+	Errors []int
+	// Security names the security schemes accepted by the route.
+	Security []string
+	// Conditional documents 304 responses to conditional requests, for
+	// routes wrapped in Cached.
+	Conditional bool
+}
+
+// Route is a registered pattern with its documentation.
+type Route struct {
+	Pattern string
+	Method  string
+	Path    string
+	Doc     RouteDoc
+
+	handler http.Handler
+}
+
+// typedRoute is implemented by handlers created with Handle.
+type typedRoute interface {
+	routeTypes() (req, resp reflect.Type)
+}
+
+// typedMiddleware is a handler created with Handle wrapped in middleware.
+type typedMiddleware struct {
+	http.Handler
+	typedRoute
+}
+
+// With wraps h in middleware, the first outermost. Handlers created with
+// Handle keep their documented types.
+func With(h http.Handler, middleware ...func(http.Handler) http.Handler) http.Handler {
+	wrapped := h
+	for _, mw := range slices.Backward(middleware) {
+		wrapped = mw(wrapped)
+	}
+	if typed, ok := h.(typedRoute); ok {
+		return typedMiddleware{Handler: wrapped, typedRoute: typed}
+	}
+	return wrapped
+}
+
+// Router is a ServeMux that records route documentation
+// to generate an OpenAPI document.
+type Router struct {
+	mux      *http.ServeMux
+	routes   []Route
+	security map[string]SecurityScheme
+}
+
+// NewRouter returns an empty Router.
+func NewRouter() *Router {
+	return &Router{mux: http.NewServeMux(), security: map[string]SecurityScheme{}}
+}
+
+// Handle registers handler for pattern, see http.ServeMux.
+func (rt *Router) Handle(pattern string, handler http.Handler, doc RouteDoc) {
+	rt.mux.Handle(pattern, handler)
+
+	method, path, ok := strings.Cut(pattern, " ")
+	if !ok {
+		method, path = "", pattern
+	}
+	path = path[strings.Index(path, "/"):]
+	rt.routes = append(rt.routes, Route{Pattern: pattern, Method: method, Path: path, Doc: doc, handler: handler})
+}
+
+// HandleFunc registers handler for pattern, see http.ServeMux.
+func (rt *Router) HandleFunc(pattern string, handler http.HandlerFunc, doc RouteDoc) {
+	rt.Handle(pattern, handler, doc)
+}
+
+// SecurityScheme registers a scheme that routes can name in RouteDoc.Security.
+func (rt *Router) SecurityScheme(name string, scheme SecurityScheme) {
+	rt.security[name] = scheme
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer reportPattern(r)
+	rt.mux.ServeHTTP(w, r)
+}
+
+// Routes returns the registered routes in registration order.
+func (rt *Router) Routes() []Route {
+	return slices.Clone(rt.routes)
+}
+
+// Undocumented returns the patterns of routes that cannot be described:
+// routes without a summary or a method, or naming unknown security schemes.
+func (rt *Router) Undocumented() []string {
+	var patterns []string
+	for _, route := range rt.routes {
+		unknownScheme := slices.ContainsFunc(route.Doc.Security, func(name string) bool {
+			_, ok := rt.security[name]
+			return !ok
+		})
+		if route.Doc.Summary == "" || route.Method == "" || unknownScheme {
+			patterns = append(patterns, route.Pattern)
+		}
+	}
+	return patterns
+}
+
+// OpenAPI generates the document for all documented routes.
+func (rt *Router) OpenAPI(info Info) *OpenAPI {
+	g := newSchemaGenerator()
+	doc := &OpenAPI{OpenAPI: "3.1.0", Info: info, Paths: map[string]PathItem{}}
+
+	for _, route := range rt.routes {
+		if route.Method == "" {
+			continue
+		}
+		path := openAPIPath(route.Path)
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = PathItem{}
+		}
+		doc.Paths[path][strings.ToLower(route.Method)] = route.operation(g)
+	}
+
+	// Every operation documents its errors as problems.
+	g.schema(reflect.TypeFor[problem]())
+	doc.Components.Schemas = g.components
+	if len(rt.security) > 0 {
+		doc.Components.SecuritySchemes = rt.security
+	}
+	return doc
+}
+
+// OpenAPIHandler serves the document, generated on first request
+// so that it covers routes registered after the handler.
+func (rt *Router) OpenAPIHandler(info Info) http.Handler {
+	body := sync.OnceValues(func() ([]byte, error) {
+		return json.Marshal(rt.OpenAPI(info)) //nolint:wrapcheck // logged below
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		data, err := body()
+		if err != nil {
+			slog.Error("failed to generate OpenAPI document", "error", err)
+			respondProblem(w, http.StatusInternalServerError, "")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(data)
+	})
+}
+
+func (route Route) operation(g *schemaGenerator) *Operation {
+	op := &Operation{
+		Summary:     route.Doc.Summary,
+		Description: route.Doc.Description,
+		Tags:        route.Doc.Tags,
+		Responses:   map[string]*Response{},
+	}
+	for _, name := range route.Doc.Security {
+		op.Security = append(op.Security, map[string][]string{name: {}})
+	}
+
+	errs := slices.Clone(route.Doc.Errors)
+	if typed, ok := route.handler.(typedRoute); ok {
+		reqType, respType := typed.routeTypes()
+		op.Parameters = g.parameters(reqType)
+		op.RequestBody = g.requestBody(reqType)
+		if len(op.Parameters) > 0 || op.RequestBody != nil {
+			errs = append(errs, http.StatusBadRequest, http.StatusUnprocessableEntity)
+		}
+		if op.RequestBody != nil {
+			errs = append(errs, http.StatusUnsupportedMediaType, http.StatusRequestEntityTooLarge)
+		}
+		errs = append(errs, http.StatusNotAcceptable)
+		op.Responses = g.typedResponses(respType)
+	} else {
+		status := cmp.Or(route.Doc.Status, http.StatusOK)
+		resp := &Response{Description: http.StatusText(status)}
+		if route.Doc.ContentType != "" {
+			var schema *Schema
+			if route.Doc.Response != nil {
+				schema = g.schema(reflect.TypeOf(route.Doc.Response))
+			} else {
+				schema = &Schema{}
+			}
+			resp.Content = map[string]MediaType{route.Doc.ContentType: {Schema: schema}}
+		}
+		op.Responses[strconv.Itoa(status)] = resp
+		op.Parameters = slices.Clone(route.Doc.Parameters)
+	}
+
+	// Path wildcards not bound by a typed request are plain strings.
+	for _, name := range pathWildcards(route.Path) {
+		if !slices.ContainsFunc(op.Parameters, func(p Parameter) bool { return p.In == "path" && p.Name == name }) {
+			op.Parameters = append(op.Parameters, Parameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}})
+		}
+	}
+
+	if route.Doc.Conditional {
+		op.Responses[strconv.Itoa(http.StatusNotModified)] = &Response{Description: http.StatusText(http.StatusNotModified)}
+	}
+
+	errs = append(errs, http.StatusInternalServerError)
+	problemSchema := &Schema{Ref: "#/components/schemas/Problem"}
+	for _, status := range errs {
+		op.Responses[strconv.Itoa(status)] = &Response{
+			Description: http.StatusText(status),
+			Content:     map[string]MediaType{"application/problem+json": {Schema: problemSchema}},
+		}
+	}
+	return op
+}
+
+// parameters documents the path and query fields of a typed request.
+func (g *schemaGenerator) parameters(t reflect.Type) []Parameter {
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var params []Parameter
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		p := Parameter{Name: sf.Tag.Get("path"), In: "path", Required: true}
+		if p.Name == "" {
+			p = Parameter{Name: sf.Tag.Get("query"), In: "query"}
+		}
+		if p.Name == "" {
+			continue
+		}
+		p.Schema = g.paramSchema(sf.Type)
+		if applyRules(p.Schema, sf.Type, sf.Tag.Get("validate")) {
+			p.Required = true
+		}
+		params = append(params, p)
+	}
+	return params
+}
+
+// requestBody documents the JSON body of a typed request, if it has one.
+func (g *schemaGenerator) requestBody(t reflect.Type) *RequestBody {
+	if t.Kind() != reflect.Struct || len(bodyFields(t)) == 0 {
+		return nil
+	}
+
+	required := slices.ContainsFunc(bodyFields(t), func(f namedField) bool {
+		return slices.Contains(strings.Split(f.Tag.Get("validate"), ","), "required")
+	})
+	return &RequestBody{
+		Required: required,
+		Content:  map[string]MediaType{"application/json": {Schema: g.schema(t)}},
+	}
+}
+
+// typedResponses documents the success response of a typed handler in
+// every media type the encoder registry offers.
+func (g *schemaGenerator) typedResponses(t reflect.Type) map[string]*Response {
+	status := http.StatusOK
+	zt := t
+	if zt.Kind() == reflect.Pointer {
+		zt = zt.Elem()
+	}
+	// A pointer to a zero value implements both value and pointer receivers.
+	if sc, ok := reflect.New(zt).Interface().(StatusCoder); ok {
+		status = sc.StatusCode()
+	}
+
+	resp := &Response{Description: http.StatusText(status)}
+	if status != http.StatusNoContent {
+		schema := g.schema(t)
+		resp.Content = map[string]MediaType{}
+		for _, mediaType := range encoders.Types() {
+			resp.Content[mediaType] = MediaType{Schema: schema}
+		}
+	}
+	return map[string]*Response{strconv.Itoa(status): resp}
+}
+
+// openAPIPath converts a ServeMux path to an OpenAPI path template.
+func openAPIPath(path string) string {
+	path = strings.TrimSuffix(path, "{$}")
+	return strings.ReplaceAll(path, "...}", "}")
+}
+
+// pathWildcards returns the wildcard names of a ServeMux path.
+func pathWildcards(path string) []string {
+	var names []string
+	for segment := range strings.SplitSeq(path, "/") {
+		if name, ok := strings.CutPrefix(segment, "{"); ok && segment != "{$}" {
+			names = append(names, strings.TrimSuffix(strings.TrimSuffix(name, "}"), "..."))
+		}
+	}
+	return names
+}
+
+// buildVersion returns the module version the binary was built from.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || info.Main.Version == "" || info.Main.Version == "(devel)" {
+		return "dev"
+	}
+	return info.Main.Version
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoutesDocumented(t *testing.T) {
+	rt := testApp(t).routes()
+
+	require.NotEmpty(t, rt.Routes())
+	assert.Empty(t, rt.Undocumented(), "every route needs a RouteDoc with a summary and a method")
+}
+
+func TestRouterUndocumented(t *testing.T) {
+	rt := NewRouter()
+	rt.SecurityScheme("bearer", SecurityScheme{Type: "http", Scheme: "bearer"})
+	rt.HandleFunc("GET /documented", handleHealth, RouteDoc{Summary: "Documented", Security: []string{"bearer"}})
+	rt.HandleFunc("GET /missing", handleHealth, RouteDoc{})
+	rt.HandleFunc("/any-method", handleHealth, RouteDoc{Summary: "Any method"})
+	rt.HandleFunc("GET /unknown-scheme", handleHealth, RouteDoc{Summary: "Unknown", Security: []string{"basic"}})
+
+	assert.Equal(t, []string{"GET /missing", "/any-method", "GET /unknown-scheme"}, rt.Undocumented())
+}
+
+func TestRouterOpenAPI(t *testing.T) {
+	rt := NewRouter()
+	rt.SecurityScheme("bearer", SecurityScheme{Type: "http", Scheme: "bearer"})
+	rt.Handle("GET /items/{id}", Handle(getTestItem), RouteDoc{Summary: "Get item", Errors: []int{http.StatusNotFound}})
+	rt.Handle("POST /items", Handle(func(_ context.Context, req testCreated) (testCreated, error) {
+		return req, nil
+	}), RouteDoc{Summary: "Create item", Security: []string{"bearer"}})
+	rt.Handle("DELETE /items/{id}", Handle(func(_ context.Context, _ struct{}) (NoContent, error) {
+		return NoContent{}, nil
+	}), RouteDoc{Summary: "Delete item"})
+	rt.HandleFunc("GET /files/{path...}", handleHealth, RouteDoc{Summary: "Get file", ContentType: "text/plain", Response: ""})
+
+	doc := rt.OpenAPI(Info{Title: "test", Version: "1.0.0"})
+
+	assert.Equal(t, "3.1.0", doc.OpenAPI)
+	assert.Equal(t, Info{Title: "test", Version: "1.0.0"}, doc.Info)
+
+	get := doc.Paths["/items/{id}"]["get"]
+	require.NotNil(t, get)
+	assert.Equal(t, "Get item", get.Summary)
+	assert.Nil(t, get.RequestBody.Content["application/json"].Schema.Properties)
+	assert.Equal(t, "#/components/schemas/testGetItem", get.RequestBody.Content["application/json"].Schema.Ref)
+	assert.Equal(t, Parameter{Name: "id", In: "path", Required: true, Schema: &Schema{Type: "integer", Format: "int64", Minimum: new(1.0)}}, get.Parameters[0])
+	assert.Equal(t, Parameter{Name: "limit", In: "query", Schema: &Schema{Type: "integer", Format: "int64", Maximum: new(100.0)}}, get.Parameters[2])
+	assert.Equal(t, &Schema{Type: "string", Format: "duration"}, get.Parameters[4].Schema)
+	assert.Equal(t, &Schema{Ref: "#/components/schemas/testItem"}, get.Responses["200"].Content["application/cbor"].Schema)
+	for _, status := range []string{"400", "404", "406", "422", "500"} {
+		require.Contains(t, get.Responses, status)
+		assert.Contains(t, get.Responses[status].Content, "application/problem+json")
+	}
+
+	post := doc.Paths["/items"]["post"]
+	require.NotNil(t, post)
+	assert.Contains(t, post.Responses, "201")
+	assert.Equal(t, []map[string][]string{{"bearer": {}}}, post.Security)
+
+	del := doc.Paths["/items/{id}"]["delete"]
+	require.NotNil(t, del)
+	assert.Nil(t, del.RequestBody)
+	assert.Empty(t, del.Responses["204"].Content)
+	assert.Equal(t, []Parameter{{Name: "id", In: "path", Required: true, Schema: &Schema{Type: "string"}}}, del.Parameters)
+
+	file := doc.Paths["/files/{path}"]["get"]
+	require.NotNil(t, file)
+	assert.Equal(t, &Schema{Type: "string"}, file.Responses["200"].Content["text/plain"].Schema)
+
+	assert.Contains(t, doc.Components.Schemas, "Problem")
+	assert.Contains(t, doc.Components.Schemas, "FieldError")
+	assert.Contains(t, doc.Components.Schemas["testGetItem"].Properties, "note")
+	assert.NotContains(t, doc.Components.Schemas["testGetItem"].Properties, "limit")
+	assert.Contains(t, doc.Components.SecuritySchemes, "bearer")
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	server := testApp(t).newServer()
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/openapi.json", http.NoBody)
+	rec := httptest.NewRecorder()
+	server.Handler.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var doc OpenAPI
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&doc))
+	assert.Equal(t, "template-go", doc.Info.Title)
+	assert.Contains(t, doc.Paths, "/health")
+	assert.Contains(t, doc.Paths, "/test")
+	assert.Contains(t, doc.Paths, "/openapi.json")
+	assert.Equal(t, &Schema{Ref: "#/components/schemas/DatabaseInfo"}, doc.Paths["/test"]["get"].Responses["200"].Content["application/json"].Schema)
+	assert.Contains(t, doc.Paths["/ws"]["get"].Responses, "101")
+	assert.NotContains(t, doc.Paths["/ws"]["get"].Responses, "200")
+	assert.Contains(t, doc.Paths["/test"]["get"].Responses, "304")
+	assert.Equal(t, []map[string][]string{{adminScheme: {}}}, doc.Paths["/admin/tasks"]["get"].Security)
+	assert.Equal(t, &Schema{Ref: "#/components/schemas/TaskStatusReport"}, doc.Paths["/admin/tasks"]["get"].Responses["200"].Content["application/json"].Schema)
+	assert.Equal(t, &Schema{Ref: "#/components/schemas/FlagReport"}, doc.Paths["/admin/flags"]["get"].Responses["200"].Content["application/json"].Schema)
+	assert.Contains(t, doc.Paths["/admin/flags/{name}/override"]["put"].Responses, "422")
+	assert.Contains(t, doc.Paths["/admin/flags/{name}/override"]["delete"].Responses, "204")
+	assert.Equal(t, []map[string][]string{{adminScheme: {}}}, doc.Paths["/debug/vars"]["get"].Security)
+	assert.Contains(t, doc.Components.SecuritySchemes, adminScheme)
+}
+
+func TestOpenAPIPath(t *testing.T) {
+	tests := []struct {
+		path          string
+		wantPath      string
+		wantWildcards []string
+	}{
+		{"/health", "/health", nil},
+		{"/items/{id}", "/items/{id}", []string{"id"}},
+		{"/users/{user}/items/{id}", "/users/{user}/items/{id}", []string{"user", "id"}},
+		{"/files/{path...}", "/files/{path}", []string{"path"}},
+		{"/{$}", "/", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.wantPath, openAPIPath(tt.path))
+			assert.Equal(t, tt.wantWildcards, pathWildcards(tt.path))
+		})
+	}
+}
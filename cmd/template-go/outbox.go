@@ -0,0 +1,538 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// OutboxEvent is an event to publish once the transaction enqueuing it
+// commits.
+type OutboxEvent struct {
+	Topic string
+	// Key identifies the entity the event is about, for consumers that
+	// partition or deduplicate by it.
+	Key string
+	// Payload is marshaled to JSON.
+	Payload any
+	Headers map[string]string
+}
+
+// OutboxMessage is a stored event handed to a Publisher.
+type OutboxMessage struct {
+	ID        int64             `json:"id"`
+	Topic     string            `json:"topic"`
+	Key       string            `json:"key,omitempty"`
+	Payload   json.RawMessage   `json:"payload"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	// Attempts counts earlier failed deliveries.
+	Attempts int `json:"attempts"`
+}
+
+// Publisher delivers outbox messages. Delivery is at least once, so
+// consumers should deduplicate by message ID.
+type Publisher interface {
+	Publish(ctx context.Context, msg *OutboxMessage) error
+}
+
+// PublisherFunc adapts a function to Publisher.
+type PublisherFunc func(ctx context.Context, msg *OutboxMessage) error
+
+// Publish calls f.
+func (f PublisherFunc) Publish(ctx context.Context, msg *OutboxMessage) error {
+	return f(ctx, msg)
+}
+
+// permanentError marks a delivery failure that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that the relay dead-letters the message at once
+// instead of retrying it.
+func Permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+// OutboxOptions configures the outbox relay.
+type OutboxOptions struct {
+	// BatchSize is how many messages are claimed at once.
+	BatchSize int
+	// Lease is how long claimed messages are hidden from other relays
+	// while the batch is published. It should exceed the time a batch
+	// takes, or messages may be delivered twice.
+	Lease time.Duration
+	// PollInterval is how often the table is checked when no enqueue
+	// notification arrives.
+	PollInterval time.Duration
+	// MaxAttempts is how many deliveries fail before a message is
+	// dead-lettered.
+	MaxAttempts int
+	// MinBackoff and MaxBackoff bound the delay between attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+const (
+	defaultOutboxBatchSize    = 100
+	defaultOutboxLease        = 5 * time.Minute
+	defaultOutboxPollInterval = time.Second
+	defaultOutboxMaxAttempts  = 10
+	defaultOutboxMinBackoff   = time.Second
+	defaultOutboxMaxBackoff   = time.Hour
+)
+
+// outboxChannel is notified by Enqueue to wake the relay on commit.
+const outboxChannel = "outbox"
+
+var errOutboxNoTx = errors.New("outbox events must be enqueued in a transaction")
+
+// Outbox stores events in the outbox table within the caller's
+// transaction and relays them to a Publisher in the background, so that
+// an event is published if and only if its transaction commits.
+//
+// Relays claim messages with FOR UPDATE SKIP LOCKED and lease them by
+// pushing available_at forward, so several instances can run side by
+// side and no transaction stays open while messages are published. A
+// failed message is retried with exponential backoff, which may reorder
+// it after later messages, and kept as a dead letter after MaxAttempts.
+type Outbox struct {
+	db   dbPool
+	pub  Publisher
+	opts OutboxOptions
+	wake chan struct{}
+
+	lag     atomic.Int64
+	pending atomic.Int64
+	dead    atomic.Int64
+}
+
+// NewOutbox creates an Outbox relaying to pub; with a nil pub, events are
+// stored but not relayed.
+func NewOutbox(db dbPool, pub Publisher, opts OutboxOptions) *Outbox {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultOutboxBatchSize
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = defaultOutboxLease
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultOutboxPollInterval
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = defaultOutboxMaxAttempts
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultOutboxMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = max(defaultOutboxMaxBackoff, opts.MinBackoff)
+	}
+
+	o := &Outbox{db: db, pub: pub, opts: opts, wake: make(chan struct{}, 1)}
+	outboxStats.Set("lag_seconds", expvar.Func(func() any { return time.Duration(o.lag.Load()).Seconds() }))
+	outboxStats.Set("pending", expvar.Func(func() any { return o.pending.Load() }))
+	outboxStats.Set("dead", expvar.Func(func() any { return o.dead.Load() }))
+	return o
+}
+
+// Enqueue stores events in the transaction carried by ctx, as started by
+// App.WithTx. It fails outside of a transaction, where the events could
+// be published for changes that are then rolled back.
+func (o *Outbox) Enqueue(ctx context.Context, events ...OutboxEvent) error {
+	tx, ok := txFromContext(ctx)
+	if !ok {
+		return errOutboxNoTx
+	}
+
+	for _, ev := range events {
+		payload, err := json.Marshal(ev.Payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s event payload: %w", ev.Topic, err)
+		}
+		headers, err := json.Marshal(ev.Headers)
+		if err != nil {
+			return fmt.Errorf("failed to marshal %s event headers: %w", ev.Topic, err)
+		}
+		if ev.Headers == nil {
+			headers = []byte("{}")
+		}
+		if _, err := tx.Exec(ctx,
+			"INSERT INTO outbox (topic, key, payload, headers) VALUES ($1, $2, $3, $4)",
+			ev.Topic, ev.Key, payload, headers,
+		); err != nil {
+			return fmt.Errorf("failed to enqueue %s event: %w", ev.Topic, err)
+		}
+	}
+	if _, err := tx.Exec(ctx, "SELECT pg_notify($1, '')", outboxChannel); err != nil {
+		return fmt.Errorf("failed to notify outbox relay: %w", err)
+	}
+	return nil
+}
+
+// Wake makes a waiting relay check for messages at once.
+func (o *Outbox) Wake() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wakeOnNotify returns a NotifyHandler waking the relay.
+func (o *Outbox) wakeOnNotify() NotifyHandler {
+	return func(context.Context, *pgconn.Notification) error {
+		o.Wake()
+		return nil
+	}
+}
+
+// Run relays messages until ctx is canceled. The message being published
+// then is not counted as a failed attempt and stays leased, while the
+// rest of the batch is released for the next run. A non-nil fence, such
+// as Elector.Fence, is checked in every transaction claiming messages or
+// recording an outcome, so that a deposed leader stops relaying.
+func (o *Outbox) Run(ctx context.Context, fence Fence) {
+	if o.pub == nil {
+		return
+	}
+	slog.InfoContext(ctx, "Outbox relay started")
+
+	for {
+		n, err := o.relay(ctx, fence)
+		if err != nil {
+			outboxStats.Add("errors", 1)
+			slog.ErrorContext(ctx, "Outbox relay failed", "error", err)
+		}
+		if err := o.measure(ctx); err != nil {
+			slog.WarnContext(ctx, "Failed to measure outbox lag", "error", err)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil && n == o.opts.BatchSize {
+			// A full batch suggests that more messages are waiting.
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-o.wake:
+		case <-time.After(o.opts.PollInterval):
+		}
+	}
+}
+
+// relay claims a batch of due messages and delivers them, returning how
+// many were claimed. Database work is not canceled with ctx, so that the
+// outcome of messages already published is recorded.
+func (o *Outbox) relay(ctx context.Context, fence Fence) (int, error) {
+	dbCtx := context.WithoutCancel(ctx)
+	msgs, err := o.claim(dbCtx, fence)
+	if err != nil {
+		return 0, err
+	}
+	for i, msg := range msgs {
+		if ctx.Err() != nil {
+			return len(msgs), o.release(dbCtx, fence, msgs[i:])
+		}
+		if err := o.deliver(ctx, dbCtx, fence, msg); err != nil {
+			return len(msgs), err
+		}
+	}
+	return len(msgs), nil
+}
+
+// claim leases due messages, skipping those locked by other relays.
+func (o *Outbox) claim(ctx context.Context, fence Fence) ([]*OutboxMessage, error) {
+	var msgs []*OutboxMessage
+	err := o.fenced(ctx, fence, func(ctx context.Context, q Querier) error {
+		rows, err := q.Query(ctx, `WITH due AS (
+				SELECT id FROM outbox
+				WHERE dead_at IS NULL AND available_at <= now()
+				ORDER BY id
+				LIMIT $1
+				FOR UPDATE SKIP LOCKED
+			)
+			UPDATE outbox SET available_at = now() + make_interval(secs => $2)
+			FROM due WHERE outbox.id = due.id
+			RETURNING outbox.id, topic, key, payload, headers, created_at, attempts`,
+			o.opts.BatchSize, o.opts.Lease.Seconds())
+		if err != nil {
+			return fmt.Errorf("failed to claim outbox messages: %w", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			msg := &OutboxMessage{}
+			if err := rows.Scan(&msg.ID, &msg.Topic, &msg.Key, &msg.Payload, &msg.Headers, &msg.CreatedAt, &msg.Attempts); err != nil {
+				return fmt.Errorf("failed to scan outbox message: %w", err)
+			}
+			msgs = append(msgs, msg)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to claim outbox messages: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// RETURNING does not keep the order of the claiming query.
+	slices.SortFunc(msgs, func(a, b *OutboxMessage) int { return cmp.Compare(a.ID, b.ID) })
+	return msgs, nil
+}
+
+// release ends the lease of messages left unpublished, making them due
+// again at once.
+func (o *Outbox) release(ctx context.Context, fence Fence, msgs []*OutboxMessage) error {
+	ids := make([]int64, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	return o.fenced(ctx, fence, func(ctx context.Context, q Querier) error {
+		if _, err := q.Exec(ctx, "UPDATE outbox SET available_at = now() WHERE id = ANY($1)", ids); err != nil {
+			return fmt.Errorf("failed to release outbox messages: %w", err)
+		}
+		return nil
+	})
+}
+
+// fenced runs fn in a transaction after checking fence, or directly on
+// the pool without a fence.
+func (o *Outbox) fenced(ctx context.Context, fence Fence, fn func(ctx context.Context, q Querier) error) error {
+	if fence == nil {
+		return fn(ctx, o.db)
+	}
+	return withTx(ctx, o.db, TxOptions{MaxRetries: -1}, func(ctx context.Context, tx pgx.Tx) error {
+		if err := fence(ctx, tx); err != nil {
+			return err
+		}
+		return fn(ctx, tx)
+	})
+}
+
+// deliver publishes msg and records the outcome: deleting it, scheduling
+// a retry, or dead-lettering it.
+func (o *Outbox) deliver(ctx, dbCtx context.Context, fence Fence, msg *OutboxMessage) error {
+	err := o.publish(ctx, msg)
+	switch {
+	case err == nil:
+		if err := o.fenced(dbCtx, fence, func(ctx context.Context, q Querier) error {
+			_, err := q.Exec(ctx, "DELETE FROM outbox WHERE id = $1", msg.ID)
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to delete outbox message %d: %w", msg.ID, err)
+		}
+		outboxStats.Add("published", 1)
+		return nil
+	case ctx.Err() != nil:
+		return nil
+	}
+
+	attempts, reason := msg.Attempts+1, err.Error()
+	var permanent *permanentError
+	if errors.As(err, &permanent) || attempts >= o.opts.MaxAttempts {
+		if err := o.fenced(dbCtx, fence, func(ctx context.Context, q Querier) error {
+			_, err := q.Exec(ctx,
+				"UPDATE outbox SET attempts = $2, last_error = $3, dead_at = now() WHERE id = $1",
+				msg.ID, attempts, reason,
+			)
+			return err
+		}); err != nil {
+			return fmt.Errorf("failed to dead-letter outbox message %d: %w", msg.ID, err)
+		}
+		outboxStats.Add("dead_lettered", 1)
+		slog.ErrorContext(ctx, "Outbox message dead-lettered", "id", msg.ID, "topic", msg.Topic, "attempts", attempts, "error", err)
+		return nil
+	}
+
+	delay := o.backoff(attempts)
+	if err := o.fenced(dbCtx, fence, func(ctx context.Context, q Querier) error {
+		_, err := q.Exec(ctx,
+			"UPDATE outbox SET attempts = $2, last_error = $3, available_at = now() + make_interval(secs => $4) WHERE id = $1",
+			msg.ID, attempts, reason, delay.Seconds(),
+		)
+		return err
+	}); err != nil {
+		return fmt.Errorf("failed to reschedule outbox message %d: %w", msg.ID, err)
+	}
+	outboxStats.Add("retried", 1)
+	slog.WarnContext(ctx, "Outbox delivery failed", "id", msg.ID, "topic", msg.Topic, "attempts", attempts, "retry_in", delay, "error", err)
+	return nil
+}
+
+// publish calls the publisher, turning a panic into an error so that the
+// relay keeps running.
+func (o *Outbox) publish(ctx context.Context, msg *OutboxMessage) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return o.pub.Publish(ctx, msg)
+}
+
+// backoff doubles MinBackoff per failed attempt up to MaxBackoff.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	return retryBackoff(o.opts.MinBackoff, o.opts.MaxBackoff, attempts)
+}
+
+// retryBackoff returns the delay after the given number of failed
+// attempts: minDelay doubled per attempt after the first, up to maxDelay.
+func retryBackoff(minDelay, maxDelay time.Duration, attempts int) time.Duration {
+	if attempts > 32 {
+		return maxDelay
+	}
+	return min(minDelay<<max(attempts-1, 0), maxDelay)
+}
+
+// measure updates the lag metric, the age of the oldest undelivered
+// message, along with the pending and dead-lettered counts.
+func (o *Outbox) measure(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+	defer cancel()
+
+	var (
+		pending, dead int64
+		lag           float64
+	)
+	err := o.db.QueryRow(ctx, `SELECT
+		count(*) FILTER (WHERE dead_at IS NULL),
+		count(*) FILTER (WHERE dead_at IS NOT NULL),
+		COALESCE(EXTRACT(EPOCH FROM now() - min(created_at) FILTER (WHERE dead_at IS NULL)), 0)::float8
+		FROM outbox`).Scan(&pending, &dead, &lag)
+	if err != nil {
+		return err
+	}
+	o.pending.Store(pending)
+	o.dead.Store(dead)
+	o.lag.Store(int64(lag * float64(time.Second)))
+	return nil
+}
+
+// newOutboxPublisher returns the publisher for SERVICE_OUTBOX_PUBLISHER:
+// nil when empty, stdout, or a webhook URL.
+func newOutboxPublisher(target, secret string) (Publisher, error) {
+	switch {
+	case target == "":
+		return nil, nil
+	case target == "stdout":
+		return &WriterPublisher{W: os.Stdout}, nil
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		return &WebhookPublisher{URL: target, Secret: secret}, nil
+	default:
+		return nil, fmt.Errorf("unsupported publisher %q, want stdout or a webhook URL", target)
+	}
+}
+
+// WriterPublisher writes messages to W as JSON lines.
+type WriterPublisher struct {
+	W  io.Writer
+	mu sync.Mutex
+}
+
+// Publish writes msg as one line.
+func (p *WriterPublisher) Publish(_ context.Context, msg *OutboxMessage) error {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		return Permanent(fmt.Errorf("failed to marshal message: %w", err))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, err = p.W.Write(append(line, '\n'))
+	return err
+}
+
+const defaultWebhookTimeout = 10 * time.Second
+
+// WebhookPublisher POSTs messages as JSON to URL. Responses other than
+// 2xx fail the delivery; 4xx responses, except 408 and 429, are permanent.
+type WebhookPublisher struct {
+	URL string
+	// Secret, when set, signs bodies with HMAC-SHA256 in the
+	// X-Outbox-Signature header as "sha256=<hex>".
+	Secret string
+	// Client defaults to a client with a 10s timeout.
+	Client *http.Client
+}
+
+// Publish posts msg. The Idempotency-Key header carries the message ID
+// so that receivers can drop redeliveries.
+func (p *WebhookPublisher) Publish(ctx context.Context, msg *OutboxMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return Permanent(fmt.Errorf("failed to marshal message: %w", err))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(fmt.Errorf("failed to create webhook request: %w", err))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", "outbox-"+strconv.FormatInt(msg.ID, 10))
+	req.Header.Set("X-Outbox-Topic", msg.Topic)
+	if p.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(p.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Outbox-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to call webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch code := resp.StatusCode; {
+	case code >= 200 && code < 300:
+		return nil
+	case code >= 400 && code < 500 && code != http.StatusRequestTimeout && code != http.StatusTooManyRequests:
+		return Permanent(fmt.Errorf("webhook answered %s", resp.Status))
+	default:
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+}
+
+// SubjectPublisher adapts subject-based brokers such as NATS: Send
+// receives the topic prefixed with Prefix and the message as JSON, which
+// matches the signature of nats.Conn.Publish.
+type SubjectPublisher struct {
+	Prefix string
+	Send   func(subject string, data []byte) error
+}
+
+// Publish sends msg on its subject.
+func (p *SubjectPublisher) Publish(_ context.Context, msg *OutboxMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return Permanent(fmt.Errorf("failed to marshal message: %w", err))
+	}
+	return p.Send(p.Prefix+msg.Topic, data)
+}
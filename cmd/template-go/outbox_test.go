@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingPublisher records published messages and fails with err.
+type recordingPublisher struct {
+	mu   sync.Mutex
+	msgs []*OutboxMessage
+	err  error
+}
+
+func (p *recordingPublisher) Publish(_ context.Context, msg *OutboxMessage) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.msgs = append(p.msgs, msg)
+	return p.err
+}
+
+func (p *recordingPublisher) Messages() []*OutboxMessage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*OutboxMessage(nil), p.msgs...)
+}
+
+func TestOutboxEnqueue(t *testing.T) {
+	t.Run("requires a transaction", func(t *testing.T) {
+		o := NewOutbox(&fakePool{}, nil, OutboxOptions{})
+		err := o.Enqueue(t.Context(), OutboxEvent{Topic: "orders"})
+		require.ErrorIs(t, err, errOutboxNoTx)
+	})
+
+	t.Run("inserts events and notifies the relay", func(t *testing.T) {
+		db := &fakeBeginner{}
+		o := NewOutbox(&fakePool{}, nil, OutboxOptions{})
+
+		err := withTx(t.Context(), db, TxOptions{}, func(ctx context.Context, _ pgx.Tx) error {
+			return o.Enqueue(ctx,
+				OutboxEvent{Topic: "orders", Key: "42", Payload: map[string]int{"id": 42}},
+				OutboxEvent{Topic: "orders", Payload: "shipped", Headers: map[string]string{"trace": "abc"}},
+			)
+		})
+		require.NoError(t, err)
+
+		calls := db.q.Calls()
+		require.Len(t, calls, 3)
+		assert.Equal(t, []any{"orders", "42", []byte(`{"id":42}`), []byte(`{}`)}, calls[0].Args)
+		assert.Equal(t, []any{"orders", "", []byte(`"shipped"`), []byte(`{"trace":"abc"}`)}, calls[1].Args)
+		assert.Equal(t, []any{outboxChannel}, calls[2].Args)
+		assert.Equal(t, []string{"begin", "commit"}, db.log)
+	})
+
+	t.Run("rejects unmarshalable payloads", func(t *testing.T) {
+		db := &fakeBeginner{}
+		o := NewOutbox(&fakePool{}, nil, OutboxOptions{})
+
+		err := withTx(t.Context(), db, TxOptions{}, func(ctx context.Context, _ pgx.Tx) error {
+			return o.Enqueue(ctx, OutboxEvent{Topic: "orders", Payload: func() {}})
+		})
+		require.Error(t, err)
+		assert.Equal(t, []string{"begin", "rollback"}, db.log)
+	})
+}
+
+func TestOutboxDeliver(t *testing.T) {
+	errDown := errors.New("broker down")
+	tests := []struct {
+		name     string
+		err      error
+		attempts int
+		wantSQL  string
+		wantArgs []any
+	}{
+		{
+			name:     "deletes published messages",
+			wantSQL:  "DELETE FROM outbox WHERE id = $1",
+			wantArgs: []any{int64(7)},
+		},
+		{
+			name:     "retries with backoff",
+			err:      errDown,
+			attempts: 2,
+			wantSQL:  "UPDATE outbox SET attempts = $2, last_error = $3, available_at = now() + make_interval(secs => $4) WHERE id = $1",
+			wantArgs: []any{int64(7), 3, "broker down", 4.0},
+		},
+		{
+			name:     "dead-letters after max attempts",
+			err:      errDown,
+			attempts: 4,
+			wantSQL:  "UPDATE outbox SET attempts = $2, last_error = $3, dead_at = now() WHERE id = $1",
+			wantArgs: []any{int64(7), 5, "broker down"},
+		},
+		{
+			name:     "dead-letters permanent failures",
+			err:      Permanent(errDown),
+			wantSQL:  "UPDATE outbox SET attempts = $2, last_error = $3, dead_at = now() WHERE id = $1",
+			wantArgs: []any{int64(7), 1, "broker down"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &fakePool{}
+			o := NewOutbox(db, &recordingPublisher{err: tt.err}, OutboxOptions{MaxAttempts: 5})
+
+			err := o.deliver(t.Context(), t.Context(), nil, &OutboxMessage{ID: 7, Attempts: tt.attempts})
+			require.NoError(t, err)
+
+			calls := db.Calls()
+			require.Len(t, calls, 1)
+			assert.Equal(t, tt.wantSQL, calls[0].SQL)
+			assert.Equal(t, tt.wantArgs, calls[0].Args)
+		})
+	}
+
+	t.Run("leaves messages alone on shutdown", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(t.Context())
+		pub := PublisherFunc(func(context.Context, *OutboxMessage) error {
+			cancel()
+			return context.Canceled
+		})
+		db := &fakePool{}
+		o := NewOutbox(db, pub, OutboxOptions{})
+
+		require.NoError(t, o.deliver(ctx, t.Context(), nil, &OutboxMessage{ID: 7}))
+		assert.Empty(t, db.Calls())
+	})
+
+	t.Run("recovers publisher panics", func(t *testing.T) {
+		pub := PublisherFunc(func(context.Context, *OutboxMessage) error { panic("boom") })
+		db := &fakePool{}
+		o := NewOutbox(db, pub, OutboxOptions{})
+
+		require.NoError(t, o.deliver(t.Context(), t.Context(), nil, &OutboxMessage{ID: 7}))
+		require.Len(t, db.Calls(), 1)
+		assert.Equal(t, "panic: boom", db.Calls()[0].Args[2])
+	})
+
+	t.Run("records outcomes behind the fence", func(t *testing.T) {
+		db := &fakePool{}
+		o := NewOutbox(db, &recordingPublisher{}, OutboxOptions{})
+		fence := func(context.Context, Querier) error { return errNotLeader }
+
+		err := o.deliver(t.Context(), t.Context(), fence, &OutboxMessage{ID: 7})
+		require.ErrorIs(t, err, errNotLeader)
+		assert.Empty(t, db.Calls(), "a deposed leader does not delete the message")
+		assert.Len(t, db.txOpts, 1)
+	})
+}
+
+func TestOutboxRelay(t *testing.T) {
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	claimed := func() *fakePool {
+		return &fakePool{recordingQuerier: recordingQuerier{Rows: [][]any{
+			{int64(2), "orders", "43", json.RawMessage(`{"id":43}`), map[string]string{}, created, 0},
+			{int64(1), "orders", "42", json.RawMessage(`{"id":42}`), map[string]string{}, created, 0},
+		}}}
+	}
+
+	t.Run("leases messages and publishes them in order", func(t *testing.T) {
+		db := claimed()
+		pub := &recordingPublisher{}
+		o := NewOutbox(db, pub, OutboxOptions{BatchSize: 2, Lease: time.Minute})
+
+		n, err := o.relay(t.Context(), nil)
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		msgs := pub.Messages()
+		require.Len(t, msgs, 2)
+		assert.Equal(t, &OutboxMessage{
+			ID: 1, Topic: "orders", Key: "42", Payload: json.RawMessage(`{"id":42}`),
+			Headers: map[string]string{}, CreatedAt: created,
+		}, msgs[0])
+		assert.Equal(t, int64(2), msgs[1].ID)
+
+		calls := db.Calls()
+		require.Len(t, calls, 3)
+		assert.Contains(t, calls[0].SQL, "FOR UPDATE SKIP LOCKED")
+		assert.Contains(t, calls[0].SQL, "SET available_at = now() + make_interval(secs => $2)")
+		assert.Equal(t, []any{2, 60.0}, calls[0].Args)
+		assert.Equal(t, []any{int64(1)}, calls[1].Args)
+		assert.Equal(t, []any{int64(2)}, calls[2].Args)
+		assert.Empty(t, db.txOpts, "no transaction is needed without a fence")
+	})
+
+	t.Run("checks the fence when claiming and recording", func(t *testing.T) {
+		db := claimed()
+		o := NewOutbox(db, &recordingPublisher{}, OutboxOptions{BatchSize: 2})
+		var checks int
+		fence := func(context.Context, Querier) error {
+			checks++
+			return nil
+		}
+
+		_, err := o.relay(t.Context(), fence)
+		require.NoError(t, err)
+		assert.Equal(t, 3, checks)
+		assert.Len(t, db.txOpts, 3, "one transaction for the claim and one per outcome")
+	})
+
+	t.Run("stops claiming once deposed", func(t *testing.T) {
+		db := claimed()
+		pub := &recordingPublisher{}
+		o := NewOutbox(db, pub, OutboxOptions{})
+
+		_, err := o.relay(t.Context(), func(context.Context, Querier) error { return errNotLeader })
+		require.ErrorIs(t, err, errNotLeader)
+		assert.Empty(t, pub.Messages())
+	})
+
+	t.Run("releases the rest of the batch on shutdown", func(t *testing.T) {
+		db := claimed()
+		ctx, cancel := context.WithCancel(t.Context())
+		pub := PublisherFunc(func(context.Context, *OutboxMessage) error {
+			cancel()
+			return nil
+		})
+		o := NewOutbox(db, pub, OutboxOptions{})
+
+		_, err := o.relay(ctx, nil)
+		require.NoError(t, err)
+
+		calls := db.Calls()
+		require.Len(t, calls, 3)
+		assert.Equal(t, "DELETE FROM outbox WHERE id = $1", calls[1].SQL)
+		assert.Equal(t, "UPDATE outbox SET available_at = now() WHERE id = ANY($1)", calls[2].SQL)
+		assert.Equal(t, []any{[]int64{2}}, calls[2].Args)
+	})
+}
+
+func TestOutboxRun(t *testing.T) {
+	t.Run("returns without a publisher", func(t *testing.T) {
+		o := NewOutbox(&fakePool{}, nil, OutboxOptions{})
+		o.Run(t.Context(), nil)
+	})
+
+	t.Run("stops when canceled", func(t *testing.T) {
+		db := &fakePool{}
+		o := NewOutbox(db, &recordingPublisher{}, OutboxOptions{PollInterval: time.Hour})
+		ctx, cancel := context.WithCancel(t.Context())
+
+		done := make(chan struct{})
+		go func() {
+			o.Run(ctx, nil)
+			close(done)
+		}()
+		o.Wake()
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("relay did not stop")
+		}
+	})
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	o := NewOutbox(&fakePool{}, nil, OutboxOptions{MinBackoff: time.Second, MaxBackoff: time.Minute})
+	assert.Equal(t, time.Second, o.backoff(1))
+	assert.Equal(t, 8*time.Second, o.backoff(4))
+	assert.Equal(t, time.Minute, o.backoff(7))
+	assert.Equal(t, time.Minute, o.backoff(100))
+}
+
+func TestNewOutboxPublisher(t *testing.T) {
+	tests := []struct {
+		target  string
+		want    Publisher
+		wantErr bool
+	}{
+		{target: "", want: nil},
+		{target: "stdout", want: &WriterPublisher{W: nil}},
+		{target: "https://hooks.example.com/events", want: &WebhookPublisher{URL: "https://hooks.example.com/events", Secret: "s"}},
+		{target: "kafka://broker", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			got, err := newOutboxPublisher(tt.target, "s")
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if w, ok := got.(*WriterPublisher); ok {
+				w.W = nil
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWriterPublisher(t *testing.T) {
+	var buf bytes.Buffer
+	p := &WriterPublisher{W: &buf}
+
+	require.NoError(t, p.Publish(t.Context(), &OutboxMessage{ID: 1, Topic: "orders", Payload: json.RawMessage(`{}`)}))
+	require.NoError(t, p.Publish(t.Context(), &OutboxMessage{ID: 2, Topic: "orders", Payload: json.RawMessage(`{}`)}))
+
+	assert.Equal(t,
+		`{"id":1,"topic":"orders","payload":{},"created_at":"0001-01-01T00:00:00Z","attempts":0}`+"\n"+
+			`{"id":2,"topic":"orders","payload":{},"created_at":"0001-01-01T00:00:00Z","attempts":0}`+"\n",
+		buf.String())
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	t.Run("posts signed messages", func(t *testing.T) {
+		var (
+			got  *http.Request
+			body []byte
+		)
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r
+			body, _ = io.ReadAll(r.Body)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer srv.Close()
+
+		p := &WebhookPublisher{URL: srv.URL, Secret: "s3cret"}
+		require.NoError(t, p.Publish(t.Context(), &OutboxMessage{ID: 7, Topic: "orders", Payload: json.RawMessage(`{"id":42}`)}))
+
+		assert.Equal(t, http.MethodPost, got.Method)
+		assert.Equal(t, "application/json", got.Header.Get("Content-Type"))
+		assert.Equal(t, "outbox-7", got.Header.Get("Idempotency-Key"))
+		assert.Equal(t, "orders", got.Header.Get("X-Outbox-Topic"))
+
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(body)
+		assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), got.Header.Get("X-Outbox-Signature"))
+
+		var msg OutboxMessage
+		require.NoError(t, json.Unmarshal(body, &msg))
+		assert.Equal(t, int64(7), msg.ID)
+		assert.JSONEq(t, `{"id":42}`, string(msg.Payload))
+	})
+
+	tests := []struct {
+		status        int
+		wantErr       bool
+		wantPermanent bool
+	}{
+		{status: http.StatusOK},
+		{status: http.StatusNoContent},
+		{status: http.StatusBadRequest, wantErr: true, wantPermanent: true},
+		{status: http.StatusGone, wantErr: true, wantPermanent: true},
+		{status: http.StatusRequestTimeout, wantErr: true},
+		{status: http.StatusTooManyRequests, wantErr: true},
+		{status: http.StatusBadGateway, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			err := (&WebhookPublisher{URL: srv.URL}).Publish(t.Context(), &OutboxMessage{ID: 1})
+			if !tt.wantErr {
+				require.NoError(t, err)
+				return
+			}
+			require.Error(t, err)
+			var permanent *permanentError
+			assert.Equal(t, tt.wantPermanent, errors.As(err, &permanent))
+		})
+	}
+}
+
+func TestSubjectPublisher(t *testing.T) {
+	var subject string
+	var data []byte
+	p := &SubjectPublisher{Prefix: "app.", Send: func(s string, d []byte) error {
+		subject, data = s, d
+		return nil
+	}}
+
+	require.NoError(t, p.Publish(t.Context(), &OutboxMessage{ID: 3, Topic: "orders", Payload: json.RawMessage(`1`)}))
+	assert.Equal(t, "app.orders", subject)
+	assert.Contains(t, string(data), `"id":3`)
+}
+
+func TestOutboxIntegration(t *testing.T) {
+	skipIfNoTestcontainers(t)
+
+	app := testApp(t)
+	_, err := testPool.Exec(t.Context(), "TRUNCATE outbox")
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = testPool.Exec(context.Background(), "TRUNCATE outbox") })
+
+	pub := &recordingPublisher{}
+	o := NewOutbox(testPool, pub, OutboxOptions{MaxAttempts: 1})
+	errRollback := errors.New("rollback")
+
+	err = app.WithTx(t.Context(), TxOptions{}, func(ctx context.Context, _ pgx.Tx) error {
+		require.NoError(t, o.Enqueue(ctx, OutboxEvent{Topic: "orders", Key: "1", Payload: map[string]int{"id": 1}}))
+		return errRollback
+	})
+	require.ErrorIs(t, err, errRollback)
+
+	err = app.WithTx(t.Context(), TxOptions{}, func(ctx context.Context, _ pgx.Tx) error {
+		return o.Enqueue(ctx, OutboxEvent{Topic: "orders", Key: "2", Payload: map[string]int{"id": 2}})
+	})
+	require.NoError(t, err)
+
+	n, err := o.relay(t.Context(), nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	require.Len(t, pub.Messages(), 1)
+	assert.Equal(t, "2", pub.Messages()[0].Key)
+	assert.JSONEq(t, `{"id":2}`, string(pub.Messages()[0].Payload))
+
+	// A failing publisher dead-letters the message after MaxAttempts.
+	pub.err = errors.New("broker down")
+	err = app.WithTx(t.Context(), TxOptions{}, func(ctx context.Context, _ pgx.Tx) error {
+		return o.Enqueue(ctx, OutboxEvent{Topic: "orders", Key: "3", Payload: 3})
+	})
+	require.NoError(t, err)
+	_, err = o.relay(t.Context(), nil)
+	require.NoError(t, err)
+
+	require.NoError(t, o.measure(t.Context()))
+	assert.Equal(t, int64(0), o.pending.Load())
+	assert.Equal(t, int64(1), o.dead.Load())
+
+	var lastError string
+	require.NoError(t, testPool.QueryRow(t.Context(), "SELECT last_error FROM outbox WHERE dead_at IS NOT NULL").Scan(&lastError))
+	assert.Equal(t, "broker down", lastError)
+}
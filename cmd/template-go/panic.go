@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// PanicReport describes a panic recovered while serving a request.
+type PanicReport struct {
+	Time   time.Time `json:"time"`
+	Value  string    `json:"value"`
+	Stack  string    `json:"stack"`
+	Method string    `json:"method"`
+	URL    string    `json:"url"`
+}
+
+// PanicReporter forwards recovered panics to an error tracker.
+type PanicReporter interface {
+	ReportPanic(ctx context.Context, report PanicReport)
+}
+
+// WriterPanicReporter writes panic reports as JSON lines.
+type WriterPanicReporter struct {
+	mu sync.Mutex
+	w  io.Writer
+	c  io.Closer
+}
+
+// NewWriterPanicReporter returns a reporter writing to w.
+func NewWriterPanicReporter(w io.Writer) *WriterPanicReporter {
+	return &WriterPanicReporter{w: w}
+}
+
+// OpenPanicReporter returns a reporter appending to the file at path,
+// or writing to stdout when path is "-".
+func OpenPanicReporter(path string) (*WriterPanicReporter, error) {
+	if path == "-" {
+		return NewWriterPanicReporter(os.Stdout), nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600) //nolint:gosec // path comes from configuration
+	if err != nil {
+		return nil, fmt.Errorf("failed to open panic log: %w", err)
+	}
+	return &WriterPanicReporter{w: f, c: f}, nil
+}
+
+// ReportPanic implements PanicReporter.
+func (r *WriterPanicReporter) ReportPanic(_ context.Context, report PanicReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := json.NewEncoder(r.w).Encode(report); err != nil {
+		slog.Error("failed to write panic report", "error", err)
+	}
+}
+
+// Close closes the underlying file, if the reporter opened one.
+func (r *WriterPanicReporter) Close() error {
+	if r.c == nil {
+		return nil
+	}
+	if err := r.c.Close(); err != nil {
+		return fmt.Errorf("failed to close panic log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterPanicReporter(t *testing.T) {
+	var buf bytes.Buffer
+	reporter := NewWriterPanicReporter(&buf)
+
+	report := PanicReport{
+		Time:   time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Value:  "boom",
+		Stack:  "goroutine 1 [running]:",
+		Method: "GET",
+		URL:    "/test",
+	}
+	reporter.ReportPanic(t.Context(), report)
+	reporter.ReportPanic(t.Context(), report)
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+
+	var got PanicReport
+	require.NoError(t, json.Unmarshal(lines[0], &got))
+	assert.Equal(t, report, got)
+	assert.NoError(t, reporter.Close())
+}
+
+func TestOpenPanicReporter(t *testing.T) {
+	t.Run("appends to file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "panics.jsonl")
+
+		reporter, err := OpenPanicReporter(path)
+		require.NoError(t, err)
+		reporter.ReportPanic(t.Context(), PanicReport{Value: "boom"})
+		require.NoError(t, reporter.Close())
+
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"value":"boom"`)
+	})
+
+	t.Run("stdout", func(t *testing.T) {
+		reporter, err := OpenPanicReporter("-")
+		require.NoError(t, err)
+		assert.NoError(t, reporter.Close())
+	})
+
+	t.Run("returns error for missing directory", func(t *testing.T) {
+		_, err := OpenPanicReporter(filepath.Join(t.TempDir(), "missing", "panics.jsonl"))
+		require.Error(t, err)
+	})
+}
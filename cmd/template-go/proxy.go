@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// ClientInfo describes the original client of a request.
+type ClientInfo struct {
+	IP     string
+	Scheme string
+	Host   string
+}
+
+type clientInfoKey struct{}
+
+// TrustedProxies resolves the client IP, scheme and host from Forwarded
+// (RFC 7239) or X-Forwarded-* headers when the peer is a trusted proxy,
+// and stores the result in the request context.
+//
+// The forwarding chain is walked from the right and the first address
+// outside the trusted networks is taken as the client.
+func TrustedProxies(trusted []netip.Prefix) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info := directClient(r)
+			if isTrusted(trusted, info.IP) {
+				resolveForwarded(r, trusted, &info)
+			}
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientInfoKey{}, info)))
+		})
+	}
+}
+
+// requestClient returns the client resolved by TrustedProxies,
+// or the directly connected peer when the middleware is not in use.
+func requestClient(r *http.Request) ClientInfo {
+	if info, ok := r.Context().Value(clientInfoKey{}).(ClientInfo); ok {
+		return info
+	}
+	return directClient(r)
+}
+
+func directClient(r *http.Request) ClientInfo {
+	info := ClientInfo{IP: r.RemoteAddr, Scheme: "http", Host: r.Host}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		info.IP = host
+	}
+	if r.TLS != nil {
+		info.Scheme = "https"
+	}
+	return info
+}
+
+// ParseTrustedProxies parses a list of CIDRs or single IP addresses.
+func ParseTrustedProxies(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			addr, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", v, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", v, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func isTrusted(trusted []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHop is one proxy hop as seen by the next one.
+type forwardedHop struct {
+	For   string
+	Proto string
+	Host  string
+}
+
+func resolveForwarded(r *http.Request, trusted []netip.Prefix, info *ClientInfo) {
+	hops := parseForwarded(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = parseXForwarded(r.Header)
+	}
+	if len(hops) == 0 {
+		return
+	}
+
+	// Walk right to left, skipping our own proxies.
+	client := 0
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !isTrusted(trusted, hops[i].For) {
+			client = i
+			break
+		}
+	}
+
+	hop := hops[client]
+	if hop.For != "" {
+		info.IP = hop.For
+	}
+	if proto := strings.ToLower(hop.Proto); proto == "http" || proto == "https" {
+		info.Scheme = proto
+	}
+	if validHost(hop.Host) {
+		info.Host = hop.Host
+	}
+}
+
+// parseForwarded parses RFC 7239 Forwarded header values.
+func parseForwarded(values []string) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			var hop forwardedHop
+			for _, pair := range splitQuoted(element, ';') {
+				key, val, ok := strings.Cut(pair, "=")
+				if !ok {
+					continue
+				}
+				val = unquote(strings.TrimSpace(val))
+				switch strings.ToLower(strings.TrimSpace(key)) {
+				case "for":
+					hop.For = forwardedNode(val)
+				case "proto":
+					hop.Proto = val
+				case "host":
+					hop.Host = val
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseXForwarded builds hops from X-Forwarded-For, attaching the
+// X-Forwarded-Proto and X-Forwarded-Host set by the nearest proxy to each.
+func parseXForwarded(h http.Header) []forwardedHop {
+	var hops []forwardedHop
+	for _, value := range h.Values("X-Forwarded-For") {
+		for ip := range strings.SplitSeq(value, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				hops = append(hops, forwardedHop{For: forwardedNode(ip)})
+			}
+		}
+	}
+
+	proto := lastListValue(h.Values("X-Forwarded-Proto"))
+	host := lastListValue(h.Values("X-Forwarded-Host"))
+	for i := range hops {
+		hops[i].Proto = proto
+		hops[i].Host = host
+	}
+	return hops
+}
+
+// forwardedNode strips the port and IPv6 brackets from a node identifier.
+func forwardedNode(node string) string {
+	if strings.HasPrefix(node, "[") {
+		if end := strings.IndexByte(node, ']'); end > 0 {
+			return node[1:end]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// splitQuoted splits s on sep outside of double-quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	inQuotes, escaped, start := false, false, 0
+	for i := range len(s) {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && inQuotes:
+			escaped = true
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == sep && !inQuotes:
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var b strings.Builder
+	escaped := false
+	for _, c := range s[1 : len(s)-1] {
+		if c == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+		escaped = false
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func lastListValue(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	last := values[len(values)-1]
+	if i := strings.LastIndexByte(last, ','); i >= 0 {
+		last = last[i+1:]
+	}
+	return strings.TrimSpace(last)
+}
+
+func validHost(host string) bool {
+	return host != "" && !strings.ContainsAny(host, " \t/\\@?#")
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	t.Run("parses CIDRs and addresses", func(t *testing.T) {
+		prefixes, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "10.1.2.3/16"})
+		require.NoError(t, err)
+
+		assert.Equal(t, []netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/8"),
+			netip.MustParsePrefix("192.0.2.1/32"),
+			netip.MustParsePrefix("2001:db8::/32"),
+			netip.MustParsePrefix("10.1.0.0/16"),
+		}, prefixes)
+	})
+
+	t.Run("returns error for invalid address", func(t *testing.T) {
+		_, err := ParseTrustedProxies([]string{"ingress"})
+		require.Error(t, err)
+	})
+
+	t.Run("returns error for invalid CIDR", func(t *testing.T) {
+		_, err := ParseTrustedProxies([]string{"10.0.0.0/33"})
+		require.Error(t, err)
+	})
+}
+
+func TestTrustedProxies(t *testing.T) {
+	trusted := []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/8"),
+		netip.MustParsePrefix("2001:db8::/32"),
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		headers    map[string][]string
+		want       ClientInfo
+	}{
+		{
+			name:       "untrusted peer ignores headers",
+			remoteAddr: "203.0.113.7:4000",
+			headers: map[string][]string{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"evil.example"},
+			},
+			want: ClientInfo{IP: "203.0.113.7", Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:       "trusted peer without headers",
+			remoteAddr: "10.0.0.5:4000",
+			want:       ClientInfo{IP: "10.0.0.5", Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:       "x-forwarded single hop",
+			remoteAddr: "10.0.0.5:4000",
+			headers: map[string][]string{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"https"},
+				"X-Forwarded-Host":  {"api.example.com"},
+			},
+			want: ClientInfo{IP: "198.51.100.1", Scheme: "https", Host: "api.example.com"},
+		},
+		{
+			name:       "x-forwarded chain skips trusted hops from the right",
+			remoteAddr: "10.0.0.5:4000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"1.1.1.1, 198.51.100.1", "10.2.3.4"},
+			},
+			want: ClientInfo{IP: "198.51.100.1", Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:       "spoofed left entries are ignored",
+			remoteAddr: "10.0.0.5:4000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"10.9.9.9, 198.51.100.1"},
+			},
+			want: ClientInfo{IP: "198.51.100.1", Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:       "all hops trusted takes leftmost",
+			remoteAddr: "10.0.0.5:4000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"10.1.1.1, 10.2.2.2"},
+			},
+			want: ClientInfo{IP: "10.1.1.1", Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:       "x-forwarded-proto uses nearest proxy value",
+			remoteAddr: "10.0.0.5:4000",
+			headers: map[string][]string{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"http, https"},
+			},
+			want: ClientInfo{IP: "198.51.100.1", Scheme: "https", Host: "example.com"},
+		},
+		{
+			name:       "invalid proto and host are ignored",
+			remoteAddr: "10.0.0.5:4000",
+			headers: map[string][]string{
+				"X-Forwarded-For":   {"198.51.100.1"},
+				"X-Forwarded-Proto": {"javascript"},
+				"X-Forwarded-Host":  {"evil.example/path"},
+			},
+			want: ClientInfo{IP: "198.51.100.1", Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:       "forwarded header",
+			remoteAddr: "10.0.0.5:4000",
+			headers: map[string][]string{
+				"Forwarded": {`for=198.51.100.1;proto=https;host=api.example.com`},
+			},
+			want: ClientInfo{IP: "198.51.100.1", Scheme: "https", Host: "api.example.com"},
+		},
+		{
+			name:       "forwarded chain with ipv6 and port",
+			remoteAddr: "10.0.0.5:4000",
+			headers: map[string][]string{
+				"Forwarded": {`for="[2001:db9::1]:4711";proto=https, for=10.3.3.3;proto=http`},
+			},
+			want: ClientInfo{IP: "2001:db9::1", Scheme: "https", Host: "example.com"},
+		},
+		{
+			name:       "forwarded takes precedence over x-forwarded",
+			remoteAddr: "10.0.0.5:4000",
+			headers: map[string][]string{
+				"Forwarded":       {`for=198.51.100.1`},
+				"X-Forwarded-For": {"198.51.100.2"},
+			},
+			want: ClientInfo{IP: "198.51.100.1", Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:       "forwarded quoted values with separators",
+			remoteAddr: "10.0.0.5:4000",
+			headers: map[string][]string{
+				"Forwarded": {`for="198.51.100.1:80";host="a.example.com";proto=HTTPS`, `for=10.4.4.4`},
+			},
+			want: ClientInfo{IP: "198.51.100.1", Scheme: "https", Host: "a.example.com"},
+		},
+		{
+			name:       "forwarded obfuscated identifier",
+			remoteAddr: "10.0.0.5:4000",
+			headers: map[string][]string{
+				"Forwarded": {`for=_hidden, for=10.4.4.4`},
+			},
+			want: ClientInfo{IP: "_hidden", Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:       "ipv6 trusted peer",
+			remoteAddr: "[2001:db8::5]:4000",
+			headers: map[string][]string{
+				"X-Forwarded-For": {"198.51.100.1"},
+			},
+			want: ClientInfo{IP: "198.51.100.1", Scheme: "http", Host: "example.com"},
+		},
+		{
+			name:       "direct TLS",
+			remoteAddr: "203.0.113.7:4000",
+			tls:        true,
+			want:       ClientInfo{IP: "203.0.113.7", Scheme: "https", Host: "example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got ClientInfo
+			handler := TrustedProxies(trusted)(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+				got = requestClient(r)
+			}))
+
+			target := "http://example.com/test"
+			if tt.tls {
+				target = "https://example.com/test"
+			}
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, target, http.NoBody)
+			req.RemoteAddr = tt.remoteAddr
+			for k, values := range tt.headers {
+				for _, v := range values {
+					req.Header.Add(k, v)
+				}
+			}
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestRequestClientWithoutMiddleware(t *testing.T) {
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	assert.Equal(t, ClientInfo{IP: "192.0.2.1", Scheme: "http", Host: "example.com"}, requestClient(req))
+}
+
+func TestTrustedProxiesFeedsLoggerAndSecure(t *testing.T) {
+	buf := captureLog(t, nil)
+
+	handler := TrustedProxies([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")})(
+		Logger(Secure(SecurityOptions{})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))),
+	)
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+	req.RemoteAddr = "10.0.0.5:4000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	assert.Contains(t, buf.String(), "ip=198.51.100.1")
+	assert.NotEmpty(t, rec.Header().Get("Strict-Transport-Security"))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReadinessCheck reports whether a dependency can serve traffic.
+type ReadinessCheck func(ctx context.Context) error
+
+// ReadinessReport is the body of a successful readiness check.
+type ReadinessReport struct {
+	Checks map[string]string `json:"checks"`
+}
+
+const readinessTimeout = 2 * time.Second
+
+// handleReady runs checks concurrently and answers 503 naming the failed
+// ones. Errors are logged rather than returned, as they may reveal internals.
+func handleReady(checks map[string]ReadinessCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+		defer cancel()
+
+		var (
+			mu     sync.Mutex
+			wg     sync.WaitGroup
+			failed []string
+		)
+		for name, check := range checks {
+			wg.Go(func() {
+				if err := check(ctx); err != nil {
+					slog.WarnContext(ctx, "Readiness check failed", "check", name, "error", err)
+					mu.Lock()
+					failed = append(failed, name)
+					mu.Unlock()
+				}
+			})
+		}
+		wg.Wait()
+
+		if len(failed) > 0 {
+			slices.Sort(failed)
+			respondProblem(w, http.StatusServiceUnavailable, "not ready: "+strings.Join(failed, ", "))
+			return
+		}
+
+		report := ReadinessReport{Checks: make(map[string]string, len(checks))}
+		for name := range checks {
+			report.Checks[name] = "ok"
+		}
+		respondJSON(w, http.StatusOK, report)
+	}
+}
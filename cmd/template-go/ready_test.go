@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleReady(t *testing.T) {
+	ok := func(context.Context) error { return nil }
+	failing := func(context.Context) error { return errors.New("password authentication failed") }
+
+	tests := []struct {
+		name       string
+		checks     map[string]ReadinessCheck
+		wantStatus int
+		wantDetail string
+	}{
+		{"no checks", nil, http.StatusOK, ""},
+		{"all ok", map[string]ReadinessCheck{"database": ok, "notify": ok}, http.StatusOK, ""},
+		{"failing", map[string]ReadinessCheck{"database": failing, "notify": failing, "cache": ok}, http.StatusServiceUnavailable, "not ready: database, notify"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/ready", http.NoBody)
+			rec := httptest.NewRecorder()
+
+			handleReady(tt.checks)(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus != http.StatusOK {
+				var p problem
+				require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &p))
+				assert.Equal(t, tt.wantDetail, p.Detail, "errors are not exposed")
+				return
+			}
+			var report ReadinessReport
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+			assert.Len(t, report.Checks, len(tt.checks))
+		})
+	}
+}
+
+func TestHandleReadyTimeout(t *testing.T) {
+	slow := func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/ready", http.NoBody)
+	rec := httptest.NewRecorder()
+
+	handleReady(map[string]ReadinessCheck{"slow": slow})(rec, req)
+
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ReplicaOptions configures read routing to replicas.
+type ReplicaOptions struct {
+	DSNs []string
+	// MaxLag excludes replicas replaying further behind the primary.
+	MaxLag time.Duration
+	// CheckInterval is how often replica health and lag are measured.
+	CheckInterval time.Duration
+}
+
+const (
+	defaultReplicaMaxLag        = 10 * time.Second
+	defaultReplicaCheckInterval = 5 * time.Second
+)
+
+// replicaLagQuery returns the replay lag in seconds, zero when the
+// replica has replayed everything it received.
+const replicaLagQuery = `SELECT CASE
+	WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END::float8`
+
+// dbPool is a connection pool, satisfied by *pgxpool.Pool.
+type dbPool interface {
+	Querier
+	txBeginner
+	Close()
+}
+
+// replica is a replica pool with its last measured state.
+type replica struct {
+	name    string
+	pool    dbPool
+	healthy atomic.Bool
+	lag     atomic.Int64
+}
+
+// ReplicaRouter is a Querier that sends reads marked with ReadOnly and
+// read-only transactions to healthy replicas in turn, and everything else
+// to the primary. Without a healthy replica reads fall back to the primary.
+type ReplicaRouter struct {
+	primary  dbPool
+	replicas []*replica
+	maxLag   time.Duration
+	next     atomic.Uint64
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// openReplicaRouter connects to the replicas and starts health checks.
+// Replicas are named by host and port, which must be unique.
+func openReplicaRouter(primary *pgxpool.Pool, opts ReplicaOptions) (*ReplicaRouter, error) {
+	names := make([]string, len(opts.DSNs))
+	for i, dsn := range opts.DSNs {
+		name, err := replicaName(dsn)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(names[:i], name) {
+			return nil, fmt.Errorf("duplicate replica %s", name)
+		}
+		names[i] = name
+	}
+
+	pools := make(map[string]dbPool, len(opts.DSNs))
+	for i, dsn := range opts.DSNs {
+		pool, err := openDB(dsn)
+		if err != nil {
+			closePools(pools)
+			return nil, fmt.Errorf("failed to open replica %s: %w", names[i], err)
+		}
+		pools[names[i]] = pool
+	}
+	return NewReplicaRouter(primary, pools, opts), nil
+}
+
+func closePools(pools map[string]dbPool) {
+	for _, pool := range pools {
+		pool.Close()
+	}
+}
+
+// replicaName identifies a replica by host and port, never credentials.
+func replicaName(dsn string) (string, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse replica config: %w", err)
+	}
+	return net.JoinHostPort(cfg.ConnConfig.Host, strconv.Itoa(int(cfg.ConnConfig.Port))), nil
+}
+
+// NewReplicaRouter routes between primary and the named replica pools.
+// Replicas are checked once before it returns and then every CheckInterval
+// until Close.
+func NewReplicaRouter(primary dbPool, replicas map[string]dbPool, opts ReplicaOptions) *ReplicaRouter {
+	if opts.MaxLag <= 0 {
+		opts.MaxLag = defaultReplicaMaxLag
+	}
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = defaultReplicaCheckInterval
+	}
+
+	rr := &ReplicaRouter{primary: primary, maxLag: opts.MaxLag, stop: make(chan struct{})}
+	for _, name := range slices.Sorted(maps.Keys(replicas)) {
+		r := &replica{name: name, pool: replicas[name]}
+		rr.replicas = append(rr.replicas, r)
+		dbReplicas.Set(name, expvar.Func(func() any {
+			return map[string]any{"healthy": r.healthy.Load(), "lag_seconds": time.Duration(r.lag.Load()).Seconds()}
+		}))
+	}
+
+	rr.checkReplicas(context.Background(), opts.CheckInterval)
+	rr.done.Go(func() {
+		ticker := time.NewTicker(opts.CheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-rr.stop:
+				return
+			case <-ticker.C:
+				rr.checkReplicas(context.Background(), opts.CheckInterval)
+			}
+		}
+	})
+	return rr
+}
+
+// checkReplicas measures the lag of every replica concurrently.
+func (rr *ReplicaRouter) checkReplicas(ctx context.Context, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, r := range rr.replicas {
+		wg.Go(func() {
+			var lagSeconds float64
+			err := r.pool.QueryRow(ctx, replicaLagQuery).Scan(&lagSeconds)
+			lag := time.Duration(lagSeconds * float64(time.Second))
+			healthy := err == nil && lag <= rr.maxLag
+
+			r.lag.Store(int64(lag))
+			if r.healthy.Swap(healthy) != healthy {
+				slog.Info("Replica health changed", "replica", r.name, "healthy", healthy, "lag", lag, "error", err)
+			}
+		})
+	}
+	wg.Wait()
+}
+
+// pick returns the next healthy replica pool, or the primary.
+func (rr *ReplicaRouter) pick() dbPool {
+	n := uint64(len(rr.replicas))
+	start := rr.next.Add(1)
+	for i := range n {
+		r := rr.replicas[(start+i)%n]
+		if r.healthy.Load() {
+			dbRoutes.Add("replica", 1)
+			return r.pool
+		}
+	}
+	dbRoutes.Add("fallback", 1)
+	return rr.primary
+}
+
+func (rr *ReplicaRouter) route(ctx context.Context) dbPool {
+	if isReadOnly(ctx) {
+		return rr.pick()
+	}
+	dbRoutes.Add("primary", 1)
+	return rr.primary
+}
+
+// Exec always runs on the primary.
+func (rr *ReplicaRouter) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	dbRoutes.Add("primary", 1)
+	return rr.primary.Exec(ctx, sql, args...) //nolint:wrapcheck // transparent wrapper
+}
+
+// Query runs on a replica when ctx is marked ReadOnly.
+func (rr *ReplicaRouter) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return rr.route(ctx).Query(ctx, sql, args...) //nolint:wrapcheck // transparent wrapper
+}
+
+// QueryRow runs on a replica when ctx is marked ReadOnly.
+func (rr *ReplicaRouter) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return rr.route(ctx).QueryRow(ctx, sql, args...)
+}
+
+// Begin starts a read-write transaction on the primary.
+func (rr *ReplicaRouter) Begin(ctx context.Context) (pgx.Tx, error) {
+	dbRoutes.Add("primary", 1)
+	return rr.primary.Begin(ctx) //nolint:wrapcheck // transparent wrapper
+}
+
+// BeginTx starts read-only transactions on a replica, others on the primary.
+func (rr *ReplicaRouter) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	if txOptions.AccessMode == pgx.ReadOnly {
+		return rr.pick().BeginTx(ctx, txOptions) //nolint:wrapcheck // transparent wrapper
+	}
+	dbRoutes.Add("primary", 1)
+	return rr.primary.BeginTx(ctx, txOptions) //nolint:wrapcheck // transparent wrapper
+}
+
+// Close stops health checks and closes the replica pools, not the primary.
+func (rr *ReplicaRouter) Close() {
+	close(rr.stop)
+	rr.done.Wait()
+	for _, r := range rr.replicas {
+		r.pool.Close()
+		dbReplicas.Delete(r.name)
+	}
+}
+
+type readOnlyKey struct{}
+
+// ReadOnly marks ctx so that queries through a ReplicaRouter may be
+// served by a replica, which can lag behind recent writes.
+func ReadOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readOnlyKey{}, true)
+}
+
+func isReadOnly(ctx context.Context) bool {
+	readOnly, _ := ctx.Value(readOnlyKey{}).(bool)
+	return readOnly
+}
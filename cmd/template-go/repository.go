@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Repositories groups the data access used by handlers.
+type Repositories struct {
+	Info InfoRepository
+}
+
+// NewRepositories returns Postgres repositories running on db, which may
+// be the pool or a transaction. A transaction started by App.WithTx and
+// carried by the context takes precedence over db.
+func NewRepositories(db Querier) Repositories {
+	return Repositories{
+		Info: &pgInfoRepository{db: db},
+	}
+}
+
+// DatabaseInfo holds the database name and version.
+type DatabaseInfo struct {
+	Database string `json:"database"`
+	Version  string `json:"version"`
+}
+
+// InfoRepository reads metadata about the database server.
+type InfoRepository interface {
+	DatabaseInfo(ctx context.Context) (*DatabaseInfo, error)
+}
+
+type pgInfoRepository struct {
+	db Querier
+}
+
+// DatabaseInfo queries the database for its name and version. The query
+// may be served by a replica.
+func (r *pgInfoRepository) DatabaseInfo(ctx context.Context) (*DatabaseInfo, error) {
+	var info DatabaseInfo
+
+	err := querier(ctx, r.db).QueryRow(ReadOnly(ctx), "SELECT current_database(), version()").Scan(&info.Database, &info.Version)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database info: %w", err)
+	}
+
+	return &info, nil
+}
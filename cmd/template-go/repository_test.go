@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memInfoRepository is an in-memory InfoRepository.
+type memInfoRepository struct {
+	info DatabaseInfo
+	err  error
+}
+
+func (r *memInfoRepository) DatabaseInfo(ctx context.Context) (*DatabaseInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	info := r.info
+	return &info, nil
+}
+
+// fakeApp returns an App backed by in-memory repositories.
+func fakeApp(t *testing.T) *App {
+	t.Helper()
+	return &App{
+		Repos: Repositories{
+			Info: &memInfoRepository{info: DatabaseInfo{Database: "testdb", Version: "PostgreSQL 18.0"}},
+		},
+		Config: &Config{},
+	}
+}
+
+// querierCall is a call recorded by recordingQuerier.
+type querierCall struct {
+	Method string
+	SQL    string
+	Args   []any
+}
+
+// recordingQuerier is a Querier mock that records calls and
+// answers them with scripted rows.
+type recordingQuerier struct {
+	mu    sync.Mutex
+	calls []querierCall
+
+	// Rows are returned by Query, the first one by QueryRow.
+	Rows [][]any
+	// Tag is returned by Exec.
+	Tag string
+	// Err fails every call.
+	Err error
+}
+
+func (q *recordingQuerier) record(method, sql string, args []any) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.calls = append(q.calls, querierCall{Method: method, SQL: sql, Args: args})
+}
+
+// Calls returns the recorded calls.
+func (q *recordingQuerier) Calls() []querierCall {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]querierCall(nil), q.calls...)
+}
+
+func (q *recordingQuerier) Exec(_ context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	q.record("Exec", sql, args)
+	return pgconn.NewCommandTag(q.Tag), q.Err
+}
+
+func (q *recordingQuerier) Query(_ context.Context, sql string, args ...any) (pgx.Rows, error) {
+	q.record("Query", sql, args)
+	if q.Err != nil {
+		return nil, q.Err
+	}
+	return &fakeRows{values: q.Rows}, nil
+}
+
+func (q *recordingQuerier) QueryRow(_ context.Context, sql string, args ...any) pgx.Row {
+	q.record("QueryRow", sql, args)
+	switch {
+	case q.Err != nil:
+		return fakeRow{err: q.Err}
+	case len(q.Rows) == 0:
+		return fakeRow{err: pgx.ErrNoRows}
+	default:
+		return fakeRow{values: q.Rows[0]}
+	}
+}
+
+func (q *recordingQuerier) Begin(_ context.Context) (pgx.Tx, error) {
+	q.record("Begin", "", nil)
+	return nil, errors.New("recordingQuerier: transactions are not supported")
+}
+
+// fakeRow scans scripted values.
+type fakeRow struct {
+	values []any
+	err    error
+}
+
+func (r fakeRow) Scan(dest ...any) error {
+	if r.err != nil {
+		return r.err
+	}
+	return scanValues(r.values, dest)
+}
+
+// fakeRows serves scripted rows; unused pgx.Rows methods panic.
+type fakeRows struct {
+	pgx.Rows
+
+	values [][]any
+	pos    int
+	err    error
+	closed bool
+}
+
+func (r *fakeRows) Next() bool {
+	if r.pos >= len(r.values) {
+		return false
+	}
+	r.pos++
+	return true
+}
+
+func (r *fakeRows) Scan(dest ...any) error {
+	return scanValues(r.values[r.pos-1], dest)
+}
+
+func (r *fakeRows) Err() error { return r.err }
+func (r *fakeRows) Close()     { r.closed = true }
+
+// scanValues assigns values to scan destinations of the same types.
+func scanValues(values, dest []any) error {
+	if len(values) != len(dest) {
+		return fmt.Errorf("scanning %d values into %d destinations", len(values), len(dest))
+	}
+	for i, v := range values {
+		reflect.ValueOf(dest[i]).Elem().Set(reflect.ValueOf(v))
+	}
+	return nil
+}
+
+func TestPGInfoRepository(t *testing.T) {
+	t.Run("scans name and version", func(t *testing.T) {
+		q := &recordingQuerier{Rows: [][]any{{"testdb", "PostgreSQL 18.0"}}}
+
+		info, err := NewRepositories(q).Info.DatabaseInfo(t.Context())
+		require.NoError(t, err)
+
+		assert.Equal(t, &DatabaseInfo{Database: "testdb", Version: "PostgreSQL 18.0"}, info)
+		assert.Equal(t, []querierCall{{Method: "QueryRow", SQL: "SELECT current_database(), version()"}}, q.Calls())
+	})
+
+	t.Run("wraps query errors", func(t *testing.T) {
+		q := &recordingQuerier{Err: context.DeadlineExceeded}
+
+		_, err := NewRepositories(q).Info.DatabaseInfo(t.Context())
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.ErrorContains(t, err, "failed to get database info")
+	})
+}
+
+func TestPGInfoRepositoryIntegration(t *testing.T) {
+	skipIfNoTestcontainers(t)
+
+	repo := NewRepositories(testPool).Info
+
+	t.Run("returns error on context timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(t.Context(), 1*time.Nanosecond)
+		defer cancel()
+		time.Sleep(1 * time.Millisecond)
+
+		_, err := repo.DatabaseInfo(ctx)
+		require.Error(t, err)
+	})
+
+	t.Run("returns error on cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		_, err := repo.DatabaseInfo(ctx)
+		require.Error(t, err)
+	})
+
+	t.Run("returns database info with valid connection", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+		defer cancel()
+
+		dbInfo, err := repo.DatabaseInfo(ctx)
+		require.NoError(t, err)
+
+		assert.Equal(t, "testdb", dbInfo.Database)
+		assert.Contains(t, dbInfo.Version, "PostgreSQL")
+	})
+
+	t.Run("runs inside a transaction", func(t *testing.T) {
+		tx, err := testPool.Begin(t.Context())
+		require.NoError(t, err)
+		defer func() { _ = tx.Rollback(t.Context()) }()
+
+		dbInfo, err := NewRepositories(tx).Info.DatabaseInfo(t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, "testdb", dbInfo.Database)
+	})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Task is the body of a scheduled task. Its context is canceled on
+// shutdown.
+type Task func(ctx context.Context) error
+
+// SchedulerOptions configures a Scheduler.
+type SchedulerOptions struct {
+	// Location is the time zone of cron expressions, UTC when nil.
+	Location *time.Location
+	// HistoryRetention is how long runs are kept in task_runs.
+	HistoryRetention time.Duration
+}
+
+const defaultTaskHistoryRetention = 30 * 24 * time.Hour
+
+// Run statuses recorded in task_runs.
+const (
+	TaskRunning   = "running"
+	TaskSucceeded = "succeeded"
+	TaskFailed    = "failed"
+)
+
+// taskLocker takes a lock shared by every instance.
+type taskLocker interface {
+	// TryLock returns whether the lock was taken, and if so a function
+	// releasing it.
+	TryLock(ctx context.Context, key int64) (release func(), ok bool, err error)
+}
+
+// advisoryLocker takes session-level advisory locks on a connection
+// held from the pool until release. If the process dies, the lock is
+// released with its session.
+type advisoryLocker struct {
+	pool *pgxpool.Pool
+}
+
+func (l advisoryLocker) TryLock(ctx context.Context, key int64) (func(), bool, error) {
+	conn, err := l.pool.Acquire(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	var ok bool
+	if err := conn.QueryRow(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&ok); err != nil {
+		conn.Release()
+		return nil, false, fmt.Errorf("failed to take advisory lock: %w", err)
+	}
+	if !ok {
+		conn.Release()
+		return nil, false, nil
+	}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+		defer cancel()
+		if _, err := conn.Exec(ctx, "SELECT pg_advisory_unlock($1)", key); err != nil {
+			// Ending the session releases the lock; the pool then drops
+			// the closed connection.
+			_ = conn.Conn().Close(ctx)
+		}
+		conn.Release()
+	}, true, nil
+}
+
+// scheduledTask is a registered task.
+type scheduledTask struct {
+	name     string
+	spec     string
+	schedule Schedule
+	fn       Task
+}
+
+// Scheduler runs tasks on cron schedules across a fleet: on each tick,
+// every instance tries the task's advisory lock and records the tick in
+// task_runs, so that the task runs once per tick and a run still going at
+// the next tick makes that tick be skipped rather than overlap. Ticks
+// missed while no instance was up are not caught up.
+type Scheduler struct {
+	db       Querier
+	locker   taskLocker
+	opts     SchedulerOptions
+	instance string
+
+	mu      sync.Mutex
+	tasks   []*scheduledTask
+	running bool
+}
+
+// NewScheduler creates a Scheduler recording runs in db.
+func NewScheduler(db Querier, locker taskLocker, opts SchedulerOptions) *Scheduler {
+	if opts.Location == nil {
+		opts.Location = time.UTC
+	}
+	if opts.HistoryRetention <= 0 {
+		opts.HistoryRetention = defaultTaskHistoryRetention
+	}
+	host, _ := os.Hostname()
+	return &Scheduler{
+		db:       db,
+		locker:   locker,
+		opts:     opts,
+		instance: host + ":" + strconv.Itoa(os.Getpid()),
+	}
+}
+
+// Register adds a task named name running on spec, see ParseSchedule.
+// Names identify tasks across instances and in the history. It must be
+// called before Run.
+func (s *Scheduler) Register(name, spec string, fn Task) error {
+	schedule, err := ParseSchedule(spec, s.opts.Location)
+	if err != nil {
+		return err
+	}
+	return s.add(&scheduledTask{name: name, spec: spec, schedule: schedule, fn: fn})
+}
+
+func (s *Scheduler) add(t *scheduledTask) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		panic("scheduler: Register called after Run")
+	}
+	for _, other := range s.tasks {
+		if other.name == t.name {
+			return fmt.Errorf("task %q already registered", t.name)
+		}
+	}
+	s.tasks = append(s.tasks, t)
+	return nil
+}
+
+// Run runs the tasks until ctx is canceled and their runs have returned.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mu.Lock()
+	s.running = true
+	tasks := s.tasks
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, t := range tasks {
+		wg.Go(func() { s.loop(ctx, t) })
+	}
+	wg.Wait()
+}
+
+// loop waits for each tick of t and runs it.
+func (s *Scheduler) loop(ctx context.Context, t *scheduledTask) {
+	for {
+		next := t.schedule.Next(time.Now())
+		if next.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.tick(ctx, t, next)
+	}
+}
+
+// tick runs the tick at of t unless another instance holds its lock or
+// has run it already.
+func (s *Scheduler) tick(ctx context.Context, t *scheduledTask, at time.Time) {
+	logger := slog.With("task", t.name, "scheduled_at", at)
+
+	release, ok, err := s.locker.TryLock(ctx, taskLockKey(t.name))
+	if err != nil {
+		schedulerStats.Add("errors", 1)
+		logger.ErrorContext(ctx, "Failed to lock task", "error", err)
+		return
+	}
+	if !ok {
+		schedulerStats.Add("skipped", 1)
+		logger.DebugContext(ctx, "Task is running on another instance")
+		return
+	}
+	defer release()
+
+	var id int64
+	err = s.db.QueryRow(ctx, `INSERT INTO task_runs (task, scheduled_at, instance) VALUES ($1, $2, $3)
+		ON CONFLICT (task, scheduled_at) DO NOTHING
+		RETURNING id`, t.name, at, s.instance).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		schedulerStats.Add("skipped", 1)
+		logger.DebugContext(ctx, "Task already ran on another instance")
+		return
+	}
+	if err != nil {
+		schedulerStats.Add("errors", 1)
+		logger.ErrorContext(ctx, "Failed to record task run", "error", err)
+		return
+	}
+
+	start := time.Now()
+	runErr := s.run(ctx, t)
+	status, message := TaskSucceeded, ""
+	if runErr != nil {
+		status, message = TaskFailed, runErr.Error()
+		schedulerStats.Add("failed", 1)
+		logger.ErrorContext(ctx, "Task failed", "duration", time.Since(start), "error", runErr)
+	} else {
+		schedulerStats.Add("succeeded", 1)
+		logger.InfoContext(ctx, "Task succeeded", "duration", time.Since(start))
+	}
+
+	dbCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if _, err := s.db.Exec(dbCtx,
+		"UPDATE task_runs SET status = $2, error = NULLIF($3, ''), finished_at = now() WHERE id = $1",
+		id, status, message,
+	); err != nil {
+		schedulerStats.Add("errors", 1)
+		logger.ErrorContext(ctx, "Failed to record task result", "error", err)
+	}
+	if _, err := s.db.Exec(dbCtx,
+		"DELETE FROM task_runs WHERE task = $1 AND scheduled_at < now() - make_interval(secs => $2)",
+		t.name, s.opts.HistoryRetention.Seconds(),
+	); err != nil {
+		logger.WarnContext(ctx, "Failed to prune task history", "error", err)
+	}
+}
+
+// run calls the task, turning a panic into an error.
+func (s *Scheduler) run(ctx context.Context, t *scheduledTask) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return t.fn(ctx)
+}
+
+// taskLockKey derives the advisory lock key of a task from its name.
+func taskLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("task:" + name))
+	return int64(h.Sum64()) //nolint:gosec // the key only needs to be stable
+}
+
+// TaskRun is a recorded run of a task.
+type TaskRun struct {
+	ScheduledAt time.Time  `json:"scheduled_at"`
+	StartedAt   time.Time  `json:"started_at"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	Instance    string     `json:"instance"`
+}
+
+// TaskStatus describes a registered task and its latest run.
+type TaskStatus struct {
+	Name     string    `json:"name"`
+	Schedule string    `json:"schedule"`
+	NextRun  time.Time `json:"next_run"`
+	LastRun  *TaskRun  `json:"last_run,omitempty"`
+}
+
+// TaskStatusReport lists the scheduled tasks.
+type TaskStatusReport struct {
+	Tasks []TaskStatus `json:"tasks"`
+}
+
+// Status returns the registered tasks with their latest run on any
+// instance.
+func (s *Scheduler) Status(ctx context.Context) (*TaskStatusReport, error) {
+	s.mu.Lock()
+	tasks := s.tasks
+	s.mu.Unlock()
+
+	names := make([]string, len(tasks))
+	for i, t := range tasks {
+		names[i] = t.name
+	}
+	rows, err := s.db.Query(ctx, `SELECT DISTINCT ON (task)
+			task, scheduled_at, started_at, finished_at, status, COALESCE(error, ''), instance
+		FROM task_runs
+		WHERE task = ANY($1)
+		ORDER BY task, scheduled_at DESC`, names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query task runs: %w", err)
+	}
+	defer rows.Close()
+
+	last := map[string]*TaskRun{}
+	for rows.Next() {
+		var (
+			name string
+			run  TaskRun
+		)
+		if err := rows.Scan(&name, &run.ScheduledAt, &run.StartedAt, &run.FinishedAt, &run.Status, &run.Error, &run.Instance); err != nil {
+			return nil, fmt.Errorf("failed to scan task run: %w", err)
+		}
+		last[name] = &run
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to query task runs: %w", err)
+	}
+
+	now := time.Now()
+	report := &TaskStatusReport{Tasks: make([]TaskStatus, 0, len(tasks))}
+	for _, t := range tasks {
+		report.Tasks = append(report.Tasks, TaskStatus{
+			Name:     t.name,
+			Schedule: t.spec,
+			NextRun:  t.schedule.Next(now),
+			LastRun:  last[t.name],
+		})
+	}
+	return report, nil
+}
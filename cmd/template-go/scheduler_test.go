@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLocker is an in-process taskLocker.
+type fakeLocker struct {
+	mu   sync.Mutex
+	held map[int64]bool
+	err  error
+}
+
+func (l *fakeLocker) TryLock(_ context.Context, key int64) (func(), bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return nil, false, l.err
+	}
+	if l.held == nil {
+		l.held = map[int64]bool{}
+	}
+	if l.held[key] {
+		return nil, false, nil
+	}
+	l.held[key] = true
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.held, key)
+	}, true, nil
+}
+
+// tickEvery is a Schedule ticking every d from now on.
+type tickEvery time.Duration
+
+func (d tickEvery) Next(t time.Time) time.Time { return t.Add(time.Duration(d)) }
+
+func TestSchedulerRegister(t *testing.T) {
+	s := NewScheduler(&fakePool{}, &fakeLocker{}, SchedulerOptions{})
+	noop := func(context.Context) error { return nil }
+
+	require.NoError(t, s.Register("cleanup", "@hourly", noop))
+	require.ErrorContains(t, s.Register("cleanup", "@daily", noop), "already registered")
+	require.Error(t, s.Register("report", "every day", noop))
+
+	s.Run(canceledContext(t))
+	assert.Panics(t, func() { _ = s.Register("late", "@daily", noop) })
+}
+
+func TestSchedulerTick(t *testing.T) {
+	at := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("records a successful run", func(t *testing.T) {
+		db := &fakePool{recordingQuerier: recordingQuerier{Rows: [][]any{{int64(9)}}}}
+		locker := &fakeLocker{}
+		s := NewScheduler(db, locker, SchedulerOptions{})
+		ran := 0
+		task := &scheduledTask{name: "cleanup", fn: func(context.Context) error {
+			ran++
+			assert.True(t, locker.held[taskLockKey("cleanup")], "the lock is held while running")
+			return nil
+		}}
+
+		s.tick(t.Context(), task, at)
+
+		assert.Equal(t, 1, ran)
+		assert.Empty(t, locker.held, "the lock is released")
+		calls := db.Calls()
+		require.Len(t, calls, 3)
+		assert.Equal(t, []any{"cleanup", at, s.instance}, calls[0].Args)
+		assert.Equal(t, []any{int64(9), TaskSucceeded, ""}, calls[1].Args)
+		assert.Contains(t, calls[2].SQL, "DELETE FROM task_runs")
+	})
+
+	t.Run("records failures and panics", func(t *testing.T) {
+		for _, fn := range []Task{
+			func(context.Context) error { return errors.New("disk full") },
+			func(context.Context) error { panic("disk full") },
+		} {
+			db := &fakePool{recordingQuerier: recordingQuerier{Rows: [][]any{{int64(9)}}}}
+			s := NewScheduler(db, &fakeLocker{}, SchedulerOptions{})
+
+			s.tick(t.Context(), &scheduledTask{name: "cleanup", fn: fn}, at)
+
+			args := db.Calls()[1].Args
+			assert.Equal(t, TaskFailed, args[1])
+			assert.Contains(t, args[2], "disk full")
+		}
+	})
+
+	t.Run("skips ticks locked elsewhere", func(t *testing.T) {
+		db := &fakePool{}
+		locker := &fakeLocker{}
+		release, _, _ := locker.TryLock(t.Context(), taskLockKey("cleanup"))
+		defer release()
+		s := NewScheduler(db, locker, SchedulerOptions{})
+
+		s.tick(t.Context(), &scheduledTask{name: "cleanup", fn: func(context.Context) error {
+			t.Fatal("task ran while locked elsewhere")
+			return nil
+		}}, at)
+		assert.Empty(t, db.Calls())
+	})
+
+	t.Run("skips ticks already run", func(t *testing.T) {
+		db := &fakePool{}
+		s := NewScheduler(db, &fakeLocker{}, SchedulerOptions{})
+
+		s.tick(t.Context(), &scheduledTask{name: "cleanup", fn: func(context.Context) error {
+			t.Fatal("task ran twice for a tick")
+			return nil
+		}}, at)
+		assert.Len(t, db.Calls(), 1)
+	})
+
+	t.Run("skips ticks when locking fails", func(t *testing.T) {
+		db := &fakePool{}
+		s := NewScheduler(db, &fakeLocker{err: errors.New("pool closed")}, SchedulerOptions{})
+
+		s.tick(t.Context(), &scheduledTask{name: "cleanup", fn: func(context.Context) error {
+			t.Fatal("task ran without its lock")
+			return nil
+		}}, at)
+		assert.Empty(t, db.Calls())
+	})
+}
+
+func TestSchedulerRun(t *testing.T) {
+	db := &fakePool{recordingQuerier: recordingQuerier{Rows: [][]any{{int64(1)}}}}
+	s := NewScheduler(db, &fakeLocker{}, SchedulerOptions{})
+	var runs atomic.Int32
+	ctx, cancel := context.WithCancel(t.Context())
+	require.NoError(t, s.add(&scheduledTask{name: "fast", schedule: tickEvery(5 * time.Millisecond), fn: func(ctx context.Context) error {
+		if runs.Add(1) == 3 {
+			cancel()
+		}
+		return ctx.Err()
+	}}))
+
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("scheduler did not stop")
+	}
+	assert.Equal(t, int32(3), runs.Load())
+}
+
+func TestSchedulerStatus(t *testing.T) {
+	started := time.Date(2026, 1, 1, 0, 0, 1, 0, time.UTC)
+	finished := started.Add(time.Second)
+	db := &fakePool{recordingQuerier: recordingQuerier{Rows: [][]any{
+		{"cleanup", started.Add(-time.Second), started, &finished, TaskFailed, "disk full", "host:1"},
+	}}}
+	s := NewScheduler(db, &fakeLocker{}, SchedulerOptions{})
+	noop := func(context.Context) error { return nil }
+	require.NoError(t, s.Register("cleanup", "@hourly", noop))
+	require.NoError(t, s.Register("report", "@daily", noop))
+
+	report, err := s.Status(t.Context())
+	require.NoError(t, err)
+	require.Len(t, report.Tasks, 2)
+
+	assert.Equal(t, "cleanup", report.Tasks[0].Name)
+	assert.Equal(t, "@hourly", report.Tasks[0].Schedule)
+	assert.Equal(t, 0, report.Tasks[0].NextRun.Minute())
+	assert.Equal(t, &TaskRun{
+		ScheduledAt: started.Add(-time.Second), StartedAt: started, FinishedAt: &finished,
+		Status: TaskFailed, Error: "disk full", Instance: "host:1",
+	}, report.Tasks[0].LastRun)
+	assert.Nil(t, report.Tasks[1].LastRun)
+	assert.Equal(t, []any{[]string{"cleanup", "report"}}, db.Calls()[0].Args)
+}
+
+func TestSchedulerIntegration(t *testing.T) {
+	skipIfNoTestcontainers(t)
+
+	_, err := testPool.Exec(t.Context(), "TRUNCATE task_runs")
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = testPool.Exec(context.Background(), "TRUNCATE task_runs") })
+
+	locker := advisoryLocker{pool: testPool}
+	t.Run("advisory locks exclude each other", func(t *testing.T) {
+		release, ok, err := locker.TryLock(t.Context(), taskLockKey("integration"))
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		_, ok, err = locker.TryLock(t.Context(), taskLockKey("integration"))
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		release()
+		release, ok, err = locker.TryLock(t.Context(), taskLockKey("integration"))
+		require.NoError(t, err)
+		require.True(t, ok)
+		release()
+	})
+
+	t.Run("runs a tick once across instances", func(t *testing.T) {
+		var runs atomic.Int32
+		task := &scheduledTask{name: "integration", spec: "@every 1m", schedule: everySchedule(time.Minute), fn: func(context.Context) error {
+			runs.Add(1)
+			return nil
+		}}
+		at := time.Now().Truncate(time.Minute)
+
+		var wg sync.WaitGroup
+		for range 3 {
+			s := NewScheduler(testPool, locker, SchedulerOptions{})
+			require.NoError(t, s.add(task))
+			wg.Go(func() { s.tick(t.Context(), task, at) })
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), runs.Load())
+
+		s := NewScheduler(testPool, locker, SchedulerOptions{})
+		require.NoError(t, s.add(task))
+		report, err := s.Status(t.Context())
+		require.NoError(t, err)
+		require.NotNil(t, report.Tasks[0].LastRun)
+		assert.Equal(t, TaskSucceeded, report.Tasks[0].LastRun.Status)
+		assert.True(t, at.Equal(report.Tasks[0].LastRun.ScheduledAt))
+	})
+}
+
+// canceledContext returns a context that is already canceled.
+func canceledContext(t *testing.T) context.Context {
+	t.Helper()
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	return ctx
+}
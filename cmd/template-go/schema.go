@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Schema is the subset of JSON Schema (2020-12) used by OpenAPI 3.1 documents.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	ContentEncoding      string             `json:"contentEncoding,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Enum                 []any              `json:"enum,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	MinItems             *int               `json:"minItems,omitempty"`
+	MaxItems             *int               `json:"maxItems,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	AnyOf                []*Schema          `json:"anyOf,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+
+	// types holds a loaded list of types such as ["string", "null"].
+	types []string
+	// closed is set by a loaded "additionalProperties": false.
+	closed bool
+}
+
+// UnmarshalJSON accepts the JSON Schema forms of type (a string or a
+// list) and additionalProperties (a schema or a boolean).
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	type plain Schema
+	aux := struct {
+		*plain
+
+		Type                 json.RawMessage `json:"type"`
+		AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	}{plain: (*plain)(s)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err //nolint:wrapcheck // reported with its location by the caller
+	}
+
+	if len(aux.Type) > 0 {
+		if err := json.Unmarshal(aux.Type, &s.Type); err != nil {
+			if err := json.Unmarshal(aux.Type, &s.types); err != nil {
+				return fmt.Errorf("invalid schema type: %w", err)
+			}
+			s.Type = ""
+		}
+	}
+
+	switch string(aux.AdditionalProperties) {
+	case "":
+	case "true":
+	case "false":
+		s.closed = true
+	default:
+		s.AdditionalProperties = &Schema{}
+		if err := json.Unmarshal(aux.AdditionalProperties, s.AdditionalProperties); err != nil {
+			return err //nolint:wrapcheck // reported with its location by the caller
+		}
+	}
+	return nil
+}
+
+// typeList returns the allowed types, empty when any type is allowed.
+func (s *Schema) typeList() []string {
+	if s.types != nil {
+		return s.types
+	}
+	if s.Type != "" {
+		return []string{s.Type}
+	}
+	return nil
+}
+
+// schemaGenerator derives schemas from Go types. Named structs are
+// collected as components and referenced by $ref.
+type schemaGenerator struct {
+	components map[string]*Schema
+	names      map[reflect.Type]string
+}
+
+func newSchemaGenerator() *schemaGenerator {
+	return &schemaGenerator{
+		components: map[string]*Schema{},
+		names:      map[reflect.Type]string{reflect.TypeFor[problem](): "Problem"},
+	}
+}
+
+// schema returns the schema of t the way encoding/json encodes it.
+func (g *schemaGenerator) schema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case implements(t, jsonMarshalerType):
+		return &Schema{}
+	case implements(t, textMarshalerType):
+		return &Schema{Type: "string"}
+	}
+
+	switch t.Kind() { //nolint:exhaustive // remaining kinds have no JSON form
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Int8, reflect.Int16, reflect.Int32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return &Schema{Type: "integer", Minimum: new(0.0)}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", ContentEncoding: "base64"}
+		}
+		return &Schema{Type: "array", Items: g.schema(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := g.componentName(t)
+		if _, ok := g.components[name]; !ok {
+			// Register before descending so recursive types terminate.
+			g.components[name] = &Schema{}
+			*g.components[name] = *g.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	default:
+		return &Schema{}
+	}
+}
+
+func (g *schemaGenerator) componentName(t reflect.Type) string {
+	if name, ok := g.names[t]; ok {
+		return name
+	}
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return r
+		}
+		return '_'
+	}, t.Name())
+	g.names[t] = name
+	return name
+}
+
+func (g *schemaGenerator) structSchema(t reflect.Type) *Schema {
+	s := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for _, f := range bodyFields(t) {
+		fs := g.schema(f.Type)
+		if applyRules(fs, f.Type, f.Tag.Get("validate")) {
+			s.Required = append(s.Required, f.name)
+		}
+		s.Properties[f.name] = fs
+	}
+	return s
+}
+
+// paramSchema returns the schema of a path or query parameter of type t.
+func (g *schemaGenerator) paramSchema(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch {
+	case t == durationType:
+		return &Schema{Type: "string", Format: "duration"}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8:
+		return &Schema{Type: "array", Items: g.paramSchema(t.Elem())}
+	default:
+		return g.schema(t)
+	}
+}
+
+// namedField is a struct field with its JSON name.
+type namedField struct {
+	reflect.StructField
+
+	name string
+}
+
+// bodyFields lists the JSON fields of struct type t, flattening untagged
+// embedded structs and skipping path and query parameters.
+func bodyFields(t reflect.Type) []namedField {
+	var fields []namedField
+	for i := range t.NumField() {
+		sf := t.Field(i)
+		if sf.Anonymous && sf.Tag.Get("json") == "" {
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				fields = append(fields, bodyFields(ft)...)
+				continue
+			}
+		}
+		if sf.Tag.Get("path") != "" || sf.Tag.Get("query") != "" {
+			continue
+		}
+		if name, ok := jsonFieldName(sf); ok {
+			fields = append(fields, namedField{StructField: sf, name: name})
+		}
+	}
+	return fields
+}
+
+// applyRules translates validate tag rules into schema keywords and
+// reports whether the field is required.
+func applyRules(s *Schema, t reflect.Type, rules string) bool {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	required := false
+	for rule := range strings.SplitSeq(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			required = true
+		case "min", "max":
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				continue
+			}
+			setBound(s, t, bound, name == "min")
+		case "oneof":
+			for option := range strings.FieldsSeq(arg) {
+				s.Enum = append(s.Enum, enumValue(t, option))
+			}
+		case "email":
+			s.Format = "email"
+		}
+	}
+	return required
+}
+
+func setBound(s *Schema, t reflect.Type, bound float64, isMin bool) {
+	n := int(bound)
+	switch t.Kind() { //nolint:exhaustive // other kinds have no bounds
+	case reflect.String:
+		if isMin {
+			s.MinLength = &n
+		} else {
+			s.MaxLength = &n
+		}
+	case reflect.Slice, reflect.Array:
+		if isMin {
+			s.MinItems = &n
+		} else {
+			s.MaxItems = &n
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if isMin {
+			s.Minimum = &bound
+		} else {
+			s.Maximum = &bound
+		}
+	}
+}
+
+// enumValue converts a oneof option to the JSON type of the field.
+func enumValue(t reflect.Type, option string) any {
+	switch t.Kind() { //nolint:exhaustive // other kinds are enumerated as strings
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		if f, err := strconv.ParseFloat(option, 64); err == nil {
+			return f
+		}
+	}
+	return option
+}
+
+// implements reports whether t or *t implements iface.
+func implements(t, iface reflect.Type) bool {
+	return t.Implements(iface) || (t.Kind() != reflect.Pointer && reflect.PointerTo(t).Implements(iface))
+}
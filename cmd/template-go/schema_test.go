@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSchemaUser struct {
+	testEmbedded
+
+	Name    string            `json:"name"              validate:"required,min=2,max=50"`
+	Email   string            `json:"email,omitempty"   validate:"email"`
+	Role    string            `json:"role"              validate:"oneof=admin user"`
+	Level   int               `json:"level"             validate:"oneof=1 2 3"`
+	Tags    []string          `json:"tags"              validate:"max=5"`
+	Created time.Time         `json:"created"`
+	Avatar  []byte            `json:"avatar"`
+	Labels  map[string]string `json:"labels"`
+	Addr    netip.Addr        `json:"addr"`
+	Parent  *testSchemaUser   `json:"parent"`
+	Page    int               `json:"-"                 query:"page"`
+	Ignored string            `json:"-"`
+	private string
+}
+
+func TestSchemaGenerator(t *testing.T) {
+	g := newSchemaGenerator()
+
+	ref := g.schema(reflect.TypeFor[*testSchemaUser]())
+	assert.Equal(t, &Schema{Ref: "#/components/schemas/testSchemaUser"}, ref)
+
+	want := &Schema{
+		Type: "object",
+		Properties: map[string]*Schema{
+			"kind":    {Type: "string"},
+			"name":    {Type: "string", MinLength: new(2), MaxLength: new(50)},
+			"email":   {Type: "string", Format: "email"},
+			"role":    {Type: "string", Enum: []any{"admin", "user"}},
+			"level":   {Type: "integer", Format: "int64", Enum: []any{1.0, 2.0, 3.0}},
+			"tags":    {Type: "array", Items: &Schema{Type: "string"}, MaxItems: new(5)},
+			"created": {Type: "string", Format: "date-time"},
+			"avatar":  {Type: "string", ContentEncoding: "base64"},
+			"labels":  {Type: "object", AdditionalProperties: &Schema{Type: "string"}},
+			"addr":    {Type: "string"},
+			"parent":  {Ref: "#/components/schemas/testSchemaUser"},
+		},
+		Required: []string{"name"},
+	}
+	assert.Equal(t, want, g.components["testSchemaUser"])
+	assert.NotContains(t, g.components, "testEmbedded")
+}
+
+func TestSchemaGeneratorScalars(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  reflect.Type
+		want *Schema
+	}{
+		{"bool", reflect.TypeFor[bool](), &Schema{Type: "boolean"}},
+		{"int32", reflect.TypeFor[int32](), &Schema{Type: "integer", Format: "int32"}},
+		{"uint", reflect.TypeFor[uint](), &Schema{Type: "integer", Minimum: new(0.0)}},
+		{"float32", reflect.TypeFor[float32](), &Schema{Type: "number", Format: "float"}},
+		{"any", reflect.TypeFor[any](), &Schema{}},
+		{"anonymous struct", reflect.TypeFor[struct {
+			A int `json:"a"`
+		}](), &Schema{Type: "object", Properties: map[string]*Schema{"a": {Type: "integer", Format: "int64"}}}},
+		{"problem", reflect.TypeFor[problem](), &Schema{Ref: "#/components/schemas/Problem"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, newSchemaGenerator().schema(tt.typ))
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SecurityOptions configures the Secure middleware.
+// Zero values select the defaults below, negative limits disable them.
+type SecurityOptions struct {
+	ContentSecurityPolicy string
+	ReferrerPolicy        string
+	HSTSMaxAge            time.Duration
+	MaxBodyBytes          int64
+	AllowedMethods        []string
+}
+
+const (
+	defaultContentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'"
+	defaultReferrerPolicy        = "no-referrer"
+	defaultHSTSMaxAge            = 365 * 24 * time.Hour
+	defaultMaxBodyBytes          = 1 << 20
+	defaultMaxHeaderBytes        = 32 << 10
+)
+
+var defaultAllowedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+func (o SecurityOptions) withDefaults() SecurityOptions {
+	if o.ContentSecurityPolicy == "" {
+		o.ContentSecurityPolicy = defaultContentSecurityPolicy
+	}
+	if o.ReferrerPolicy == "" {
+		o.ReferrerPolicy = defaultReferrerPolicy
+	}
+	if o.HSTSMaxAge == 0 {
+		o.HSTSMaxAge = defaultHSTSMaxAge
+	}
+	if o.MaxBodyBytes == 0 {
+		o.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if len(o.AllowedMethods) == 0 {
+		o.AllowedMethods = defaultAllowedMethods
+	}
+	return o
+}
+
+// Secure sets security headers on every response, limits request bodies
+// and rejects requests with unexpected methods or malformed paths.
+func Secure(opts SecurityOptions) func(http.Handler) http.Handler {
+	opts = opts.withDefaults()
+	hsts := "max-age=" + strconv.Itoa(int(opts.HSTSMaxAge.Seconds())) + "; includeSubDomains"
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("Referrer-Policy", opts.ReferrerPolicy)
+			h.Set("Content-Security-Policy", opts.ContentSecurityPolicy)
+			h.Set("Cache-Control", "no-store")
+			if opts.HSTSMaxAge > 0 && requestClient(r).Scheme == "https" {
+				h.Set("Strict-Transport-Security", hsts)
+			}
+
+			if !slices.Contains(opts.AllowedMethods, r.Method) {
+				h.Set("Allow", strings.Join(opts.AllowedMethods, ", "))
+				respondProblem(w, http.StatusMethodNotAllowed, "method "+r.Method+" is not allowed")
+				return
+			}
+			if suspiciousPath(r) {
+				respondProblem(w, http.StatusBadRequest, "malformed request path")
+				return
+			}
+
+			if opts.MaxBodyBytes > 0 {
+				if r.ContentLength > opts.MaxBodyBytes {
+					respondProblem(w, http.StatusRequestEntityTooLarge, "request body too large")
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, opts.MaxBodyBytes)
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// suspiciousPath reports whether the request path contains traversal
+// segments, control characters or encoded separators.
+func suspiciousPath(r *http.Request) bool {
+	path := r.URL.Path
+	if !strings.HasPrefix(path, "/") && r.Method != http.MethodOptions {
+		return true
+	}
+	if strings.ContainsFunc(path, func(c rune) bool { return c < 0x20 || c == 0x7f || c == '\\' }) {
+		return true
+	}
+	for segment := range strings.SplitSeq(path, "/") {
+		if segment == ".." || segment == "." {
+			return true
+		}
+	}
+
+	raw := strings.ToLower(r.URL.RawPath)
+	return strings.Contains(raw, "%2f") || strings.Contains(raw, "%5c") || strings.Contains(raw, "%00")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSecureHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     SecurityOptions
+		tls      bool
+		wantCSP  string
+		wantRef  string
+		wantHSTS string
+	}{
+		{
+			name:    "defaults over plain HTTP",
+			wantCSP: defaultContentSecurityPolicy,
+			wantRef: defaultReferrerPolicy,
+		},
+		{
+			name:     "HSTS over TLS",
+			tls:      true,
+			wantCSP:  defaultContentSecurityPolicy,
+			wantRef:  defaultReferrerPolicy,
+			wantHSTS: "max-age=31536000; includeSubDomains",
+		},
+		{
+			name:     "custom policies",
+			opts:     SecurityOptions{ContentSecurityPolicy: "default-src 'self'", ReferrerPolicy: "same-origin", HSTSMaxAge: time.Hour},
+			tls:      true,
+			wantCSP:  "default-src 'self'",
+			wantRef:  "same-origin",
+			wantHSTS: "max-age=3600; includeSubDomains",
+		},
+		{
+			name:    "HSTS disabled",
+			opts:    SecurityOptions{HSTSMaxAge: -1},
+			tls:     true,
+			wantCSP: defaultContentSecurityPolicy,
+			wantRef: defaultReferrerPolicy,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Secure(tt.opts)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "nosniff", rec.Header().Get("X-Content-Type-Options"))
+			assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+			assert.Equal(t, tt.wantCSP, rec.Header().Get("Content-Security-Policy"))
+			assert.Equal(t, tt.wantRef, rec.Header().Get("Referrer-Policy"))
+			assert.Equal(t, tt.wantHSTS, rec.Header().Get("Strict-Transport-Security"))
+		})
+	}
+}
+
+func TestSecureHandlerCanOverrideCacheControl(t *testing.T) {
+	handler := Secure(SecurityOptions{})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/test", http.NoBody)
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, "public, max-age=60", rec.Header().Get("Cache-Control"))
+}
+
+func TestSecureRejectsRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+	}{
+		{"TRACE method", http.MethodTrace, "/test", http.StatusMethodNotAllowed},
+		{"CONNECT method", http.MethodConnect, "/test", http.StatusMethodNotAllowed},
+		{"custom method", "PROPFIND", "/test", http.StatusMethodNotAllowed},
+		{"traversal segment", http.MethodGet, "/static/../etc/passwd", http.StatusBadRequest},
+		{"dot segment", http.MethodGet, "/./test", http.StatusBadRequest},
+		{"encoded slash", http.MethodGet, "/files/a%2Fb", http.StatusBadRequest},
+		{"encoded backslash", http.MethodGet, "/files/a%5Cb", http.StatusBadRequest},
+		{"encoded NUL", http.MethodGet, "/files/a%00b", http.StatusBadRequest},
+		{"control character", http.MethodGet, "/files/a%0Ab", http.StatusBadRequest},
+		{"regular path", http.MethodGet, "/test", http.StatusOK},
+		{"encoded space", http.MethodGet, "/files/a%20b", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := Secure(SecurityOptions{})(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequestWithContext(t.Context(), tt.method, tt.target, http.NoBody)
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantStatus != http.StatusOK {
+				assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestSecureMaxBodyBytes(t *testing.T) {
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			respondProblem(w, http.StatusRequestEntityTooLarge, err.Error())
+			return
+		}
+		_, _ = w.Write(body)
+	})
+
+	t.Run("declared length over limit", func(t *testing.T) {
+		handler := Secure(SecurityOptions{MaxBodyBytes: 8})(echo)
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/test", strings.NewReader("0123456789"))
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	})
+
+	t.Run("streamed body over limit", func(t *testing.T) {
+		handler := Secure(SecurityOptions{MaxBodyBytes: 8})(echo)
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/test", io.NopCloser(strings.NewReader("0123456789")))
+		req.ContentLength = -1
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	})
+
+	t.Run("body within limit", func(t *testing.T) {
+		handler := Secure(SecurityOptions{MaxBodyBytes: 8})(echo)
+
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/test", strings.NewReader("01234567"))
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "01234567", rec.Body.String())
+	})
+
+	t.Run("limit disabled", func(t *testing.T) {
+		handler := Secure(SecurityOptions{MaxBodyBytes: -1})(echo)
+
+		payload := strings.Repeat("x", defaultMaxBodyBytes+1)
+		req := httptest.NewRequestWithContext(t.Context(), http.MethodPost, "/test", strings.NewReader(payload))
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Len(t, rec.Body.String(), len(payload))
+	})
+}
+
+func TestNewServerSecurityHeaders(t *testing.T) {
+	app := testApp(t)
+	server := app.newServer()
+
+	assert.Equal(t, app.Config.MaxHeaderBytes, server.MaxHeaderBytes)
+
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/health", http.NoBody)
+	rec := httptest.NewRecorder()
+
+	server.Handler.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "nosniff", rec.Header().Get("X-Content-Type-Options"))
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Event is a server-sent event published to a topic.
+type Event struct {
+	// ID is assigned by the Broker and increases across all topics.
+	ID    uint64
+	Topic string
+	// Type is the event name, empty for the default "message".
+	Type string
+	Data string
+}
+
+// BrokerOptions configures a Broker.
+type BrokerOptions struct {
+	// Topics limits subscriptions to these topics.
+	Topics []string
+	// ReplaySize is how many events per topic are kept for clients
+	// resuming with Last-Event-ID.
+	ReplaySize int
+	// ClientBuffer is how many events may wait for a client before it is
+	// disconnected as too slow. It can resume with Last-Event-ID.
+	ClientBuffer int
+	// Heartbeat is the interval of comments sent to keep idle streams open.
+	Heartbeat time.Duration
+	// WriteTimeout bounds each write to a client, replacing the server's
+	// WriteTimeout, which would cut streams off.
+	WriteTimeout time.Duration
+}
+
+const (
+	defaultEventReplaySize   = 256
+	defaultEventClientBuffer = 32
+	defaultEventHeartbeat    = 15 * time.Second
+	defaultEventWriteTimeout = 10 * time.Second
+	// eventRetry is the reconnection delay suggested to clients.
+	eventRetry = 3 * time.Second
+)
+
+// resetEvent tells a resuming client that events were missed, so it
+// should reload its state.
+const resetEvent = "reset"
+
+var errBrokerClosed = errors.New("event broker closed")
+
+// eventTopic holds the replay buffer and subscribers of a topic.
+type eventTopic struct {
+	replay []Event
+	// evicted is the ID of the last event dropped from replay.
+	evicted uint64
+	clients map[*eventClient]struct{}
+}
+
+// eventClient is a subscriber with its pending events. ch is closed when
+// the client falls too far behind or the broker closes.
+type eventClient struct {
+	ch chan Event
+}
+
+// Broker fans events out to SSE clients. Each client has a bounded queue;
+// a client that lets it fill up is disconnected rather than slowing down
+// publishers or other clients.
+type Broker struct {
+	opts   BrokerOptions
+	topics map[string]*eventTopic
+	// epoch distinguishes IDs of this process from earlier ones, so that a
+	// client resuming across a restart is told to reset.
+	epoch string
+
+	mu     sync.Mutex
+	nextID uint64
+	closed bool
+}
+
+// NewBroker creates a Broker for opts.Topics.
+func NewBroker(opts BrokerOptions) *Broker {
+	if opts.ReplaySize <= 0 {
+		opts.ReplaySize = defaultEventReplaySize
+	}
+	if opts.ClientBuffer <= 0 {
+		opts.ClientBuffer = defaultEventClientBuffer
+	}
+	if opts.Heartbeat <= 0 {
+		opts.Heartbeat = defaultEventHeartbeat
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = defaultEventWriteTimeout
+	}
+
+	b := &Broker{
+		opts:   opts,
+		topics: make(map[string]*eventTopic, len(opts.Topics)),
+		epoch:  strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+	for _, name := range opts.Topics {
+		b.topics[name] = &eventTopic{clients: map[*eventClient]struct{}{}}
+	}
+	return b
+}
+
+// Publish sends an event to the subscribers of topic and keeps it for
+// replay. Events on unknown topics are discarded.
+func (b *Broker) Publish(topic, typ, data string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	t, ok := b.topics[topic]
+	if !ok || b.closed {
+		return
+	}
+	b.nextID++
+	ev := Event{ID: b.nextID, Topic: topic, Type: typ, Data: data}
+	eventStats.Add("published", 1)
+
+	if len(t.replay) == b.opts.ReplaySize {
+		t.evicted = t.replay[0].ID
+		t.replay = append(t.replay[:0], t.replay[1:]...)
+	}
+	t.replay = append(t.replay, ev)
+
+	for c := range t.clients {
+		select {
+		case c.ch <- ev:
+		default:
+			eventStats.Add("slow_clients", 1)
+			b.removeLocked(c)
+		}
+	}
+}
+
+// subscribe registers a client for topics and returns the events after
+// lastID, atomically with registration so that none are missed. reset
+// reports that some events after lastID are no longer available.
+func (b *Broker) subscribe(topics []string, lastID string) (c *eventClient, replay []Event, reset bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, nil, false, errBrokerClosed
+	}
+
+	after, resume := b.parseID(lastID)
+	reset = lastID != "" && !resume
+	c = &eventClient{ch: make(chan Event, b.opts.ClientBuffer)}
+	for _, name := range topics {
+		t := b.topics[name]
+		t.clients[c] = struct{}{}
+		if !resume {
+			continue
+		}
+		if after < t.evicted {
+			reset = true
+		}
+		for _, ev := range t.replay {
+			if ev.ID > after {
+				replay = append(replay, ev)
+			}
+		}
+	}
+	slices.SortFunc(replay, func(a, b Event) int { return cmp.Compare(a.ID, b.ID) })
+	eventStats.Add("clients", 1)
+	return c, replay, reset, nil
+}
+
+// unsubscribe removes c unless it was already dropped.
+func (b *Broker) unsubscribe(c *eventClient) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.removeLocked(c)
+}
+
+func (b *Broker) removeLocked(c *eventClient) {
+	removed := false
+	for _, t := range b.topics {
+		if _, ok := t.clients[c]; ok {
+			delete(t.clients, c)
+			removed = true
+		}
+	}
+	if removed {
+		close(c.ch)
+		eventStats.Add("clients", -1)
+	}
+}
+
+// Close disconnects every client and refuses new ones. Register it with
+// http.Server.RegisterOnShutdown, as Shutdown does not end streams itself.
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, t := range b.topics {
+		for c := range t.clients {
+			b.removeLocked(c)
+		}
+	}
+}
+
+// formatID renders an event ID as "<epoch>-<id>".
+func (b *Broker) formatID(id uint64) string {
+	return b.epoch + "-" + strconv.FormatUint(id, 10)
+}
+
+// parseID parses a Last-Event-ID issued by this process.
+func (b *Broker) parseID(s string) (uint64, bool) {
+	epoch, id, ok := strings.Cut(s, "-")
+	if !ok || epoch != b.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(id, 10, 64)
+	return n, err == nil && n <= b.nextID
+}
+
+// ServeHTTP streams events of the topics named by the topic query
+// parameters as text/event-stream, starting after Last-Event-ID.
+func (b *Broker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	topics := r.URL.Query()["topic"]
+	if len(topics) == 0 {
+		respondProblem(w, http.StatusBadRequest, "topic is required")
+		return
+	}
+	for _, name := range topics {
+		if _, ok := b.topics[name]; !ok {
+			respondProblem(w, http.StatusNotFound, "unknown topic "+strconv.Quote(name))
+			return
+		}
+	}
+	if _, ok := negotiateContentType(r.Header.Get("Accept"), []string{"text/event-stream"}); !ok {
+		respondProblem(w, http.StatusNotAcceptable, "supported media types: text/event-stream")
+		return
+	}
+
+	c, replay, reset, err := b.subscribe(slices.Compact(slices.Sorted(slices.Values(topics))), r.Header.Get("Last-Event-ID"))
+	if err != nil {
+		respondProblem(w, http.StatusServiceUnavailable, "server is shutting down")
+		return
+	}
+	defer b.unsubscribe(c)
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	s := &eventStream{w: w, rc: http.NewResponseController(w), timeout: b.opts.WriteTimeout}
+	s.printf("retry: %d\n\n", eventRetry.Milliseconds())
+	if reset {
+		s.printf("event: %s\ndata:\n\n", resetEvent)
+	}
+	for _, ev := range replay {
+		s.event(b.formatID(ev.ID), ev)
+	}
+	if s.flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(b.opts.Heartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-c.ch:
+			if !ok {
+				return
+			}
+			s.event(b.formatID(ev.ID), ev)
+		case <-heartbeat.C:
+			s.printf(": heartbeat\n\n")
+		}
+		if s.flush() != nil {
+			return
+		}
+	}
+}
+
+// eventStream writes SSE frames, extending the write deadline before each
+// batch so that the stream can outlive the server's WriteTimeout.
+type eventStream struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	timeout time.Duration
+	err     error
+}
+
+func (s *eventStream) printf(format string, args ...any) {
+	if s.err != nil {
+		return
+	}
+	if s.err = s.rc.SetWriteDeadline(time.Now().Add(s.timeout)); errors.Is(s.err, http.ErrNotSupported) {
+		s.err = nil
+	}
+	if s.err == nil {
+		_, s.err = fmt.Fprintf(s.w, format, args...)
+	}
+}
+
+// eventNewlines normalizes the line endings SSE recognizes.
+var eventNewlines = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// event writes ev, splitting multi-line data into several data fields.
+func (s *eventStream) event(id string, ev Event) {
+	var sb strings.Builder
+	sb.WriteString("id: " + id + "\n")
+	if ev.Type != "" {
+		sb.WriteString("event: " + ev.Type + "\n")
+	}
+	for line := range strings.SplitSeq(eventNewlines.Replace(ev.Data), "\n") {
+		sb.WriteString("data: " + line + "\n")
+	}
+	sb.WriteString("\n")
+	s.printf("%s", sb.String())
+}
+
+func (s *eventStream) flush() error {
+	if s.err == nil {
+		s.err = s.rc.Flush()
+	}
+	return s.err
+}
+
+// publishNotifications returns a NotifyHandler publishing each payload as
+// an event on the topic named after the channel.
+func (b *Broker) publishNotifications() NotifyHandler {
+	return func(_ context.Context, n *pgconn.Notification) error {
+		b.Publish(n.Channel, "", n.Payload)
+		return nil
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// eventReader reads SSE frames from a response.
+type eventReader struct {
+	t    *testing.T
+	resp *http.Response
+	sc   *bufio.Scanner
+}
+
+// openEvents connects to an SSE endpoint of srv.
+func openEvents(t *testing.T, srv *httptest.Server, query, lastID string) *eventReader {
+	t.Helper()
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL+"/events?"+query, http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := &eventReader{t: t, resp: resp, sc: bufio.NewScanner(resp.Body)}
+	assert.Equal(t, "retry: 3000", r.frame())
+	return r
+}
+
+// frame returns the next frame with its lines joined by "|", or "" at EOF.
+func (r *eventReader) frame() string {
+	r.t.Helper()
+	var lines []string
+	for r.sc.Scan() {
+		if r.sc.Text() == "" {
+			return strings.Join(lines, "|")
+		}
+		lines = append(lines, r.sc.Text())
+	}
+	return strings.Join(lines, "|")
+}
+
+// withoutID strips the leading id field of a frame.
+func withoutID(frame string) string {
+	_, rest, _ := strings.Cut(frame, "|")
+	return rest
+}
+
+func newEventServer(t *testing.T, opts BrokerOptions) (*Broker, *httptest.Server) {
+	t.Helper()
+	b := NewBroker(opts)
+	mux := http.NewServeMux()
+	mux.Handle("GET /events", b)
+	srv := httptest.NewServer(LoggerWith(LoggerOptions{})(mux))
+	t.Cleanup(srv.Close)
+	t.Cleanup(b.Close)
+	return b, srv
+}
+
+// waitClients waits until n clients are subscribed to topic.
+func waitClients(t *testing.T, b *Broker, topic string, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.topics[topic].clients) == n
+	}, time.Second, time.Millisecond)
+}
+
+func TestBrokerRejects(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		accept     string
+		wantStatus int
+	}{
+		{"missing topic", "", "text/event-stream", http.StatusBadRequest},
+		{"unknown topic", "topic=orders&topic=secrets", "text/event-stream", http.StatusNotFound},
+		{"not acceptable", "topic=orders", "application/json", http.StatusNotAcceptable},
+	}
+
+	b := NewBroker(BrokerOptions{Topics: []string{"orders"}})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/events?"+tt.query, http.NoBody)
+			req.Header.Set("Accept", tt.accept)
+			rec := httptest.NewRecorder()
+
+			b.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+		})
+	}
+}
+
+func TestBrokerStreams(t *testing.T) {
+	b, srv := newEventServer(t, BrokerOptions{Topics: []string{"orders", "users"}})
+	r1 := openEvents(t, srv, "topic=orders", "")
+	r2 := openEvents(t, srv, "topic=orders&topic=users", "")
+	waitClients(t, b, "orders", 2)
+
+	b.Publish("orders", "created", "line 1\nline 2\r\nline 3")
+	b.Publish("users", "", "alice")
+	b.Publish("unknown", "", "dropped")
+
+	assert.Equal(t, "event: created|data: line 1|data: line 2|data: line 3", withoutID(r1.frame()))
+	assert.Equal(t, "event: created|data: line 1|data: line 2|data: line 3", withoutID(r2.frame()))
+	assert.Equal(t, "data: alice", withoutID(r2.frame()))
+}
+
+func TestBrokerResume(t *testing.T) {
+	b, srv := newEventServer(t, BrokerOptions{Topics: []string{"orders", "users"}, ReplaySize: 2})
+	first := openEvents(t, srv, "topic=orders", "")
+	waitClients(t, b, "orders", 1)
+	b.Publish("orders", "", "1")
+	id, _, _ := strings.Cut(first.frame(), "|")
+	lastID := strings.TrimPrefix(id, "id: ")
+	b.Publish("orders", "", "2")
+	b.Publish("users", "", "u")
+	b.Publish("orders", "", "3")
+
+	t.Run("replays missed events", func(t *testing.T) {
+		r := openEvents(t, srv, "topic=orders&topic=users", lastID)
+		assert.Equal(t, "data: 2", withoutID(r.frame()))
+		assert.Equal(t, "data: u", withoutID(r.frame()))
+		assert.Equal(t, "data: 3", withoutID(r.frame()))
+	})
+
+	t.Run("resets when events were evicted", func(t *testing.T) {
+		b.Publish("orders", "", "4")
+		r := openEvents(t, srv, "topic=orders", lastID)
+		assert.Equal(t, "event: reset|data:", r.frame())
+		assert.Equal(t, "data: 3", withoutID(r.frame()))
+		assert.Equal(t, "data: 4", withoutID(r.frame()))
+	})
+
+	t.Run("resets on IDs of another process", func(t *testing.T) {
+		r := openEvents(t, srv, "topic=orders", "0-1")
+		assert.Equal(t, "event: reset|data:", r.frame())
+		b.Publish("orders", "", "5")
+		assert.Equal(t, "data: 5", withoutID(r.frame()))
+	})
+}
+
+func TestBrokerDisconnectsSlowClients(t *testing.T) {
+	b := NewBroker(BrokerOptions{Topics: []string{"orders"}, ClientBuffer: 2})
+	slow, _, _, err := b.subscribe([]string{"orders"}, "")
+	require.NoError(t, err)
+	fast, _, _, err := b.subscribe([]string{"orders"}, "")
+	require.NoError(t, err)
+
+	for range 3 {
+		b.Publish("orders", "", "x")
+		<-fast.ch
+	}
+
+	assert.Len(t, slow.ch, 2)
+	<-slow.ch
+	<-slow.ch
+	_, open := <-slow.ch
+	assert.False(t, open, "the slow client is disconnected")
+	b.Publish("orders", "", "y")
+	assert.Equal(t, "y", (<-fast.ch).Data, "other clients are unaffected")
+}
+
+func TestBrokerHeartbeat(t *testing.T) {
+	b, srv := newEventServer(t, BrokerOptions{Topics: []string{"orders"}, Heartbeat: 10 * time.Millisecond})
+	r := openEvents(t, srv, "topic=orders", "")
+	waitClients(t, b, "orders", 1)
+
+	assert.Equal(t, ": heartbeat", r.frame())
+}
+
+func TestBrokerOutlivesWriteTimeout(t *testing.T) {
+	b := NewBroker(BrokerOptions{Topics: []string{"orders"}, WriteTimeout: time.Second})
+	t.Cleanup(b.Close)
+	mux := http.NewServeMux()
+	mux.Handle("GET /events", b)
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.WriteTimeout = 50 * time.Millisecond
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	r := openEvents(t, srv, "topic=orders", "")
+	waitClients(t, b, "orders", 1)
+	time.Sleep(150 * time.Millisecond)
+
+	b.Publish("orders", "", "late")
+	assert.Equal(t, "data: late", withoutID(r.frame()))
+}
+
+func TestBrokerClose(t *testing.T) {
+	b, srv := newEventServer(t, BrokerOptions{Topics: []string{"orders"}})
+	r := openEvents(t, srv, "topic=orders", "")
+	waitClients(t, b, "orders", 1)
+
+	b.Close()
+
+	assert.Empty(t, r.frame(), "the stream ends")
+	req := httptest.NewRequestWithContext(t.Context(), http.MethodGet, "/events?topic=orders", http.NoBody)
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestServerShutdownEndsStreams(t *testing.T) {
+	app := testApp(t)
+	app.Events = NewBroker(BrokerOptions{Topics: []string{"orders"}})
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config = app.newServer()
+	srv.Start()
+	r := openEvents(t, srv, "topic=orders", "")
+	waitClients(t, app.Events, "orders", 1)
+
+	ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+	defer cancel()
+	require.NoError(t, srv.Config.Shutdown(ctx))
+	assert.Empty(t, r.frame())
+}
+
+func TestPublishNotifications(t *testing.T) {
+	b := NewBroker(BrokerOptions{Topics: []string{"orders"}})
+	c, _, _, err := b.subscribe([]string{"orders"}, "")
+	require.NoError(t, err)
+
+	require.NoError(t, b.publishNotifications()(t.Context(), &pgconn.Notification{Channel: "orders", Payload: "42"}))
+
+	ev := <-c.ch
+	assert.Equal(t, Event{ID: 1, Topic: "orders", Data: "42"}, ev)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// TxOptions configures App.WithTx.
+type TxOptions struct {
+	IsoLevel pgx.TxIsoLevel
+	ReadOnly bool
+	// MaxRetries limits retries after serialization failures and deadlocks.
+	// Zero selects the default, negative disables retries.
+	MaxRetries int
+	// Backoff is the delay before the first retry, doubled on each attempt.
+	Backoff time.Duration
+}
+
+const (
+	defaultTxMaxRetries = 3
+	defaultTxBackoff    = 10 * time.Millisecond
+	maxTxBackoff        = time.Second
+)
+
+// txBeginner starts transactions, satisfied by *pgxpool.Pool.
+type txBeginner interface {
+	BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error)
+}
+
+type txKey struct{}
+
+// txFromContext returns the transaction started by WithTx, if any.
+func txFromContext(ctx context.Context) (pgx.Tx, bool) {
+	tx, ok := ctx.Value(txKey{}).(pgx.Tx)
+	return tx, ok
+}
+
+// querier returns the transaction carried by ctx, or db outside of one.
+// Repositories call it so that they join transactions transparently.
+func querier(ctx context.Context, db Querier) Querier {
+	if tx, ok := txFromContext(ctx); ok {
+		return tx
+	}
+	return db
+}
+
+// WithTx runs fn in a transaction that is committed when fn returns nil
+// and rolled back when it fails or panics. The transaction travels in the
+// context passed to fn. Transactions failing with a serialization failure
+// (40001) or deadlock (40P01) are retried with exponential backoff, so fn
+// must be safe to run more than once.
+//
+// Called with a context that already carries a transaction, WithTx runs
+// fn in a savepoint of it instead; opts are ignored and retries are left
+// to the outermost call. Read-only transactions may run on a replica.
+func (app *App) WithTx(ctx context.Context, opts TxOptions, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	return withTx(ctx, app.db(), opts, fn)
+}
+
+func withTx(ctx context.Context, db txBeginner, opts TxOptions, fn func(ctx context.Context, tx pgx.Tx) error) error {
+	if tx, ok := txFromContext(ctx); ok {
+		return runSavepoint(ctx, tx, fn)
+	}
+
+	if opts.MaxRetries == 0 {
+		opts.MaxRetries = defaultTxMaxRetries
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = defaultTxBackoff
+	}
+	txOpts := pgx.TxOptions{IsoLevel: opts.IsoLevel}
+	if opts.ReadOnly {
+		txOpts.AccessMode = pgx.ReadOnly
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := runTx(ctx, db, txOpts, fn)
+		if err == nil || !isRetryableTxError(err) || attempt >= opts.MaxRetries {
+			return err
+		}
+
+		delay := txBackoff(opts.Backoff, attempt)
+		slog.DebugContext(ctx, "retrying transaction", "attempt", attempt+1, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("transaction retry aborted: %w", errors.Join(ctx.Err(), err))
+		case <-time.After(delay):
+		}
+	}
+}
+
+// runTx runs a single attempt of a top-level transaction.
+func runTx(ctx context.Context, db txBeginner, txOpts pgx.TxOptions, fn func(ctx context.Context, tx pgx.Tx) error) (err error) {
+	tx, err := db.BeginTx(ctx, txOpts)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer rollbackOnFailure(ctx, tx, &err)
+
+	if err = fn(context.WithValue(ctx, txKey{}, tx), tx); err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// runSavepoint runs fn in a savepoint of an enclosing transaction.
+func runSavepoint(ctx context.Context, parent pgx.Tx, fn func(ctx context.Context, tx pgx.Tx) error) (err error) {
+	tx, err := parent.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create savepoint: %w", err)
+	}
+	defer rollbackOnFailure(ctx, tx, &err)
+
+	if err = fn(context.WithValue(ctx, txKey{}, tx), tx); err != nil {
+		return err
+	}
+	if err = tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to release savepoint: %w", err)
+	}
+	return nil
+}
+
+// rollbackOnFailure rolls tx back when *errp is set or fn panicked,
+// re-raising the panic afterwards.
+func rollbackOnFailure(ctx context.Context, tx pgx.Tx, errp *error) {
+	p := recover()
+	if p == nil && *errp == nil {
+		return
+	}
+
+	// Roll back even if ctx was canceled, so the connection is released clean.
+	if err := tx.Rollback(context.WithoutCancel(ctx)); err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+		slog.ErrorContext(ctx, "failed to roll back transaction", "error", err)
+	}
+	if p != nil {
+		panic(p)
+	}
+}
+
+// isRetryableTxError reports whether err is a serialization failure or deadlock.
+func isRetryableTxError(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code == "40001" || pgErr.Code == "40P01"
+}
+
+// txBackoff doubles base per attempt up to maxTxBackoff, with jitter
+// so that conflicting transactions do not retry in lockstep.
+func txBackoff(base time.Duration, attempt int) time.Duration {
+	d := min(base<<attempt, maxTxBackoff)
+	return d/2 + rand.N(d/2+1) //nolint:gosec // jitter does not need a secure source
+}
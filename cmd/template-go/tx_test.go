@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTx records transaction control calls in a log shared with its
+// savepoints and delegates queries to a recordingQuerier.
+type fakeTx struct {
+	pgx.Tx
+
+	q         *recordingQuerier
+	log       *[]string
+	depth     int
+	commitErr error
+}
+
+func (tx *fakeTx) Begin(_ context.Context) (pgx.Tx, error) {
+	*tx.log = append(*tx.log, "savepoint")
+	return &fakeTx{q: tx.q, log: tx.log, depth: tx.depth + 1}, nil
+}
+
+func (tx *fakeTx) Commit(_ context.Context) error {
+	if tx.depth > 0 {
+		*tx.log = append(*tx.log, "release")
+		return nil
+	}
+	*tx.log = append(*tx.log, "commit")
+	return tx.commitErr
+}
+
+func (tx *fakeTx) Rollback(_ context.Context) error {
+	if tx.depth > 0 {
+		*tx.log = append(*tx.log, "rollback to savepoint")
+		return nil
+	}
+	*tx.log = append(*tx.log, "rollback")
+	return nil
+}
+
+func (tx *fakeTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return tx.q.Exec(ctx, sql, args...)
+}
+
+func (tx *fakeTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return tx.q.Query(ctx, sql, args...)
+}
+
+func (tx *fakeTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return tx.q.QueryRow(ctx, sql, args...)
+}
+
+// fakeBeginner starts fakeTx transactions, failing the commit of
+// attempt i with commitErrs[i] when set.
+type fakeBeginner struct {
+	q          recordingQuerier
+	log        []string
+	opts       []pgx.TxOptions
+	commitErrs []error
+}
+
+func (b *fakeBeginner) BeginTx(_ context.Context, opts pgx.TxOptions) (pgx.Tx, error) {
+	tx := &fakeTx{q: &b.q, log: &b.log}
+	if n := len(b.opts); n < len(b.commitErrs) {
+		tx.commitErr = b.commitErrs[n]
+	}
+	b.opts = append(b.opts, opts)
+	b.log = append(b.log, "begin")
+	return tx, nil
+}
+
+var (
+	errSerialization = &pgconn.PgError{Code: "40001", Message: "could not serialize access"}
+	errDeadlock      = &pgconn.PgError{Code: "40P01", Message: "deadlock detected"}
+)
+
+func TestWithTx(t *testing.T) {
+	t.Run("commits and passes options", func(t *testing.T) {
+		db := &fakeBeginner{}
+
+		err := withTx(t.Context(), db, TxOptions{IsoLevel: pgx.Serializable, ReadOnly: true}, func(ctx context.Context, tx pgx.Tx) error {
+			ctxTx, ok := txFromContext(ctx)
+			assert.True(t, ok)
+			assert.Same(t, tx, ctxTx)
+			return nil
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"begin", "commit"}, db.log)
+		assert.Equal(t, []pgx.TxOptions{{IsoLevel: pgx.Serializable, AccessMode: pgx.ReadOnly}}, db.opts)
+	})
+
+	t.Run("rolls back on error", func(t *testing.T) {
+		db := &fakeBeginner{}
+		errFailed := errors.New("failed")
+
+		err := withTx(t.Context(), db, TxOptions{}, func(context.Context, pgx.Tx) error {
+			return errFailed
+		})
+
+		require.ErrorIs(t, err, errFailed)
+		assert.Equal(t, []string{"begin", "rollback"}, db.log)
+	})
+
+	t.Run("rolls back and re-panics", func(t *testing.T) {
+		db := &fakeBeginner{}
+
+		assert.PanicsWithValue(t, "boom", func() {
+			_ = withTx(t.Context(), db, TxOptions{}, func(context.Context, pgx.Tx) error {
+				panic("boom")
+			})
+		})
+		assert.Equal(t, []string{"begin", "rollback"}, db.log)
+	})
+
+	t.Run("retries serialization failures", func(t *testing.T) {
+		db := &fakeBeginner{}
+		attempts := 0
+
+		err := withTx(t.Context(), db, TxOptions{Backoff: time.Millisecond}, func(context.Context, pgx.Tx) error {
+			attempts++
+			if attempts < 3 {
+				return errSerialization
+			}
+			return nil
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, 3, attempts)
+		assert.Equal(t, []string{"begin", "rollback", "begin", "rollback", "begin", "commit"}, db.log)
+	})
+
+	t.Run("retries deadlocks on commit", func(t *testing.T) {
+		db := &fakeBeginner{commitErrs: []error{errDeadlock}}
+
+		err := withTx(t.Context(), db, TxOptions{Backoff: time.Millisecond}, func(context.Context, pgx.Tx) error {
+			return nil
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"begin", "commit", "rollback", "begin", "commit"}, db.log)
+	})
+
+	t.Run("gives up after max retries", func(t *testing.T) {
+		db := &fakeBeginner{}
+		attempts := 0
+
+		err := withTx(t.Context(), db, TxOptions{MaxRetries: 2, Backoff: time.Millisecond}, func(context.Context, pgx.Tx) error {
+			attempts++
+			return errSerialization
+		})
+
+		require.ErrorIs(t, err, errSerialization)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("does not retry other errors", func(t *testing.T) {
+		db := &fakeBeginner{}
+		attempts := 0
+
+		err := withTx(t.Context(), db, TxOptions{}, func(context.Context, pgx.Tx) error {
+			attempts++
+			return &pgconn.PgError{Code: "23505"}
+		})
+
+		require.Error(t, err)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("negative max retries disables retries", func(t *testing.T) {
+		db := &fakeBeginner{}
+		attempts := 0
+
+		err := withTx(t.Context(), db, TxOptions{MaxRetries: -1}, func(context.Context, pgx.Tx) error {
+			attempts++
+			return errSerialization
+		})
+
+		require.ErrorIs(t, err, errSerialization)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("stops retrying when the context ends", func(t *testing.T) {
+		db := &fakeBeginner{}
+		ctx, cancel := context.WithCancel(t.Context())
+
+		err := withTx(ctx, db, TxOptions{Backoff: time.Hour}, func(context.Context, pgx.Tx) error {
+			cancel()
+			return errSerialization
+		})
+
+		require.ErrorIs(t, err, context.Canceled)
+		require.ErrorIs(t, err, errSerialization)
+		assert.Equal(t, []string{"begin", "rollback"}, db.log)
+	})
+}
+
+func TestWithTxNested(t *testing.T) {
+	t.Run("uses savepoints", func(t *testing.T) {
+		db := &fakeBeginner{}
+
+		err := withTx(t.Context(), db, TxOptions{}, func(ctx context.Context, _ pgx.Tx) error {
+			return withTx(ctx, db, TxOptions{}, func(context.Context, pgx.Tx) error {
+				return nil
+			})
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"begin", "savepoint", "release", "commit"}, db.log)
+		assert.Len(t, db.opts, 1)
+	})
+
+	t.Run("rolls back to the savepoint", func(t *testing.T) {
+		db := &fakeBeginner{}
+		errInner := errors.New("inner failed")
+
+		err := withTx(t.Context(), db, TxOptions{}, func(ctx context.Context, _ pgx.Tx) error {
+			innerErr := withTx(ctx, db, TxOptions{}, func(context.Context, pgx.Tx) error {
+				return errInner
+			})
+			assert.ErrorIs(t, innerErr, errInner)
+			return nil
+		})
+
+		require.NoError(t, err)
+		assert.Equal(t, []string{"begin", "savepoint", "rollback to savepoint", "commit"}, db.log)
+	})
+}
+
+func TestRepositoriesJoinTransaction(t *testing.T) {
+	db := &fakeBeginner{q: recordingQuerier{Rows: [][]any{{"txdb", "PostgreSQL 18.0"}}}}
+	pool := &recordingQuerier{}
+	repos := NewRepositories(pool)
+
+	err := withTx(t.Context(), db, TxOptions{ReadOnly: true}, func(ctx context.Context, _ pgx.Tx) error {
+		info, err := repos.Info.DatabaseInfo(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, "txdb", info.Database)
+		return nil
+	})
+
+	require.NoError(t, err)
+	assert.Empty(t, pool.Calls())
+	assert.Len(t, db.q.Calls(), 1)
+}
+
+func TestTxBackoff(t *testing.T) {
+	for attempt := range 12 {
+		want := min(defaultTxBackoff<<attempt, maxTxBackoff)
+		got := txBackoff(defaultTxBackoff, attempt)
+		assert.GreaterOrEqual(t, got, want/2)
+		assert.LessOrEqual(t, got, want)
+	}
+}
+
+func TestWithTxIntegration(t *testing.T) {
+	skipIfNoTestcontainers(t)
+
+	app := testApp(t)
+	_, err := testPool.Exec(t.Context(), "CREATE TABLE IF NOT EXISTS tx_test (id int PRIMARY KEY)")
+	require.NoError(t, err)
+	t.Cleanup(func() { _, _ = testPool.Exec(context.Background(), "DROP TABLE tx_test") })
+
+	err = app.WithTx(t.Context(), TxOptions{IsoLevel: pgx.Serializable}, func(ctx context.Context, tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "INSERT INTO tx_test VALUES (1)"); err != nil {
+			return err
+		}
+		// The failed savepoint is rolled back without aborting the transaction.
+		nestedErr := app.WithTx(ctx, TxOptions{}, func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, "INSERT INTO tx_test VALUES (1)")
+			return err
+		})
+		assert.Error(t, nestedErr)
+		return nil
+	})
+	require.NoError(t, err)
+
+	var count int
+	require.NoError(t, testPool.QueryRow(t.Context(), "SELECT count(*) FROM tx_test").Scan(&count))
+	assert.Equal(t, 1, count)
+
+	err = app.WithTx(t.Context(), TxOptions{ReadOnly: true}, func(ctx context.Context, tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, "INSERT INTO tx_test VALUES (2)")
+		return err
+	})
+	require.Error(t, err)
+}
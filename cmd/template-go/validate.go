@@ -0,0 +1,245 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validator is implemented by request types with rules that
+// cannot be expressed with validate struct tags.
+type Validator interface {
+	Validate() error
+}
+
+// FieldError describes an invalid body field, located by a JSON pointer
+// (RFC 6901), or an invalid path or query parameter.
+type FieldError struct {
+	Pointer   string `json:"pointer,omitempty"`
+	Parameter string `json:"parameter,omitempty"`
+	Detail    string `json:"detail"`
+}
+
+// ValidationError lists every invalid field of a request.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Pointer + ": " + f.Detail
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// validate checks the `validate` struct tags of v and calls Validate on
+// every value implementing Validator. Supported rules are required,
+// min=N, max=N (length for strings, slices and maps), oneof=a b c and email.
+// Fields tagged path or query are reported as parameters.
+func validate(v any) error {
+	if v == nil {
+		return nil
+	}
+
+	// Copy into an addressable value so pointer-receiver Validate methods are found.
+	rv := reflect.New(reflect.TypeOf(v)).Elem()
+	rv.Set(reflect.ValueOf(v))
+
+	var fields []FieldError
+	validateValue(rv, nil, &fields)
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+func validateValue(rv reflect.Value, path []string, fields *[]FieldError) {
+	switch rv.Kind() { //nolint:exhaustive // only containers need walking
+	case reflect.Pointer, reflect.Interface:
+		if !rv.IsNil() {
+			validateValue(rv.Elem(), path, fields)
+		}
+		return
+	case reflect.Struct:
+		t := rv.Type()
+		for i := range t.NumField() {
+			sf := t.Field(i)
+			fv := rv.Field(i)
+			if sf.Anonymous && sf.Tag.Get("json") == "" && sf.Type.Kind() == reflect.Struct {
+				validateValue(fv, path, fields)
+				continue
+			}
+			if param := cmp.Or(sf.Tag.Get("path"), sf.Tag.Get("query")); param != "" && sf.IsExported() {
+				if detail := checkRules(fv, sf.Tag.Get("validate")); detail != "" {
+					*fields = append(*fields, FieldError{Parameter: param, Detail: detail})
+				}
+				continue
+			}
+			name, ok := jsonFieldName(sf)
+			if !ok {
+				continue
+			}
+			fieldPath := append(slices.Clip(path), name)
+			if detail := checkRules(fv, sf.Tag.Get("validate")); detail != "" {
+				*fields = append(*fields, FieldError{Pointer: jsonPointer(fieldPath...), Detail: detail})
+				continue
+			}
+			validateValue(fv, fieldPath, fields)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := range rv.Len() {
+			validateValue(rv.Index(i), append(slices.Clip(path), strconv.Itoa(i)), fields)
+		}
+	}
+
+	callValidator(rv, path, fields)
+}
+
+// callValidator runs Validate and prefixes nested field pointers with path.
+func callValidator(rv reflect.Value, path []string, fields *[]FieldError) {
+	var val Validator
+	switch {
+	case rv.CanAddr() && rv.Addr().CanInterface():
+		val, _ = rv.Addr().Interface().(Validator)
+	case rv.CanInterface():
+		val, _ = rv.Interface().(Validator)
+	}
+	if val == nil {
+		return
+	}
+
+	err := val.Validate()
+	if err == nil {
+		return
+	}
+
+	prefix := jsonPointer(path...)
+	var valErr *ValidationError
+	if errors.As(err, &valErr) {
+		for _, f := range valErr.Fields {
+			*fields = append(*fields, FieldError{Pointer: prefix + f.Pointer, Detail: f.Detail})
+		}
+		return
+	}
+	*fields = append(*fields, FieldError{Pointer: prefix, Detail: err.Error()})
+}
+
+// jsonFieldName returns the JSON name of an exported struct field.
+func jsonFieldName(sf reflect.StructField) (string, bool) {
+	if !sf.IsExported() {
+		return "", false
+	}
+	tag := sf.Tag.Get("json")
+	if tag == "-" {
+		return "", false
+	}
+	name, _, _ := strings.Cut(tag, ",")
+	if name == "" {
+		name = sf.Name
+	}
+	return name, true
+}
+
+// checkRules returns a description of the first failed rule, or "".
+func checkRules(fv reflect.Value, rules string) string {
+	if rules == "" {
+		return ""
+	}
+	required := slices.Contains(strings.Split(rules, ","), "required")
+	if fv.IsZero() {
+		if required {
+			return "is required"
+		}
+		return ""
+	}
+
+	v := fv
+	for v.Kind() == reflect.Pointer {
+		v = v.Elem()
+	}
+
+	for rule := range strings.SplitSeq(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		var detail string
+		switch name {
+		case "required":
+		case "min":
+			detail = checkBound(v, arg, true)
+		case "max":
+			detail = checkBound(v, arg, false)
+		case "oneof":
+			options := strings.Fields(arg)
+			if !slices.Contains(options, fmt.Sprint(v.Interface())) {
+				detail = "must be one of: " + strings.Join(options, ", ")
+			}
+		case "email":
+			if addr, err := mail.ParseAddress(v.String()); err != nil || addr.Address != v.String() {
+				detail = "must be a valid email address"
+			}
+		default:
+			panic(fmt.Sprintf("validate: unknown rule %q", name))
+		}
+		if detail != "" {
+			return detail
+		}
+	}
+	return ""
+}
+
+// checkBound applies a min or max rule to a number or a length.
+func checkBound(v reflect.Value, arg string, isMin bool) string {
+	bound, err := strconv.ParseFloat(arg, 64)
+	if err != nil {
+		panic(fmt.Sprintf("validate: invalid bound %q", arg))
+	}
+
+	var (
+		actual float64
+		unit   string
+	)
+	switch v.Kind() { //nolint:exhaustive // other kinds have no bounds
+	case reflect.String:
+		actual, unit = float64(utf8.RuneCountInString(v.String())), " characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		actual, unit = float64(v.Len()), " items"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		actual = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		actual = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		actual = v.Float()
+	default:
+		panic("validate: min/max on unsupported kind " + v.Kind().String())
+	}
+
+	switch {
+	case isMin && actual < bound:
+		if unit != "" {
+			return "must contain at least " + arg + unit
+		}
+		return "must be at least " + arg
+	case !isMin && actual > bound:
+		if unit != "" {
+			return "must contain at most " + arg + unit
+		}
+		return "must be at most " + arg
+	}
+	return ""
+}
+
+// jsonPointer builds an RFC 6901 JSON pointer from reference tokens.
+func jsonPointer(tokens ...string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteByte('/')
+		b.WriteString(strings.NewReplacer("~", "~0", "/", "~1").Replace(token))
+	}
+	return b.String()
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testAddress struct {
+	City string `json:"city" validate:"required"`
+	Zip  string `json:"zip" validate:"min=5,max=5"`
+}
+
+type testTag struct {
+	Name string `json:"name" validate:"required,max=8"`
+}
+
+type testCreateUser struct {
+	Name    string       `json:"name" validate:"required,min=2,max=16"`
+	Email   string       `json:"email" validate:"required,email"`
+	Role    string       `json:"role" validate:"oneof=admin member"`
+	Age     int          `json:"age" validate:"min=18,max=130"`
+	Score   *float64     `json:"score,omitempty" validate:"max=1"`
+	Tags    []testTag    `json:"tags" validate:"max=3"`
+	Address *testAddress `json:"address,omitempty"`
+	Nick    string       `json:"nick_name,omitempty" validate:"max=4"`
+	Ignored string       `json:"-" validate:"required"`
+}
+
+type testRange struct {
+	From int `json:"from"`
+	To   int `json:"to"`
+}
+
+func (r testRange) Validate() error {
+	if r.From > r.To {
+		return errors.New("from must not be after to")
+	}
+	return nil
+}
+
+type testPointerValidator struct {
+	Items []string `json:"items"`
+}
+
+func (p *testPointerValidator) Validate() error {
+	if len(p.Items) == 0 {
+		return &ValidationError{Fields: []FieldError{{Pointer: "/items", Detail: "must not be empty"}}}
+	}
+	return nil
+}
+
+type testNestedValidator struct {
+	Range testRange            `json:"range"`
+	List  testPointerValidator `json:"list"`
+}
+
+func TestValidate(t *testing.T) {
+	score := 1.5
+
+	tests := []struct {
+		name  string
+		value any
+		want  []FieldError
+	}{
+		{
+			name: "valid",
+			value: testCreateUser{
+				Name: "alice", Email: "alice@example.com", Role: "admin", Age: 30,
+				Tags: []testTag{{Name: "a"}}, Address: &testAddress{City: "Berlin", Zip: "10115"},
+			},
+		},
+		{
+			name:  "missing required fields",
+			value: testCreateUser{},
+			want: []FieldError{
+				{Pointer: "/name", Detail: "is required"},
+				{Pointer: "/email", Detail: "is required"},
+			},
+		},
+		{
+			name: "string bounds, email and oneof",
+			value: testCreateUser{
+				Name: "a", Email: "Alice <alice@example.com>", Role: "owner", Age: 30, Nick: "toolong",
+			},
+			want: []FieldError{
+				{Pointer: "/name", Detail: "must contain at least 2 characters"},
+				{Pointer: "/email", Detail: "must be a valid email address"},
+				{Pointer: "/role", Detail: "must be one of: admin, member"},
+				{Pointer: "/nick_name", Detail: "must contain at most 4 characters"},
+			},
+		},
+		{
+			name: "numeric bounds and pointers",
+			value: testCreateUser{
+				Name: "alice", Email: "alice@example.com", Age: 12, Score: &score,
+			},
+			want: []FieldError{
+				{Pointer: "/age", Detail: "must be at least 18"},
+				{Pointer: "/score", Detail: "must be at most 1"},
+			},
+		},
+		{
+			name: "nested structs and slices",
+			value: testCreateUser{
+				Name: "alice", Email: "alice@example.com", Age: 30,
+				Tags:    []testTag{{Name: "ok"}, {Name: ""}, {Name: "waytoolong"}},
+				Address: &testAddress{Zip: "123"},
+			},
+			want: []FieldError{
+				{Pointer: "/tags/1/name", Detail: "is required"},
+				{Pointer: "/tags/2/name", Detail: "must contain at most 8 characters"},
+				{Pointer: "/address/city", Detail: "is required"},
+				{Pointer: "/address/zip", Detail: "must contain at least 5 characters"},
+			},
+		},
+		{
+			name: "slice length",
+			value: testCreateUser{
+				Name: "alice", Email: "alice@example.com", Age: 30,
+				Tags: []testTag{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}},
+			},
+			want: []FieldError{{Pointer: "/tags", Detail: "must contain at most 3 items"}},
+		},
+		{
+			name:  "value receiver validator",
+			value: testRange{From: 2, To: 1},
+			want:  []FieldError{{Pointer: "", Detail: "from must not be after to"}},
+		},
+		{
+			name:  "pointer receiver validator",
+			value: testPointerValidator{},
+			want:  []FieldError{{Pointer: "/items", Detail: "must not be empty"}},
+		},
+		{
+			name:  "nested validators are prefixed",
+			value: &testNestedValidator{Range: testRange{From: 5, To: 1}},
+			want: []FieldError{
+				{Pointer: "/range", Detail: "from must not be after to"},
+				{Pointer: "/list/items", Detail: "must not be empty"},
+			},
+		},
+		{
+			name:  "nil value",
+			value: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validate(tt.value)
+
+			if tt.want == nil {
+				require.NoError(t, err)
+				return
+			}
+
+			var valErr *ValidationError
+			require.ErrorAs(t, err, &valErr)
+			assert.Equal(t, tt.want, valErr.Fields)
+		})
+	}
+}
+
+func TestValidatePanicsOnUnknownRule(t *testing.T) {
+	type bad struct {
+		Name string `json:"name" validate:"uuid"`
+	}
+
+	assert.Panics(t, func() {
+		_ = validate(bad{Name: "x"})
+	})
+}
+
+func TestValidationErrorMessage(t *testing.T) {
+	err := &ValidationError{Fields: []FieldError{
+		{Pointer: "/name", Detail: "is required"},
+		{Pointer: "/age", Detail: "must be at least 18"},
+	}}
+
+	assert.Equal(t, "validation failed: /name: is required; /age: must be at least 18", err.Error())
+}
+
+func TestJSONPointer(t *testing.T) {
+	assert.Empty(t, jsonPointer())
+	assert.Equal(t, "/a/0/b", jsonPointer("a", "0", "b"))
+	assert.Equal(t, "/a~1b/c~0d", jsonPointer("a/b", "c~d"))
+}
@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1" //nolint:gosec // mandated by RFC 6455 for the handshake
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// MessageType is the type of a WebSocket data message.
+type MessageType byte
+
+// Data message types.
+const (
+	TextMessage   MessageType = 1
+	BinaryMessage MessageType = 2
+)
+
+// Frame opcodes (RFC 6455 section 5.2).
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close status codes (RFC 6455 section 7.4.1).
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseInvalidPayload  = 1007
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+)
+
+// websocketGUID is appended to the client key to compute the accept key.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// CloseError reports the close frame that ended a connection, sent by the
+// peer or by this side after a protocol violation.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return "websocket closed: " + strconv.Itoa(e.Code)
+	}
+	return "websocket closed: " + strconv.Itoa(e.Code) + " " + e.Reason
+}
+
+var errWebSocketClosed = errors.New("websocket closed")
+
+// WebSocketOptions configures WebSockets.
+type WebSocketOptions struct {
+	// AllowedOrigins are cross-origin patterns allowed to connect, as in
+	// CORSPolicy. Same-origin requests and clients sending no Origin, which
+	// are not browsers, are always allowed.
+	AllowedOrigins []string
+	// MaxMessageBytes limits received messages; larger ones close the
+	// connection with status 1009.
+	MaxMessageBytes int64
+	// PingInterval is how often the server pings; a peer that sends
+	// nothing, not even a pong, for PingInterval+PongTimeout is dropped.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	// WriteTimeout bounds each frame written.
+	WriteTimeout time.Duration
+}
+
+const (
+	defaultWebSocketMaxMessageBytes = 64 << 10
+	defaultWebSocketPingInterval    = 30 * time.Second
+	defaultWebSocketPongTimeout     = 10 * time.Second
+	defaultWebSocketWriteTimeout    = 10 * time.Second
+)
+
+// WebSocketHandler serves an upgraded connection. ctx is canceled when the
+// peer goes away or the server shuts down; returning closes the connection,
+// with status 1011 when the error is not a CloseError or from ctx.
+type WebSocketHandler func(ctx context.Context, ws *WebSocket) error
+
+// WebSockets upgrades requests to WebSocket connections (RFC 6455) and
+// tracks them so that they can be closed on shutdown.
+type WebSockets struct {
+	opts WebSocketOptions
+
+	mu     sync.Mutex
+	conns  map[*WebSocket]context.CancelFunc
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewWebSockets creates a WebSockets with opts.
+func NewWebSockets(opts WebSocketOptions) *WebSockets {
+	if opts.MaxMessageBytes <= 0 {
+		opts.MaxMessageBytes = defaultWebSocketMaxMessageBytes
+	}
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = defaultWebSocketPingInterval
+	}
+	if opts.PongTimeout <= 0 {
+		opts.PongTimeout = defaultWebSocketPongTimeout
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = defaultWebSocketWriteTimeout
+	}
+	return &WebSockets{opts: opts, conns: map[*WebSocket]context.CancelFunc{}}
+}
+
+// Handler upgrades requests and serves them with h.
+func (s *WebSockets) Handler(h WebSocketHandler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key, status, detail := s.checkHandshake(r)
+		if status != 0 {
+			if status == http.StatusUpgradeRequired {
+				w.Header().Set("Upgrade", "websocket")
+				w.Header().Set("Sec-WebSocket-Version", "13")
+			}
+			respondProblem(w, status, detail)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			respondProblem(w, http.StatusServiceUnavailable, "server is shutting down")
+			return
+		}
+		s.wg.Add(1)
+		defer s.wg.Done()
+		s.mu.Unlock()
+
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			respondProblem(w, http.StatusNotImplemented, "websocket upgrade is not supported on this connection")
+			return
+		}
+		defer conn.Close()
+
+		ws := &WebSocket{conn: conn, br: brw.Reader, bw: brw.Writer, opts: &s.opts, msgs: make(chan wsMessage), done: make(chan struct{})}
+		if err := ws.handshake(key); err != nil {
+			slog.DebugContext(ctx, "WebSocket handshake failed", "error", err)
+			return
+		}
+		s.serve(ctx, cancel, ws, h)
+	})
+}
+
+// checkHandshake validates an opening handshake, returning the client key
+// or the status and detail of the rejection.
+func (s *WebSockets) checkHandshake(r *http.Request) (string, int, string) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		return "", http.StatusUpgradeRequired, "websocket upgrade required"
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return "", http.StatusUpgradeRequired, "unsupported websocket version"
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 16 {
+		return "", http.StatusBadRequest, "invalid Sec-WebSocket-Key"
+	}
+	if !s.allowsOrigin(r) {
+		return "", http.StatusForbidden, "origin not allowed"
+	}
+	return key, 0, ""
+}
+
+// allowsOrigin guards against cross-site WebSocket hijacking, as browsers
+// do not apply CORS to upgrades.
+func (s *WebSockets) allowsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, pattern := range s.opts.AllowedOrigins {
+		if matchOrigin(strings.ToLower(pattern), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// serve runs h with a reader and a pinger alongside, then closes ws.
+func (s *WebSockets) serve(ctx context.Context, cancel context.CancelFunc, ws *WebSocket, h WebSocketHandler) {
+	s.mu.Lock()
+	s.conns[ws] = cancel
+	s.mu.Unlock()
+	websocketStats.Add("connections", 1)
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, ws)
+		s.mu.Unlock()
+		websocketStats.Add("connections", -1)
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	wg.Go(func() {
+		defer cancel()
+		ws.readLoop(ctx)
+	})
+	wg.Go(func() {
+		ticker := time.NewTicker(s.opts.PingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if ws.writeFrame(opPing, nil) != nil {
+					cancel()
+					return
+				}
+			}
+		}
+	})
+
+	err := h(ctx, ws)
+
+	code, reason := CloseNormal, ""
+	var closeErr *CloseError
+	switch {
+	case s.shuttingDown():
+		code = CloseGoingAway
+	case err == nil, errors.As(err, &closeErr), errors.Is(err, context.Canceled), errors.Is(err, errWebSocketClosed):
+	default:
+		slog.ErrorContext(ctx, "WebSocket handler failed", "error", err)
+		code, reason = CloseInternalError, "internal error"
+	}
+	_ = ws.Close(code, reason)
+	cancel()
+}
+
+func (s *WebSockets) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Close cancels the context of every connection, so that handlers return
+// and connections close with status 1001, and waits for them. Register it
+// with http.Server.RegisterOnShutdown, as Shutdown ignores hijacked
+// connections.
+func (s *WebSockets) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for _, cancel := range s.conns {
+		cancel()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// wsMessage is a data message received by the read loop.
+type wsMessage struct {
+	typ  MessageType
+	data []byte
+}
+
+// WebSocket is an upgraded connection. Receive and Send may be called
+// concurrently with each other; control frames are handled internally.
+type WebSocket struct {
+	conn net.Conn
+	br   *bufio.Reader
+	opts *WebSocketOptions
+
+	wmu       sync.Mutex
+	bw        *bufio.Writer
+	closeSent bool
+
+	msgs chan wsMessage
+	done chan struct{}
+	err  error
+}
+
+// handshake completes the upgrade. Deadlines the server set for the
+// request are cleared, as the connection now manages its own.
+func (ws *WebSocket) handshake(key string) error {
+	if err := ws.conn.SetDeadline(time.Time{}); err != nil {
+		return fmt.Errorf("failed to clear deadlines: %w", err)
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID)) //nolint:gosec // mandated by RFC 6455
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	_ = ws.conn.SetWriteDeadline(time.Now().Add(ws.opts.WriteTimeout))
+	_, _ = ws.bw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n\r\n")
+	if err := ws.bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write handshake: %w", err)
+	}
+	return nil
+}
+
+// Receive returns the next data message. After the connection ends it
+// returns a *CloseError when a close frame was exchanged, or an error
+// wrapping the connection error.
+func (ws *WebSocket) Receive(ctx context.Context) (MessageType, []byte, error) {
+	select {
+	case m := <-ws.msgs:
+		return m.typ, m.data, nil
+	case <-ws.done:
+		return 0, nil, ws.err
+	case <-ctx.Done():
+		// The connection context ends when the read loop does; report why.
+		select {
+		case <-ws.done:
+			return 0, nil, ws.err
+		default:
+			return 0, nil, ctx.Err()
+		}
+	}
+}
+
+// Send writes a data message in a single frame.
+func (ws *WebSocket) Send(typ MessageType, data []byte) error {
+	if typ != TextMessage && typ != BinaryMessage {
+		return fmt.Errorf("invalid message type %d", typ)
+	}
+	if typ == TextMessage && !utf8.Valid(data) {
+		return errors.New("text message is not valid UTF-8")
+	}
+	if err := ws.writeFrame(byte(typ), data); err != nil {
+		return err
+	}
+	websocketStats.Add("messages_out", 1)
+	return nil
+}
+
+// Close sends a close frame, unless one was sent already, and closes the
+// connection.
+func (ws *WebSocket) Close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code)) //nolint:gosec // close codes fit
+	payload = append(payload, reason...)
+	err := ws.writeFrame(opClose, payload)
+	if cerr := ws.conn.Close(); err == nil || errors.Is(err, errWebSocketClosed) {
+		err = cerr
+	}
+	return err //nolint:wrapcheck // transparent wrapper
+}
+
+// writeFrame writes a single final frame. Server frames are not masked.
+func (ws *WebSocket) writeFrame(op byte, payload []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+	if ws.closeSent {
+		return errWebSocketClosed
+	}
+	if op == opClose {
+		ws.closeSent = true
+	}
+
+	header := []byte{0x80 | op, 0}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] = byte(n)
+	case n <= 0xFFFF:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	_ = ws.conn.SetWriteDeadline(time.Now().Add(ws.opts.WriteTimeout))
+	_, _ = ws.bw.Write(header)
+	_, _ = ws.bw.Write(payload)
+	if err := ws.bw.Flush(); err != nil {
+		return fmt.Errorf("failed to write frame: %w", err)
+	}
+	return nil
+}
+
+// readLoop reads messages for Receive until the connection ends.
+func (ws *WebSocket) readLoop(ctx context.Context) {
+	defer close(ws.done)
+	for {
+		typ, data, err := ws.readMessage()
+		var closeErr *CloseError
+		if errors.As(err, &closeErr) {
+			ws.err = err
+			return
+		}
+		if err != nil {
+			ws.err = fmt.Errorf("%w: %w", errWebSocketClosed, err)
+			return
+		}
+		websocketStats.Add("messages_in", 1)
+		select {
+		case ws.msgs <- wsMessage{typ: typ, data: data}:
+		case <-ctx.Done():
+			ws.err = ctx.Err()
+			return
+		}
+	}
+}
+
+// readMessage reads frames until a data message is complete, answering
+// pings and close frames. Protocol violations close the connection.
+func (ws *WebSocket) readMessage() (MessageType, []byte, error) {
+	var (
+		typ     MessageType
+		message []byte
+	)
+	for {
+		fin, op, payload, err := ws.readFrame(int64(len(message)))
+		if err != nil {
+			return 0, nil, ws.fail(err)
+		}
+
+		switch op {
+		case opPing:
+			if err := ws.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, ws.closeReceived(payload)
+		case opText, opBinary:
+			if typ != 0 {
+				return 0, nil, ws.fail(&CloseError{Code: CloseProtocolError, Reason: "expected continuation frame"})
+			}
+			typ = MessageType(op)
+		case opContinuation:
+			if typ == 0 {
+				return 0, nil, ws.fail(&CloseError{Code: CloseProtocolError, Reason: "unexpected continuation frame"})
+			}
+		default:
+			return 0, nil, ws.fail(&CloseError{Code: CloseProtocolError, Reason: "unknown opcode"})
+		}
+
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+		if typ == TextMessage && !utf8.Valid(message) {
+			return 0, nil, ws.fail(&CloseError{Code: CloseInvalidPayload, Reason: "invalid UTF-8"})
+		}
+		return typ, message, nil
+	}
+}
+
+// readFrame reads and unmasks one frame, given the size of the message
+// read so far.
+func (ws *WebSocket) readFrame(read int64) (fin bool, op byte, payload []byte, err error) {
+	_ = ws.conn.SetReadDeadline(time.Now().Add(ws.opts.PingInterval + ws.opts.PongTimeout))
+
+	var header [2]byte
+	if _, err := io.ReadFull(ws.br, header[:]); err != nil {
+		return false, 0, nil, err //nolint:wrapcheck // connection errors end the read loop as is
+	}
+	fin, op = header[0]&0x80 != 0, header[0]&0x0F
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "reserved bits set"}
+	}
+	if header[1]&0x80 == 0 {
+		return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "client frames must be masked"}
+	}
+
+	length := int64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err //nolint:wrapcheck // see above
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err //nolint:wrapcheck // see above
+		}
+		n := binary.BigEndian.Uint64(ext[:])
+		if n > 1<<62 {
+			return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "invalid frame length"}
+		}
+		length = int64(n)
+	}
+
+	control := op >= opClose
+	switch {
+	case control && (!fin || length > 125):
+		return false, 0, nil, &CloseError{Code: CloseProtocolError, Reason: "invalid control frame"}
+	case !control && read+length > ws.opts.MaxMessageBytes:
+		return false, 0, nil, &CloseError{Code: CloseMessageTooBig, Reason: "message too big"}
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+		return false, 0, nil, err //nolint:wrapcheck // see above
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(ws.br, payload); err != nil {
+		return false, 0, nil, err //nolint:wrapcheck // see above
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// fail sends the close frame for a protocol violation and returns err.
+func (ws *WebSocket) fail(err error) error {
+	var closeErr *CloseError
+	if errors.As(err, &closeErr) {
+		_ = ws.Close(closeErr.Code, closeErr.Reason)
+	}
+	return err
+}
+
+// closeReceived answers a close frame with the same status code.
+func (ws *WebSocket) closeReceived(payload []byte) error {
+	switch {
+	case len(payload) == 0:
+		_ = ws.Close(CloseNormal, "")
+		return &CloseError{Code: CloseNormal}
+	case len(payload) == 1:
+		return ws.fail(&CloseError{Code: CloseProtocolError, Reason: "invalid close frame"})
+	}
+
+	code := int(binary.BigEndian.Uint16(payload))
+	reason := payload[2:]
+	if !validCloseCode(code) || !utf8.Valid(reason) {
+		return ws.fail(&CloseError{Code: CloseProtocolError, Reason: "invalid close frame"})
+	}
+	_ = ws.Close(code, "")
+	return &CloseError{Code: code, Reason: string(reason)}
+}
+
+// validCloseCode reports whether code may be sent in a close frame.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	default:
+		return code >= 3000 && code <= 4999
+	}
+}
+
+// headerHasToken reports whether a comma-separated header contains token.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for part := range strings.SplitSeq(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleEcho sends every message back to the client.
+func handleEcho(ctx context.Context, ws *WebSocket) error {
+	for {
+		typ, data, err := ws.Receive(ctx)
+		if err != nil {
+			return err
+		}
+		if err := ws.Send(typ, data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testWebSocketKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+// wsClient is a minimal RFC 6455 client for tests.
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+// dialWebSocket upgrades a connection to srv, failing the test unless the
+// server switches protocols.
+func dialWebSocket(t *testing.T, srv *httptest.Server, header http.Header) *wsClient {
+	t.Helper()
+	c, resp := rawUpgrade(t, srv, header)
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	return c
+}
+
+// rawUpgrade sends an upgrade request and reads the response head.
+func rawUpgrade(t *testing.T, srv *httptest.Server, header http.Header) (*wsClient, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, srv.URL+"/ws", http.NoBody)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", testWebSocketKey)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	require.NoError(t, req.Write(conn))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	require.NoError(t, err)
+	return &wsClient{t: t, conn: conn, br: br}, resp
+}
+
+// send writes a masked frame.
+func (c *wsClient) send(fin bool, op byte, payload []byte) {
+	c.t.Helper()
+	c.write(fin, op, payload, true)
+}
+
+func (c *wsClient) write(fin bool, op byte, payload []byte, masked bool) {
+	c.t.Helper()
+	b0 := op
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0, 0}
+	switch n := len(payload); {
+	case n < 126:
+		frame[1] = byte(n)
+	case n <= 0xFFFF:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if masked {
+		frame[1] |= 0x80
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := c.conn.Write(frame)
+	require.NoError(c.t, err)
+}
+
+// recv reads an unmasked server frame.
+func (c *wsClient) recv() (op byte, payload []byte) {
+	c.t.Helper()
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(2*time.Second)))
+	var header [2]byte
+	_, err := io.ReadFull(c.br, header[:])
+	require.NoError(c.t, err)
+	require.Zero(c.t, header[1]&0x80, "server frames are not masked")
+	n := int(header[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.br, ext[:])
+		n = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.br, ext[:])
+		n = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	require.NoError(c.t, err)
+	payload = make([]byte, n)
+	_, err = io.ReadFull(c.br, payload)
+	require.NoError(c.t, err)
+	return header[0] & 0x0F, payload
+}
+
+// recvClose reads frames until a close frame and returns its code.
+func (c *wsClient) recvClose() int {
+	c.t.Helper()
+	for {
+		op, payload := c.recv()
+		if op == opClose {
+			require.GreaterOrEqual(c.t, len(payload), 2)
+			return int(binary.BigEndian.Uint16(payload))
+		}
+	}
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+func newWebSocketServer(t *testing.T, opts WebSocketOptions, h WebSocketHandler) (*WebSockets, *httptest.Server) {
+	t.Helper()
+	ws := NewWebSockets(opts)
+	mux := http.NewServeMux()
+	mux.Handle("GET /ws", ws.Handler(h))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	t.Cleanup(ws.Close)
+	return ws, srv
+}
+
+func TestWebSocketHandshakeRejects(t *testing.T) {
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+	}{
+		{"not an upgrade", http.Header{"Upgrade": {"h2c"}}, http.StatusUpgradeRequired},
+		{"wrong version", http.Header{"Sec-Websocket-Version": {"8"}}, http.StatusUpgradeRequired},
+		{"invalid key", http.Header{"Sec-Websocket-Key": {"short"}}, http.StatusBadRequest},
+		{"cross origin", http.Header{"Origin": {"https://evil.example"}}, http.StatusForbidden},
+	}
+
+	_, srv := newWebSocketServer(t, WebSocketOptions{AllowedOrigins: []string{"https://*.example.com"}}, handleEcho)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, resp := rawUpgrade(t, srv, tt.header)
+			defer resp.Body.Close()
+
+			assert.Equal(t, tt.wantStatus, resp.StatusCode)
+			assert.Equal(t, "application/problem+json", resp.Header.Get("Content-Type"))
+		})
+	}
+}
+
+func TestWebSocketOrigins(t *testing.T) {
+	_, srv := newWebSocketServer(t, WebSocketOptions{AllowedOrigins: []string{"https://*.Example.com"}}, handleEcho)
+
+	for _, origin := range []string{"", srv.URL, "https://app.example.com", "https://App.EXAMPLE.com"} {
+		t.Run(origin, func(t *testing.T) {
+			header := http.Header{}
+			if origin != "" {
+				header.Set("Origin", origin)
+			}
+			dialWebSocket(t, srv, header)
+		})
+	}
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	_, srv := newWebSocketServer(t, WebSocketOptions{}, handleEcho)
+	c := dialWebSocket(t, srv, nil)
+
+	c.send(true, opText, []byte("hello"))
+	op, payload := c.recv()
+	assert.Equal(t, byte(opText), op)
+	assert.Equal(t, "hello", string(payload))
+
+	c.send(true, opBinary, make([]byte, 300))
+	op, payload = c.recv()
+	assert.Equal(t, byte(opBinary), op)
+	assert.Len(t, payload, 300)
+
+	// A fragmented message with a ping in between.
+	c.send(false, opText, []byte("frag"))
+	c.send(true, opPing, []byte("are you there"))
+	c.send(true, opContinuation, []byte("mented"))
+	op, payload = c.recv()
+	assert.Equal(t, byte(opPong), op)
+	assert.Equal(t, "are you there", string(payload))
+	op, payload = c.recv()
+	assert.Equal(t, byte(opText), op)
+	assert.Equal(t, "fragmented", string(payload))
+
+	c.send(true, opClose, closePayload(CloseNormal, "bye"))
+	assert.Equal(t, CloseNormal, c.recvClose())
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		send     func(c *wsClient)
+		wantCode int
+	}{
+		{"unmasked frame", func(c *wsClient) { c.write(true, opText, []byte("hi"), false) }, CloseProtocolError},
+		{"message too big", func(c *wsClient) { c.send(true, opBinary, make([]byte, 1025)) }, CloseMessageTooBig},
+		{"fragments too big", func(c *wsClient) {
+			c.send(false, opBinary, make([]byte, 1000))
+			c.send(true, opContinuation, make([]byte, 100))
+		}, CloseMessageTooBig},
+		{"invalid UTF-8", func(c *wsClient) { c.send(true, opText, []byte{0xff, 0xfe}) }, CloseInvalidPayload},
+		{"unexpected continuation", func(c *wsClient) { c.send(true, opContinuation, []byte("x")) }, CloseProtocolError},
+		{"fragmented ping", func(c *wsClient) { c.send(false, opPing, nil) }, CloseProtocolError},
+		{"unknown opcode", func(c *wsClient) { c.send(true, 0x3, nil) }, CloseProtocolError},
+		{"invalid close code", func(c *wsClient) { c.send(true, opClose, closePayload(1005, "")) }, CloseProtocolError},
+	}
+
+	_, srv := newWebSocketServer(t, WebSocketOptions{MaxMessageBytes: 1024}, handleEcho)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialWebSocket(t, srv, nil)
+			tt.send(c)
+			assert.Equal(t, tt.wantCode, c.recvClose())
+		})
+	}
+}
+
+func TestWebSocketHandlerError(t *testing.T) {
+	_, srv := newWebSocketServer(t, WebSocketOptions{}, func(context.Context, *WebSocket) error {
+		return io.ErrUnexpectedEOF
+	})
+	c := dialWebSocket(t, srv, nil)
+
+	assert.Equal(t, CloseInternalError, c.recvClose())
+}
+
+func TestWebSocketKeepalive(t *testing.T) {
+	done := make(chan error, 1)
+	_, srv := newWebSocketServer(t, WebSocketOptions{PingInterval: 20 * time.Millisecond, PongTimeout: 20 * time.Millisecond},
+		func(ctx context.Context, ws *WebSocket) error {
+			_, _, err := ws.Receive(ctx)
+			done <- err
+			return err
+		})
+	c := dialWebSocket(t, srv, nil)
+
+	op, _ := c.recv()
+	assert.Equal(t, byte(opPing), op)
+	c.send(true, opPong, nil)
+	op, _ = c.recv()
+	assert.Equal(t, byte(opPing), op, "answering pings keeps the connection open")
+
+	// A silent peer is dropped.
+	select {
+	case err := <-done:
+		require.ErrorIs(t, err, errWebSocketClosed)
+	case <-time.After(2 * time.Second):
+		t.Fatal("silent peer not dropped")
+	}
+}
+
+func TestWebSocketsClose(t *testing.T) {
+	ended := make(chan error, 1)
+	sockets, srv := newWebSocketServer(t, WebSocketOptions{}, func(ctx context.Context, ws *WebSocket) error {
+		<-ctx.Done()
+		ended <- ctx.Err()
+		return ctx.Err()
+	})
+	c := dialWebSocket(t, srv, nil)
+	require.Eventually(t, func() bool {
+		sockets.mu.Lock()
+		defer sockets.mu.Unlock()
+		return len(sockets.conns) == 1
+	}, time.Second, time.Millisecond)
+
+	sockets.Close()
+
+	require.ErrorIs(t, <-ended, context.Canceled)
+	assert.Equal(t, CloseGoingAway, c.recvClose())
+	_, resp := rawUpgrade(t, srv, nil)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWebSocketThroughMiddleware(t *testing.T) {
+	var buf syncBuffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	app := testApp(t)
+	srv := httptest.NewUnstartedServer(nil)
+	srv.Config = app.newServer()
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	c := dialWebSocket(t, srv, nil)
+	c.send(true, opText, []byte("hi"))
+	_, payload := c.recv()
+	assert.Equal(t, "hi", string(payload))
+	c.send(true, opClose, closePayload(CloseNormal, ""))
+	assert.Equal(t, CloseNormal, c.recvClose())
+
+	require.Eventually(t, func() bool { return strings.Contains(buf.String(), "msg=connection") }, time.Second, time.Millisecond)
+	assert.Contains(t, buf.String(), "upgrade=websocket")
+	assert.Contains(t, buf.String(), "duration=")
+	assert.NotContains(t, buf.String(), "status=")
+}